@@ -0,0 +1,130 @@
+//go:build linux && !appengine
+// +build linux,!appengine
+
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// AddFile starts monitoring the file or directory f, which is already open.
+//
+// This watches the object f refers to, even if it was renamed or replaced since
+// it was opened, so there is no race between checking a path and watching it.
+// Event.Name is based on f.Name(), which may no longer be the file's name.
+//
+// On Linux this uses /proc/self/fd, so /proc must be mounted. Other backends
+// add f.Name(), and return an error if that no longer refers to f; this makes
+// the window for a race small, but doesn't close it.
+//
+// The options are the same as for [Watcher.AddWith]. f can be closed after
+// AddFile returns.
+func (w *Watcher) AddFile(f *os.File, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	with := getOptions(append(w.defaults, opts...)...)
+	if err := with.checkRestricted(); err != nil {
+		return err
+	}
+	name, err := with.watchPath(filepath.Clean(f.Name()))
+	if err != nil {
+		return err
+	}
+
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cErr := conn.Control(func(fd uintptr) {
+		_, err = w.add(name, procFd(int(fd)), with)
+	})
+	if cErr != nil {
+		return cErr
+	}
+	return err
+}
+
+// AddAt starts monitoring name relative to the directory file descriptor
+// dirfd (or the working directory if dirfd is unix.AT_FDCWD), like openat().
+// This way the directory can't be replaced while the path is looked up.
+//
+// Event.Name is the current path of dirfd joined with name. This is only
+// supported on Linux. The options are the same as for [Watcher.AddWith].
+func (w *Watcher) AddAt(dirfd int, name string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	with := getOptions(append(w.defaults, opts...)...)
+	if err := with.checkRestricted(); err != nil {
+		return err
+	}
+
+	fd, err := unix.Openat(dirfd, name, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "openat", Path: name, Err: err}
+	}
+	defer unix.Close(fd)
+
+	if dirfd != unix.AT_FDCWD && !filepath.IsAbs(name) {
+		dir, err := os.Readlink(procFd(dirfd))
+		if err != nil {
+			return err
+		}
+		name = filepath.Join(dir, name)
+	}
+	name, err = with.watchPath(filepath.Clean(name))
+	if err != nil {
+		return err
+	}
+	_, err = w.add(name, procFd(fd), with)
+	return err
+}
+
+// openResolve opens name with O_PATH for WithNoFollow and WithResolveBeneath,
+// using openat2() so the kernel checks the symlinks as it resolves the path.
+func openResolve(name string, with withOpts) (int, error) {
+	var (
+		how   = unix.OpenHow{Flags: unix.O_PATH | unix.O_CLOEXEC}
+		dirfd = unix.AT_FDCWD
+		path  = name
+	)
+	if with.nofollow {
+		how.Resolve |= unix.RESOLVE_NO_SYMLINKS
+	}
+	if with.beneath != "" {
+		rel, err := beneathPath(with.beneath, name)
+		if err != nil {
+			return -1, err
+		}
+		root, err := unix.Open(with.beneath, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return -1, &os.PathError{Op: "open", Path: with.beneath, Err: err}
+		}
+		defer unix.Close(root)
+		dirfd, path = root, rel
+		how.Resolve |= unix.RESOLVE_BENEATH
+	}
+
+	fd, err := unix.Openat2(dirfd, path, &how)
+	switch {
+	case err == nil:
+		return fd, nil
+	case errors.Is(err, unix.ELOOP):
+		return -1, fmt.Errorf("%w: %q has a symlink", ErrUnsafePath, name)
+	case errors.Is(err, unix.EXDEV):
+		return -1, fmt.Errorf("%w: %q resolves to outside %q", ErrUnsafePath, name, with.beneath)
+	default:
+		return -1, &os.PathError{Op: "openat2", Path: name, Err: err}
+	}
+}
+
+// procFd returns the path that refers to fd in /proc. inotify_add_watch()
+// follows this "magic" link to the object fd refers to.
+func procFd(fd int) string { return "/proc/self/fd/" + strconv.Itoa(fd) }
@@ -0,0 +1,36 @@
+//go:build !linux || appengine
+// +build !linux appengine
+
+package fsnotify
+
+import (
+	"fmt"
+	"os"
+)
+
+// AddFile starts monitoring the file or directory f, which is already open.
+//
+// This watches the object f refers to, even if it was renamed or replaced since
+// it was opened, so there is no race between checking a path and watching it.
+// Event.Name is based on f.Name(), which may no longer be the file's name.
+//
+// On Linux this uses /proc/self/fd, so /proc must be mounted. Other backends
+// add f.Name(), and return an error if that no longer refers to f; this makes
+// the window for a race small, but doesn't close it.
+//
+// The options are the same as for [Watcher.AddWith]. f can be closed after
+// AddFile returns.
+func (w *Watcher) AddFile(f *os.File, opts ...addOpt) error {
+	have, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	now, err := os.Stat(f.Name())
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(have, now) {
+		return fmt.Errorf("fsnotify: %q was replaced after it was opened", f.Name())
+	}
+	return w.AddWith(f.Name(), opts...)
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -128,14 +129,37 @@ type Watcher struct {
 	//  - inotify:      There are too many queued events (fs.inotify.max_queued_events sysctl)
 	//  - windows:      The buffer size is too small; WithBufferSize() can be used to increase it.
 	//  - kqueue, fen:  Not used.
+	//
+	// All errors sent here have a Temporary() bool and Path() string method, so
+	// you can tell transient errors apart from permanent ones without
+	// inspecting the underlying error.
 	Errors chan error
 
-	mu         sync.Mutex
-	port       *unix.EventPort
-	done       chan struct{}       // Channel for sending a "quit message" to the reader goroutine
-	dirs       map[string]struct{} // Explicitly watched directories
-	watches    map[string]struct{} // Explicitly watched non-directories
-	withoutdir bool                // do not send events for directory
+	mu       sync.Mutex
+	port     *unix.EventPort
+	done     chan struct{}       // Channel for sending a "quit message" to the reader goroutine
+	finished chan struct{}       // Closed when the channels are closed; see Done.
+	dirs     map[string]withOpts // Explicitly watched directories
+	watches  map[string]withOpts // Explicitly watched non-directories
+	denied   map[string]struct{} // Watched directories that can't be read; see AccessLost
+
+	defaults []addOpt    // Options from NewWatcherWith.
+	queue    queueStats  // Stats for the Events channel.
+	dispatch func(Event) // WithDirectDispatch handler.
+	dedup    dedup       // Drop duplicate events; see WithDedup.
+	replays  replays     // Running Replay calls.
+	maxWatch int         // WithMaxWatches; 0 means no limit.
+	faults   *faults     // Errors to inject; only set in tests.
+	hot      hotPaths    // Events by watch; see TopPaths.
+	coalesce coalescer   // See WithCoalesceHot.
+	summary  summarizer  // See WithSummaries.
+	routes   routes      // See Route.
+	locks    lockfiles   // See WithLockfileConvention.
+	filter   filter      // See WithFilterPresets.
+	bursts   bursts      // See WithBurstMarks.
+	limits   limits      // See SetLimit.
+	listings listings    // See ListConsistent.
+	pipeline pipeline    // See Use.
 }
 
 // NewWatcher creates a new Watcher.
@@ -152,12 +176,50 @@ func NewWatcher() (*Watcher, error) {
 // cases, and whenever possible you will be better off increasing the kernel
 // buffers instead of adding a large userspace buffer.
 func NewBufferedWatcher(sz uint) (*Watcher, error) {
+	return newBufferedWatcher(sz, nil)
+}
+
+// NewWatcherWith creates a new Watcher with options.
+//
+// Options that apply to a watch (such as [WithOps]) are used as the defaults
+// for [Watcher.Add] and [Watcher.AddWith]. Options that apply to the entire
+// watcher are:
+//
+//   - [WithSlowConsumer] sends a warning on Watcher.Errors if events aren't
+//     read fast enough.
+//   - [WithDirectDispatch] calls a function for every event, instead of
+//     sending them on Watcher.Events.
+//   - [WithPool] reads events on a goroutine shared with other watchers;
+//     only supported on Linux.
+//   - [WithEventQueue] sets the size of the queue between reading events and
+//     sending them on Watcher.Events; only supported on Windows.
+//   - [DrainOnClose] keeps sending events that were already read after
+//     [Watcher.Close] is called.
+//   - [WithDedup] drops events that are identical to the previous event for
+//     the same path.
+//   - [WithMergeOverlapping] sends events only once if a path is covered by
+//     more than one watch.
+//   - [WithMaxWatches] limits the number of kernel watches.
+//   - [WithCompletionPort] uses an I/O completion port from the application;
+//     only supported on Windows.
+//   - [WithEventLog] writes lifecycle and error events to the Windows Event
+//     Log; only supported on Windows.
+func NewWatcherWith(opts ...addOpt) (*Watcher, error) {
+	if getOptions(opts...).restricted {
+		return nil, fmt.Errorf("%w: only supported on Linux", ErrRestricted)
+	}
+	return newBufferedWatcher(0, opts)
+}
+
+func newBufferedWatcher(sz uint, opts []addOpt) (*Watcher, error) {
 	w := &Watcher{
-		Events:  make(chan Event, sz),
-		Errors:  make(chan error),
-		dirs:    make(map[string]struct{}),
-		watches: make(map[string]struct{}),
-		done:    make(chan struct{}),
+		Events:   make(chan Event, sz),
+		Errors:   make(chan error),
+		dirs:     make(map[string]withOpts),
+		watches:  make(map[string]withOpts),
+		denied:   make(map[string]struct{}),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
 	}
 
 	var err error
@@ -166,6 +228,9 @@ func NewBufferedWatcher(sz uint) (*Watcher, error) {
 		return nil, fmt.Errorf("fsnotify.NewWatcher: %w", err)
 	}
 
+	w.setOptions(opts)
+	w.startOptions()
+
 	go w.readEvents()
 	return w, nil
 }
@@ -173,24 +238,61 @@ func NewBufferedWatcher(sz uint) (*Watcher, error) {
 // sendEvent attempts to send an event to the user, returning true if the event
 // was put in the channel successfully and false if the watcher has been closed.
 func (w *Watcher) sendEvent(name string, op Op) (sent bool) {
-	if w.withoutdir {
-		if fi, err := os.Stat(name); err == nil && fi.IsDir() {
-			return true
-		}
+	op &= w.watchOpts(name).op
+	if op == 0 {
+		return true
 	}
-	select {
-	case w.Events <- Event{Name: name, Op: op}:
+	return w.send(Event{Name: name, Op: op})
+}
+
+func (w *Watcher) send(e Event) (sent bool) {
+	e.Seq = w.listings.count(e)
+	if w.filter.drop(e) || w.dedup.drop(e) {
 		return true
-	case <-w.done:
+	}
+	held, released := w.locks.hold(e)
+	if held {
+		return true
+	}
+	if released != nil && !w.send(*released) {
 		return false
 	}
+	w.bursts.count(e)
+	if t, ok := w.limits.count(e); ok {
+		w.sendLater(t)
+	}
+	if w.summary.absorb(e) || w.coalesce.absorb(e) {
+		return true
+	}
+	e, ok := w.pipeline.apply(e)
+	if !ok {
+		return true
+	}
+	if w.routes.route(e) {
+		return true
+	}
+	if w.dispatch != nil {
+		w.dispatch(e)
+		return true
+	}
+
+	start := w.queue.queued(len(w.Events))
+	select {
+	case w.Events <- e:
+	case <-w.done:
+		return w.queue.closed(w.Events, e)
+	}
+	if err := w.queue.sent(start, len(w.Events)); err != nil {
+		return w.sendError(err)
+	}
+	return true
 }
 
 // sendError attempts to send an error to the user, returning true if the error
 // was put in the channel successfully and false if the watcher has been closed.
 func (w *Watcher) sendError(err error) (sent bool) {
 	select {
-	case w.Errors <- err:
+	case w.Errors <- newError(err, ""):
 		return true
 	case <-w.done:
 		return false
@@ -207,7 +309,30 @@ func (w *Watcher) isClosed() bool {
 }
 
 // Close removes all watches and closes the Events channel.
+//
+// No events are sent after Close returns. Events that were already read from
+// the kernel but not yet sent are dropped and counted in [Stats], unless
+// [DrainOnClose] is used.
+//
+// This is the same as [Watcher.Stop] followed by [Watcher.Wait]. Calling it
+// again returns nil.
 func (w *Watcher) Close() error {
+	if err := w.Stop(); err != nil {
+		return err
+	}
+	w.Wait()
+	return nil
+}
+
+// Stop removes all watches and releases the kernel resources, without waiting
+// for the events that were already read to be sent.
+//
+// No new events are read after Stop returns. The events that were already read
+// are dropped (or sent, with [DrainOnClose]) and the Events and Errors channels
+// are closed in the background; use [Watcher.Wait] or [Watcher.Done] to wait
+// for that. This allows applications to drain their own queues in between.
+// Calling it again returns nil.
+func (w *Watcher) Stop() error {
 	// Take the lock used by associateFile to prevent lingering events from
 	// being processed after the close
 	w.mu.Lock()
@@ -219,6 +344,23 @@ func (w *Watcher) Close() error {
 	return w.port.Close()
 }
 
+// Done returns a channel that's closed once the watcher is fully shut down
+// after [Watcher.Stop] or [Watcher.Close]: all events are sent or dropped, and
+// the Events and Errors channels are closed.
+func (w *Watcher) Done() <-chan struct{} { return w.finished }
+
+// Wait blocks until the watcher is fully shut down; see [Watcher.Done].
+func (w *Watcher) Wait() { <-w.finished }
+
+// IsClosed reports if [Watcher.Close] or [Watcher.Stop] was called. The
+// watcher may still be sending events that were already read; use
+// [Watcher.Done] to wait for it to be fully shut down.
+//
+// After Close, methods that add paths (Add, AddWith, AddEx, Replay, and so on)
+// return [ErrClosed], while Close, Stop, and Remove return nil and WatchList
+// returns nil, so that cleanup code doesn't need to check.
+func (w *Watcher) IsClosed() bool { return w.isClosed() }
+
 // Add starts monitoring the path for changes.
 //
 // A path can only be watched once; watching it more than once is a no-op and will
@@ -255,6 +397,30 @@ func (w *Watcher) Close() error {
 //
 // Watch the parent directory and use Event.Name to filter out files you're not
 // interested in. There is an example of this in cmd/fsnotify/file.go.
+//
+// # Special files
+//
+// Named pipes (FIFOs), sockets, and device nodes can be watched directly on
+// Linux; note that writing to a named pipe sends a Chmod rather than a Write, as
+// the kernel only updates the timestamps. Other backends return
+// [ErrUnsupportedPath], as opening them may block or have side effects. Special
+// files in a watched directory are reported with Create and Remove (and Rename
+// where supported) on all backends.
+//
+// # Symlinks
+//
+// Symlinks passed to Add are followed: a symlink to a directory watches the
+// files in the directory it points to, and a symlink to a file watches that
+// file. Event names use the path that was passed to Add, not the path the link
+// points to, and adding a symlink that can't be resolved returns an error;
+// except on kqueue, which uses the path the link points to and ignores
+// unresolvable symlinks. Use [FollowSymlinks] to get the same behaviour on all
+// backends, or to watch the link itself. Use [WithNoFollow] to refuse symlinks
+// instead.
+//
+// Symlinks in a watched directory are reported as any other file: a Create or
+// Remove is sent for the link itself. Changes to the file a link points to are
+// not reported, except on kqueue, which also opens the target.
 func (w *Watcher) Add(name string) error { return w.AddWith(name) }
 
 // AddWith is like [Watcher.Add], but allows adding options. When using Add()
@@ -264,46 +430,105 @@ func (w *Watcher) Add(name string) error { return w.AddWith(name) }
 //
 //   - [WithBufferSize] sets the buffer size for the Windows backend; no-op on
 //     other platforms. The default is 64K (65536 bytes).
+//   - [WithOps] sets which operations to listen for. The default is all of
+//     them.
+//   - [WithoutDirectories] filters out events for directories.
+//   - [PreferCloseWrite] sends Write when a file is closed after writing,
+//     rather than on every write; only supported on inotify (Linux).
+//   - [WithRetry] retries re-arming a watch after a transient error, rather
+//     than removing it.
+//   - [ResolveShortNames] resolves 8.3 short names in events to long names;
+//     only supported on Windows.
+//   - [WithNormalizer] sets a function to normalize event names with; only
+//     supported on kqueue (macOS, BSD).
+//   - [DetectHardLinks] sets Event.HardLink on a Create for a new hard link;
+//     only supported on Linux and kqueue (macOS, BSD).
+//   - [DetectAttrChanges] sets Event.Attrs on a Chmod to the attributes that
+//     changed; only supported on Linux and kqueue (macOS, BSD).
+//   - [DetectFileIDs] sets Event.FileID to the inode number; only supported
+//     on Linux and kqueue (macOS, BSD).
+//   - [WithSuppressDeleteChmod] doesn't send the Chmod when a file is
+//     removed; only supported on Linux.
+//   - [WithAbsolutePaths] makes the path absolute, so that Event.Name is
+//     always absolute.
+//   - [WithNoFollow] and [WithResolveBeneath] refuse to watch paths with
+//     symlinks, or outside a root directory.
+//   - [FollowSymlinks] sets if a symlink passed to Add is followed, or if the
+//     link itself is watched; watching the link itself is only supported on
+//     Linux, macOS, and illumos.
+//   - [WithExclusive] returns an error if the path is already watched.
+//   - [AllowHydration] allows downloading cloud placeholder files; only
+//     supported on Windows.
+//   - [DetectPlaceholders] sets Event.Placeholder for writes to cloud
+//     placeholder files; only supported on Windows.
+//   - [WithPriority] sends the events before events for other paths if the
+//     application can't keep up; only supported on Windows.
+//   - [WithCopyCompleteDetection] sends CloseWrite once a written file is no
+//     longer open; only supported on Windows.
+//   - [WithShareMode] sets the share mode of the directory handle, for example
+//     to prevent deleting the directory while it's watched; only supported on
+//     Windows.
 func (w *Watcher) AddWith(name string, opts ...addOpt) error {
+	_, err := w.addWith(name, opts...)
+	return err
+}
+
+// addWith is AddWith, but also returns the number of watches that were created.
+func (w *Watcher) addWith(name string, opts ...addOpt) (int, error) {
 	if w.isClosed() {
-		return ErrClosed
+		return 0, ErrClosed
+	}
+	with := getOptions(append(w.defaults, opts...)...)
+	name, err := with.watchPath(name)
+	if err != nil {
+		return 0, err
+	}
+	if err := with.checkPath(name); err != nil {
+		return 0, err
 	}
 	if w.port.PathIsWatched(name) {
-		return nil
+		if with.exclusive {
+			return 0, fmt.Errorf("%w: %s", ErrAlreadyWatched, name)
+		}
+		return 0, nil
 	}
 
-	with := getOptions(opts...)
-	w.withoutdir = with.withoutdir
-
 	// Currently we resolve symlinks that were explicitly requested to be
-	// watched. Otherwise we would use LStat here.
+	// watched, unless FollowSymlinks(false) is used.
+	follow := with.symlinks != linkNoFollow
 	stat, err := os.Stat(name)
+	if !follow {
+		stat, err = os.Lstat(name)
+	}
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if isSpecial(stat) {
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedPath, name)
 	}
 
 	// Associate all files in the directory.
 	if stat.IsDir() {
 		err := w.handleDirectory(name, stat, true, w.associateFile)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
 		w.mu.Lock()
-		w.dirs[name] = struct{}{}
+		w.dirs[name] = with
 		w.mu.Unlock()
-		return nil
+		return 1, nil
 	}
 
-	err = w.associateFile(name, stat, true)
+	err = w.associateFile(name, stat, follow)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	w.mu.Lock()
-	w.watches[name] = struct{}{}
+	w.watches[name] = with
 	w.mu.Unlock()
-	return nil
+	return 1, nil
 }
 
 // Remove stops monitoring the path for changes.
@@ -328,7 +553,9 @@ func (w *Watcher) Remove(name string) error {
 	w.mu.Lock()
 	delete(w.watches, name)
 	delete(w.dirs, name)
+	delete(w.denied, name)
 	w.mu.Unlock()
+	w.locks.remove(name)
 
 	stat, err := os.Stat(name)
 	if err != nil {
@@ -357,13 +584,20 @@ func (w *Watcher) readEvents() {
 	// If this function returns, the watcher has been closed and we can close
 	// these channels
 	defer func() {
+		w.replays.close()
 		close(w.Errors)
 		close(w.Events)
+		close(w.finished)
 	}()
 
 	pevents := make([]unix.PortEvent, 8)
 	for {
-		count, err := w.port.Get(pevents, 1, nil)
+		var count int
+		err := w.faults.next(faultRead)
+		if err == nil {
+			count, err = w.port.Get(pevents, 1, nil)
+		}
+		w.queue.read()
 		if err != nil && err != unix.ETIME {
 			// Interrupted system call (count should be 0) ignore and continue
 			if errors.Is(err, unix.EINTR) && count == 0 {
@@ -391,7 +625,7 @@ func (w *Watcher) readEvents() {
 
 			err = w.handleEvent(&pevent)
 			if err != nil {
-				if !w.sendError(err) {
+				if !w.sendError(newError(err, pevent.Path)) {
 					return
 				}
 			}
@@ -439,14 +673,25 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 	w.mu.Unlock()
 	isWatched := watchedDir || watchedPath
 
+	// The mode was recorded when the path was associated, so there's no need
+	// to stat() it again (and it may already be gone).
+	skip := fmode.IsDir() && w.withoutDir(path)
+	send := func(op Op) bool {
+		// The Remove for the watched path itself is always sent.
+		if skip && !(isWatched && op == Remove) {
+			return true
+		}
+		return w.sendEvent(path, op)
+	}
+
 	if events&unix.FILE_DELETE != 0 {
-		if !w.sendEvent(path, Remove) {
+		if !send(Remove) {
 			return nil
 		}
 		reRegister = false
 	}
 	if events&unix.FILE_RENAME_FROM != 0 {
-		if !w.sendEvent(path, Rename) {
+		if !send(Rename) {
 			return nil
 		}
 		// Don't keep watching the new file name
@@ -460,7 +705,7 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 
 		// inotify reports a Remove event in this case, so we simulate this
 		// here.
-		if !w.sendEvent(path, Remove) {
+		if !send(Remove) {
 			return nil
 		}
 		// Don't keep watching the file that was removed
@@ -494,7 +739,7 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 		// get here, the sudirectory is already gone. Clearly we were watching
 		// this path but now it is gone. Let's tell the user that it was
 		// removed.
-		if !w.sendEvent(path, Remove) {
+		if !send(Remove) {
 			return nil
 		}
 		// Suppress extra write events on removed directories; they are not
@@ -504,12 +749,13 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 
 	// resolve symlinks that were explicitly watched as we would have at Add()
 	// time. this helps suppress spurious Chmod events on watched symlinks
-	if isWatched {
+	follow := isWatched && w.watchOpts(path).symlinks != linkNoFollow
+	if follow {
 		stat, err = os.Stat(path)
 		if err != nil {
 			// The symlink still exists, but the target is gone. Report the
 			// Remove similar to above.
-			if !w.sendEvent(path, Remove) {
+			if !send(Remove) {
 				return nil
 			}
 			// Don't return the error
@@ -523,20 +769,32 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 					return err
 				}
 			} else {
-				if !w.sendEvent(path, Write) {
+				if !send(Write) {
 					return nil
 				}
 			}
 		} else {
-			if !w.sendEvent(path, Write) {
+			if !send(Write) {
 				return nil
 			}
 		}
 	}
+	if events&unix.FILE_TRUNC != 0 && !fmode.IsDir() {
+		if !send(Truncate) {
+			return nil
+		}
+	}
+	if events&unix.FILE_ATTRIB != 0 && events&unix.FILE_MODIFIED == 0 && watchedDir {
+		// Read the directory to find out if we lost or regained access to it;
+		// see AccessLost.
+		if err := w.updateDirectory(path); err != nil {
+			return err
+		}
+	}
 	if events&unix.FILE_ATTRIB != 0 && stat != nil {
 		// Only send Chmod if perms changed
 		if stat.Mode().Perm() != fmode.Perm() {
-			if !w.sendEvent(path, Chmod) {
+			if !send(Chmod) {
 				return nil
 			}
 		}
@@ -545,19 +803,63 @@ func (w *Watcher) handleEvent(event *unix.PortEvent) error {
 	if stat != nil {
 		// If we get here, it means we've hit an event above that requires us to
 		// continue watching the file or directory
-		return w.associateFile(path, stat, isWatched)
+		err := w.associateFile(path, stat, follow)
+		if err != nil && w.retryAssociate(path, stat, follow, 1) {
+			return nil
+		}
+		return err
 	}
 	return nil
 }
 
+// retryAssociate tries to associate the path again after a failure, if it was
+// added with WithRetry. It returns false if there are no (more) attempts left.
+func (w *Watcher) retryAssociate(path string, stat os.FileInfo, follow bool, attempt int) bool {
+	backoff := w.watchOpts(path).retry
+	if backoff == nil || w.isClosed() {
+		return false
+	}
+	d := backoff(attempt)
+	if d < 0 {
+		return false
+	}
+
+	time.AfterFunc(d, func() {
+		err := w.associateFile(path, stat, follow)
+		if err != nil && !errors.Is(err, ErrClosed) && !w.retryAssociate(path, stat, follow, attempt+1) {
+			w.sendError(newError(err, path))
+		}
+	})
+	return true
+}
+
 func (w *Watcher) updateDirectory(path string) error {
 	// The directory was modified, so we must find unwatched entities and watch
 	// them. If something was removed from the directory, nothing will happen,
 	// as everything else should still be watched.
 	files, err := os.ReadDir(path)
 	if err != nil {
+		// Keep the watch, and read the directory again once the permissions
+		// change; see handleEvent.
+		if errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) {
+			w.mu.Lock()
+			_, denied := w.denied[path]
+			w.denied[path] = struct{}{}
+			w.mu.Unlock()
+			if !denied {
+				w.sendError(&AccessLost{Dir: path, Err: err})
+			}
+			return nil
+		}
 		return err
 	}
+	w.mu.Lock()
+	_, denied := w.denied[path]
+	delete(w.denied, path)
+	w.mu.Unlock()
+	if denied {
+		w.sendError(&AccessRestored{Dir: path})
+	}
 
 	for _, entry := range files {
 		path := filepath.Join(path, entry.Name())
@@ -571,10 +873,13 @@ func (w *Watcher) updateDirectory(path string) error {
 		}
 		err = w.associateFile(path, finfo, false)
 		if err != nil {
-			if !w.sendError(err) {
+			if !w.sendError(newError(err, path)) {
 				return nil
 			}
 		}
+		if finfo.IsDir() && w.withoutDir(path) {
+			continue
+		}
 		if !w.sendEvent(path, Create) {
 			return nil
 		}
@@ -582,6 +887,26 @@ func (w *Watcher) updateDirectory(path string) error {
 	return nil
 }
 
+// watchOpts gets the options for the path, from the explicit watch on either
+// the path itself or the directory it's in.
+func (w *Watcher) watchOpts(name string) withOpts {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if with, ok := w.dirs[name]; ok {
+		return with
+	}
+	if with, ok := w.watches[name]; ok {
+		return with
+	}
+	if with, ok := w.dirs[filepath.Dir(name)]; ok {
+		return with
+	}
+	return defaultOpts
+}
+
+// withoutDir reports if directory events for the path should be dropped.
+func (w *Watcher) withoutDir(name string) bool { return w.watchOpts(name).withoutdir }
+
 func (w *Watcher) associateFile(path string, stat os.FileInfo, follow bool) error {
 	if w.isClosed() {
 		return ErrClosed
@@ -606,10 +931,10 @@ func (w *Watcher) associateFile(path string, stat os.FileInfo, follow bool) erro
 	}
 	// FILE_NOFOLLOW means we watch symlinks themselves rather than their
 	// targets.
-	events := unix.FILE_MODIFIED | unix.FILE_ATTRIB | unix.FILE_NOFOLLOW
+	events := unix.FILE_MODIFIED | unix.FILE_ATTRIB | unix.FILE_TRUNC | unix.FILE_NOFOLLOW
 	if follow {
 		// We *DO* follow symlinks for explicitly watched entries.
-		events = unix.FILE_MODIFIED | unix.FILE_ATTRIB
+		events = unix.FILE_MODIFIED | unix.FILE_ATTRIB | unix.FILE_TRUNC
 	}
 	return w.port.AssociatePath(path, stat,
 		events,
@@ -645,3 +970,29 @@ func (w *Watcher) WatchList() []string {
 
 	return entries
 }
+
+// watchCount returns the number of explicitly watched paths; the files in
+// watched directories aren't counted.
+func (w *Watcher) watchCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.watches) + len(w.dirs)
+}
+
+func (w *Watcher) exportWatches() map[string]withOpts {
+	if w.isClosed() {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	watches := make(map[string]withOpts, len(w.watches)+len(w.dirs))
+	for pathname, with := range w.dirs {
+		watches[pathname] = with
+	}
+	for pathname, with := range w.watches {
+		watches[pathname] = with
+	}
+	return watches
+}
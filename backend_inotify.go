@@ -7,14 +7,14 @@
 package fsnotify
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
-	"unsafe"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -131,18 +131,55 @@ type Watcher struct {
 	//  - inotify:      There are too many queued events (fs.inotify.max_queued_events sysctl)
 	//  - windows:      The buffer size is too small; WithBufferSize() can be used to increase it.
 	//  - kqueue, fen:  Not used.
+	//
+	// All errors sent here have a Temporary() bool and Path() string method, so
+	// you can tell transient errors apart from permanent ones without
+	// inspecting the underlying error.
 	Errors chan error
 
 	// Store fd here as os.File.Read() will no longer return on close after
 	// calling Fd(). See: https://github.com/golang/go/issues/26439
-	fd               int
-	inotifyFile      *os.File
-	watches          *watches
-	done             chan struct{} // Channel for sending a "quit message" to the reader goroutine
-	closeMu          sync.Mutex
-	doneResp         chan struct{} // Channel to respond to Close
-	withoutdir       bool          // do not send events for directory
-	preferclosewrite bool
+	fd          int
+	inotifyFile *os.File
+	watches     *watches
+	done        chan struct{} // Channel for sending a "quit message" to the reader goroutine
+	closeMu     sync.Mutex
+	doneResp    chan struct{} // Closed when the channels are closed; see Done
+
+	defaults []addOpt    // Options from NewWatcherWith.
+	queue    queueStats  // Stats for the Events channel.
+	dispatch func(Event) // WithDirectDispatch handler.
+	dedup    dedup       // Drop duplicate events; see WithDedup.
+	replays  replays     // Running Replay calls.
+	maxWatch int         // WithMaxWatches; 0 means no limit.
+	faults   *faults     // Errors to inject; only set in tests.
+	hot      hotPaths    // Events by watch; see TopPaths.
+	coalesce coalescer   // See WithCoalesceHot.
+	summary  summarizer  // See WithSummaries.
+	routes   routes      // See Route.
+	locks    lockfiles   // See WithLockfileConvention.
+	filter   filter      // See WithFilterPresets.
+	bursts   bursts      // See WithBurstMarks.
+	limits   limits      // See SetLimit.
+	listings listings    // See ListConsistent.
+	pipeline pipeline    // See Use.
+	attrs    attrCache   // File attributes; see DetectAttrChanges.
+	fileIDs  idCache     // Inode numbers; see DetectFileIDs.
+	pool     *Pool       // Pool to read events on; nil if it has its own goroutine.
+
+	// IN_MOVED_FROM by cookie, to set Event.RenamedFrom on the IN_MOVED_TO
+	// with the same cookie; only used in handleEvents. See addMove.
+	moved map[uint32]move
+}
+
+// moveTimeout is how long an IN_MOVED_FROM waits for the IN_MOVED_TO with the
+// same cookie.
+const moveTimeout = time.Second
+
+// move is the old name of a rename, waiting for the new name.
+type move struct {
+	from string
+	at   time.Time
 }
 
 type (
@@ -152,9 +189,18 @@ type (
 		path map[string]uint32 // pathname → wd
 	}
 	watch struct {
-		wd    uint32 // Watch descriptor (as returned by the inotify_add_watch() syscall)
-		flags uint32 // inotify flags of this watch (see inotify(7) for the list of valid flags)
-		path  string // Watch path.
+		wd         uint32 // Watch descriptor (as returned by the inotify_add_watch() syscall)
+		flags      uint32 // inotify flags of this watch (see inotify(7) for the list of valid flags)
+		path       string // Watch path.
+		op         Op     // Operations to send events for.
+		withoutdir bool   // Don't send events for directories.
+		closeWrite bool   // Send Write on IN_CLOSE_WRITE rather than IN_MODIFY.
+		hardLinks  bool   // Set Event.HardLink on Create.
+		attrs      bool   // Set Event.Attrs on Chmod.
+		fileIDs    bool   // Set Event.FileID.
+		nodelchmod bool   // Don't send the Chmod for a removed file.
+		dev        uint64 // Device of the path; see Event.Device.
+		lastName   string // Last name from name(); only used in readEvents.
 	}
 )
 
@@ -252,6 +298,43 @@ func NewWatcher() (*Watcher, error) {
 // cases, and whenever possible you will be better off increasing the kernel
 // buffers instead of adding a large userspace buffer.
 func NewBufferedWatcher(sz uint) (*Watcher, error) {
+	return newBufferedWatcher(sz, nil)
+}
+
+// NewWatcherWith creates a new Watcher with options.
+//
+// Options that apply to a watch (such as [WithOps]) are used as the defaults
+// for [Watcher.Add] and [Watcher.AddWith]. Options that apply to the entire
+// watcher are:
+//
+//   - [WithSlowConsumer] sends a warning on Watcher.Errors if events aren't
+//     read fast enough.
+//   - [WithDirectDispatch] calls a function for every event, instead of
+//     sending them on Watcher.Events.
+//   - [WithPool] reads events on a goroutine shared with other watchers;
+//     only supported on Linux.
+//   - [WithEventQueue] sets the size of the queue between reading events and
+//     sending them on Watcher.Events; only supported on Windows.
+//   - [DrainOnClose] keeps sending events that were already read after
+//     [Watcher.Close] is called.
+//   - [WithDedup] drops events that are identical to the previous event for
+//     the same path.
+//   - [WithMergeOverlapping] sends events only once if a path is covered by
+//     more than one watch.
+//   - [WithMaxWatches] limits the number of kernel watches.
+//   - [WithCompletionPort] uses an I/O completion port from the application;
+//     only supported on Windows.
+//   - [WithEventLog] writes lifecycle and error events to the Windows Event
+//     Log; only supported on Windows.
+func NewWatcherWith(opts ...addOpt) (*Watcher, error) {
+	return newBufferedWatcher(0, opts)
+}
+
+func newBufferedWatcher(sz uint, opts []addOpt) (*Watcher, error) {
+	if err := getOptions(opts...).checkRestricted(); err != nil {
+		return nil, err
+	}
+
 	// Need to set nonblocking mode for SetDeadline to work, otherwise blocking
 	// I/O operations won't terminate on close.
 	fd, errno := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
@@ -269,29 +352,74 @@ func NewBufferedWatcher(sz uint) (*Watcher, error) {
 		doneResp:    make(chan struct{}),
 	}
 
+	// The pool may read events as soon as the watcher is added, so set the
+	// options first; the goroutines are started once it's added, as they only
+	// stop once the watcher is closed.
+	w.setOptions(opts)
+	if pool := getOptions(opts...).pool; pool != nil {
+		err := pool.add(w)
+		if err != nil {
+			w.inotifyFile.Close()
+			return nil, err
+		}
+		w.pool = pool
+		w.startOptions()
+		return w, nil
+	}
+
+	w.startOptions()
 	go w.readEvents()
 	return w, nil
 }
 
 // Returns true if the event was sent, or false if watcher is closed.
 func (w *Watcher) sendEvent(e Event) bool {
-	if w.withoutdir {
-		if fi, err := os.Stat(e.Name); err == nil && fi.IsDir() {
-			return true
-		}
+	e.Seq = w.listings.count(e)
+	if w.filter.drop(e) || w.dedup.drop(e) {
+		return true
 	}
+	held, released := w.locks.hold(e)
+	if held {
+		return true
+	}
+	if released != nil && !w.sendEvent(*released) {
+		return false
+	}
+	w.bursts.count(e)
+	if t, ok := w.limits.count(e); ok {
+		w.sendLater(t)
+	}
+	if w.summary.absorb(e) || w.coalesce.absorb(e) {
+		return true
+	}
+	e, ok := w.pipeline.apply(e)
+	if !ok {
+		return true
+	}
+	if w.routes.route(e) {
+		return true
+	}
+	if w.dispatch != nil {
+		w.dispatch(e)
+		return true
+	}
+
+	start := w.queue.queued(len(w.Events))
 	select {
 	case w.Events <- e:
-		return true
 	case <-w.done:
-		return false
+		return w.queue.closed(w.Events, e)
+	}
+	if err := w.queue.sent(start, len(w.Events)); err != nil {
+		return w.sendError(err)
 	}
+	return true
 }
 
 // Returns true if the error was sent, or false if watcher is closed.
 func (w *Watcher) sendError(err error) bool {
 	select {
-	case w.Errors <- err:
+	case w.Errors <- newError(err, ""):
 		return true
 	case <-w.done:
 		return false
@@ -308,7 +436,30 @@ func (w *Watcher) isClosed() bool {
 }
 
 // Close removes all watches and closes the Events channel.
+//
+// No events are sent after Close returns. Events that were already read from
+// the kernel but not yet sent are dropped and counted in [Stats], unless
+// [DrainOnClose] is used.
+//
+// This is the same as [Watcher.Stop] followed by [Watcher.Wait]. Calling it
+// again returns nil.
 func (w *Watcher) Close() error {
+	if err := w.Stop(); err != nil {
+		return err
+	}
+	w.Wait()
+	return nil
+}
+
+// Stop removes all watches and releases the kernel resources, without waiting
+// for the events that were already read to be sent.
+//
+// No new events are read after Stop returns. The events that were already read
+// are dropped (or sent, with [DrainOnClose]) and the Events and Errors channels
+// are closed in the background; use [Watcher.Wait] or [Watcher.Done] to wait
+// for that. This allows applications to drain their own queues in between.
+// Calling it again returns nil.
+func (w *Watcher) Stop() error {
 	w.closeMu.Lock()
 	if w.isClosed() {
 		w.closeMu.Unlock()
@@ -317,18 +468,33 @@ func (w *Watcher) Close() error {
 	close(w.done)
 	w.closeMu.Unlock()
 
+	// The pool may still have a pending read for the file descriptor, so it
+	// closes it once the watcher is removed from the pool.
+	if w.pool != nil {
+		return w.pool.del(w)
+	}
+
 	// Causes any blocking reads to return with an error, provided the file
 	// still supports deadline operations.
-	err := w.inotifyFile.Close()
-	if err != nil {
-		return err
-	}
+	return w.inotifyFile.Close()
+}
 
-	// Wait for goroutine to close
-	<-w.doneResp
+// Done returns a channel that's closed once the watcher is fully shut down
+// after [Watcher.Stop] or [Watcher.Close]: all events are sent or dropped, and
+// the Events and Errors channels are closed.
+func (w *Watcher) Done() <-chan struct{} { return w.doneResp }
 
-	return nil
-}
+// Wait blocks until the watcher is fully shut down; see [Watcher.Done].
+func (w *Watcher) Wait() { <-w.doneResp }
+
+// IsClosed reports if [Watcher.Close] or [Watcher.Stop] was called. The
+// watcher may still be sending events that were already read; use
+// [Watcher.Done] to wait for it to be fully shut down.
+//
+// After Close, methods that add paths (Add, AddWith, AddEx, Replay, and so on)
+// return [ErrClosed], while Close, Stop, and Remove return nil and WatchList
+// returns nil, so that cleanup code doesn't need to check.
+func (w *Watcher) IsClosed() bool { return w.isClosed() }
 
 // Add starts monitoring the path for changes.
 //
@@ -366,6 +532,30 @@ func (w *Watcher) Close() error {
 //
 // Watch the parent directory and use Event.Name to filter out files you're not
 // interested in. There is an example of this in cmd/fsnotify/file.go.
+//
+// # Special files
+//
+// Named pipes (FIFOs), sockets, and device nodes can be watched directly on
+// Linux; note that writing to a named pipe sends a Chmod rather than a Write, as
+// the kernel only updates the timestamps. Other backends return
+// [ErrUnsupportedPath], as opening them may block or have side effects. Special
+// files in a watched directory are reported with Create and Remove (and Rename
+// where supported) on all backends.
+//
+// # Symlinks
+//
+// Symlinks passed to Add are followed: a symlink to a directory watches the
+// files in the directory it points to, and a symlink to a file watches that
+// file. Event names use the path that was passed to Add, not the path the link
+// points to, and adding a symlink that can't be resolved returns an error;
+// except on kqueue, which uses the path the link points to and ignores
+// unresolvable symlinks. Use [FollowSymlinks] to get the same behaviour on all
+// backends, or to watch the link itself. Use [WithNoFollow] to refuse symlinks
+// instead.
+//
+// Symlinks in a watched directory are reported as any other file: a Create or
+// Remove is sent for the link itself. Changes to the file a link points to are
+// not reported, except on kqueue, which also opens the target.
 func (w *Watcher) Add(name string) error { return w.AddWith(name) }
 
 // AddWith is like [Watcher.Add], but allows adding options. When using Add()
@@ -375,44 +565,159 @@ func (w *Watcher) Add(name string) error { return w.AddWith(name) }
 //
 //   - [WithBufferSize] sets the buffer size for the Windows backend; no-op on
 //     other platforms. The default is 64K (65536 bytes).
+//   - [WithOps] sets which operations to listen for. The default is all of
+//     them.
+//   - [WithoutDirectories] filters out events for directories.
+//   - [PreferCloseWrite] sends Write when a file is closed after writing,
+//     rather than on every write; only supported on inotify (Linux).
+//   - [WithRetry] retries re-arming a watch after a transient error, rather
+//     than removing it.
+//   - [ResolveShortNames] resolves 8.3 short names in events to long names;
+//     only supported on Windows.
+//   - [WithNormalizer] sets a function to normalize event names with; only
+//     supported on kqueue (macOS, BSD).
+//   - [DetectHardLinks] sets Event.HardLink on a Create for a new hard link;
+//     only supported on Linux and kqueue (macOS, BSD).
+//   - [DetectAttrChanges] sets Event.Attrs on a Chmod to the attributes that
+//     changed; only supported on Linux and kqueue (macOS, BSD).
+//   - [DetectFileIDs] sets Event.FileID to the inode number; only supported
+//     on Linux and kqueue (macOS, BSD).
+//   - [WithSuppressDeleteChmod] doesn't send the Chmod when a file is
+//     removed; only supported on Linux.
+//   - [WithAbsolutePaths] makes the path absolute, so that Event.Name is
+//     always absolute.
+//   - [WithNoFollow] and [WithResolveBeneath] refuse to watch paths with
+//     symlinks, or outside a root directory.
+//   - [FollowSymlinks] sets if a symlink passed to Add is followed, or if the
+//     link itself is watched; watching the link itself is only supported on
+//     Linux, macOS, and illumos.
+//   - [WithExclusive] returns an error if the path is already watched.
+//   - [AllowHydration] allows downloading cloud placeholder files; only
+//     supported on Windows.
+//   - [DetectPlaceholders] sets Event.Placeholder for writes to cloud
+//     placeholder files; only supported on Windows.
+//   - [WithPriority] sends the events before events for other paths if the
+//     application can't keep up; only supported on Windows.
+//   - [WithCopyCompleteDetection] sends CloseWrite once a written file is no
+//     longer open; only supported on Windows.
+//   - [WithShareMode] sets the share mode of the directory handle, for example
+//     to prevent deleting the directory while it's watched; only supported on
+//     Windows.
 func (w *Watcher) AddWith(name string, opts ...addOpt) error {
+	_, err := w.addWith(name, opts...)
+	return err
+}
+
+// addWith is AddWith, but also returns the number of watches that were created.
+func (w *Watcher) addWith(name string, opts ...addOpt) (int, error) {
 	if w.isClosed() {
-		return ErrClosed
+		return 0, ErrClosed
 	}
 
-	name = filepath.Clean(name)
-	with := getOptions(opts...)
-	w.withoutdir = with.withoutdir
-	w.preferclosewrite = with.preferclosewrite
+	with := getOptions(append(w.defaults, opts...)...)
+	if err := with.checkRestricted(); err != nil {
+		return 0, err
+	}
+	name, err := with.watchPath(filepath.Clean(name))
+	if err != nil {
+		return 0, err
+	}
+	if with.nofollow || with.beneath != "" {
+		fd, err := openResolve(name, with)
+		if err != nil {
+			return 0, err
+		}
+		defer unix.Close(fd)
+		return w.add(name, procFd(fd), with)
+	}
+	return w.add(name, name, with)
+}
 
-	var flags uint32 = unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
-		unix.IN_CREATE | unix.IN_ATTRIB | unix.IN_MODIFY |
-		unix.IN_MOVE_SELF | unix.IN_DELETE | unix.IN_DELETE_SELF
-	if w.preferclosewrite {
-		flags = flags | unix.IN_CLOSE_WRITE
+// add a watch for kpath, which is the path given to the kernel, and send events
+// for it as name. These are the same, except for AddFile and AddAt.
+//
+// Returns the number of watches that were created: 1 for a new watch, and 0 if
+// the path was already watched.
+func (w *Watcher) add(name, kpath string, with withOpts) (int, error) {
+	flags := inotifyFlags(with)
+	var (
+		st  unix.Stat_t
+		dev uint64
+	)
+	if unix.Stat(kpath, &st) == nil {
+		dev = uint64(st.Dev)
 	}
-	return w.watches.updatePath(name, func(existing *watch) (*watch, error) {
+	n := 0
+	err := w.watches.updatePath(name, func(existing *watch) (*watch, error) {
+		if with.exclusive && existing != nil {
+			return nil, fmt.Errorf("%w: %s", ErrAlreadyWatched, name)
+		}
 		if existing != nil {
 			flags |= existing.flags | unix.IN_MASK_ADD
+			with.op |= existing.op
+		} else if w.maxWatch > 0 && len(w.watches.wd) >= w.maxWatch {
+			return nil, &WatchLimitError{Limit: w.maxWatch, Skipped: []string{name}}
 		}
 
-		wd, err := unix.InotifyAddWatch(w.fd, name, flags)
+		// Not kept in watch.flags, as it can't be combined with IN_MASK_ADD.
+		// A new path may still be an alias for a watched inode; use
+		// IN_MASK_ADD so that doesn't replace the flags of that watch.
+		addFlags := flags
+		if with.exclusive {
+			addFlags |= unix.IN_MASK_CREATE
+		} else {
+			addFlags |= unix.IN_MASK_ADD
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, kpath, addFlags)
 		if wd == -1 {
+			if err == unix.EEXIST && with.exclusive {
+				return nil, fmt.Errorf("%w: %s", ErrAlreadyWatched, name)
+			}
 			return nil, err
 		}
 
 		if existing == nil {
+			if other := w.watches.wd[uint32(wd)]; other != nil {
+				return nil, fmt.Errorf("%w: %q is the same as %q", ErrAliasWatch, name, other.path)
+			}
+			n = 1
 			return &watch{
-				wd:    uint32(wd),
-				path:  name,
-				flags: flags,
+				wd:         uint32(wd),
+				path:       name,
+				flags:      flags,
+				op:         with.op,
+				withoutdir: with.withoutdir,
+				closeWrite: with.preferclosewrite,
+				hardLinks:  with.hardlinks,
+				attrs:      with.attrs,
+				fileIDs:    with.fileIDs,
+				nodelchmod: with.nodelchmod,
+				dev:        dev,
 			}, nil
 		}
 
 		existing.wd = uint32(wd)
 		existing.flags = flags
+		existing.op = with.op
+		existing.withoutdir = with.withoutdir
+		existing.closeWrite = with.preferclosewrite
+		existing.hardLinks = with.hardlinks
+		existing.attrs = with.attrs
+		existing.fileIDs = with.fileIDs
+		existing.nodelchmod = with.nodelchmod
+		existing.dev = dev
 		return existing, nil
 	})
+	if err == nil && with.attrs {
+		w.attrs.addAll(name)
+	}
+	if err == nil && with.fileIDs {
+		w.fileIDs.addAll(name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
 }
 
 // Remove stops monitoring the path for changes.
@@ -450,6 +755,9 @@ func (w *Watcher) remove(name string) error {
 		//         are watching is deleted.
 		return errno
 	}
+	w.attrs.remove(name)
+	w.fileIDs.remove(name)
+	w.locks.remove(name)
 	return nil
 }
 
@@ -472,124 +780,312 @@ func (w *Watcher) WatchList() []string {
 	return entries
 }
 
+func (w *Watcher) watchCount() int { return w.watches.len() }
+
+func (w *Watcher) exportWatches() map[string]withOpts {
+	if w.isClosed() {
+		return nil
+	}
+
+	w.watches.mu.RLock()
+	defer w.watches.mu.RUnlock()
+
+	watches := make(map[string]withOpts, len(w.watches.wd))
+	for _, watch := range w.watches.wd {
+		with := defaultOpts
+		with.op = watch.op
+		with.withoutdir = watch.withoutdir
+		with.preferclosewrite = watch.closeWrite
+		with.hardlinks = watch.hardLinks
+		with.attrs = watch.attrs
+		with.fileIDs = watch.fileIDs
+		with.nodelchmod = watch.nodelchmod
+		watches[watch.path] = with
+	}
+	return watches
+}
+
 // readEvents reads from the inotify file descriptor, converts the
 // received events into Event objects and sends them via the Events channel
 func (w *Watcher) readEvents() {
-	defer func() {
-		close(w.doneResp)
-		close(w.Errors)
-		close(w.Events)
-	}()
+	defer w.closeChannels()
 
-	var (
-		buf   [unix.SizeofInotifyEvent * 4096]byte // Buffer for a maximum of 4096 raw events
-		errno error                                // Syscall errno
-	)
+	buf := newInotifyBuffer()
 	for {
 		// See if we have been closed.
 		if w.isClosed() {
 			return
 		}
 
-		n, err := w.inotifyFile.Read(buf[:])
-		switch {
-		case errors.Unwrap(err) == os.ErrClosed:
+		n, err := w.inotifyFile.Read(buf)
+		if errors.Unwrap(err) == os.ErrClosed {
+			return
+		}
+		if !w.handleEvents(buf, n, err) {
 			return
-		case err != nil:
-			if !w.sendError(err) {
-				return
-			}
-			continue
 		}
+	}
+}
 
-		if n < unix.SizeofInotifyEvent {
-			var err error
-			if n == 0 {
-				err = io.EOF // If EOF is received. This should really never happen.
-			} else if n < 0 {
-				err = errno // If an error occurred while reading.
-			} else {
-				err = errors.New("notify: short read in readEvents()") // Read was too short.
-			}
-			if !w.sendError(err) {
-				return
-			}
-			continue
-		}
-
-		var offset uint32
-		// We don't know how many events we just read into the buffer
-		// While the offset points to at least one whole event...
-		for offset <= uint32(n-unix.SizeofInotifyEvent) {
-			var (
-				// Point "raw" to the event in the buffer
-				raw     = (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
-				mask    = uint32(raw.Mask)
-				nameLen = uint32(raw.Len)
-			)
-
-			if mask&unix.IN_Q_OVERFLOW != 0 {
-				if !w.sendError(ErrEventOverflow) {
-					return
-				}
-			}
+func (w *Watcher) closeChannels() {
+	w.replays.close()
+	close(w.doneResp)
+	close(w.Errors)
+	close(w.Events)
+}
 
-			// If the event happened to the watched directory or the watched file, the kernel
-			// doesn't append the filename to the event, but we would like to always fill the
-			// the "Name" field with a valid filename. We retrieve the path of the watch from
-			// the "paths" map.
-			watch := w.watches.byWd(uint32(raw.Wd))
+// newInotifyBuffer returns a buffer for a maximum of 4096 raw events. This is
+// re-used for every read. It doesn't need to be aligned, as parseInotify
+// copies the headers out of it.
+func newInotifyBuffer() []byte {
+	return make([]byte, unix.SizeofInotifyEvent*4096)
+}
+
+// handleEvents converts the n bytes of raw events that were read in to buf to
+// Event values and sends them; err is the error from the read. It returns false
+// if the watcher was closed.
+func (w *Watcher) handleEvents(buf []byte, n int, err error) bool {
+	w.queue.read()
+	n, err = w.faults.read(n, err)
+	if err != nil {
+		return w.sendError(err)
+	}
+	if n < unix.SizeofInotifyEvent {
+		if n == 0 {
+			err = io.EOF // If EOF is received. This should really never happen.
+		} else {
+			err = errors.New("notify: short read in readEvents()") // Read was too short.
+		}
+		return w.sendError(err)
+	}
+
+	ok := true
+	now := time.Now()
+	w.dedup.reset()
+	err = parseInotify(buf[:n], func(raw inotifyEvent, rawName []byte) bool {
+		var (
+			mask    = raw.Mask
+			nameLen = raw.Len
+		)
 
-			// inotify will automatically remove the watch on deletes; just need
-			// to clean our state here.
-			if watch != nil && mask&unix.IN_DELETE_SELF == unix.IN_DELETE_SELF {
-				w.watches.remove(watch.wd)
+		if mask&unix.IN_Q_OVERFLOW != 0 {
+			if !w.sendError(ErrEventOverflow) {
+				ok = false
+				return false
 			}
-			// We can't really update the state when a watched path is moved;
-			// only IN_MOVE_SELF is sent and not IN_MOVED_{FROM,TO}. So remove
-			// the watch.
-			if watch != nil && mask&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF {
-				err := w.remove(watch.path)
-				if err != nil && !errors.Is(err, ErrNonExistentWatch) {
-					if !w.sendError(err) {
-						return
-					}
+		}
+
+		// If the event happened to the watched directory or the watched file, the kernel
+		// doesn't append the filename to the event, but we would like to always fill the
+		// the "Name" field with a valid filename. We retrieve the path of the watch from
+		// the "paths" map.
+		watch := w.watches.byWd(uint32(raw.Wd))
+		if watch != nil {
+			w.hot.add(watch.path, now)
+		}
+
+		// inotify will automatically remove the watch on deletes and unmounts; just need
+		// to clean our state here.
+		if watch != nil && mask&(unix.IN_DELETE_SELF|unix.IN_UNMOUNT) != 0 {
+			w.watches.remove(watch.wd)
+		}
+		// We can't really update the state when a watched path is moved;
+		// only IN_MOVE_SELF is sent and not IN_MOVED_{FROM,TO}. So remove
+		// the watch.
+		if watch != nil && mask&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF {
+			err := w.remove(watch.path)
+			if err != nil && !errors.Is(err, ErrNonExistentWatch) {
+				if !w.sendError(newError(err, watch.path)) {
+					ok = false
+					return false
 				}
 			}
+		}
+
+		var name string
+		if nameLen > 0 {
+			name = watch.name(rawName)
+		} else if watch != nil {
+			name = watch.path
+		}
 
-			var name string
-			if watch != nil {
-				name = watch.path
+		var closeWrite bool
+		if watch != nil {
+			closeWrite = watch.closeWrite
+		}
+		event := w.newEvent(name, mask, closeWrite)
+		if watch != nil {
+			event.WatchRoot, event.Device = watch.path, watch.dev
+		}
+		if mask&unix.IN_MOVED_FROM != 0 {
+			w.addMove(raw.Cookie, name)
+		} else if mask&unix.IN_MOVED_TO != 0 {
+			event.RenamedFrom = w.takeMove(raw.Cookie)
+		}
+
+		// The kernel tells us if the subject is a directory, so there's no
+		// need to stat() the path (which may no longer exist).
+		// The Remove for the watched directory itself is always sent.
+		isRoot := nameLen == 0 && mask&unix.IN_DELETE_SELF != 0
+		skip := watch != nil && watch.withoutdir && mask&unix.IN_ISDIR != 0 && !isRoot
+		if watch != nil && event.Op != 0 {
+			event.Op &= watch.op
+			skip = skip || event.Op == 0
+		}
+		if !skip && watch != nil && watch.hardLinks && event.Has(Create) && mask&unix.IN_ISDIR == 0 {
+			if fi, err := os.Lstat(name); err == nil {
+				event.HardLink = isHardLink(fi)
 			}
-			if nameLen > 0 {
-				// Point "bytes" at the first byte of the filename
-				bytes := (*[unix.PathMax]byte)(unsafe.Pointer(&buf[offset+unix.SizeofInotifyEvent]))[:nameLen:nameLen]
-				// The filename is padded with NULL bytes. TrimRight() gets rid of those.
-				name += "/" + strings.TrimRight(string(bytes[0:nameLen]), "\000")
+		}
+		if watch != nil && watch.attrs {
+			switch {
+			case mask&(unix.IN_DELETE|unix.IN_DELETE_SELF|unix.IN_MOVED_FROM|unix.IN_MOVE_SELF) != 0:
+				w.attrs.remove(name)
+			case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+				w.attrs.add(name)
+			case mask&unix.IN_ATTRIB != 0:
+				event.Attrs, event.Owner = w.attrs.changed(name)
+			case mask&unix.IN_MODIFY != 0:
+				w.attrs.changed(name) // Writes update the modification time.
+			}
+		}
+		if watch != nil && watch.fileIDs {
+			switch {
+			case mask&(unix.IN_DELETE|unix.IN_DELETE_SELF|unix.IN_MOVED_FROM|unix.IN_MOVE_SELF) != 0:
+				event.FileID = w.fileIDs.remove(name)
+			case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+				event.FileID = w.fileIDs.update(name)
+			default:
+				event.FileID = w.fileIDs.get(name)
 			}
+		}
 
-			event := w.newEvent(name, mask)
+		if !skip && watch != nil && watch.nodelchmod && event.Op == Chmod {
+			skip = event.Attrs == AttrLinks || !exists(name)
+		}
 
-			// Send the events that are not ignored on the events channel
-			if mask&unix.IN_IGNORED == 0 {
-				if !w.sendEvent(event) {
-					return
-				}
+		// Send the events that are not ignored on the events channel. Keep
+		// going if the watcher was closed, so the remaining events are
+		// counted as dropped.
+		if mask&unix.IN_IGNORED == 0 && !skip && !w.dedup.overlap(event) {
+			if !w.sendEvent(event) {
+				ok = false
 			}
+		}
+		return true
+	})
+	if err != nil && !w.sendError(newError(err, "")) {
+		return false
+	}
+	return ok
+}
+
+// addMove remembers the old name of a rename until the IN_MOVED_TO with the
+// same cookie is read.
+//
+// The kernel sends the IN_MOVED_FROM and IN_MOVED_TO of a rename right after
+// each other, but they're for different watches if the file is moved to
+// another watched directory, and can be in different reads. There's no
+// IN_MOVED_TO at all if the file is moved out of the watched directories, so
+// the old names are kept for moveTimeout; the Rename for the old name is sent
+// either way, and an IN_MOVED_TO without an old name is sent as a plain Create.
+func (w *Watcher) addMove(cookie uint32, from string) {
+	now := time.Now()
+	for c, m := range w.moved {
+		if now.Sub(m.at) > moveTimeout {
+			delete(w.moved, c)
+		}
+	}
+	if w.moved == nil {
+		w.moved = make(map[uint32]move)
+	}
+	w.moved[cookie] = move{from: from, at: now}
+}
+
+// takeMove returns the old name for the IN_MOVED_TO with cookie, or "" if
+// there isn't one.
+func (w *Watcher) takeMove(cookie uint32) string {
+	m, ok := w.moved[cookie]
+	if !ok {
+		return ""
+	}
+	delete(w.moved, cookie)
+	if time.Since(m.at) > moveTimeout {
+		return ""
+	}
+	return m.from
+}
+
+// exists reports if path exists; it's assumed to exist if it can't be
+// determined.
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// name returns the full path for an event on a file inside this watch; b is
+// the filename from the event, which is padded with NUL bytes. watch may be
+// nil.
+//
+// The same file is often changed many times in a row (e.g. a log file), so the
+// last name is kept and re-used if it's the same, instead of allocating a new
+// string for every event.
+func (watch *watch) name(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i > -1 {
+		b = b[:i]
+	}
+	if watch == nil {
+		return "/" + string(b)
+	}
+
+	// The string(b) conversions don't allocate.
+	if l, p := len(watch.lastName), len(watch.path); l == p+1+len(b) && watch.lastName[p+1:] == string(b) {
+		return watch.lastName
+	}
+	watch.lastName = watch.path + "/" + string(b)
+	return watch.lastName
+}
 
-			// Move to the next event in the buffer
-			offset += unix.SizeofInotifyEvent + nameLen
+// inotifyFlags returns the inotify flags to use for a watch with these
+// options. IN_DELETE_SELF and IN_MOVE_SELF are always added, as we need them to
+// keep track of the watch itself.
+func inotifyFlags(with withOpts) uint32 {
+	var flags uint32 = unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+	if with.op.Has(Create) {
+		flags |= unix.IN_CREATE | unix.IN_MOVED_TO
+	}
+	if with.op.Has(Write) {
+		if with.preferclosewrite {
+			flags |= unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO
+		} else {
+			flags |= unix.IN_MODIFY
 		}
 	}
+	if with.op.Has(Remove) {
+		flags |= unix.IN_DELETE
+	}
+	if with.op.Has(Rename) {
+		flags |= unix.IN_MOVED_FROM
+	}
+	if with.op.Has(Chmod) {
+		flags |= unix.IN_ATTRIB
+	}
+	if with.op.Has(CloseWrite) {
+		flags |= unix.IN_CLOSE_WRITE
+	}
+	if with.symlinks == linkNoFollow {
+		flags |= unix.IN_DONT_FOLLOW
+	}
+	return flags
 }
 
 // newEvent returns an platform-independent Event based on an inotify mask.
-func (w *Watcher) newEvent(name string, mask uint32) Event {
+func (w *Watcher) newEvent(name string, mask uint32, closeWrite bool) Event {
 	e := Event{Name: name}
 	if mask&unix.IN_DELETE_SELF == unix.IN_DELETE_SELF || mask&unix.IN_DELETE == unix.IN_DELETE {
 		e.Op |= Remove
 	}
-	if !w.preferclosewrite {
+	if !closeWrite {
 		if mask&unix.IN_CREATE == unix.IN_CREATE || mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
 			e.Op |= Create
 		}
@@ -610,5 +1106,11 @@ func (w *Watcher) newEvent(name string, mask uint32) Event {
 	if mask&unix.IN_ATTRIB == unix.IN_ATTRIB {
 		e.Op |= Chmod
 	}
+	if mask&unix.IN_CLOSE_WRITE == unix.IN_CLOSE_WRITE {
+		e.Op |= CloseWrite
+	}
+	if mask&unix.IN_UNMOUNT == unix.IN_UNMOUNT {
+		e.Op |= Unmount
+	}
 	return e
 }
@@ -5,12 +5,20 @@ package fsnotify
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"testing/quick"
 	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 // Ensure that the correct error is returned on overflows.
@@ -102,6 +110,283 @@ func TestInotifyDeleteOpenFile(t *testing.T) {
 	cmpEvents(t, tmp, e, newEvents(t, `remove /file`))
 }
 
+func TestInotifySuppressDeleteChmod(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file, link := join(tmp, "file"), join(tmp, "link")
+
+	touch(t, file)
+	fp, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	w := newCollector(t)
+	if err := w.w.AddWith(file, WithSuppressDeleteChmod(), DetectAttrChanges()); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	// Only the number of links changes.
+	if err := os.Link(file, link); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+	rm(t, link)
+	eventSeparator()
+	if err := os.Chmod(file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+	rm(t, file)
+	waitForEvents()
+	cmpEvents(t, tmp, w.events(t), newEvents(t, `chmod /file`))
+
+	fp.Close()
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `remove /file`))
+}
+
+func TestInotifyCloseWrite(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, WithOps(Create|CloseWrite)); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	cat(t, "data", tmp, "file")
+	cat(t, "data", tmp, "file")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create       /file
+		close_write  /file
+		close_write  /file
+	`))
+}
+
+func TestInotifySpecialFiles(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	fifo := join(tmp, "fifo")
+	w := newCollector(t, tmp)
+	w.collect(t)
+
+	if err := unix.Mkfifo(fifo, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// O_RDWR doesn't block waiting for the other end on Linux. The write only
+	// updates the timestamps, so it's a Chmod.
+	fp, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	waitForEvents()
+	if err := w.w.Add(fifo); err != nil {
+		t.Fatalf("Add(fifo): %s", err)
+	}
+	rm(t, fifo)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /fifo
+		chmod   /fifo
+		remove  /fifo
+		remove  /fifo
+	`))
+}
+
+func TestInotifyPoolStats(t *testing.T) {
+	t.Parallel()
+
+	pool, err := NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	tmp := t.TempDir()
+	for i, n := range []int{1, 2} {
+		w, err := NewWatcherWith(WithPool(pool))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < n; j++ {
+			dir := join(tmp, strconv.Itoa(i), strconv.Itoa(j))
+			mkdirAll(t, dir)
+			addWatch(t, w, dir)
+		}
+		if have := w.Stats().Watches; have != n {
+			t.Errorf("Stats().Watches = %d; want %d", have, n)
+		}
+	}
+
+	if have, want := pool.Stats(), (PoolStats{Watchers: 2, Watches: 3}); have != want {
+		t.Errorf("\nhave: %#v\nwant: %#v", have, want)
+	}
+}
+
+func TestInotifyPoolFail(t *testing.T) {
+	t.Parallel()
+
+	pool, err := NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := make([]*Watcher, 2)
+	for i := range ws {
+		ws[i], err = NewWatcherWith(WithPool(pool))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Replace the epoll fd with something that isn't an epoll fd, so that the
+	// next epoll_wait fails with EINVAL.
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	if err := unix.Dup3(int(null.Fd()), pool.epfd, unix.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	pool.mu.Lock()
+	pool.wakeup()
+	pool.mu.Unlock()
+
+	// The errors are sent one watcher at a time, so read them all at once.
+	var wg sync.WaitGroup
+	for i, w := range ws {
+		i, w := i, w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case err := <-w.Errors:
+				if !errors.Is(err, unix.EINVAL) {
+					t.Errorf("watcher %d: wrong error: %v", i, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("watcher %d: no error", i)
+				return
+			}
+			select {
+			case <-w.Done():
+			case <-time.After(5 * time.Second):
+				t.Errorf("watcher %d: not closed", i)
+			}
+		}()
+	}
+	wg.Wait()
+	<-pool.done
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWatcherWith(WithPool(pool)); !errors.Is(err, ErrClosed) {
+		t.Errorf("wrong error\nhave: %v\nwant: %v", err, ErrClosed)
+	}
+}
+
+func TestInotifyMovePairing(t *testing.T) {
+	var w Watcher
+
+	// Interleaved renames are paired by cookie.
+	w.addMove(1, "/a/old1")
+	w.addMove(2, "/b/old2")
+	if have := w.takeMove(2); have != "/b/old2" {
+		t.Errorf("cookie 2: have %q", have)
+	}
+	if have := w.takeMove(1); have != "/a/old1" {
+		t.Errorf("cookie 1: have %q", have)
+	}
+	if have := w.takeMove(1); have != "" {
+		t.Errorf("used twice: have %q", have)
+	}
+
+	// An IN_MOVED_FROM without IN_MOVED_TO expires, and is removed once
+	// another rename is seen.
+	w.addMove(3, "/a/gone")
+	w.moved[3] = move{from: "/a/gone", at: time.Now().Add(-2 * moveTimeout)}
+	if have := w.takeMove(3); have != "" {
+		t.Errorf("expired: have %q", have)
+	}
+	w.addMove(4, "/a/gone")
+	w.moved[4] = move{from: "/a/gone", at: time.Now().Add(-2 * moveTimeout)}
+	w.addMove(5, "/a/old")
+	if _, ok := w.moved[4]; ok || len(w.moved) != 1 {
+		t.Errorf("not removed: %v", w.moved)
+	}
+}
+
+// Moves to and from unwatched directories are a plain Rename and Create, and
+// don't affect the pairing of later renames.
+func TestInotifyMoveUnwatched(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	for _, d := range []string{"dir1", "dir2", "unwatched"} {
+		mkdir(t, tmp, d)
+	}
+	touch(t, tmp, "dir1", "out")
+	touch(t, tmp, "unwatched", "in")
+	touch(t, tmp, "dir1", "file")
+
+	w := newCollector(t, join(tmp, "dir1"), join(tmp, "dir2"))
+	w.collect(t)
+	mv(t, join(tmp, "dir1", "out"), tmp, "unwatched", "out")
+	mv(t, join(tmp, "unwatched", "in"), tmp, "dir2", "in")
+	mv(t, join(tmp, "dir1", "file"), tmp, "dir2", "file")
+
+	var have []string
+	for _, e := range w.stop(t) {
+		have = append(have, fmt.Sprintf("%s %s %q", e.Op, filepath.Base(e.Name), e.RenamedFrom))
+	}
+	want := []string{
+		`RENAME out ""`,
+		`CREATE in ""`,
+		`RENAME file ""`,
+		fmt.Sprintf(`CREATE file %q`, join(tmp, "dir1", "file")),
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+}
+
+func TestInotifyXattr(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := join(tmp, "file")
+	touch(t, file)
+
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, DetectAttrChanges(), WithOps(Chmod)); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	err := unix.Setxattr(file, "user.fsnotify", []byte("value"), 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("user xattrs not supported on " + tmp)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := w.stop(t)
+	if len(events) != 1 || events[0].Attrs != AttrXattr {
+		t.Errorf("wrong events:\n%s", events)
+	}
+}
+
 func TestRemoveState(t *testing.T) {
 	var (
 		tmp  = t.TempDir()
@@ -134,3 +419,425 @@ func TestRemoveState(t *testing.T) {
 	}
 	check(0)
 }
+
+func BenchmarkInotifyName(b *testing.B) {
+	var (
+		watch = &watch{path: "/path/to/dir"}
+		names = [][]byte{
+			[]byte("file\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"),
+			[]byte("other-file\x00\x00\x00\x00\x00\x00"),
+		}
+	)
+
+	b.Run("same", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = watch.name(names[0])
+		}
+	})
+	b.Run("different", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = watch.name(names[i%2])
+		}
+	})
+}
+
+// AddFile must watch the directory that was opened, not the one that has its
+// name now.
+func TestInotifyAddFile(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dir := join(tmp, "dir")
+	mkdir(t, dir)
+	f, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	mv(t, dir, tmp, "moved")
+	mkdir(t, dir)
+
+	w := newCollector(t)
+	if err := w.w.AddFile(f); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	touch(t, dir, "not-watched")
+	touch(t, tmp, "moved", "file")
+
+	events := w.stop(t)
+	if len(events) == 0 {
+		t.Fatal("no events")
+	}
+	for _, e := range events {
+		if e.Name != join(dir, "file") {
+			t.Errorf("wrong event: %s", e)
+		}
+	}
+}
+
+func TestInotifyAddAt(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "sub")
+	dirfd, err := unix.Open(tmp, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(dirfd)
+
+	w := newCollector(t)
+	if err := w.w.AddAt(dirfd, "sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.AddAt(dirfd, "missing"); !errors.Is(err, unix.ENOENT) {
+		t.Errorf("wrong error for missing path: %v", err)
+	}
+	w.collect(t)
+
+	touch(t, tmp, "sub", "file")
+
+	events := w.stop(t)
+	if len(events) == 0 || events[0].Name != join(tmp, "sub", "file") {
+		t.Errorf("wrong events:\n%s", events)
+	}
+}
+
+// IN_MASK_CREATE also catches a different path to the same directory.
+func TestInotifyExclusiveSymlink(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	symlink(t, join(tmp, "dir"), tmp, "link")
+
+	w := newWatcher(t)
+	defer w.Close()
+	if err := w.AddWith(join(tmp, "dir"), WithExclusive()); err != nil {
+		t.Fatal(err)
+	}
+	err := w.AddWith(join(tmp, "link"), WithExclusive())
+	if errors.Is(err, unix.EINVAL) {
+		t.Skip("IN_MASK_CREATE not supported")
+	}
+	if !errors.Is(err, ErrAlreadyWatched) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+// The values in native.go must match the kernel's, and the result must match
+// what the backend sends.
+func TestInotifyNativeOps(t *testing.T) {
+	if inCreate != unix.IN_CREATE || inModify != unix.IN_MODIFY || inAttrib != unix.IN_ATTRIB ||
+		inCloseWrite != unix.IN_CLOSE_WRITE || inMovedFrom != unix.IN_MOVED_FROM ||
+		inMovedTo != unix.IN_MOVED_TO || inDelete != unix.IN_DELETE || inDeleteSelf != unix.IN_DELETE_SELF ||
+		inMoveSelf != unix.IN_MOVE_SELF || inUnmount != unix.IN_UNMOUNT {
+		t.Error("inotify flags don't match")
+	}
+
+	var w Watcher
+	for bit := uint32(1); bit != 0; bit <<= 1 {
+		if have, want := OpFromInotify(bit), w.newEvent("", bit, false).Op; have != want {
+			t.Errorf("0x%x: have %s; want %s", bit, have, want)
+		}
+	}
+}
+
+// The backend translates any mask in the same way as OpFromInotify, and
+// PreferCloseWrite only changes where Create and Write come from.
+func TestInotifyNewEventProperties(t *testing.T) {
+	var w Watcher
+	same := func(mask uint32) bool {
+		return w.newEvent("", mask, false).Op == OpFromInotify(mask)
+	}
+	closeWrite := func(mask uint32) bool {
+		var (
+			have = w.newEvent("", mask, true).Op
+			want = OpFromInotify(mask)
+		)
+		return have&^(Create|Write) == want&^(Create|Write) &&
+			have.Has(Create) == (mask&unix.IN_CREATE != 0) &&
+			have.Has(Write) == (mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) != 0)
+	}
+	if err := quick.Check(same, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+	if err := quick.Check(closeWrite, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+	if inotifyEventSize != unix.SizeofInotifyEvent {
+		t.Errorf("inotifyEventSize is %d; want %d", inotifyEventSize, unix.SizeofInotifyEvent)
+	}
+}
+
+func TestInotifyWatchBudget(t *testing.T) {
+	tmp := t.TempDir()
+	mkdir(t, tmp, "a")
+	mkdir(t, tmp, "b")
+
+	_, before, err := WatchBudget()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newWatcher(t, tmp, join(tmp, "a"), join(tmp, "b"))
+	defer w.Close()
+
+	limit, used, err := WatchBudget()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit == 0 || used < before+3 {
+		t.Errorf("limit=%d, used=%d; want used at least %d", limit, used, before+3)
+	}
+}
+
+// Names up to NAME_MAX are sent in full, and a name length that goes past the
+// end of what was read is an error rather than reading past it.
+func TestInotifyLongName(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t, tmp)
+	w.collect(t)
+
+	long := strings.Repeat("a", 255)
+	touch(t, tmp, long)
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /`+long+`
+	`))
+
+	w2 := newWatcher(t)
+	defer w2.Close()
+	buf := newInotifyBuffer()
+	raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+	raw.Wd, raw.Mask, raw.Len = -1, unix.IN_CREATE, 4096
+	n := unix.SizeofInotifyEvent + 16
+
+	go w2.handleEvents(buf, n, nil)
+	select {
+	case err := <-w2.Errors:
+		if !errors.Is(err, ErrInvalidEvent) || !isTemporary(err) {
+			t.Errorf("wrong error: %v", err)
+		}
+	case ev := <-w2.Events:
+		t.Errorf("unexpected event: %v", ev)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestInotifyFaults(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		fault   error
+		wantErr error
+	}{
+		{"read error", unix.EIO, unix.EIO},
+		{"short read", errShortRead, ErrInvalidEvent},
+	}
+	for _, tt := range tests {
+		for _, withPool := range []bool{false, true} {
+			tt, withPool := tt, withPool
+			t.Run(fmt.Sprintf("%s/pool=%t", tt.name, withPool), func(t *testing.T) {
+				t.Parallel()
+
+				f := new(faults)
+				f.add(faultRead, tt.fault)
+				opts := []addOpt{withFaults(f)}
+				if withPool {
+					pool, err := NewPool()
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer pool.Close()
+					opts = append(opts, WithPool(pool))
+				}
+				w, err := NewWatcherWith(opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer w.Close()
+
+				tmp := t.TempDir()
+				addWatch(t, w, tmp)
+				mkdir(t, tmp, "dir") // A single event.
+				select {
+				case err := <-w.Errors:
+					if !errors.Is(err, tt.wantErr) {
+						t.Fatalf("wrong error: %v", err)
+					}
+				case e := <-w.Events:
+					t.Fatalf("event instead of error: %s", e)
+				case <-time.After(5 * time.Second):
+					t.Fatal("timeout waiting for error")
+				}
+
+				// Events are read as normal after the error.
+				touch(t, tmp, "file")
+				select {
+				case err := <-w.Errors:
+					t.Fatalf("unexpected error: %v", err)
+				case e := <-w.Events:
+					if !e.Has(Create) || e.Name != join(tmp, "file") {
+						t.Errorf("wrong event: %s", e)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("timeout waiting for event")
+				}
+			})
+		}
+	}
+}
+
+func TestInotifyTopPaths(t *testing.T) {
+	t.Parallel()
+
+	var (
+		tmp   = t.TempDir()
+		quiet = join(tmp, "quiet")
+		noisy = join(tmp, "noisy")
+	)
+	mkdir(t, quiet)
+	mkdir(t, noisy)
+	w := newCollector(t, quiet)
+	// Counted even though the events are filtered.
+	if err := w.w.AddWith(noisy, WithoutDirectories()); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	touch(t, quiet, "file")
+	for i := 0; i < 10; i++ {
+		mkdir(t, noisy, "dir"+strconv.Itoa(i), noWait)
+	}
+	w.stop(t)
+
+	top := w.w.TopPaths(5)
+	if len(top) != 2 || top[0].Path != noisy || top[1].Path != quiet || top[0].Events < 10 {
+		t.Errorf("wrong top paths: %v", top)
+	}
+}
+
+func TestInotifyReroot(t *testing.T) {
+	t.Parallel()
+
+	var (
+		tmp     = t.TempDir()
+		dir     = join(tmp, "jail", "dir")
+		outside = join(tmp, "outside")
+	)
+	mkdir(t, join(tmp, "jail"))
+	mkdir(t, dir)
+	mkdir(t, outside)
+	w := newCollector(t, dir, outside)
+	if err := w.w.Reroot(join(tmp, "jail")); err != nil {
+		t.Fatal(err)
+	}
+	if l := w.w.WatchList(); len(l) != 1 || l[0] != "/dir" {
+		t.Errorf("wrong WatchList: %q", l)
+	}
+	w.collect(t)
+
+	// There is no chroot here, so the test can look at the real paths; only
+	// the names in the events are changed.
+	touch(t, dir, "file")
+	touch(t, outside, "file")
+	events := w.stop(t)
+	if len(events) != 1 || events[0].Name != "/dir/file" || !events[0].Has(Create) {
+		t.Errorf("wrong events:\n%s", events)
+	}
+
+	if err := w.w.Reroot("jail"); err == nil {
+		t.Error("no error for a relative path")
+	}
+	if err := w.w.Remove("/dir"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInotifyRerootChroot(t *testing.T) {
+	// The child process: add the watch, enter the chroot, and print the event.
+	if jail := os.Getenv("FSNOTIFY_TEST_CHROOT"); jail != "" {
+		w, err := NewWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		if err := w.Add(join(jail, "dir")); err != nil {
+			t.Fatal(err)
+		}
+		if err := unix.Chroot(jail); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Reroot(jail); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile("/dir/file", nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case e := <-w.Events:
+			os.Stdout.WriteString("CHILD " + e.Op.String() + " " + e.Name + "\n")
+		case err := <-w.Errors:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+		}
+		return
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("need root to chroot")
+	}
+	jail := t.TempDir()
+	mkdir(t, jail, "dir")
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInotifyRerootChroot$")
+	cmd.Env = append(os.Environ(), "FSNOTIFY_TEST_CHROOT="+jail)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "CHILD CREATE /dir/file\n") {
+		t.Errorf("child didn't see the event; output:\n%s", out)
+	}
+}
+
+func TestInotifyRestricted(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewWatcherWith(WithRestricted(), WithQuiescentWarning(time.Minute, true)); !errors.Is(err, ErrRestricted) {
+		t.Errorf("wrong error for WithQuiescentWarning: %v", err)
+	}
+
+	tmp := t.TempDir()
+	ww, err := NewWatcherWith(WithRestricted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &eventCollector{w: ww, done: make(chan struct{})}
+	for _, opt := range []addOpt{DetectAttrChanges(), DetectFileIDs(), DetectHardLinks(), WithSuppressDeleteChmod()} {
+		if err := w.w.AddWith(tmp, opt); !errors.Is(err, ErrRestricted) {
+			t.Errorf("wrong error: %v", err)
+		}
+	}
+	if err := w.w.SetLimit(tmp, DirLimit{Entries: 1}); !errors.Is(err, ErrRestricted) {
+		t.Errorf("wrong error for SetLimit: %v", err)
+	}
+	addWatch(t, w.w, tmp)
+	w.collect(t)
+
+	touch(t, tmp, "file")
+	rm(t, tmp, "file")
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /file
+		remove  /file
+	`))
+}
@@ -11,8 +11,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 
+	"github.com/camille-sound4/fsnotify/kqueue"
 	"golang.org/x/sys/unix"
 )
 
@@ -128,25 +130,52 @@ type Watcher struct {
 	//  - inotify:      There are too many queued events (fs.inotify.max_queued_events sysctl)
 	//  - windows:      The buffer size is too small; WithBufferSize() can be used to increase it.
 	//  - kqueue, fen:  Not used.
+	//
+	// All errors sent here have a Temporary() bool and Path() string method, so
+	// you can tell transient errors apart from permanent ones without
+	// inspecting the underlying error.
 	Errors chan error
 
 	done         chan struct{}
+	finished     chan struct{}               // Closed when the channels are closed; see Done.
 	kq           int                         // File descriptor (as returned by the kqueue() syscall).
 	closepipe    [2]int                      // Pipe used for closing.
 	mu           sync.Mutex                  // Protects access to watcher data
 	watches      map[string]int              // Watched file descriptors (key: path).
 	watchesByDir map[string]map[int]struct{} // Watched file descriptors indexed by the parent directory (key: dirname(path)).
-	userWatches  map[string]struct{}         // Watches added with Watcher.Add()
+	userWatches  map[string]withOpts         // Watches added with Watcher.Add(), and the options they were added with.
 	dirFlags     map[string]uint32           // Watched directories to fflags used in kqueue.
 	paths        map[int]pathInfo            // File descriptors to path names for processing kqueue events.
 	fileExists   map[string]struct{}         // Keep track of if we know this file exists (to stop duplicate create events).
+	unopened     map[string]struct{}         // Files in watched directories that aren't opened (special files, or over WithMaxWatches); these are in fileExists.
+	denied       map[string]struct{}         // Watched directories that can't be read; see AccessLost.
 	isClosed     bool                        // Set to true when Close() is first called
-	withoutdir   bool                        // do not send events for directory
+
+	defaults []addOpt    // Options from NewWatcherWith.
+	queue    queueStats  // Stats for the Events channel.
+	dispatch func(Event) // WithDirectDispatch handler.
+	dedup    dedup       // Drop duplicate events; see WithDedup.
+	replays  replays     // Running Replay calls.
+	maxWatch int         // WithMaxWatches; 0 means no limit.
+	faults   *faults     // Errors to inject; only set in tests.
+	hot      hotPaths    // Events by watch; see TopPaths.
+	coalesce coalescer   // See WithCoalesceHot.
+	summary  summarizer  // See WithSummaries.
+	routes   routes      // See Route.
+	locks    lockfiles   // See WithLockfileConvention.
+	filter   filter      // See WithFilterPresets.
+	bursts   bursts      // See WithBurstMarks.
+	limits   limits      // See SetLimit.
+	listings listings    // See ListConsistent.
+	pipeline pipeline    // See Use.
+	attrs    attrCache   // File attributes; see DetectAttrChanges.
+	fileIDs  idCache     // Inode numbers; see DetectFileIDs.
 }
 
 type pathInfo struct {
 	name  string
 	isDir bool
+	dev   uint64 // Device; see Event.Device.
 }
 
 // NewWatcher creates a new Watcher.
@@ -163,6 +192,42 @@ func NewWatcher() (*Watcher, error) {
 // cases, and whenever possible you will be better off increasing the kernel
 // buffers instead of adding a large userspace buffer.
 func NewBufferedWatcher(sz uint) (*Watcher, error) {
+	return newBufferedWatcher(sz, nil)
+}
+
+// NewWatcherWith creates a new Watcher with options.
+//
+// Options that apply to a watch (such as [WithOps]) are used as the defaults
+// for [Watcher.Add] and [Watcher.AddWith]. Options that apply to the entire
+// watcher are:
+//
+//   - [WithSlowConsumer] sends a warning on Watcher.Errors if events aren't
+//     read fast enough.
+//   - [WithDirectDispatch] calls a function for every event, instead of
+//     sending them on Watcher.Events.
+//   - [WithPool] reads events on a goroutine shared with other watchers;
+//     only supported on Linux.
+//   - [WithEventQueue] sets the size of the queue between reading events and
+//     sending them on Watcher.Events; only supported on Windows.
+//   - [DrainOnClose] keeps sending events that were already read after
+//     [Watcher.Close] is called.
+//   - [WithDedup] drops events that are identical to the previous event for
+//     the same path.
+//   - [WithMergeOverlapping] sends events only once if a path is covered by
+//     more than one watch.
+//   - [WithMaxWatches] limits the number of kernel watches.
+//   - [WithCompletionPort] uses an I/O completion port from the application;
+//     only supported on Windows.
+//   - [WithEventLog] writes lifecycle and error events to the Windows Event
+//     Log; only supported on Windows.
+func NewWatcherWith(opts ...addOpt) (*Watcher, error) {
+	if getOptions(opts...).restricted {
+		return nil, fmt.Errorf("%w: only supported on Linux", ErrRestricted)
+	}
+	return newBufferedWatcher(0, opts)
+}
+
+func newBufferedWatcher(sz uint, opts []addOpt) (*Watcher, error) {
 	kq, closepipe, err := newKqueue()
 	if err != nil {
 		return nil, err
@@ -176,12 +241,18 @@ func NewBufferedWatcher(sz uint) (*Watcher, error) {
 		dirFlags:     make(map[string]uint32),
 		paths:        make(map[int]pathInfo),
 		fileExists:   make(map[string]struct{}),
-		userWatches:  make(map[string]struct{}),
+		unopened:     make(map[string]struct{}),
+		denied:       make(map[string]struct{}),
+		userWatches:  make(map[string]withOpts),
 		Events:       make(chan Event, sz),
 		Errors:       make(chan error),
 		done:         make(chan struct{}),
+		finished:     make(chan struct{}),
 	}
 
+	w.setOptions(opts)
+	w.startOptions()
+
 	go w.readEvents()
 	return w, nil
 }
@@ -223,23 +294,52 @@ func newKqueue() (kq int, closepipe [2]int, err error) {
 
 // Returns true if the event was sent, or false if watcher is closed.
 func (w *Watcher) sendEvent(e Event) bool {
-	if w.withoutdir {
-		if fi, err := os.Stat(e.Name); err == nil && fi.IsDir() {
-			return true
-		}
+	e.Seq = w.listings.count(e)
+	if w.filter.drop(e) || w.dedup.drop(e) {
+		return true
+	}
+	held, released := w.locks.hold(e)
+	if held {
+		return true
+	}
+	if released != nil && !w.sendEvent(*released) {
+		return false
+	}
+	w.bursts.count(e)
+	if t, ok := w.limits.count(e); ok {
+		w.sendLater(t)
+	}
+	if w.summary.absorb(e) || w.coalesce.absorb(e) {
+		return true
 	}
+	e, ok := w.pipeline.apply(e)
+	if !ok {
+		return true
+	}
+	if w.routes.route(e) {
+		return true
+	}
+	if w.dispatch != nil {
+		w.dispatch(e)
+		return true
+	}
+
+	start := w.queue.queued(len(w.Events))
 	select {
 	case w.Events <- e:
-		return true
 	case <-w.done:
-		return false
+		return w.queue.closed(w.Events, e)
 	}
+	if err := w.queue.sent(start, len(w.Events)); err != nil {
+		return w.sendError(err)
+	}
+	return true
 }
 
 // Returns true if the error was sent, or false if watcher is closed.
 func (w *Watcher) sendError(err error) bool {
 	select {
-	case w.Errors <- err:
+	case w.Errors <- newError(err, ""):
 		return true
 	case <-w.done:
 		return false
@@ -247,7 +347,30 @@ func (w *Watcher) sendError(err error) bool {
 }
 
 // Close removes all watches and closes the Events channel.
+//
+// No events are sent after Close returns. Events that were already read from
+// the kernel but not yet sent are dropped and counted in [Stats], unless
+// [DrainOnClose] is used.
+//
+// This is the same as [Watcher.Stop] followed by [Watcher.Wait]. Calling it
+// again returns nil.
 func (w *Watcher) Close() error {
+	if err := w.Stop(); err != nil {
+		return err
+	}
+	w.Wait()
+	return nil
+}
+
+// Stop removes all watches and releases the kernel resources, without waiting
+// for the events that were already read to be sent.
+//
+// No new events are read after Stop returns. The events that were already read
+// are dropped (or sent, with [DrainOnClose]) and the Events and Errors channels
+// are closed in the background; use [Watcher.Wait] or [Watcher.Done] to wait
+// for that. This allows applications to drain their own queues in between.
+// Calling it again returns nil.
+func (w *Watcher) Stop() error {
 	w.mu.Lock()
 	if w.isClosed {
 		w.mu.Unlock()
@@ -272,6 +395,27 @@ func (w *Watcher) Close() error {
 	return nil
 }
 
+// Done returns a channel that's closed once the watcher is fully shut down
+// after [Watcher.Stop] or [Watcher.Close]: all events are sent or dropped, and
+// the Events and Errors channels are closed.
+func (w *Watcher) Done() <-chan struct{} { return w.finished }
+
+// Wait blocks until the watcher is fully shut down; see [Watcher.Done].
+func (w *Watcher) Wait() { <-w.finished }
+
+// IsClosed reports if [Watcher.Close] or [Watcher.Stop] was called. The
+// watcher may still be sending events that were already read; use
+// [Watcher.Done] to wait for it to be fully shut down.
+//
+// After Close, methods that add paths (Add, AddWith, AddEx, Replay, and so on)
+// return [ErrClosed], while Close, Stop, and Remove return nil and WatchList
+// returns nil, so that cleanup code doesn't need to check.
+func (w *Watcher) IsClosed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.isClosed
+}
+
 // Add starts monitoring the path for changes.
 //
 // A path can only be watched once; watching it more than once is a no-op and will
@@ -308,6 +452,30 @@ func (w *Watcher) Close() error {
 //
 // Watch the parent directory and use Event.Name to filter out files you're not
 // interested in. There is an example of this in cmd/fsnotify/file.go.
+//
+// # Special files
+//
+// Named pipes (FIFOs), sockets, and device nodes can be watched directly on
+// Linux; note that writing to a named pipe sends a Chmod rather than a Write, as
+// the kernel only updates the timestamps. Other backends return
+// [ErrUnsupportedPath], as opening them may block or have side effects. Special
+// files in a watched directory are reported with Create and Remove (and Rename
+// where supported) on all backends.
+//
+// # Symlinks
+//
+// Symlinks passed to Add are followed: a symlink to a directory watches the
+// files in the directory it points to, and a symlink to a file watches that
+// file. Event names use the path that was passed to Add, not the path the link
+// points to, and adding a symlink that can't be resolved returns an error;
+// except on kqueue, which uses the path the link points to and ignores
+// unresolvable symlinks. Use [FollowSymlinks] to get the same behaviour on all
+// backends, or to watch the link itself. Use [WithNoFollow] to refuse symlinks
+// instead.
+//
+// Symlinks in a watched directory are reported as any other file: a Create or
+// Remove is sent for the link itself. Changes to the file a link points to are
+// not reported, except on kqueue, which also opens the target.
 func (w *Watcher) Add(name string) error { return w.AddWith(name) }
 
 // AddWith is like [Watcher.Add], but allows adding options. When using Add()
@@ -317,15 +485,98 @@ func (w *Watcher) Add(name string) error { return w.AddWith(name) }
 //
 //   - [WithBufferSize] sets the buffer size for the Windows backend; no-op on
 //     other platforms. The default is 64K (65536 bytes).
+//   - [WithOps] sets which operations to listen for. The default is all of
+//     them.
+//   - [WithoutDirectories] filters out events for directories.
+//   - [PreferCloseWrite] sends Write when a file is closed after writing,
+//     rather than on every write; only supported on inotify (Linux).
+//   - [WithRetry] retries re-arming a watch after a transient error, rather
+//     than removing it.
+//   - [ResolveShortNames] resolves 8.3 short names in events to long names;
+//     only supported on Windows.
+//   - [WithNormalizer] sets a function to normalize event names with; only
+//     supported on kqueue (macOS, BSD).
+//   - [DetectHardLinks] sets Event.HardLink on a Create for a new hard link;
+//     only supported on Linux and kqueue (macOS, BSD).
+//   - [DetectAttrChanges] sets Event.Attrs on a Chmod to the attributes that
+//     changed; only supported on Linux and kqueue (macOS, BSD).
+//   - [DetectFileIDs] sets Event.FileID to the inode number; only supported
+//     on Linux and kqueue (macOS, BSD).
+//   - [WithSuppressDeleteChmod] doesn't send the Chmod when a file is
+//     removed; only supported on Linux.
+//   - [WithAbsolutePaths] makes the path absolute, so that Event.Name is
+//     always absolute.
+//   - [WithNoFollow] and [WithResolveBeneath] refuse to watch paths with
+//     symlinks, or outside a root directory.
+//   - [FollowSymlinks] sets if a symlink passed to Add is followed, or if the
+//     link itself is watched; watching the link itself is only supported on
+//     Linux, macOS, and illumos.
+//   - [WithExclusive] returns an error if the path is already watched.
+//   - [AllowHydration] allows downloading cloud placeholder files; only
+//     supported on Windows.
+//   - [DetectPlaceholders] sets Event.Placeholder for writes to cloud
+//     placeholder files; only supported on Windows.
+//   - [WithPriority] sends the events before events for other paths if the
+//     application can't keep up; only supported on Windows.
+//   - [WithCopyCompleteDetection] sends CloseWrite once a written file is no
+//     longer open; only supported on Windows.
+//   - [WithShareMode] sets the share mode of the directory handle, for example
+//     to prevent deleting the directory while it's watched; only supported on
+//     Windows.
 func (w *Watcher) AddWith(name string, opts ...addOpt) error {
-	with := getOptions(opts...)
-	w.withoutdir = with.withoutdir
+	_, err := w.addWith(name, opts...)
+	return err
+}
+
+// addWith is AddWith, but also returns the number of watches that were created.
+func (w *Watcher) addWith(name string, opts ...addOpt) (int, error) {
+	if w.IsClosed() {
+		return 0, ErrClosed
+	}
+	with := getOptions(append(w.defaults, opts...)...)
+	name, err := with.watchPath(filepath.Clean(name))
+	if err != nil {
+		return 0, err
+	}
+	if err := with.checkPath(name); err != nil {
+		return 0, err
+	}
+
+	// Opening a FIFO may block until there's a writer, and opening a device
+	// may have side effects.
+	if fi, err := os.Stat(name); err == nil && isSpecial(fi) {
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedPath, name)
+	}
 
 	w.mu.Lock()
-	w.userWatches[name] = struct{}{}
+	existing, existed := w.userWatches[name]
+	if existed && with.exclusive {
+		w.mu.Unlock()
+		return 0, fmt.Errorf("%w: %s", ErrAlreadyWatched, name)
+	}
+	if existed {
+		with.op |= existing.op
+	}
+	w.userWatches[name] = with
 	w.mu.Unlock()
-	_, err := w.addWatch(name, noteAllEvents)
-	return err
+	_, n, err := w.addWatch(name, noteAllEvents)
+	if err != nil && !existed {
+		w.mu.Lock()
+		if _, ok := w.watches[name]; !ok {
+			delete(w.userWatches, name)
+		}
+		w.mu.Unlock()
+	}
+	if err == nil && with.attrs {
+		w.attrs.addAll(name)
+	}
+	if err == nil && with.fileIDs {
+		w.fileIDs.addAll(name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
 }
 
 // Remove stops monitoring the path for changes.
@@ -337,6 +588,9 @@ func (w *Watcher) AddWith(name string, opts ...addOpt) error {
 //
 // Returns nil if [Watcher.Close] was called.
 func (w *Watcher) Remove(name string) error {
+	w.attrs.remove(filepath.Clean(name))
+	w.fileIDs.remove(filepath.Clean(name))
+	w.locks.remove(filepath.Clean(name))
 	return w.remove(name, true)
 }
 
@@ -375,6 +629,15 @@ func (w *Watcher) remove(name string, unwatchFiles bool) error {
 	delete(w.paths, watchfd)
 	delete(w.dirFlags, name)
 	delete(w.fileExists, name)
+	delete(w.denied, name)
+	if isDir {
+		for s := range w.unopened {
+			if filepath.Dir(s) == name {
+				delete(w.unopened, s)
+				delete(w.fileExists, s)
+			}
+		}
+	}
 	w.mu.Unlock()
 
 	// Find all watched paths that are in this directory that are not external.
@@ -417,21 +680,48 @@ func (w *Watcher) WatchList() []string {
 	return entries
 }
 
+// watchCount returns the number of open file descriptors.
+func (w *Watcher) watchCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.paths)
+}
+
+func (w *Watcher) exportWatches() map[string]withOpts {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.isClosed {
+		return nil
+	}
+
+	watches := make(map[string]withOpts, len(w.userWatches))
+	for pathname, with := range w.userWatches {
+		watches[pathname] = with
+	}
+	return watches
+}
+
 // Watch all events (except NOTE_EXTEND, NOTE_LINK, NOTE_REVOKE)
-const noteAllEvents = unix.NOTE_DELETE | unix.NOTE_WRITE | unix.NOTE_ATTRIB | unix.NOTE_RENAME
+const noteAllEvents = unix.NOTE_DELETE | unix.NOTE_WRITE | unix.NOTE_ATTRIB | unix.NOTE_RENAME | kqueue.NoteTruncate
 
 // addWatch adds name to the watched file set; the flags are interpreted as
 // described in kevent(2).
 //
-// Returns the real path to the file which was added, with symlinks resolved.
-func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
-	var isDir bool
+// Returns the real path to the file which was added, with symlinks resolved
+// unless the path was added with FollowSymlinks, and the number of files that
+// were opened; for a directory this includes the files in it.
+func (w *Watcher) addWatch(name string, flags uint32) (string, int, error) {
+	var (
+		isDir bool
+		dev   uint64
+		n     int
+	)
 	name = filepath.Clean(name)
 
 	w.mu.Lock()
 	if w.isClosed {
 		w.mu.Unlock()
-		return "", ErrClosed
+		return "", 0, ErrClosed
 	}
 	watchfd, alreadyWatching := w.watches[name]
 	// We already have a watch, but we can still override flags.
@@ -443,23 +733,36 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 	if !alreadyWatching {
 		fi, err := os.Lstat(name)
 		if err != nil {
-			return "", err
+			return "", 0, err
 		}
 
-		// Don't watch sockets or named pipes
-		if (fi.Mode()&os.ModeSocket == os.ModeSocket) || (fi.Mode()&os.ModeNamedPipe == os.ModeNamedPipe) {
-			return "", nil
-		}
+		w.mu.Lock()
+		links := w.userWatches[name].symlinks
+		w.mu.Unlock()
 
-		// Follow Symlinks.
-		if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		// Follow symlinks. With FollowSymlinks(true) the path is watched with
+		// the name it was added with, like on the other backends: events for
+		// the files in a symlink to a directory are for link/file, not
+		// target/file. With FollowSymlinks(false) the link itself is opened.
+		openMode := kqueue.OpenMode
+		if fi.Mode()&os.ModeSymlink == os.ModeSymlink && links == linkNoFollow {
+			if kqueue.NoFollowMode == 0 {
+				return "", 0, fmt.Errorf("%w: %s: watching a symlink itself is not supported", ErrUnsupportedPath, name)
+			}
+			openMode = kqueue.NoFollowMode
+		} else if fi.Mode()&os.ModeSymlink == os.ModeSymlink && links == linkFollow {
+			fi, err = os.Stat(name)
+			if err != nil {
+				return "", 0, err
+			}
+		} else if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
 			link, err := os.Readlink(name)
 			if err != nil {
 				// Return nil because Linux can add unresolvable symlinks to the
 				// watch list without problems, so maintain consistency with
 				// that. There will be no file events for broken symlinks.
 				// TODO: more specific check; returns os.PathError; ENOENT?
-				return "", nil
+				return "", 0, nil
 			}
 
 			w.mu.Lock()
@@ -471,16 +774,32 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 				// on when we diff the directories.
 				w.watches[name] = 0
 				w.fileExists[name] = struct{}{}
-				return link, nil
+				return link, 0, nil
 			}
 
 			name = link
 			fi, err = os.Lstat(name)
 			if err != nil {
-				return "", nil
+				return "", 0, nil
 			}
 		}
 
+		// Don't open sockets, named pipes, or devices in watched directories;
+		// sendDirectoryChangeEvents takes care of Create and Remove for them.
+		if isSpecial(fi) {
+			w.mu.Lock()
+			w.unopened[name] = struct{}{}
+			w.mu.Unlock()
+			return name, 0, nil
+		}
+
+		w.mu.Lock()
+		full := w.maxWatch > 0 && len(w.paths) >= w.maxWatch
+		w.mu.Unlock()
+		if full {
+			return "", 0, &WatchLimitError{Limit: w.maxWatch, Skipped: []string{name}}
+		}
+
 		// Retry on EINTR; open() can return EINTR in practice on macOS.
 		// See #354, and Go issues 11180 and 39237.
 		for {
@@ -492,16 +811,16 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 				continue
 			}
 
-			return "", err
+			return "", 0, err
 		}
 
-		isDir = fi.IsDir()
+		isDir, dev = fi.IsDir(), deviceID(fi)
 	}
 
 	err := w.register([]int{watchfd}, unix.EV_ADD|unix.EV_CLEAR|unix.EV_ENABLE, flags)
 	if err != nil {
 		unix.Close(watchfd)
-		return "", err
+		return "", 0, err
 	}
 
 	if !alreadyWatching {
@@ -515,8 +834,9 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 			w.watchesByDir[parentName] = watchesByDir
 		}
 		watchesByDir[watchfd] = struct{}{}
-		w.paths[watchfd] = pathInfo{name: name, isDir: isDir}
+		w.paths[watchfd] = pathInfo{name: name, isDir: isDir, dev: dev}
 		w.mu.Unlock()
+		n = 1
 	}
 
 	if isDir {
@@ -531,27 +851,32 @@ func (w *Watcher) addWatch(name string, flags uint32) (string, error) {
 		w.mu.Unlock()
 
 		if watchDir {
-			if err := w.watchDirectoryFiles(name); err != nil {
-				return "", err
+			m, err := w.watchDirectoryFiles(name)
+			if err != nil {
+				return "", 0, err
 			}
+			n += m
 		}
 	}
-	return name, nil
+	return name, n, nil
 }
 
 // readEvents reads from kqueue and converts the received kevents into
 // Event values that it sends down the Events channel.
 func (w *Watcher) readEvents() {
 	defer func() {
+		w.replays.close()
 		close(w.Events)
 		close(w.Errors)
 		_ = unix.Close(w.kq)
 		unix.Close(w.closepipe[0])
+		close(w.finished)
 	}()
 
 	eventBuffer := make([]unix.Kevent_t, 10)
 	for closed := false; !closed; {
 		kevents, err := w.read(eventBuffer)
+		w.queue.read()
 		// EINTR is okay, the syscall was interrupted before timeout expired.
 		if err != nil && err != unix.EINTR {
 			if !w.sendError(fmt.Errorf("fsnotify.readEvents: %w", err)) {
@@ -576,9 +901,31 @@ func (w *Watcher) readEvents() {
 
 			w.mu.Lock()
 			path := w.paths[watchfd]
+			_, isRoot := w.userWatches[path.name]
 			w.mu.Unlock()
 
+			// Get the options before the watch is removed below.
+			with := w.watchOpts(path.name)
 			event := w.newEvent(path.name, mask)
+			event.Op &= with.op
+			event.Device = path.dev
+			if with.attrs {
+				switch {
+				case event.Has(Remove) || event.Has(Rename):
+					w.attrs.remove(event.Name)
+				case event.Has(Chmod):
+					event.Attrs, event.Owner = w.attrs.changed(event.Name)
+				case event.Has(Write):
+					w.attrs.changed(event.Name) // Writes update the modification time.
+				}
+			}
+			if with.fileIDs {
+				if event.Has(Remove) || event.Has(Rename) {
+					event.FileID = w.fileIDs.remove(event.Name)
+				} else {
+					event.FileID = w.fileIDs.get(event.Name)
+				}
+			}
 
 			if event.Has(Rename) || event.Has(Remove) {
 				w.remove(event.Name, false)
@@ -587,10 +934,19 @@ func (w *Watcher) readEvents() {
 				w.mu.Unlock()
 			}
 
+			// Read the directory when its permissions change, to find out if
+			// we lost or regained access to it; see AccessLost.
+			if path.isDir && mask&unix.NOTE_ATTRIB != 0 && mask&unix.NOTE_WRITE == 0 && !event.Has(Remove) {
+				w.sendDirectoryChangeEvents(path.name)
+			}
+
 			if path.isDir && event.Has(Write) && !event.Has(Remove) {
 				w.sendDirectoryChangeEvents(event.Name)
-			} else {
-				if !w.sendEvent(event) {
+			} else if event.Op != 0 && (!path.isDir || !with.withoutdir || (isRoot && event.Has(Remove))) {
+				// The Remove for the watched path itself is always sent.
+				e := event
+				e.Name = with.eventName(e.Name)
+				if !w.sendEvent(e) {
 					closed = true
 					continue
 				}
@@ -607,7 +963,7 @@ func (w *Watcher) readEvents() {
 					if found {
 						err := w.sendDirectoryChangeEvents(fileDir)
 						if err != nil {
-							if !w.sendError(err) {
+							if !w.sendError(newError(err, fileDir)) {
 								closed = true
 							}
 						}
@@ -617,7 +973,7 @@ func (w *Watcher) readEvents() {
 					if fi, err := os.Lstat(filePath); err == nil {
 						err := w.sendFileCreatedEventIfNew(filePath, fi)
 						if err != nil {
-							if !w.sendError(err) {
+							if !w.sendError(newError(err, filePath)) {
 								closed = true
 							}
 						}
@@ -628,6 +984,20 @@ func (w *Watcher) readEvents() {
 	}
 }
 
+// watchOpts gets the options for the path, from the user watch on either the
+// path itself or the directory it's in.
+func (w *Watcher) watchOpts(name string) withOpts {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if with, ok := w.userWatches[name]; ok {
+		return with
+	}
+	if with, ok := w.userWatches[filepath.Dir(name)]; ok {
+		return with
+	}
+	return defaultOpts
+}
+
 // newEvent returns an platform-independent Event based on kqueue Fflags.
 func (w *Watcher) newEvent(name string, mask uint32) Event {
 	e := Event{Name: name}
@@ -643,6 +1013,9 @@ func (w *Watcher) newEvent(name string, mask uint32) Event {
 	if mask&unix.NOTE_ATTRIB == unix.NOTE_ATTRIB {
 		e.Op |= Chmod
 	}
+	if mask&kqueue.NoteTruncate != 0 {
+		e.Op |= Truncate
+	}
 	// No point sending a write and delete event at the same time: if it's gone,
 	// then it's gone.
 	if e.Op.Has(Write) && e.Op.Has(Remove) {
@@ -652,22 +1025,28 @@ func (w *Watcher) newEvent(name string, mask uint32) Event {
 }
 
 // watchDirectoryFiles to mimic inotify when adding a watch on a directory
-func (w *Watcher) watchDirectoryFiles(dirPath string) error {
+//
+// Returns the number of files that were opened.
+func (w *Watcher) watchDirectoryFiles(dirPath string) (int, error) {
 	// Get all files
 	files, err := os.ReadDir(dirPath)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	var (
+		skipped []string
+		n       int
+	)
 	for _, f := range files {
 		path := filepath.Join(dirPath, f.Name())
 
 		fi, err := f.Info()
 		if err != nil {
-			return fmt.Errorf("%q: %w", path, err)
+			return 0, fmt.Errorf("%q: %w", path, err)
 		}
 
-		cleanPath, err := w.internalWatch(path, fi)
+		cleanPath, m, err := w.internalWatch(path, fi)
 		if err != nil {
 			// No permission to read the file; that's not a problem: just skip.
 			// But do add it to w.fileExists to prevent it from being picked up
@@ -676,17 +1055,27 @@ func (w *Watcher) watchDirectoryFiles(dirPath string) error {
 			switch {
 			case errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM):
 				cleanPath = filepath.Clean(path)
+			case errors.Is(err, ErrWatchLimit):
+				cleanPath = filepath.Clean(path)
+				skipped = append(skipped, cleanPath)
+				w.mu.Lock()
+				w.unopened[cleanPath] = struct{}{}
+				w.mu.Unlock()
 			default:
-				return fmt.Errorf("%q: %w", path, err)
+				return 0, fmt.Errorf("%q: %w", path, err)
 			}
 		}
+		n += m
 
 		w.mu.Lock()
 		w.fileExists[cleanPath] = struct{}{}
 		w.mu.Unlock()
 	}
 
-	return nil
+	if len(skipped) > 0 {
+		return 0, &WatchLimitError{Limit: w.maxWatch, Skipped: skipped}
+	}
+	return n, nil
 }
 
 // Search the directory for new files and send an event for them.
@@ -701,16 +1090,38 @@ func (w *Watcher) sendDirectoryChangeEvents(dir string) error {
 		if errors.Is(err, os.ErrNotExist) {
 			return nil
 		}
+		// Keep the watch, and read the directory again once the permissions
+		// change; see readEvents.
+		if errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) {
+			w.mu.Lock()
+			_, denied := w.denied[dir]
+			w.denied[dir] = struct{}{}
+			w.mu.Unlock()
+			if !denied {
+				w.sendError(&AccessLost{Dir: dir, Err: err})
+			}
+			return nil
+		}
 		return fmt.Errorf("fsnotify.sendDirectoryChangeEvents: %w", err)
 	}
+	w.mu.Lock()
+	_, denied := w.denied[dir]
+	delete(w.denied, dir)
+	w.mu.Unlock()
+	if denied {
+		w.sendError(&AccessRestored{Dir: dir})
+	}
 
+	seen := make(map[string]struct{}, len(files))
 	for _, f := range files {
 		fi, err := f.Info()
 		if err != nil {
 			return fmt.Errorf("fsnotify.sendDirectoryChangeEvents: %w", err)
 		}
 
-		err = w.sendFileCreatedEventIfNew(filepath.Join(dir, fi.Name()), fi)
+		path := filepath.Join(dir, fi.Name())
+		seen[path] = struct{}{}
+		err = w.sendFileCreatedEventIfNew(path, fi)
 		if err != nil {
 			// Don't need to send an error if this file isn't readable.
 			if errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) {
@@ -719,6 +1130,33 @@ func (w *Watcher) sendDirectoryChangeEvents(dir string) error {
 			return fmt.Errorf("fsnotify.sendDirectoryChangeEvents: %w", err)
 		}
 	}
+
+	// Special files and files over the WithMaxWatches limit aren't opened, so
+	// there's no NOTE_DELETE for them; look for the ones that are gone from
+	// the directory instead.
+	var gone []string
+	w.mu.Lock()
+	for s := range w.unopened {
+		if _, ok := seen[s]; !ok && filepath.Dir(s) == dir {
+			gone = append(gone, s)
+			delete(w.unopened, s)
+			delete(w.fileExists, s)
+		}
+	}
+	w.mu.Unlock()
+	sort.Strings(gone)
+	for _, s := range gone {
+		with := w.watchOpts(s)
+		e := Event{Name: with.eventName(s), Op: Remove}
+		if with.fileIDs {
+			e.FileID = w.fileIDs.remove(s)
+		}
+		if with.op.Has(Remove) {
+			if !w.sendEvent(e) {
+				return nil
+			}
+		}
+	}
 	return nil
 }
 
@@ -727,17 +1165,35 @@ func (w *Watcher) sendFileCreatedEventIfNew(filePath string, fi os.FileInfo) (er
 	w.mu.Lock()
 	_, doesExist := w.fileExists[filePath]
 	w.mu.Unlock()
-	if !doesExist {
-		if !w.sendEvent(Event{Name: filePath, Op: Create}) {
+	with := w.watchOpts(filePath)
+	if !doesExist && with.op.Has(Create) && (!fi.IsDir() || !with.withoutdir) {
+		e := Event{Name: with.eventName(filePath), Op: Create, Device: deviceID(fi)}
+		e.HardLink = with.hardlinks && isHardLink(fi)
+		if with.attrs {
+			w.attrs.set(filePath, fi)
+		}
+		if with.fileIDs {
+			e.FileID = w.fileIDs.set(filePath, fi)
+		}
+		if !w.sendEvent(e) {
 			return
 		}
 	}
 
 	// like watchDirectoryFiles (but without doing another ReadDir)
-	filePath, err = w.internalWatch(filePath, fi)
+	watchPath, _, err := w.internalWatch(filePath, fi)
+	if errors.Is(err, ErrWatchLimit) {
+		w.mu.Lock()
+		w.unopened[filePath] = struct{}{}
+		w.fileExists[filePath] = struct{}{}
+		w.mu.Unlock()
+		w.sendError(newError(err, filePath))
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	filePath = watchPath
 
 	w.mu.Lock()
 	w.fileExists[filePath] = struct{}{}
@@ -746,7 +1202,7 @@ func (w *Watcher) sendFileCreatedEventIfNew(filePath string, fi os.FileInfo) (er
 	return nil
 }
 
-func (w *Watcher) internalWatch(name string, fi os.FileInfo) (string, error) {
+func (w *Watcher) internalWatch(name string, fi os.FileInfo) (string, int, error) {
 	if fi.IsDir() {
 		// mimic Linux providing delete events for subdirectories, but preserve
 		// the flags used if currently watching subdirectory
@@ -781,6 +1237,9 @@ func (w *Watcher) register(fds []int, flags int, fflags uint32) error {
 
 // read retrieves pending events, or waits until an event occurs.
 func (w *Watcher) read(events []unix.Kevent_t) ([]unix.Kevent_t, error) {
+	if err := w.faults.next(faultRead); err != nil {
+		return nil, err
+	}
 	n, err := unix.Kevent(w.kq, nil, events, nil)
 	if err != nil {
 		return nil, err
@@ -4,9 +4,13 @@
 package fsnotify
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestRemoveState(t *testing.T) {
@@ -94,3 +98,110 @@ func TestRemoveState(t *testing.T) {
 		}
 	}
 }
+
+func TestWithNormalizer(t *testing.T) {
+	var (
+		tmp = t.TempDir()
+		nfd = "cafe\u0301" // Decomposed: "e" followed by a combining accent.
+		nfc = "caf\u00e9"  // Composed.
+	)
+
+	w := newCollector(t)
+	err := w.w.AddWith(tmp, WithNormalizer(func(name string) string {
+		return strings.ReplaceAll(name, nfd, nfc)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	touch(t, tmp, nfd)
+	rm(t, tmp, nfd)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /`+nfc+`
+		remove  /`+nfc+`
+	`))
+}
+
+func TestKqueueSpecialFiles(t *testing.T) {
+	tmp := t.TempDir()
+	fifo := join(tmp, "fifo")
+	w := newCollector(t, tmp)
+	w.collect(t)
+
+	// Opening the FIFO would block until there's a writer.
+	if err := unix.Mkfifo(fifo, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvents()
+	if err := w.w.Add(fifo); !errors.Is(err, ErrUnsupportedPath) {
+		t.Errorf("wrong error from Add(fifo): %v", err)
+	}
+	touch(t, tmp, "file")
+	rm(t, fifo)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /fifo
+		create  /file
+		remove  /fifo
+	`))
+}
+
+func TestKqueueNativeOps(t *testing.T) {
+	if noteDelete != unix.NOTE_DELETE || noteWrite != unix.NOTE_WRITE ||
+		noteAttrib != unix.NOTE_ATTRIB || noteRename != unix.NOTE_RENAME {
+		t.Error("kqueue flags don't match")
+	}
+
+	var w Watcher
+	for fflags := uint32(0); fflags < 0x40; fflags++ {
+		if have, want := OpFromKqueue(fflags), w.newEvent("", fflags).Op; have != want {
+			t.Errorf("0x%x: have %s; want %s", fflags, have, want)
+		}
+	}
+}
+
+func TestKqueueFaults(t *testing.T) {
+	// kevent() is retried on EINTR, and other errors are sent on Errors
+	// without stopping the watcher.
+	f := new(faults)
+	eintr := make([]error, 1000)
+	for i := range eintr {
+		eintr[i] = unix.EINTR
+	}
+	f.add(faultRead, eintr...)
+	f.add(faultRead, unix.EIO)
+
+	w, err := NewWatcherWith(withFaults(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	select {
+	case err := <-w.Errors:
+		if !errors.Is(err, unix.EIO) {
+			t.Fatalf("wrong error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for error")
+	}
+	if n := f.pending(faultRead); n != 0 {
+		t.Fatalf("%d faults not injected", n)
+	}
+
+	tmp := t.TempDir()
+	addWatch(t, w, tmp)
+	touch(t, tmp, "file")
+	select {
+	case err := <-w.Errors:
+		t.Fatalf("unexpected error: %v", err)
+	case e := <-w.Events:
+		if !e.Has(Create) || e.Name != join(tmp, "file") {
+			t.Errorf("wrong event: %s", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+}
@@ -120,7 +120,29 @@ type Watcher struct {
 	//  - inotify:      There are too many queued events (fs.inotify.max_queued_events sysctl)
 	//  - windows:      The buffer size is too small; WithBufferSize() can be used to increase it.
 	//  - kqueue, fen:  Not used.
+	//
+	// All errors sent here have a Temporary() bool and Path() string method, so
+	// you can tell transient errors apart from permanent ones without
+	// inspecting the underlying error.
 	Errors chan error
+
+	defaults []addOpt    // Options from NewWatcherWith.
+	queue    queueStats  // Stats for the Events channel.
+	dispatch func(Event) // WithDirectDispatch handler.
+	dedup    dedup       // Drop duplicate events; see WithDedup.
+	replays  replays     // Running Replay calls.
+	maxWatch int         // WithMaxWatches; 0 means no limit.
+	faults   *faults     // Errors to inject; only set in tests.
+	hot      hotPaths    // Events by watch; see TopPaths.
+	coalesce coalescer   // See WithCoalesceHot.
+	summary  summarizer  // See WithSummaries.
+	routes   routes      // See Route.
+	locks    lockfiles   // See WithLockfileConvention.
+	filter   filter      // See WithFilterPresets.
+	bursts   bursts      // See WithBurstMarks.
+	limits   limits      // See SetLimit.
+	listings listings    // See ListConsistent.
+	pipeline pipeline    // See Use.
 }
 
 // NewWatcher creates a new Watcher.
@@ -138,15 +160,83 @@ func NewWatcher() (*Watcher, error) {
 // buffers instead of adding a large userspace buffer.
 func NewBufferedWatcher(sz uint) (*Watcher, error) { return NewWatcher() }
 
+// NewWatcherWith creates a new Watcher with options.
+//
+// Options that apply to a watch (such as [WithOps]) are used as the defaults
+// for [Watcher.Add] and [Watcher.AddWith]. Options that apply to the entire
+// watcher are:
+//
+//   - [WithSlowConsumer] sends a warning on Watcher.Errors if events aren't
+//     read fast enough.
+//   - [WithDirectDispatch] calls a function for every event, instead of
+//     sending them on Watcher.Events.
+//   - [WithPool] reads events on a goroutine shared with other watchers;
+//     only supported on Linux.
+//   - [WithEventQueue] sets the size of the queue between reading events and
+//     sending them on Watcher.Events; only supported on Windows.
+//   - [DrainOnClose] keeps sending events that were already read after
+//     [Watcher.Close] is called.
+//   - [WithDedup] drops events that are identical to the previous event for
+//     the same path.
+//   - [WithMergeOverlapping] sends events only once if a path is covered by
+//     more than one watch.
+//   - [WithMaxWatches] limits the number of kernel watches.
+//   - [WithCompletionPort] uses an I/O completion port from the application;
+//     only supported on Windows.
+//   - [WithEventLog] writes lifecycle and error events to the Windows Event
+//     Log; only supported on Windows.
+func NewWatcherWith(opts ...addOpt) (*Watcher, error) { return NewWatcher() }
+
 // Close removes all watches and closes the Events channel.
+//
+// No events are sent after Close returns. Events that were already read from
+// the kernel but not yet sent are dropped and counted in [Stats], unless
+// [DrainOnClose] is used.
+//
+// This is the same as [Watcher.Stop] followed by [Watcher.Wait]. Calling it
+// again returns nil.
 func (w *Watcher) Close() error { return nil }
 
+// Stop removes all watches and releases the kernel resources, without waiting
+// for the events that were already read to be sent.
+//
+// No new events are read after Stop returns. The events that were already read
+// are dropped (or sent, with [DrainOnClose]) and the Events and Errors channels
+// are closed in the background; use [Watcher.Wait] or [Watcher.Done] to wait
+// for that. This allows applications to drain their own queues in between.
+// Calling it again returns nil.
+func (w *Watcher) Stop() error { return nil }
+
+// Done returns a channel that's closed once the watcher is fully shut down
+// after [Watcher.Stop] or [Watcher.Close]: all events are sent or dropped, and
+// the Events and Errors channels are closed.
+func (w *Watcher) Done() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+// Wait blocks until the watcher is fully shut down; see [Watcher.Done].
+func (w *Watcher) Wait() {}
+
+// IsClosed reports if [Watcher.Close] or [Watcher.Stop] was called. The
+// watcher may still be sending events that were already read; use
+// [Watcher.Done] to wait for it to be fully shut down.
+//
+// After Close, methods that add paths (Add, AddWith, AddEx, Replay, and so on)
+// return [ErrClosed], while Close, Stop, and Remove return nil and WatchList
+// returns nil, so that cleanup code doesn't need to check.
+func (w *Watcher) IsClosed() bool { return true }
+
 // WatchList returns all paths explicitly added with [Watcher.Add] (and are not
 // yet removed).
 //
 // Returns nil if [Watcher.Close] was called.
 func (w *Watcher) WatchList() []string { return nil }
 
+func (w *Watcher) exportWatches() map[string]withOpts { return nil }
+func (w *Watcher) watchCount() int                    { return 0 }
+
 // Add starts monitoring the path for changes.
 //
 // A path can only be watched once; watching it more than once is a no-op and will
@@ -183,6 +273,30 @@ func (w *Watcher) WatchList() []string { return nil }
 //
 // Watch the parent directory and use Event.Name to filter out files you're not
 // interested in. There is an example of this in cmd/fsnotify/file.go.
+//
+// # Special files
+//
+// Named pipes (FIFOs), sockets, and device nodes can be watched directly on
+// Linux; note that writing to a named pipe sends a Chmod rather than a Write, as
+// the kernel only updates the timestamps. Other backends return
+// [ErrUnsupportedPath], as opening them may block or have side effects. Special
+// files in a watched directory are reported with Create and Remove (and Rename
+// where supported) on all backends.
+//
+// # Symlinks
+//
+// Symlinks passed to Add are followed: a symlink to a directory watches the
+// files in the directory it points to, and a symlink to a file watches that
+// file. Event names use the path that was passed to Add, not the path the link
+// points to, and adding a symlink that can't be resolved returns an error;
+// except on kqueue, which uses the path the link points to and ignores
+// unresolvable symlinks. Use [FollowSymlinks] to get the same behaviour on all
+// backends, or to watch the link itself. Use [WithNoFollow] to refuse symlinks
+// instead.
+//
+// Symlinks in a watched directory are reported as any other file: a Create or
+// Remove is sent for the link itself. Changes to the file a link points to are
+// not reported, except on kqueue, which also opens the target.
 func (w *Watcher) Add(name string) error { return nil }
 
 // AddWith is like [Watcher.Add], but allows adding options. When using Add()
@@ -192,8 +306,48 @@ func (w *Watcher) Add(name string) error { return nil }
 //
 //   - [WithBufferSize] sets the buffer size for the Windows backend; no-op on
 //     other platforms. The default is 64K (65536 bytes).
+//   - [WithOps] sets which operations to listen for. The default is all of
+//     them.
+//   - [WithoutDirectories] filters out events for directories.
+//   - [PreferCloseWrite] sends Write when a file is closed after writing,
+//     rather than on every write; only supported on inotify (Linux).
+//   - [WithRetry] retries re-arming a watch after a transient error, rather
+//     than removing it.
+//   - [ResolveShortNames] resolves 8.3 short names in events to long names;
+//     only supported on Windows.
+//   - [WithNormalizer] sets a function to normalize event names with; only
+//     supported on kqueue (macOS, BSD).
+//   - [DetectHardLinks] sets Event.HardLink on a Create for a new hard link;
+//     only supported on Linux and kqueue (macOS, BSD).
+//   - [DetectAttrChanges] sets Event.Attrs on a Chmod to the attributes that
+//     changed; only supported on Linux and kqueue (macOS, BSD).
+//   - [DetectFileIDs] sets Event.FileID to the inode number; only supported
+//     on Linux and kqueue (macOS, BSD).
+//   - [WithSuppressDeleteChmod] doesn't send the Chmod when a file is
+//     removed; only supported on Linux.
+//   - [WithAbsolutePaths] makes the path absolute, so that Event.Name is
+//     always absolute.
+//   - [WithNoFollow] and [WithResolveBeneath] refuse to watch paths with
+//     symlinks, or outside a root directory.
+//   - [FollowSymlinks] sets if a symlink passed to Add is followed, or if the
+//     link itself is watched; watching the link itself is only supported on
+//     Linux, macOS, and illumos.
+//   - [WithExclusive] returns an error if the path is already watched.
+//   - [AllowHydration] allows downloading cloud placeholder files; only
+//     supported on Windows.
+//   - [DetectPlaceholders] sets Event.Placeholder for writes to cloud
+//     placeholder files; only supported on Windows.
+//   - [WithPriority] sends the events before events for other paths if the
+//     application can't keep up; only supported on Windows.
+//   - [WithCopyCompleteDetection] sends CloseWrite once a written file is no
+//     longer open; only supported on Windows.
+//   - [WithShareMode] sets the share mode of the directory handle, for example
+//     to prevent deleting the directory while it's watched; only supported on
+//     Windows.
 func (w *Watcher) AddWith(name string, opts ...addOpt) error { return nil }
 
+func (w *Watcher) addWith(name string, opts ...addOpt) (int, error) { return 0, nil }
+
 // Remove stops monitoring the path for changes.
 //
 // Directories are always removed non-recursively. For example, if you added
@@ -15,10 +15,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"reflect"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -136,16 +136,54 @@ type Watcher struct {
 	//  - inotify:      There are too many queued events (fs.inotify.max_queued_events sysctl)
 	//  - windows:      The buffer size is too small; WithBufferSize() can be used to increase it.
 	//  - kqueue, fen:  Not used.
+	//
+	// All errors sent here have a Temporary() bool and Path() string method, so
+	// you can tell transient errors apart from permanent ones without
+	// inspecting the underlying error.
 	Errors chan error
 
-	port  windows.Handle // Handle to completion port
-	input chan *input    // Inputs to the reader are sent on this channel
-	quit  chan chan<- error
-
-	mu         sync.Mutex // Protects access to watches, closed
-	watches    watchMap   // Map of watches (key: i-number)
-	closed     bool       // Set to true when Close() is first called
-	withoutdir bool       // do not send events for directory
+	port    windows.Handle // Handle to completion port
+	portKey uintptr        // Completion key for port.
+	extPort bool           // port is from WithCompletionPort; see HandleCompletion.
+	elog    *evlog         // WithEventLog; nil if not used.
+	input   chan *input    // Inputs to the reader are sent on this channel
+	quit    chan chan<- error
+	done    chan struct{} // Closed by Close(), for deliverEvents
+
+	// Events are queued in events by the I/O thread, and sent on Events by
+	// deliverEvents. There is a queue for every Priority.
+	events    map[Priority]chan Event
+	delivered chan struct{} // Closed when deliverEvents is done.
+	finished  chan struct{} // Closed when the channels are closed; see Done.
+	policy    QueuePolicy
+	dropping  bool                                  // Currently dropping events; only used in the I/O thread.
+	hold      bool                                  // Hold events in pending; only used in the I/O thread.
+	pending   []Event                               // Events decoded from the buffer before re-arming it.
+	writing   map[string]openWrite                  // Files to probe; only used in the I/O thread.
+	probing   bool                                  // Probe is scheduled; only used in the I/O thread.
+	reads     map[*windows.Overlapped]*pendingReads // Pinned reads; only used in the I/O thread.
+
+	mu      sync.Mutex // Protects access to watches, closed
+	watches watchMap   // Map of watches (key: i-number)
+	closed  bool       // Set to true when Close() is first called
+
+	defaults []addOpt    // Options from NewWatcherWith.
+	queue    queueStats  // Stats for the Events channel.
+	dispatch func(Event) // WithDirectDispatch handler.
+	dedup    dedup       // Drop duplicate events; see WithDedup.
+	replays  replays     // Running Replay calls.
+	maxWatch int         // WithMaxWatches; 0 means no limit.
+	faults   *faults     // Errors to inject; only set in tests.
+	hot      hotPaths    // Events by watch; see TopPaths.
+	coalesce coalescer   // See WithCoalesceHot.
+	summary  summarizer  // See WithSummaries.
+	routes   routes      // See Route.
+	locks    lockfiles   // See WithLockfileConvention.
+	filter   filter      // See WithFilterPresets.
+	bursts   bursts      // See WithBurstMarks.
+	limits   limits      // See SetLimit.
+	listings listings    // See ListConsistent.
+	pipeline pipeline    // See Use.
 }
 
 // NewWatcher creates a new Watcher.
@@ -162,19 +200,88 @@ func NewWatcher() (*Watcher, error) {
 // cases, and whenever possible you will be better off increasing the kernel
 // buffers instead of adding a large userspace buffer.
 func NewBufferedWatcher(sz uint) (*Watcher, error) {
-	port, err := windows.CreateIoCompletionPort(windows.InvalidHandle, 0, 0, 0)
+	return newBufferedWatcher(sz, nil)
+}
+
+// NewWatcherWith creates a new Watcher with options.
+//
+// Options that apply to a watch (such as [WithOps]) are used as the defaults
+// for [Watcher.Add] and [Watcher.AddWith]. Options that apply to the entire
+// watcher are:
+//
+//   - [WithSlowConsumer] sends a warning on Watcher.Errors if events aren't
+//     read fast enough.
+//   - [WithDirectDispatch] calls a function for every event, instead of
+//     sending them on Watcher.Events.
+//   - [WithPool] reads events on a goroutine shared with other watchers;
+//     only supported on Linux.
+//   - [WithEventQueue] sets the size of the queue between reading events and
+//     sending them on Watcher.Events; only supported on Windows.
+//   - [DrainOnClose] keeps sending events that were already read after
+//     [Watcher.Close] is called.
+//   - [WithDedup] drops events that are identical to the previous event for
+//     the same path.
+//   - [WithMergeOverlapping] sends events only once if a path is covered by
+//     more than one watch.
+//   - [WithMaxWatches] limits the number of kernel watches.
+//   - [WithCompletionPort] uses an I/O completion port from the application;
+//     only supported on Windows.
+//   - [WithEventLog] writes lifecycle and error events to the Windows Event
+//     Log; only supported on Windows.
+func NewWatcherWith(opts ...addOpt) (*Watcher, error) {
+	if getOptions(opts...).restricted {
+		return nil, fmt.Errorf("%w: only supported on Linux", ErrRestricted)
+	}
+	return newBufferedWatcher(50, opts)
+}
+
+func newBufferedWatcher(sz uint, opts []addOpt) (*Watcher, error) {
+	with := getOptions(opts...)
+	port := windows.Handle(with.port)
+	if port == 0 {
+		var err error
+		port, err = windows.CreateIoCompletionPort(windows.InvalidHandle, 0, 0, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("CreateIoCompletionPort", err)
+		}
+	}
+	if with.queueSize < 1 {
+		with.queueSize = 1
+	}
+	elog, err := openEventLog(with.eventLog)
 	if err != nil {
-		return nil, os.NewSyscallError("CreateIoCompletionPort", err)
+		if with.port == 0 {
+			windows.CloseHandle(port)
+		}
+		return nil, err
 	}
 	w := &Watcher{
-		port:    port,
-		watches: make(watchMap),
-		input:   make(chan *input, 1),
-		Events:  make(chan Event, sz),
-		Errors:  make(chan error),
-		quit:    make(chan chan<- error, 1),
-	}
-	go w.readEvents()
+		port:      port,
+		portKey:   with.portKey,
+		extPort:   with.port != 0,
+		watches:   make(watchMap),
+		input:     make(chan *input, 1),
+		Events:    make(chan Event, sz),
+		Errors:    make(chan error),
+		quit:      make(chan chan<- error, 1),
+		done:      make(chan struct{}),
+		events:    make(map[Priority]chan Event),
+		delivered: make(chan struct{}),
+		finished:  make(chan struct{}),
+		policy:    with.queuePolicy,
+		elog:      elog,
+	}
+	for _, p := range priorities {
+		w.events[p] = make(chan Event, with.queueSize)
+	}
+	w.setOptions(opts)
+	w.startOptions()
+
+	if !w.extPort {
+		go w.readEvents()
+	}
+	go w.deliverEvents()
+	w.elog.info(evCreated, "fsnotify: watcher created")
 	return w, nil
 }
 
@@ -184,43 +291,225 @@ func (w *Watcher) isClosed() bool {
 	return w.closed
 }
 
-func (w *Watcher) sendEvent(name string, mask uint64) bool {
+// sendEvent sends an event for a watched path in watch; name is also used as
+// the WatchRoot.
+func (w *Watcher) sendEvent(watch *watch, name string, mask uint64) bool {
+	return w.sendRenameEvent(watch, name, "", name, mask, false)
+}
+
+// sendRenameEvent is like sendEvent, but sets Event.RenamedFrom and
+// Event.Placeholder, and root is the path of the watch.
+func (w *Watcher) sendRenameEvent(watch *watch, name, from, root string, mask uint64, placeholder bool) bool {
 	if mask == 0 {
 		return false
 	}
-	if w.withoutdir {
-		if fi, err := os.Stat(name); err == nil && fi.IsDir() {
-			return true
-		}
-	}
 
 	event := w.newEvent(name, uint32(mask))
-	select {
-	case ch := <-w.quit:
-		w.quit <- ch
-	case w.Events <- event:
+	event.RenamedFrom, event.WatchRoot = from, root
+	event.Device = uint64(watch.ino.volume)
+	event.Placeholder = placeholder
+	event.Seq = w.listings.count(event)
+	if w.filter.drop(event) || w.dedup.overlap(event) || w.dedup.drop(event) {
+		return true
 	}
+	held, released := w.locks.hold(event)
+	if held {
+		return true
+	}
+	if released != nil {
+		w.send(watch, *released)
+	}
+	w.send(watch, event)
 	return true
 }
 
+// send queues the event, or holds it in pending while decoding a buffer.
+func (w *Watcher) send(watch *watch, event Event) {
+	w.bursts.count(event)
+	if t, ok := w.limits.count(event); ok {
+		w.sendLater(t)
+	}
+	if w.summary.absorb(event) || w.coalesce.absorb(event) {
+		return
+	}
+	if w.hold {
+		w.pending = append(w.pending, event)
+		return
+	}
+	w.queueEvent(event, watch.priority)
+}
+
+// queueEvent queues an event in the queue for prio to be sent by
+// deliverEvents according to the WithEventQueue policy, or calls the Route or
+// WithDirectDispatch handler.
+//
+// Must run within the I/O thread.
+func (w *Watcher) queueEvent(e Event, prio Priority) {
+	e, ok := w.pipeline.apply(e)
+	if !ok {
+		return
+	}
+	if w.routes.route(e) {
+		return
+	}
+	if w.dispatch != nil {
+		w.dispatch(e)
+		return
+	}
+
+	events := w.events[prio]
+	switch w.policy {
+	case QueueDropNewest:
+		select {
+		case events <- e:
+			w.dropping = false
+		default:
+			w.drop(e)
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case events <- e:
+				w.dropping = false
+				return
+			default:
+			}
+			select {
+			case old := <-events:
+				w.drop(old)
+			default:
+			}
+		}
+	default:
+		// Doesn't block forever: deliverEvents keeps reading from the queue
+		// after Close until it's closed.
+		events <- e
+	}
+}
+
+// Must run within the I/O thread.
+func (w *Watcher) drop(e Event) {
+	w.queue.drop(e)
+	if !w.dropping {
+		w.dropping = true
+		w.sendError(ErrEventOverflow)
+	}
+}
+
+// deliverEvents sends the events queued by the I/O thread on the Events
+// channel, so that a slow application doesn't stop the I/O thread from reading
+// the next events.
+func (w *Watcher) deliverEvents() {
+	defer close(w.delivered)
+
+	for {
+		e, ok := w.nextEvent()
+		if !ok {
+			return
+		}
+		start := w.queue.queued(len(w.Events))
+		select {
+		case w.Events <- e:
+		case <-w.done:
+			w.queue.closed(w.Events, e)
+			continue
+		}
+		if err := w.queue.sent(start, len(w.Events)); err != nil {
+			select {
+			case w.Errors <- err:
+			case <-w.done:
+			}
+		}
+	}
+}
+
+// nextEvent returns the next queued event with the highest priority, waiting
+// for one if all queues are empty. Returns false once all queues are closed
+// and empty.
+func (w *Watcher) nextEvent() (Event, bool) {
+	for {
+		var (
+			ch   [len(priorities)]chan Event
+			open bool
+		)
+		for i, p := range priorities {
+			select {
+			case e, ok := <-w.events[p]:
+				if ok {
+					return e, true
+				}
+				// Closed; leave ch[i] nil so the select below doesn't spin
+				// on it.
+			default:
+				ch[i], open = w.events[p], true
+			}
+		}
+		if !open {
+			return Event{}, false
+		}
+
+		select {
+		case e, ok := <-ch[0]:
+			if ok {
+				return e, true
+			}
+		case e, ok := <-ch[1]:
+			if ok {
+				return e, true
+			}
+		case e, ok := <-ch[2]:
+			if ok {
+				return e, true
+			}
+		}
+	}
+}
+
 // Returns true if the error was sent, or false if watcher is closed.
 func (w *Watcher) sendError(err error) bool {
+	err = newError(err, "")
+	w.elog.report(err)
 	select {
 	case w.Errors <- err:
 		return true
-	case <-w.quit:
+	case ch := <-w.quit:
+		w.quit <- ch
 	}
 	return false
 }
 
 // Close removes all watches and closes the Events channel.
+//
+// No events are sent after Close returns. Events that were already read from
+// the kernel but not yet sent are dropped and counted in [Stats], unless
+// [DrainOnClose] is used.
+//
+// This is the same as [Watcher.Stop] followed by [Watcher.Wait]. Calling it
+// again returns nil.
 func (w *Watcher) Close() error {
-	if w.isClosed() {
-		return nil
+	if err := w.Stop(); err != nil {
+		return err
 	}
+	w.Wait()
+	return nil
+}
 
+// Stop removes all watches and releases the kernel resources, without waiting
+// for the events that were already read to be sent.
+//
+// No new events are read after Stop returns. The events that were already read
+// are dropped (or sent, with [DrainOnClose]) and the Events and Errors channels
+// are closed in the background; use [Watcher.Wait] or [Watcher.Done] to wait
+// for that. This allows applications to drain their own queues in between.
+// Calling it again returns nil.
+func (w *Watcher) Stop() error {
 	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
 	w.closed = true
+	close(w.done)
 	w.mu.Unlock()
 
 	// Send "quit" message to the reader goroutine
@@ -232,6 +521,23 @@ func (w *Watcher) Close() error {
 	return <-ch
 }
 
+// Done returns a channel that's closed once the watcher is fully shut down
+// after [Watcher.Stop] or [Watcher.Close]: all events are sent or dropped, and
+// the Events and Errors channels are closed.
+func (w *Watcher) Done() <-chan struct{} { return w.finished }
+
+// Wait blocks until the watcher is fully shut down; see [Watcher.Done].
+func (w *Watcher) Wait() { <-w.finished }
+
+// IsClosed reports if [Watcher.Close] or [Watcher.Stop] was called. The
+// watcher may still be sending events that were already read; use
+// [Watcher.Done] to wait for it to be fully shut down.
+//
+// After Close, methods that add paths (Add, AddWith, AddEx, Replay, and so on)
+// return [ErrClosed], while Close, Stop, and Remove return nil and WatchList
+// returns nil, so that cleanup code doesn't need to check.
+func (w *Watcher) IsClosed() bool { return w.isClosed() }
+
 // Add starts monitoring the path for changes.
 //
 // A path can only be watched once; watching it more than once is a no-op and will
@@ -268,6 +574,30 @@ func (w *Watcher) Close() error {
 //
 // Watch the parent directory and use Event.Name to filter out files you're not
 // interested in. There is an example of this in cmd/fsnotify/file.go.
+//
+// # Special files
+//
+// Named pipes (FIFOs), sockets, and device nodes can be watched directly on
+// Linux; note that writing to a named pipe sends a Chmod rather than a Write, as
+// the kernel only updates the timestamps. Other backends return
+// [ErrUnsupportedPath], as opening them may block or have side effects. Special
+// files in a watched directory are reported with Create and Remove (and Rename
+// where supported) on all backends.
+//
+// # Symlinks
+//
+// Symlinks passed to Add are followed: a symlink to a directory watches the
+// files in the directory it points to, and a symlink to a file watches that
+// file. Event names use the path that was passed to Add, not the path the link
+// points to, and adding a symlink that can't be resolved returns an error;
+// except on kqueue, which uses the path the link points to and ignores
+// unresolvable symlinks. Use [FollowSymlinks] to get the same behaviour on all
+// backends, or to watch the link itself. Use [WithNoFollow] to refuse symlinks
+// instead.
+//
+// Symlinks in a watched directory are reported as any other file: a Create or
+// Remove is sent for the link itself. Changes to the file a link points to are
+// not reported, except on kqueue, which also opens the target.
 func (w *Watcher) Add(name string) error { return w.AddWith(name) }
 
 // AddWith is like [Watcher.Add], but allows adding options. When using Add()
@@ -277,29 +607,90 @@ func (w *Watcher) Add(name string) error { return w.AddWith(name) }
 //
 //   - [WithBufferSize] sets the buffer size for the Windows backend; no-op on
 //     other platforms. The default is 64K (65536 bytes).
+//   - [WithOps] sets which operations to listen for. The default is all of
+//     them.
+//   - [WithoutDirectories] filters out events for directories.
+//   - [PreferCloseWrite] sends Write when a file is closed after writing,
+//     rather than on every write; only supported on inotify (Linux).
+//   - [WithRetry] retries re-arming a watch after a transient error, rather
+//     than removing it.
+//   - [ResolveShortNames] resolves 8.3 short names in events to long names;
+//     only supported on Windows.
+//   - [WithNormalizer] sets a function to normalize event names with; only
+//     supported on kqueue (macOS, BSD).
+//   - [DetectHardLinks] sets Event.HardLink on a Create for a new hard link;
+//     only supported on Linux and kqueue (macOS, BSD).
+//   - [DetectAttrChanges] sets Event.Attrs on a Chmod to the attributes that
+//     changed; only supported on Linux and kqueue (macOS, BSD).
+//   - [DetectFileIDs] sets Event.FileID to the inode number; only supported
+//     on Linux and kqueue (macOS, BSD).
+//   - [WithSuppressDeleteChmod] doesn't send the Chmod when a file is
+//     removed; only supported on Linux.
+//   - [WithAbsolutePaths] makes the path absolute, so that Event.Name is
+//     always absolute.
+//   - [WithNoFollow] and [WithResolveBeneath] refuse to watch paths with
+//     symlinks, or outside a root directory.
+//   - [FollowSymlinks] sets if a symlink passed to Add is followed, or if the
+//     link itself is watched; watching the link itself is only supported on
+//     Linux, macOS, and illumos.
+//   - [WithExclusive] returns an error if the path is already watched.
+//   - [AllowHydration] allows downloading cloud placeholder files; only
+//     supported on Windows.
+//   - [DetectPlaceholders] sets Event.Placeholder for writes to cloud
+//     placeholder files; only supported on Windows.
+//   - [WithPriority] sends the events before events for other paths if the
+//     application can't keep up; only supported on Windows.
+//   - [WithCopyCompleteDetection] sends CloseWrite once a written file is no
+//     longer open; only supported on Windows.
+//   - [WithShareMode] sets the share mode of the directory handle, for example
+//     to prevent deleting the directory while it's watched; only supported on
+//     Windows.
 func (w *Watcher) AddWith(name string, opts ...addOpt) error {
+	_, err := w.addWith(name, opts...)
+	return err
+}
+
+// addWith is AddWith, but also returns the number of watches that were created.
+func (w *Watcher) addWith(name string, opts ...addOpt) (int, error) {
 	if w.isClosed() {
-		return ErrClosed
+		return 0, ErrClosed
 	}
 
-	with := getOptions(opts...)
+	with := getOptions(append(w.defaults, opts...)...)
+	name, err := with.watchPath(name)
+	if err != nil {
+		return 0, err
+	}
+	if err := with.checkPath(name); err != nil {
+		return 0, err
+	}
 	if with.bufsize < 4096 {
-		return fmt.Errorf("fsnotify.WithBufferSize: buffer size cannot be smaller than 4096 bytes")
+		return 0, fmt.Errorf("fsnotify.WithBufferSize: buffer size cannot be smaller than 4096 bytes")
+	}
+	if isDevicePath(name) {
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedPath, name)
+	}
+	if with.symlinks == linkNoFollow {
+		if fi, err := os.Lstat(name); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return 0, fmt.Errorf("%w: %s: watching a symlink itself is not supported", ErrUnsupportedPath, name)
+		}
 	}
-	w.withoutdir = with.withoutdir
 
 	in := &input{
-		op:      opAddWatch,
-		path:    filepath.Clean(name),
-		flags:   sysFSALLEVENTS,
-		reply:   make(chan error),
-		bufsize: with.bufsize,
+		op:    opAddWatch,
+		path:  cleanPath(name),
+		flags: w.opFlags(with.op),
+		reply: make(chan error),
+		with:  with,
 	}
 	w.input <- in
 	if err := w.wakeupReader(); err != nil {
-		return err
+		return 0, err
+	}
+	if err := <-in.reply; err != nil {
+		return 0, err
 	}
-	return <-in.reply
+	return in.watches, nil
 }
 
 // Remove stops monitoring the path for changes.
@@ -317,14 +708,18 @@ func (w *Watcher) Remove(name string) error {
 
 	in := &input{
 		op:    opRemoveWatch,
-		path:  filepath.Clean(name),
+		path:  cleanPath(name),
 		reply: make(chan error),
 	}
 	w.input <- in
 	if err := w.wakeupReader(); err != nil {
 		return err
 	}
-	return <-in.reply
+	err := <-in.reply
+	if err == nil {
+		w.locks.remove(in.path)
+	}
+	return err
 }
 
 // WatchList returns all paths explicitly added with [Watcher.Add] (and are not
@@ -349,6 +744,45 @@ func (w *Watcher) WatchList() []string {
 	return entries
 }
 
+// watchCount returns the number of directory handles.
+func (w *Watcher) watchCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.watches.len()
+}
+
+func (w *Watcher) exportWatches() map[string]withOpts {
+	if w.isClosed() {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	watches := make(map[string]withOpts)
+	for _, entry := range w.watches {
+		for _, watchEntry := range entry {
+			with := defaultOpts
+			with.bufsize = len(watchEntry.buf)
+			with.op = watchEntry.op
+			with.withoutdir = watchEntry.withoutdir
+			with.longnames = watchEntry.longnames != nil
+			with.hydrate = watchEntry.hydrate
+			with.placeholders = watchEntry.placehold
+			with.copyComplete = watchEntry.copyDetect
+			with.priority = watchEntry.priority
+			with.share = watchEntry.share
+			if watchEntry.mask&^provisional != 0 {
+				watches[watchEntry.path] = with
+			}
+			for name := range watchEntry.names {
+				watches[filepath.Join(watchEntry.path, name)] = with
+			}
+		}
+	}
+	return watches
+}
+
 // These options are from the old golang.org/x/exp/winfsnotify, where you could
 // add various options to the watch. This has long since been removed.
 //
@@ -361,6 +795,7 @@ const (
 	sysFSDELETE     = 0x200
 	sysFSDELETESELF = 0x400
 	sysFSMODIFY     = 0x2
+	sysFSCLOSEWRITE = 0x8
 	sysFSMOVE       = 0xc0
 	sysFSMOVEDFROM  = 0x40
 	sysFSMOVEDTO    = 0x80
@@ -379,6 +814,9 @@ func (w *Watcher) newEvent(name string, mask uint32) Event {
 	if mask&sysFSMODIFY == sysFSMODIFY {
 		e.Op |= Write
 	}
+	if mask&sysFSCLOSEWRITE == sysFSCLOSEWRITE {
+		e.Op |= CloseWrite
+	}
 	if mask&sysFSMOVE == sysFSMOVE || mask&sysFSMOVESELF == sysFSMOVESELF || mask&sysFSMOVEDFROM == sysFSMOVEDFROM {
 		e.Op |= Rename
 	}
@@ -388,6 +826,8 @@ func (w *Watcher) newEvent(name string, mask uint32) Event {
 const (
 	opAddWatch = iota
 	opRemoveWatch
+	opReconnectWatch
+	opProbeWrites
 )
 
 const (
@@ -398,8 +838,10 @@ type input struct {
 	op      int
 	path    string
 	flags   uint32
-	bufsize int
+	with    withOpts
+	watch   *watch // For opReconnectWatch
 	reply   chan error
+	watches int // Number of handles opened by opAddWatch; set before reply.
 }
 
 type inode struct {
@@ -409,14 +851,36 @@ type inode struct {
 }
 
 type watch struct {
-	ov      windows.Overlapped
-	ino     *inode            // i-number
-	recurse bool              // Recursive watch?
-	path    string            // Directory path
-	mask    uint64            // Directory itself is being watched with these notify flags
-	names   map[string]uint64 // Map of names being watched and their notify flags
-	rename  string            // Remembers the old name while renaming a file
-	buf     []byte            // buffer, allocated later
+	ov         windows.Overlapped
+	ino        *inode              // i-number
+	recurse    bool                // Recursive watch?
+	path       string              // Directory path
+	mask       uint64              // Directory itself is being watched with these notify flags
+	names      map[string]uint64   // Map of names being watched and their notify flags
+	renames    []rename            // Old names of renames, oldest first; see addRename
+	buf        []byte              // buffer, allocated later
+	op         Op                  // Operations the watch was added with
+	withoutdir bool                // Don't send events for directories
+	dirs       map[string]struct{} // Names of subdirectories; only kept with withoutdir
+	longnames  map[string]string   // 8.3 short name → long name; only kept with ResolveShortNames
+	decoded    decodedNames        // Cache for decodeName
+	hydrate    bool                // Allow downloading cloud placeholders; see AllowHydration
+	placehold  bool                // Set Event.Placeholder; see DetectPlaceholders
+	copyDetect bool                // See WithCopyCompleteDetection
+	share      ShareMode           // See WithShareMode
+	priority   Priority            // Highest priority the watch was added with
+	retry      func(int) time.Duration
+	attempt    int  // Current retry attempt
+	offline    bool // Network share is unreachable or access was lost; see disconnect
+	denied     bool // Offline because access was lost
+}
+
+// pendingReads is the number of reads for a watch that the kernel may still
+// write to; see pinRead.
+type pendingReads struct {
+	watch *watch
+	n     int
+	pin   pinner
 }
 
 type (
@@ -425,13 +889,53 @@ type (
 )
 
 func (w *Watcher) wakeupReader() error {
-	err := windows.PostQueuedCompletionStatus(w.port, 0, 0, nil)
+	err := windows.PostQueuedCompletionStatus(w.port, 0, w.portKey, nil)
 	if err != nil {
 		return os.NewSyscallError("PostQueuedCompletionStatus", err)
 	}
 	return nil
 }
 
+// cleanPath is like filepath.Clean, but turns a drive letter without a
+// separator ("C:") in to the root of that volume ("C:\"), rather than the
+// current directory on that drive. A volume root always keeps its trailing
+// separator, so that filepath.Join() with it gives an absolute path.
+func cleanPath(name string) string {
+	name = filepath.Clean(name)
+	if len(name) == 2 && name[1] == ':' && filepath.VolumeName(name) == name {
+		return name + `\`
+	}
+	return name
+}
+
+// isDevicePath reports if name refers to a named pipe or device rather than a
+// file or directory; ReadDirectoryChangesW doesn't work on these, and opening
+// them may block (pipes) or have side effects.
+//
+// This is anything in the \\.\ device namespace (e.g. \\.\pipe\name or
+// \\.\COM1), and the reserved DOS device names such as NUL or COM1, which
+// refer to the device in any directory and with any extension.
+func isDevicePath(name string) bool {
+	if len(name) >= 4 && (name[:4] == `\\.\` || name[:4] == `//./`) {
+		return true
+	}
+	if len(name) >= 9 && strings.EqualFold(name[:9], `\\?\pipe\`) {
+		return true
+	}
+
+	base := filepath.Base(name)
+	if i := strings.IndexByte(base, '.'); i > -1 {
+		base = base[:i]
+	}
+	base = strings.ToUpper(strings.TrimRight(base, " "))
+	switch base {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+	return len(base) == 4 && (base[:3] == "COM" || base[:3] == "LPT") &&
+		base[3] >= '1' && base[3] <= '9'
+}
+
 func (w *Watcher) getDir(pathname string) (dir string, err error) {
 	attr, err := windows.GetFileAttributes(windows.StringToUTF16Ptr(pathname))
 	if err != nil {
@@ -446,12 +950,18 @@ func (w *Watcher) getDir(pathname string) (dir string, err error) {
 	return
 }
 
-func (w *Watcher) getIno(path string) (ino *inode, err error) {
+// getIno opens the directory path; see WithShareMode for the flags.
+func (w *Watcher) getIno(path string, hydrate bool, share ShareMode) (ino *inode, err error) {
+	flags := uint32(windows.FILE_FLAG_BACKUP_SEMANTICS | windows.FILE_FLAG_OVERLAPPED)
+	if !hydrate {
+		flags |= windows.FILE_FLAG_OPEN_NO_RECALL
+	}
+	if share == 0 {
+		share = DefaultShareMode
+	}
 	h, err := windows.CreateFile(windows.StringToUTF16Ptr(path),
-		windows.FILE_LIST_DIRECTORY,
-		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
-		nil, windows.OPEN_EXISTING,
-		windows.FILE_FLAG_BACKUP_SEMANTICS|windows.FILE_FLAG_OVERLAPPED, 0)
+		windows.FILE_LIST_DIRECTORY, uint32(share),
+		nil, windows.OPEN_EXISTING, flags, 0)
 	if err != nil {
 		return nil, os.NewSyscallError("CreateFile", err)
 	}
@@ -478,6 +988,28 @@ func (m watchMap) get(ino *inode) *watch {
 	return nil
 }
 
+// byPath returns the watch for the directory path, or nil if there isn't one.
+//
+// Must run within the I/O thread.
+func (m watchMap) byPath(path string) *watch {
+	for _, i := range m {
+		for _, watch := range i {
+			if strings.EqualFold(watch.path, path) {
+				return watch
+			}
+		}
+	}
+	return nil
+}
+
+func (m watchMap) len() int {
+	var n int
+	for _, i := range m {
+		n += len(i)
+	}
+	return n
+}
+
 // Must run within the I/O thread.
 func (m watchMap) set(ino *inode, watch *watch) {
 	i := m[ino.volume]
@@ -489,41 +1021,83 @@ func (m watchMap) set(ino *inode, watch *watch) {
 }
 
 // Must run within the I/O thread.
-func (w *Watcher) addWatch(pathname string, flags uint64, bufsize int) error {
+//
+// Returns the number of directory handles that were opened: 1 if the directory
+// wasn't watched yet, and 0 otherwise.
+func (w *Watcher) addWatch(pathname string, flags uint64, with withOpts) (int, error) {
 	//pathname, recurse := recursivePath(pathname)
 	recurse := false
 
 	dir, err := w.getDir(pathname)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	ino, err := w.getIno(dir)
+	ino, err := w.getIno(dir, with.hydrate, with.share)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	w.mu.Lock()
 	watchEntry := w.watches.get(ino)
 	w.mu.Unlock()
+	if watchEntry == nil && w.maxWatch > 0 && w.watches.len() >= w.maxWatch {
+		windows.CloseHandle(ino.handle)
+		return 0, &WatchLimitError{Limit: w.maxWatch, Skipped: []string{pathname}}
+	}
+	n := 0
 	if watchEntry == nil {
-		_, err := windows.CreateIoCompletionPort(ino.handle, w.port, 0, 0)
+		_, err := windows.CreateIoCompletionPort(ino.handle, w.port, w.portKey, 0)
 		if err != nil {
 			windows.CloseHandle(ino.handle)
-			return os.NewSyscallError("CreateIoCompletionPort", err)
+			return 0, os.NewSyscallError("CreateIoCompletionPort", err)
 		}
 		watchEntry = &watch{
 			ino:     ino,
 			path:    dir,
 			names:   make(map[string]uint64),
 			recurse: recurse,
-			buf:     make([]byte, bufsize),
+			buf:     make([]byte, with.bufsize),
+			share:   with.share,
 		}
 		w.mu.Lock()
 		w.watches.set(ino, watchEntry)
 		w.mu.Unlock()
 		flags |= provisional
+		n = 1
 	} else {
 		windows.CloseHandle(ino.handle)
+		if !strings.EqualFold(watchEntry.path, dir) {
+			return 0, fmt.Errorf("%w: %q is the same directory as %q", ErrAliasWatch, dir, watchEntry.path)
+		}
+		if with.exclusive && ((pathname == dir && watchEntry.mask != 0) ||
+			(pathname != dir && watchEntry.names[filepath.Base(pathname)] != 0)) {
+			return 0, fmt.Errorf("%w: %s", ErrAlreadyWatched, pathname)
+		}
+	}
+	watchEntry.op |= with.op
+	if with.retry != nil {
+		watchEntry.retry = with.retry
+	}
+	watchEntry.hydrate = watchEntry.hydrate || with.hydrate
+	watchEntry.placehold = watchEntry.placehold || with.placeholders
+	watchEntry.copyDetect = watchEntry.copyDetect || with.copyComplete
+	if with.priority.higher(watchEntry.priority) {
+		watchEntry.priority = with.priority
+	}
+	if with.withoutdir && !watchEntry.withoutdir {
+		watchEntry.withoutdir = true
+		watchEntry.dirs = make(map[string]struct{})
+		if watchEntry.hydrate || !isPlaceholder(dir) {
+			ls, _ := os.ReadDir(dir)
+			for _, f := range ls {
+				if f.IsDir() {
+					watchEntry.dirs[f.Name()] = struct{}{}
+				}
+			}
+		}
+	}
+	if with.longnames && watchEntry.longnames == nil {
+		watchEntry.longnames = make(map[string]string)
 	}
 	if pathname == dir {
 		watchEntry.mask |= flags
@@ -533,7 +1107,7 @@ func (w *Watcher) addWatch(pathname string, flags uint64, bufsize int) error {
 
 	err = w.startRead(watchEntry)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if pathname == dir {
@@ -541,7 +1115,7 @@ func (w *Watcher) addWatch(pathname string, flags uint64, bufsize int) error {
 	} else {
 		watchEntry.names[filepath.Base(pathname)] &= ^provisional
 	}
-	return nil
+	return n, nil
 }
 
 // Must run within the I/O thread.
@@ -552,49 +1126,86 @@ func (w *Watcher) remWatch(pathname string) error {
 	if err != nil {
 		return err
 	}
-	ino, err := w.getIno(dir)
-	if err != nil {
-		return err
-	}
 
+	// Find the watch by the path it was added with, rather than opening the
+	// directory again: that fails with ERROR_SHARING_VIOLATION if the watch was
+	// added with a WithShareMode that doesn't include ShareRead.
 	w.mu.Lock()
-	watch := w.watches.get(ino)
+	watch := w.watches.byPath(dir)
 	w.mu.Unlock()
+	if watch == nil {
+		// A different spelling of the same directory, such as a short name.
+		ino, err := w.getIno(dir, false, 0)
+		if err != nil {
+			return err
+		}
+		w.mu.Lock()
+		watch = w.watches.get(ino)
+		w.mu.Unlock()
 
-	if recurse && !watch.recurse {
-		return fmt.Errorf("can't use \\... with non-recursive watch %q", pathname)
-	}
-
-	err = windows.CloseHandle(ino.handle)
-	if err != nil {
-		w.sendError(os.NewSyscallError("CloseHandle", err))
+		err = windows.CloseHandle(ino.handle)
+		if err != nil {
+			w.sendError(newError(os.NewSyscallError("CloseHandle", err), pathname))
+		}
 	}
 	if watch == nil {
 		return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
 	}
+	if recurse && !watch.recurse {
+		return fmt.Errorf("can't use \\... with non-recursive watch %q", pathname)
+	}
 	if pathname == dir {
-		w.sendEvent(watch.path, watch.mask&sysFSIGNORED)
+		w.sendEvent(watch, watch.path, watch.mask&sysFSIGNORED)
 		watch.mask = 0
 	} else {
 		name := filepath.Base(pathname)
-		w.sendEvent(filepath.Join(watch.path, name), watch.names[name]&sysFSIGNORED)
+		w.sendEvent(watch, filepath.Join(watch.path, name), watch.names[name]&sysFSIGNORED)
 		delete(watch.names, name)
 	}
 
 	return w.startRead(watch)
 }
 
+// FILE_STANDARD_INFO
+type fileStandardInfo struct {
+	AllocationSize int64
+	EndOfFile      int64
+	NumberOfLinks  uint32
+	DeletePending  bool
+	Directory      bool
+}
+
+// rootGone reports if the watched directory was removed, rather than us
+// losing access to it; ReadDirectoryChangesW returns ERROR_ACCESS_DENIED for
+// both.
+//
+// This uses the handle we already have, as opening the path again also fails
+// with ERROR_ACCESS_DENIED if the directory is pending deletion.
+//
+// Must run within the I/O thread.
+func (w *Watcher) rootGone(watch *watch) bool {
+	var fi fileStandardInfo
+	err := windows.GetFileInformationByHandleEx(watch.ino.handle, windows.FileStandardInfo,
+		(*byte)(unsafe.Pointer(&fi)), uint32(unsafe.Sizeof(fi)))
+	if err == nil {
+		return fi.DeletePending || fi.NumberOfLinks == 0
+	}
+
+	_, err = windows.GetFileAttributes(windows.StringToUTF16Ptr(watch.path))
+	return err == windows.ERROR_FILE_NOT_FOUND || err == windows.ERROR_PATH_NOT_FOUND
+}
+
 // Must run within the I/O thread.
 func (w *Watcher) deleteWatch(watch *watch) {
 	for name, mask := range watch.names {
 		if mask&provisional == 0 {
-			w.sendEvent(filepath.Join(watch.path, name), mask&sysFSIGNORED)
+			w.sendEvent(watch, filepath.Join(watch.path, name), mask&sysFSIGNORED)
 		}
 		delete(watch.names, name)
 	}
 	if watch.mask != 0 {
 		if watch.mask&provisional == 0 {
-			w.sendEvent(watch.path, watch.mask&sysFSIGNORED)
+			w.sendEvent(watch, watch.path, watch.mask&sysFSIGNORED)
 		}
 		watch.mask = 0
 	}
@@ -604,17 +1215,21 @@ func (w *Watcher) deleteWatch(watch *watch) {
 func (w *Watcher) startRead(watch *watch) error {
 	err := windows.CancelIo(watch.ino.handle)
 	if err != nil {
-		w.sendError(os.NewSyscallError("CancelIo", err))
+		w.sendError(newError(os.NewSyscallError("CancelIo", err), watch.path))
 		w.deleteWatch(watch)
 	}
 	mask := w.toWindowsFlags(watch.mask)
 	for _, m := range watch.names {
 		mask |= w.toWindowsFlags(m)
 	}
+	// No need to get directory names if we're going to drop them anyway.
+	if watch.withoutdir {
+		mask &^= windows.FILE_NOTIFY_CHANGE_DIR_NAME
+	}
 	if mask == 0 {
 		err := windows.CloseHandle(watch.ino.handle)
 		if err != nil {
-			w.sendError(os.NewSyscallError("CloseHandle", err))
+			w.sendError(newError(os.NewSyscallError("CloseHandle", err), watch.path))
 		}
 		w.mu.Lock()
 		delete(w.watches[watch.ino.volume], watch.ino.index)
@@ -622,16 +1237,28 @@ func (w *Watcher) startRead(watch *watch) error {
 		return nil
 	}
 
-	// We need to pass the array, rather than the slice.
-	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&watch.buf))
-	rdErr := windows.ReadDirectoryChanges(watch.ino.handle,
-		(*byte)(unsafe.Pointer(hdr.Data)), uint32(hdr.Len),
-		watch.recurse, mask, nil, &watch.ov, 0)
+	rdErr := w.faults.next(faultReadDirectoryChanges)
+	if rdErr == nil {
+		w.pinRead(watch)
+		rdErr = windows.ReadDirectoryChanges(watch.ino.handle,
+			&watch.buf[0], uint32(len(watch.buf)),
+			watch.recurse, mask, nil, &watch.ov, 0)
+		if rdErr != nil {
+			w.unpinRead(&watch.ov)
+		}
+	}
 	if rdErr != nil {
 		err := os.NewSyscallError("ReadDirectoryChanges", rdErr)
+		if isNetError(rdErr) && watch.mask&provisional == 0 {
+			w.disconnect(watch, err)
+			return nil
+		}
 		if rdErr == windows.ERROR_ACCESS_DENIED && watch.mask&provisional == 0 {
-			// Watched directory was probably removed
-			w.sendEvent(watch.path, watch.mask&sysFSDELETESELF)
+			if !w.rootGone(watch) {
+				w.disconnect(watch, err)
+				return nil
+			}
+			w.sendEvent(watch, watch.path, watch.mask&sysFSDELETESELF)
 			err = nil
 		}
 		w.deleteWatch(watch)
@@ -653,159 +1280,623 @@ func (w *Watcher) readEvents() {
 	runtime.LockOSThread()
 
 	for {
-		// This error is handled after the watch == nil check below.
+		// This error is handled after the watch == nil check in
+		// handleCompletion.
 		qErr := windows.GetQueuedCompletionStatus(w.port, &n, &key, &ov, windows.INFINITE)
+		if w.handleCompletion(n, ov, qErr) {
+			return
+		}
+	}
+}
 
-		watch := (*watch)(unsafe.Pointer(ov))
-		if watch == nil {
-			select {
-			case ch := <-w.quit:
-				w.mu.Lock()
-				var indexes []indexMap
-				for _, index := range w.watches {
-					indexes = append(indexes, index)
-				}
-				w.mu.Unlock()
-				for _, index := range indexes {
-					for _, watch := range index {
-						w.deleteWatch(watch)
-						w.startRead(watch)
-					}
+// pinRead keeps the watch and its buffer in place until the completion for the
+// read is dequeued. There can be more than one pending read for a watch, as a
+// read cancelled with CancelIo still queues a completion, which may arrive
+// after the watch was deleted.
+//
+// The watch is looked up by the OVERLAPPED in handleCompletion, rather than
+// converting the pointer, so it doesn't depend on the layout of watch.
+//
+// Must run within the I/O thread.
+func (w *Watcher) pinRead(wt *watch) {
+	if w.reads == nil {
+		w.reads = make(map[*windows.Overlapped]*pendingReads)
+	}
+	r, ok := w.reads[&wt.ov]
+	if !ok {
+		r = &pendingReads{watch: wt}
+		w.reads[&wt.ov] = r
+	}
+	r.n++
+	r.pin.pin(wt)
+	r.pin.pin(&wt.buf[0])
+}
+
+// unpinRead is called for every completion of a read started with pinRead, and
+// returns the watch the read was for; the watch is unpinned once there are no
+// more pending reads. It returns nil if ov isn't for a read of this watcher.
+//
+// Must run within the I/O thread.
+func (w *Watcher) unpinRead(ov *windows.Overlapped) *watch {
+	r, ok := w.reads[ov]
+	if !ok {
+		return nil
+	}
+	r.n--
+	if r.n <= 0 {
+		r.pin.unpin()
+		delete(w.reads, ov)
+	}
+	return r.watch
+}
+
+// HandleCompletion handles a completion packet for the watcher from the
+// completion port set with [WithCompletionPort]. Call it for every packet with
+// the watcher's completion key, with the values from GetQueuedCompletionStatus;
+// err is the error it returned, ov may be nil. The application must not close
+// the port before the watcher is closed.
+//
+// All calls must be made from the same OS thread (see runtime.LockOSThread),
+// as pending reads are cancelled with CancelIo, which only works on the thread
+// that started them. [Watcher.Add], [Watcher.Remove], and [Watcher.Close] wait
+// until the next call to HandleCompletion, so they must not be called from the
+// thread that calls it. Sending on the Errors channel also blocks it.
+//
+// Returns true if the watcher was closed; there are no more packets for the
+// watcher after that.
+func (w *Watcher) HandleCompletion(n uint32, ov *windows.Overlapped, err error) bool {
+	if !w.extPort {
+		panic("fsnotify: HandleCompletion called on a watcher without WithCompletionPort")
+	}
+	return w.handleCompletion(n, ov, err)
+}
+
+// handleCompletion handles a completion packet from the port; ov is nil for
+// packets posted by wakeupReader. It returns true if the watcher was closed.
+//
+// Must run within the I/O thread.
+func (w *Watcher) handleCompletion(n uint32, ov *windows.Overlapped, qErr error) bool {
+	w.queue.read()
+
+	var watch *watch
+	if ov != nil {
+		watch = w.unpinRead(ov)
+		if watch == nil { // Not from ReadDirectoryChanges; shouldn't happen.
+			return false
+		}
+	}
+	if watch == nil {
+		select {
+		case ch := <-w.quit:
+			w.mu.Lock()
+			var indexes []indexMap
+			for _, index := range w.watches {
+				indexes = append(indexes, index)
+			}
+			w.mu.Unlock()
+			for _, index := range indexes {
+				for _, watch := range index {
+					w.deleteWatch(watch)
+					w.startRead(watch)
 				}
+			}
 
-				err := windows.CloseHandle(w.port)
+			var err error
+			if !w.extPort {
+				err = windows.CloseHandle(w.port)
 				if err != nil {
 					err = os.NewSyscallError("CloseHandle", err)
 				}
-				close(w.Events)
-				close(w.Errors)
-				ch <- err
-				return
-			case in := <-w.input:
-				switch in.op {
-				case opAddWatch:
-					in.reply <- w.addWatch(in.path, uint64(in.flags), in.bufsize)
-				case opRemoveWatch:
-					in.reply <- w.remWatch(in.path)
-				}
-			default:
 			}
-			continue
-		}
+			// All handles are closed, which cancels the pending reads; the
+			// kernel no longer writes to the buffers.
+			for ov, r := range w.reads {
+				r.pin.unpin()
+				delete(w.reads, ov)
+			}
 
-		switch qErr {
-		case nil:
-			// No error
-		case windows.ERROR_MORE_DATA:
-			if watch == nil {
-				w.sendError(errors.New("ERROR_MORE_DATA has unexpectedly null lpOverlapped buffer"))
-			} else {
-				// The i/o succeeded but the buffer is full.
-				// In theory we should be building up a full packet.
-				// In practice we can get away with just carrying on.
-				n = uint32(unsafe.Sizeof(watch.buf))
+			// Stop returns here; the rest is waited for with Wait.
+			ch <- err
+			for _, events := range w.events {
+				close(events)
+			}
+			<-w.delivered
+			w.replays.close()
+			close(w.Events)
+			close(w.Errors)
+			w.elog.info(evClosed, "fsnotify: watcher closed")
+			w.elog.close()
+			close(w.finished)
+			return true
+		case in := <-w.input:
+			switch in.op {
+			case opAddWatch:
+				n, err := w.addWatch(in.path, uint64(in.flags), in.with)
+				in.watches = n
+				in.reply <- err
+			case opRemoveWatch:
+				in.reply <- w.remWatch(in.path)
+			case opReconnectWatch:
+				w.reconnect(in.watch)
+			case opProbeWrites:
+				w.probeWrites()
 			}
-		case windows.ERROR_ACCESS_DENIED:
-			// Watched directory was probably removed
-			w.sendEvent(watch.path, watch.mask&sysFSDELETESELF)
-			w.deleteWatch(watch)
-			w.startRead(watch)
-			continue
-		case windows.ERROR_OPERATION_ABORTED:
-			// CancelIo was called on this handle
-			continue
 		default:
-			w.sendError(os.NewSyscallError("GetQueuedCompletionPort", qErr))
-			continue
 		}
+		return false
+	}
 
-		var offset uint32
-		for {
-			if n == 0 {
-				w.sendError(ErrEventOverflow)
-				break
-			}
+	if err := w.faults.next(faultCompletion); err != nil {
+		qErr = err
+	}
+	switch qErr {
+	case nil:
+		// No error
+	case windows.ERROR_MORE_DATA:
+		if watch == nil {
+			w.sendError(errors.New("ERROR_MORE_DATA has unexpectedly null lpOverlapped buffer"))
+		} else {
+			// The i/o succeeded but the buffer is full.
+			// In theory we should be building up a full packet.
+			// In practice we can get away with just carrying on.
+			n = uint32(len(watch.buf))
+		}
+	case windows.ERROR_ACCESS_DENIED:
+		if !w.rootGone(watch) {
+			w.disconnect(watch, os.NewSyscallError("GetQueuedCompletionPort", qErr))
+			return false
+		}
+		w.sendEvent(watch, watch.path, watch.mask&sysFSDELETESELF)
+		w.deleteWatch(watch)
+		w.startRead(watch)
+		return false
+	case windows.ERROR_OPERATION_ABORTED:
+		// CancelIo was called on this handle
+		return false
+	default:
+		if isNetError(qErr) {
+			w.disconnect(watch, os.NewSyscallError("GetQueuedCompletionPort", qErr))
+			return false
+		}
+		w.sendError(newError(os.NewSyscallError("GetQueuedCompletionPort", qErr), watch.path))
+		return false
+	}
 
-			// Point "raw" to the event in the buffer
-			raw := (*windows.FileNotifyInformation)(unsafe.Pointer(&watch.buf[offset]))
-
-			// Create a buf that is the size of the path name
-			size := int(raw.FileNameLength / 2)
-			var buf []uint16
-			// TODO: Use unsafe.Slice in Go 1.17; https://stackoverflow.com/questions/51187973
-			sh := (*reflect.SliceHeader)(unsafe.Pointer(&buf))
-			sh.Data = uintptr(unsafe.Pointer(&raw.FileName))
-			sh.Len = size
-			sh.Cap = size
-			name := windows.UTF16ToString(buf)
-			fullname := filepath.Join(watch.path, name)
-
-			var mask uint64
-			switch raw.Action {
-			case windows.FILE_ACTION_REMOVED:
-				mask = sysFSDELETESELF
-			case windows.FILE_ACTION_MODIFIED:
-				mask = sysFSMODIFY
-			case windows.FILE_ACTION_RENAMED_OLD_NAME:
-				watch.rename = name
-			case windows.FILE_ACTION_RENAMED_NEW_NAME:
-				// Update saved path of all sub-watches.
-				old := filepath.Join(watch.path, watch.rename)
-				w.mu.Lock()
-				for _, watchMap := range w.watches {
-					for _, ww := range watchMap {
-						if strings.HasPrefix(ww.path, old) {
-							ww.path = filepath.Join(fullname, strings.TrimPrefix(ww.path, old))
-						}
-					}
-				}
-				w.mu.Unlock()
+	// Decode all events before sending any of them, so the buffer can be
+	// re-armed as soon as possible.
+	w.hold = true
+	w.dedup.reset()
+	err := ErrEventOverflow
+	if n > 0 {
+		err = parseNotifyInfo(watch.buf[:n], func(action uint32, name []byte) {
+			w.handleNotify(watch, action, name)
+		})
+	}
+	if err != nil {
+		w.sendError(newError(err, watch.path))
+	}
+
+	watch.attempt = 0
+	if err := w.startRead(watch); err != nil {
+		w.sendError(newError(err, watch.path))
+	}
+
+	w.hold = false
+	for i, e := range w.pending {
+		w.queueEvent(e, watch.priority)
+		w.pending[i] = Event{}
+	}
+	w.pending = w.pending[:0]
+	return false
+}
+
+// handleNotify handles one FILE_NOTIFY_INFORMATION entry for the watch; name is
+// the raw UTF-16 name.
+//
+// Must run within the I/O thread.
+func (w *Watcher) handleNotify(watch *watch, action uint32, rawName []byte) {
+	name, fullname := watch.decodeName(rawName)
+	if long := watch.longName(name, action); long != name {
+		name, fullname = long, filepath.Join(watch.path, long)
+	}
+
+	// The old name of a rename, if this is the new name. There is no
+	// old name if it expired or was in a buffer that overflowed, in which
+	// case it's sent as a Create.
+	var old string
+	if action == windows.FILE_ACTION_RENAMED_NEW_NAME {
+		old = watch.takeRename(name)
+	}
+	skip := watch.withoutdir && watch.isDir(name, old, action)
+
+	// Cloud sync engines report changes to placeholders (e.g. removing the
+	// local copy to free up space) as a modification.
+	placeholder := watch.placehold && action == windows.FILE_ACTION_MODIFIED &&
+		isPlaceholder(fullname)
+
+	var mask uint64
+	switch action {
+	case windows.FILE_ACTION_REMOVED:
+		mask = sysFSDELETESELF
+	case windows.FILE_ACTION_MODIFIED:
+		mask = sysFSMODIFY
+	case windows.FILE_ACTION_RENAMED_OLD_NAME:
+		watch.addRename(name)
+	case windows.FILE_ACTION_RENAMED_NEW_NAME:
+		if old == "" {
+			break
+		}
 
-				if watch.names[watch.rename] != 0 {
-					watch.names[name] |= watch.names[watch.rename]
-					delete(watch.names, watch.rename)
-					mask = sysFSMOVESELF
+		// Update saved path of all sub-watches.
+		oldpath := filepath.Join(watch.path, old)
+		w.mu.Lock()
+		for _, watchMap := range w.watches {
+			for _, ww := range watchMap {
+				if ww.path == oldpath || strings.HasPrefix(ww.path, oldpath+string(filepath.Separator)) {
+					ww.path = filepath.Join(fullname, strings.TrimPrefix(ww.path, oldpath))
 				}
 			}
+		}
+		w.mu.Unlock()
 
-			sendNameEvent := func() {
-				w.sendEvent(fullname, watch.names[name]&mask)
-			}
-			if raw.Action != windows.FILE_ACTION_RENAMED_NEW_NAME {
-				sendNameEvent()
-			}
-			if raw.Action == windows.FILE_ACTION_REMOVED {
-				w.sendEvent(fullname, watch.names[name]&sysFSIGNORED)
-				delete(watch.names, name)
-			}
+		if watch.names[old] != 0 {
+			watch.names[name] |= watch.names[old]
+			delete(watch.names, old)
+			mask = sysFSMOVESELF
+		}
+	}
 
-			w.sendEvent(fullname, watch.mask&w.toFSnotifyFlags(raw.Action))
-			if raw.Action == windows.FILE_ACTION_RENAMED_NEW_NAME {
-				fullname = filepath.Join(watch.path, watch.rename)
-				sendNameEvent()
-			}
+	sendNameEvent := func() {
+		if !skip {
+			w.sendRenameEvent(watch, fullname, "", fullname, watch.names[name]&mask, placeholder)
+		}
+	}
+	if action != windows.FILE_ACTION_RENAMED_NEW_NAME {
+		sendNameEvent()
+	}
+	if action == windows.FILE_ACTION_REMOVED {
+		w.sendEvent(watch, fullname, watch.names[name]&sysFSIGNORED)
+		delete(watch.names, name)
+	}
 
-			// Move to the next event in the buffer
-			if raw.NextEntryOffset == 0 {
-				break
-			}
-			offset += raw.NextEntryOffset
-
-			// Error!
-			if offset >= n {
-				//lint:ignore ST1005 Windows should be capitalized
-				w.sendError(errors.New(
-					"Windows system assumed buffer larger than it is, events have likely been missed"))
-				break
-			}
+	if !skip {
+		var from string
+		if old != "" {
+			from = filepath.Join(watch.path, old)
+		}
+		w.sendRenameEvent(watch, fullname, from, watch.path, watch.mask&w.toFSnotifyFlags(action), placeholder)
+	}
+	if watch.copyDetect && !skip {
+		w.trackWrite(watch, name, fullname, action)
+	}
+	if old != "" {
+		fullname = filepath.Join(watch.path, old)
+		sendNameEvent()
+	}
+}
+
+// isNetError reports if err means the network share is unreachable.
+func isNetError(err error) bool {
+	switch err {
+	case windows.ERROR_NETNAME_DELETED, windows.ERROR_BAD_NETPATH,
+		windows.ERROR_UNEXP_NET_ERR, windows.ERROR_NETWORK_UNREACHABLE:
+		return true
+	}
+	return false
+}
+
+// Backoff for reconnecting if the watch wasn't added with WithRetry: double the
+// wait on every attempt, up to a minute.
+func reconnectBackoff(attempt int) time.Duration {
+	if attempt > 6 {
+		return time.Minute
+	}
+	return time.Second << (attempt - 1)
+}
+
+// disconnect sends Disconnected (once) for a watch on a network share that
+// failed with err, or AccessLost if we no longer have access to the directory,
+// and schedules re-opening it; see reconnect. The WithRetry backoff is used if
+// it's set; giving up removes the watch.
+//
+// Must run within the I/O thread.
+func (w *Watcher) disconnect(watch *watch, err error) {
+	if !watch.offline {
+		watch.offline = true
+		watch.denied = errors.Is(err, windows.ERROR_ACCESS_DENIED)
+		if watch.denied {
+			w.sendError(&AccessLost{Dir: watch.path, Err: err})
+		} else {
+			w.sendError(&Disconnected{Dir: watch.path, Err: err})
+		}
+	}
+
+	watch.attempt++
+	d := reconnectBackoff(watch.attempt)
+	if watch.retry != nil {
+		d = watch.retry(watch.attempt)
+	}
+	if d < 0 {
+		w.sendError(newError(fmt.Errorf("fsnotify: giving up reconnecting to %q: %w",
+			watch.path, err), watch.path))
+		w.deleteWatch(watch)
+		w.startRead(watch)
+		return
+	}
+
+	time.AfterFunc(d, func() {
+		// The I/O thread stops reading input once the watcher is closed, which
+		// can happen at any time.
+		select {
+		case w.input <- &input{op: opReconnectWatch, watch: watch}:
+			w.wakeupReader()
+		case <-w.done:
 		}
+	})
+}
 
-		if err := w.startRead(watch); err != nil {
-			w.sendError(err)
+// reconnect opens the directory of a disconnected watch again, as the old
+// handle is no longer usable once the network session is gone or access was
+// lost.
+//
+// Must run within the I/O thread.
+func (w *Watcher) reconnect(watch *watch) {
+	w.mu.Lock()
+	current := w.watches.get(watch.ino)
+	w.mu.Unlock()
+	if current != watch { // Removed in the meanwhile.
+		return
+	}
+
+	ino, err := w.getIno(watch.path, watch.hydrate, watch.share)
+	if err != nil {
+		w.disconnect(watch, err)
+		return
+	}
+	_, err = windows.CreateIoCompletionPort(ino.handle, w.port, w.portKey, 0)
+	if err != nil {
+		windows.CloseHandle(ino.handle)
+		w.disconnect(watch, os.NewSyscallError("CreateIoCompletionPort", err))
+		return
+	}
+
+	windows.CloseHandle(watch.ino.handle)
+	w.mu.Lock()
+	delete(w.watches[watch.ino.volume], watch.ino.index)
+	watch.ino = ino
+	w.watches.set(ino, watch)
+	w.mu.Unlock()
+
+	attempt := watch.attempt
+	if err := w.startRead(watch); err != nil {
+		w.sendError(newError(err, watch.path))
+		return
+	}
+	if watch.attempt == attempt { // startRead didn't call disconnect again.
+		watch.attempt, watch.offline = 0, false
+		if watch.denied {
+			w.sendError(&AccessRestored{Dir: watch.path})
+		} else {
+			w.sendError(&Reconnected{Dir: watch.path})
+		}
+	}
+}
+
+// isDir reports if name is a directory, using the cache kept for
+// WithoutDirectories. Only new names are stat'd, rather than every event, and
+// this also works for names that no longer exist (e.g. after a remove).
+//
+// Must run within the I/O thread.
+func (watch *watch) isDir(name, old string, action uint32) bool {
+	switch action {
+	case windows.FILE_ACTION_ADDED:
+		watch.statDir(name)
+	case windows.FILE_ACTION_RENAMED_NEW_NAME:
+		if _, ok := watch.dirs[old]; ok && old != "" {
+			delete(watch.dirs, old)
+			watch.dirs[name] = struct{}{}
+		} else {
+			watch.statDir(name)
+		}
+	}
+
+	_, ok := watch.dirs[name]
+	if action == windows.FILE_ACTION_REMOVED {
+		delete(watch.dirs, name)
+	}
+	return ok
+}
+
+// How long to wait for the new name of a rename after the old name.
+const renameTimeout = time.Second
+
+type rename struct {
+	old string
+	at  time.Time
+}
+
+// addRename remembers the old name of a rename until the new name is seen,
+// which may be in the next buffer.
+//
+// Windows sends the old and new name right after each other for a single
+// rename, but renames can be interleaved: both for different directories with
+// a recursive watch, and for several renames in the same directory. The old
+// names are kept in order, each with its own timeout, and takeRename pairs the
+// new name with the oldest one. Moves to another directory are sent as a
+// remove and add, so only old names in the same directory are used.
+//
+// Must run within the I/O thread.
+func (watch *watch) addRename(old string) {
+	now := time.Now()
+	watch.expireRenames(now)
+	watch.renames = append(watch.renames, rename{old: old, at: now})
+}
+
+// takeRename returns the old name for the new name of a rename, or "" if
+// there isn't one.
+//
+// Must run within the I/O thread.
+func (watch *watch) takeRename(name string) string {
+	watch.expireRenames(time.Now())
+	dir := filepath.Dir(name)
+	for i, r := range watch.renames {
+		if filepath.Dir(r.old) == dir {
+			watch.renames = append(watch.renames[:i], watch.renames[i+1:]...)
+			return r.old
 		}
 	}
+	return ""
+}
+
+// expireRenames removes the old names that are older than renameTimeout; the
+// oldest are first.
+func (watch *watch) expireRenames(now time.Time) {
+	i := 0
+	for i < len(watch.renames) && now.Sub(watch.renames[i].at) > renameTimeout {
+		i++
+	}
+	if i > 0 {
+		watch.renames = append(watch.renames[:0], watch.renames[i:]...)
+	}
+}
+
+// isPlaceholder reports if path is a cloud placeholder whose data isn't stored
+// locally; this doesn't cause it to be downloaded.
+func isPlaceholder(path string) bool {
+	attr, err := windows.GetFileAttributes(windows.StringToUTF16Ptr(path))
+	return err == nil && attr&(windows.FILE_ATTRIBUTE_RECALL_ON_OPEN|
+		windows.FILE_ATTRIBUTE_RECALL_ON_DATA_ACCESS|windows.FILE_ATTRIBUTE_OFFLINE) != 0
+}
+
+// Must run within the I/O thread.
+func (watch *watch) statDir(name string) {
+	attr, err := windows.GetFileAttributes(windows.StringToUTF16Ptr(filepath.Join(watch.path, name)))
+	if err == nil && attr&windows.FILE_ATTRIBUTE_DIRECTORY != 0 {
+		watch.dirs[name] = struct{}{}
+	} else {
+		delete(watch.dirs, name)
+	}
+}
+
+// Maximum number of entries in watch.decoded; the cache is cleared once it's
+// full, like longnames.
+const maxDecodedNames = 1024
+
+// decodedNames caches the names decoded by decodeName.
+type decodedNames struct {
+	path  string               // watch.path the full names are for.
+	names map[string][2]string // Raw UTF-16 name → name, full name.
+}
+
+// decodeName returns the name from the UTF-16 FileName of a
+// FILE_NOTIFY_INFORMATION, and the name joined with the watch path.
+//
+// Directories with a lot of events (e.g. build output) usually have the same
+// files changing over and over again, so the results are cached by the raw
+// name instead of calling UTF16ToString and filepath.Join for every event.
+//
+// Must run within the I/O thread.
+func (watch *watch) decodeName(raw []byte) (name, fullname string) {
+	c := &watch.decoded
+	if c.path != watch.path || len(c.names) >= maxDecodedNames {
+		c.path, c.names = watch.path, make(map[string][2]string)
+	}
+	// The string(raw) conversion doesn't allocate for map lookups.
+	if n, ok := c.names[string(raw)]; ok {
+		return n[0], n[1]
+	}
+
+	buf := make([]uint16, len(raw)/2)
+	for i := range buf {
+		buf[i] = uint16(raw[2*i]) | uint16(raw[2*i+1])<<8
+	}
+	name = windows.UTF16ToString(buf)
+	fullname = filepath.Join(watch.path, name)
+	c.names[string(raw)] = [2]string{name, fullname}
+	return name, fullname
+}
+
+// Maximum number of entries in watch.longnames; the cache is cleared once it's
+// full, which is a lot simpler than keeping track of what was used least.
+const maxLongNames = 4096
+
+// longName resolves an 8.3 short name (e.g. "PROGRA~1") to the long name if
+// ResolveShortNames was used for this watch, and returns name as-is otherwise.
+//
+// Names are resolved with GetLongPathName(), which only works for paths that
+// exist, so results are cached to still give the long name in the Remove or
+// Rename event.
+//
+// Must run within the I/O thread.
+func (watch *watch) longName(name string, action uint32) string {
+	// Short names generated by Windows always have a "~"; this keeps the hot
+	// path cheap for the common case.
+	if watch.longnames == nil || !strings.Contains(name, "~") {
+		return name
+	}
+
+	long, ok := watch.longnames[name]
+	if !ok {
+		l, err := getLongPathName(filepath.Join(watch.path, name))
+		if err != nil { // Already gone, or not a short name after all.
+			return name
+		}
+		long = filepath.Join(filepath.Dir(name), filepath.Base(l))
+		if len(watch.longnames) >= maxLongNames {
+			watch.longnames = make(map[string]string)
+		}
+		watch.longnames[name] = long
+	}
+
+	// The short name may be re-used for a different file after this.
+	if action == windows.FILE_ACTION_REMOVED || action == windows.FILE_ACTION_RENAMED_OLD_NAME {
+		delete(watch.longnames, name)
+	}
+	return long
+}
+
+func getLongPathName(path string) (string, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]uint16, windows.MAX_PATH)
+	for {
+		n, err := windows.GetLongPathName(p, &buf[0], uint32(len(buf)))
+		if err != nil {
+			return "", os.NewSyscallError("GetLongPathName", err)
+		}
+		// Buffer was too small; n is the required size including the NUL.
+		if n > uint32(len(buf)) {
+			buf = make([]uint16, n)
+			continue
+		}
+		return windows.UTF16ToString(buf[:n]), nil
+	}
+}
+
+// opFlags returns the sysFS* flags needed to send events for op; Chmod is
+// never sent on Windows.
+func (w *Watcher) opFlags(op Op) uint32 {
+	var m uint32
+	if op.Has(Create) {
+		m |= sysFSCREATE | sysFSMOVEDTO
+	}
+	if op.Has(Write) {
+		m |= sysFSMODIFY
+	}
+	if op.Has(Remove) {
+		m |= sysFSDELETE | sysFSDELETESELF
+	}
+	if op.Has(Rename) {
+		m |= sysFSMOVEDFROM | sysFSMOVESELF
+	}
+	return m
 }
 
+// toWindowsFlags returns the FILE_NOTIFY_CHANGE_* flags for the sysFS* mask;
+// FILE_NOTIFY_CHANGE_LAST_WRITE is only needed for writes, and the name flags
+// only for creates, removes, and renames.
 func (w *Watcher) toWindowsFlags(mask uint64) uint32 {
 	var m uint32
 	if mask&sysFSMODIFY != 0 {
@@ -4,9 +4,17 @@
 package fsnotify
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
 )
 
 func TestRemoveState(t *testing.T) {
@@ -66,3 +74,752 @@ func TestWindowsRemWatch(t *testing.T) {
 		t.Fatal("Should be fail with closed handle\n")
 	}
 }
+
+func TestWindowsCleanPath(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`C:`, `C:\`},
+		{`c:`, `c:\`},
+		{`C:\`, `C:\`},
+		{`C:/`, `C:\`},
+		{`C:\\`, `C:\`},
+		{`C:\dir\`, `C:\dir`},
+		{`C:/dir/file`, `C:\dir\file`},
+		{`dir`, `dir`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have := cleanPath(tt.in)
+			if have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowsVolumeRoot(t *testing.T) {
+	root := filepath.VolumeName(t.TempDir())
+	if len(root) != 2 {
+		t.Skipf("temp directory is not on a drive letter: %q", root)
+	}
+
+	for _, name := range []string{root, root + `\`, root + `/`} {
+		t.Run(name, func(t *testing.T) {
+			w := newWatcher(t)
+			defer w.Close()
+
+			addWatch(t, w, name)
+			if have, want := w.WatchList(), []string{root + `\`}; !reflect.DeepEqual(have, want) {
+				t.Errorf("WatchList()\nhave: %q\nwant: %q", have, want)
+			}
+			if err := w.Remove(name); err != nil {
+				t.Fatal(err)
+			}
+			if have := w.WatchList(); len(have) != 0 {
+				t.Errorf("WatchList() not empty after Remove(): %q", have)
+			}
+		})
+	}
+}
+
+func TestWindowsResolveShortNames(t *testing.T) {
+	tmp := t.TempDir()
+	long := join(tmp, "a long file name.txt")
+	touch(t, long)
+
+	p, err := windows.UTF16PtrFromString(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]uint16, windows.MAX_PATH)
+	n, err := windows.GetShortPathName(p, &buf[0], uint32(len(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := windows.UTF16ToString(buf[:n])
+	if filepath.Base(short) == filepath.Base(long) {
+		t.Skip("8.3 names are disabled on this volume")
+	}
+
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, ResolveShortNames()); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	if err := os.WriteFile(join(tmp, filepath.Base(short)), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	events := w.stop(t)
+	if len(events) == 0 {
+		t.Fatal("no events")
+	}
+	for _, e := range events {
+		if e.Name != long {
+			t.Errorf("event not for long name: %s", e)
+		}
+	}
+}
+
+func TestWindowsEventQueue(t *testing.T) {
+	tmp := t.TempDir()
+
+	w, err := NewWatcherWith(WithEventQueue(1, QueueDropNewest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp)
+
+	// Don't read from Events; the queue fills up and events are dropped, which
+	// shouldn't stop the I/O thread.
+	for i := 0; i < 10; i++ {
+		touch(t, tmp, fmt.Sprintf("file%d", i))
+	}
+
+	select {
+	case err := <-w.Errors:
+		if !errors.Is(err, ErrEventOverflow) {
+			t.Fatalf("wrong error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for ErrEventOverflow")
+	}
+	if s := w.Stats(); s.Dropped == 0 {
+		t.Errorf("Stats.Dropped is 0")
+	}
+}
+
+// Close must not hang when the I/O thread is blocked on a full queue, and the
+// queued events must be counted as dropped.
+func TestWindowsCloseFullQueue(t *testing.T) {
+	tmp := t.TempDir()
+
+	w, err := NewWatcherWith(WithEventQueue(1, QueueBlock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp)
+
+	// More than fits in the Events channel buffer and the queue.
+	for i := 0; i < 200; i++ {
+		touch(t, tmp, fmt.Sprintf("file%d", i))
+	}
+	waitForEvents()
+
+	closed := make(chan error)
+	go func() { closed <- w.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() timed out")
+	}
+
+	if s := w.Stats(); s.Dropped == 0 {
+		t.Error("Stats.Dropped is 0")
+	}
+}
+
+func TestWindowsUnsupportedPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{`\\.\pipe\fsnotify`, true},
+		{`//./pipe/fsnotify`, true},
+		{`\\?\pipe\fsnotify`, true},
+		{`\\.\COM1`, true},
+		{`NUL`, true},
+		{`C:\dir\nul.txt`, true},
+		{`C:\dir\lpt9`, true},
+		{`C:\dir\con `, true},
+		{`C:\dir\file`, false},
+		{`C:\dir\COM0`, false},
+		{`C:\dir\console`, false},
+		{`\\?\C:\dir`, false},
+		{`\\server\share\dir`, false},
+	}
+
+	w := newWatcher(t)
+	defer w.Close()
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if have := isDevicePath(tt.path); have != tt.want {
+				t.Fatalf("isDevicePath(%q) = %t; want %t", tt.path, have, tt.want)
+			}
+			if tt.want {
+				if err := w.Add(tt.path); !errors.Is(err, ErrUnsupportedPath) {
+					t.Errorf("wrong error from Add(): %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestWindowsCompletionPort(t *testing.T) {
+	tmp := t.TempDir()
+
+	port, err := windows.CreateIoCompletionPort(windows.InvalidHandle, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer windows.CloseHandle(port)
+
+	const key = 42
+	w, err := NewWatcherWith(WithCompletionPort(uintptr(port), key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The application's I/O loop.
+	loopDone := make(chan struct{})
+	go func() {
+		defer close(loopDone)
+		runtime.LockOSThread()
+		for {
+			var (
+				n  uint32
+				k  uintptr
+				ov *windows.Overlapped
+			)
+			err := windows.GetQueuedCompletionStatus(port, &n, &k, &ov, windows.INFINITE)
+			if k != key {
+				t.Errorf("wrong key: %d", k)
+				return
+			}
+			if w.HandleCompletion(n, ov, err) {
+				return
+			}
+		}
+	}()
+
+	addWatch(t, w, tmp)
+	touch(t, tmp, "file")
+
+	select {
+	case e := <-w.Events:
+		if !e.Has(Create) || filepath.Base(e.Name) != "file" {
+			t.Errorf("wrong event: %s", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-loopDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleCompletion didn't return true after Close")
+	}
+}
+
+func TestWindowsRenamePairing(t *testing.T) {
+	watch := &watch{}
+
+	// Renames in different directories of a recursive watch are interleaved.
+	watch.addRename(`a\old`)
+	watch.addRename(`b\old`)
+	if have := watch.takeRename(`b\new`); have != `b\old` {
+		t.Errorf("b: have %q", have)
+	}
+	if have := watch.takeRename(`a\new`); have != `a\old` {
+		t.Errorf("a: have %q", have)
+	}
+	if have := watch.takeRename(`a\new2`); have != "" {
+		t.Errorf("old name used twice: %q", have)
+	}
+
+	// Two interleaved renames in the same directory are paired in order.
+	watch.addRename(`dir\old1`)
+	watch.addRename(`dir\old2`)
+	if have := watch.takeRename(`dir\new1`); have != `dir\old1` {
+		t.Errorf("first: have %q", have)
+	}
+	if have := watch.takeRename(`dir\new2`); have != `dir\old2` {
+		t.Errorf("second: have %q", have)
+	}
+
+	// The new name can be in the next buffer, but not after the timeout; each
+	// old name has its own timeout.
+	watch.addRename(`old1`)
+	watch.renames[0].at = time.Now().Add(-2 * renameTimeout)
+	watch.addRename(`old2`)
+	if have := watch.takeRename(`new`); have != "old2" {
+		t.Errorf("expired: have %q", have)
+	}
+	if len(watch.renames) != 0 {
+		t.Errorf("not removed: %v", watch.renames)
+	}
+}
+
+func TestWindowsRenameInterleaved(t *testing.T) {
+	tmp := t.TempDir()
+	touch(t, tmp, "a", noWait)
+	touch(t, tmp, "b", noWait)
+
+	w := newCollector(t, tmp)
+	w.collect(t)
+
+	// MoveFileEx doesn't allow doing this atomically, but the notifications
+	// of two renames right after each other are decoded from the same buffer
+	// most of the time; the pairing is the same either way.
+	mv(t, join(tmp, "a"), tmp, "a2", noWait)
+	mv(t, join(tmp, "b"), tmp, "b2", noWait)
+	eventSeparator()
+
+	renamed := make(map[string]string)
+	for _, e := range w.stop(t) {
+		if e.Has(Create) {
+			renamed[e.Name] = e.RenamedFrom
+		}
+	}
+	want := map[string]string{join(tmp, "a2"): join(tmp, "a"), join(tmp, "b2"): join(tmp, "b")}
+	if !reflect.DeepEqual(renamed, want) {
+		t.Errorf("\nhave: %q\nwant: %q", renamed, want)
+	}
+}
+
+func TestWindowsPlaceholder(t *testing.T) {
+	tmp := t.TempDir()
+	file := join(tmp, "file")
+	touch(t, file)
+
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, WithOps(Write), DetectPlaceholders()); err != nil {
+		t.Fatal(err)
+	}
+	// Without DetectPlaceholders the attributes aren't read.
+	other := newCollector(t)
+	if err := other.w.AddWith(tmp, WithOps(Write)); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+	other.collect(t)
+
+	// There's no way to create a real placeholder without a sync engine, but
+	// FILE_ATTRIBUTE_OFFLINE is also "data isn't stored locally".
+	err := windows.SetFileAttributes(windows.StringToUTF16Ptr(file), windows.FILE_ATTRIBUTE_OFFLINE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+
+	events := w.stop(t)
+	if len(events) == 0 {
+		t.Fatal("no events")
+	}
+	for _, e := range events {
+		if !e.Placeholder {
+			t.Errorf("Placeholder not set: %s", e)
+		}
+	}
+	for _, e := range other.stop(t) {
+		if e.Placeholder {
+			t.Errorf("Placeholder set without DetectPlaceholders: %s", e)
+		}
+	}
+}
+
+func TestWindowsPriority(t *testing.T) {
+	var (
+		tmp  = t.TempDir()
+		bulk = join(tmp, "bulk")
+		conf = join(tmp, "conf")
+	)
+	mkdir(t, bulk)
+	mkdir(t, conf)
+
+	w, err := NewWatcherWith(WithEventQueue(1000, QueueBlock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.AddWith(bulk, WithPriority(PriorityLow)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddWith(conf, WithPriority(PriorityHigh)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Don't read from Events until all events are queued; more than fits in
+	// the Events channel buffer.
+	for i := 0; i < 200; i++ {
+		touch(t, bulk, fmt.Sprintf("file%d", i))
+	}
+	waitForEvents()
+	touch(t, conf, "file")
+	waitForEvents()
+
+	var (
+		bulkSeen int
+		timeout  = time.After(10 * time.Second)
+	)
+	for {
+		select {
+		case e := <-w.Events:
+			if e.Name != join(conf, "file") {
+				bulkSeen++
+				continue
+			}
+			// Events already in the Events channel buffer and the one
+			// deliverEvents is sending are sent before it.
+			if bulkSeen > cap(w.Events)+1 {
+				t.Errorf("high priority event sent after %d low priority events", bulkSeen)
+			}
+			return
+		case err := <-w.Errors:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatal("timeout waiting for the high priority event")
+		}
+	}
+}
+
+func TestWindowsReconnectBackoff(t *testing.T) {
+	var got []time.Duration
+	for i := 1; i <= 9; i++ {
+		got = append(got, reconnectBackoff(i))
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 32 * time.Second, time.Minute, time.Minute, time.Minute}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\nhave: %v\nwant: %v", got, want)
+	}
+
+	err := newError(&Disconnected{Dir: `\\server\share`, Err: windows.ERROR_NETNAME_DELETED}, "")
+	if !isTemporary(err) || err.(interface{ Path() string }).Path() != `\\server\share` {
+		t.Errorf("wrong Temporary() or Path() for %v", err)
+	}
+	if !errors.Is(err, windows.ERROR_NETNAME_DELETED) {
+		t.Errorf("doesn't wrap the system error: %v", err)
+	}
+	if !isNetError(windows.ERROR_BAD_NETPATH) || isNetError(windows.ERROR_ACCESS_DENIED) {
+		t.Error("wrong isNetError")
+	}
+}
+
+func TestWindowsNativeOps(t *testing.T) {
+	if fileActionAdded != windows.FILE_ACTION_ADDED || fileActionRemoved != windows.FILE_ACTION_REMOVED ||
+		fileActionModified != windows.FILE_ACTION_MODIFIED ||
+		fileActionRenamedOldName != windows.FILE_ACTION_RENAMED_OLD_NAME ||
+		fileActionRenamedNewName != windows.FILE_ACTION_RENAMED_NEW_NAME ||
+		fileNotifyChangeFileName != windows.FILE_NOTIFY_CHANGE_FILE_NAME ||
+		fileNotifyChangeDirName != windows.FILE_NOTIFY_CHANGE_DIR_NAME ||
+		fileNotifyChangeLastWrite != windows.FILE_NOTIFY_CHANGE_LAST_WRITE {
+		t.Error("Windows flags don't match")
+	}
+
+	var w Watcher
+	for action := uint32(0); action < 8; action++ {
+		if have, want := OpFromWindowsAction(action), w.newEvent("", uint32(w.toFSnotifyFlags(action))).Op; have != want {
+			t.Errorf("action %d: have %s; want %s", action, have, want)
+		}
+	}
+}
+
+// utf16Raw returns name as the raw UTF-16 bytes of FILE_NOTIFY_INFORMATION.
+func utf16Raw(name string) []byte {
+	u := windows.StringToUTF16(name)
+	u = u[:len(u)-1] // Not NUL-terminated.
+	raw := make([]byte, 0, len(u)*2)
+	for _, c := range u {
+		raw = append(raw, byte(c), byte(c>>8))
+	}
+	return raw
+}
+
+func TestWindowsDecodeName(t *testing.T) {
+	watch := &watch{path: `C:\dir`}
+
+	for i := 0; i < 2; i++ { // Second time is from the cache.
+		name, full := watch.decodeName(utf16Raw(`sub\ファイル.txt`))
+		if name != `sub\ファイル.txt` || full != `C:\dir\sub\ファイル.txt` {
+			t.Errorf("wrong name: %q, %q", name, full)
+		}
+	}
+
+	// Renaming the watched directory changes the path.
+	watch.path = `C:\moved`
+	if _, full := watch.decodeName(utf16Raw("file")); full != `C:\moved\file` {
+		t.Errorf("wrong full name after rename: %q", full)
+	}
+
+	for i := 0; i < maxDecodedNames+10; i++ {
+		watch.decodeName(utf16Raw(fmt.Sprintf("file%d", i)))
+	}
+	if l := len(watch.decoded.names); l > maxDecodedNames {
+		t.Errorf("cache not cleared: %d entries", l)
+	}
+}
+
+// Build output: the same few hundred files in a handful of directories are
+// written over and over again.
+func BenchmarkWindowsDecodeName(b *testing.B) {
+	var names [][]byte
+	for _, dir := range []string{`obj\Debug`, `obj\Release`, `bin\Debug`, `bin\Release`} {
+		for i := 0; i < 50; i++ {
+			names = append(names, utf16Raw(fmt.Sprintf(`%s\module%d.obj`, dir, i)))
+		}
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		watch := &watch{path: `C:\src\project`}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			watch.decodeName(names[i%len(names)])
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		watch := &watch{path: `C:\src\project`}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			watch.decoded = decodedNames{}
+			watch.decodeName(names[i%len(names)])
+		}
+	})
+}
+
+func TestWindowsDecodeLongName(t *testing.T) {
+	long := strings.Repeat("x", 32767) // Longest name with \\?\ paths.
+	watch := &watch{path: `\\?\C:\dir`}
+	if name, _ := watch.decodeName(utf16Raw(long)); name != long {
+		t.Errorf("name truncated to %d characters", len(name))
+	}
+}
+
+func TestWindowsFaults(t *testing.T) {
+	t.Run("ReadDirectoryChanges", func(t *testing.T) {
+		f := new(faults)
+		f.add(faultReadDirectoryChanges, windows.ERROR_INVALID_FUNCTION)
+		w, err := NewWatcherWith(withFaults(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+
+		tmp := t.TempDir()
+		if err := w.Add(tmp); !errors.Is(err, windows.ERROR_INVALID_FUNCTION) {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if l := w.WatchList(); len(l) != 0 {
+			t.Fatalf("watch not removed: %q", l)
+		}
+		addWatch(t, w, tmp)
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		f := new(faults)
+		f.add(faultCompletion, windows.ERROR_NETNAME_DELETED)
+		w, err := NewWatcherWith(withFaults(f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+
+		tmp := t.TempDir()
+		addWatch(t, w, tmp)
+		touch(t, tmp, "file")
+
+		var d *Disconnected
+		var r *Reconnected
+		for _, want := range []interface{}{&d, &r} {
+			select {
+			case err := <-w.Errors:
+				if !errors.As(err, want) {
+					t.Fatalf("wrong error: %v", err)
+				}
+			case e := <-w.Events:
+				t.Fatalf("unexpected event: %s", e)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for error")
+			}
+		}
+
+		touch(t, tmp, "file2")
+		select {
+		case err := <-w.Errors:
+			t.Fatalf("unexpected error: %v", err)
+		case e := <-w.Events:
+			if !e.Has(Create) || e.Name != join(tmp, "file2") {
+				t.Errorf("wrong event: %s", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	})
+}
+
+func TestWindowsEventLog(t *testing.T) {
+	tests := []struct {
+		err      error
+		id       uint32
+		severity uint16
+	}{
+		{ErrEventOverflow, evOverflow, windows.EVENTLOG_WARNING_TYPE},
+		{newError(fmt.Errorf("wrap: %w", ErrEventOverflow), `C:\dir`), evOverflow, windows.EVENTLOG_WARNING_TYPE},
+		{&Disconnected{Dir: `C:\dir`}, evDisconnected, windows.EVENTLOG_WARNING_TYPE},
+		{&Reconnected{Dir: `C:\dir`}, evReconnected, windows.EVENTLOG_INFORMATION_TYPE},
+		{&AccessLost{Dir: `C:\dir`}, evAccessLost, windows.EVENTLOG_WARNING_TYPE},
+		{&AccessRestored{Dir: `C:\dir`}, evAccessRestored, windows.EVENTLOG_INFORMATION_TYPE},
+		{&SlowConsumer{}, evTemporary, windows.EVENTLOG_WARNING_TYPE},
+		{errors.New("oh no"), evError, windows.EVENTLOG_ERROR_TYPE},
+	}
+	for _, tt := range tests {
+		id, severity := eventLogID(tt.err)
+		if id != tt.id || severity != tt.severity {
+			t.Errorf("%v: have %d, %d; want %d, %d", tt.err, id, severity, tt.id, tt.severity)
+		}
+	}
+
+	w, err := NewWatcherWith(WithEventLog("fsnotify-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.elog == nil {
+		t.Fatal("elog not set")
+	}
+	addWatch(t, w, t.TempDir())
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWindowsCopyComplete(t *testing.T) {
+	tmp := t.TempDir()
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.AddWith(tmp, WithCopyCompleteDetection()); err != nil {
+		t.Fatal(err)
+	}
+
+	file := join(tmp, "file")
+	fp, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if _, err := fp.WriteString("data"); err != nil {
+		t.Fatal(err)
+	}
+
+	// closeWrite reports if there was a CloseWrite event for file before
+	// timeout.
+	closeWrite := func(timeout time.Duration) bool {
+		t.Helper()
+		deadline := time.After(timeout)
+		for {
+			select {
+			case e := <-w.Events:
+				if e.Has(CloseWrite) {
+					if e.Name != file || e.Op != CloseWrite {
+						t.Fatalf("wrong event: %s", e)
+					}
+					return true
+				}
+			case err := <-w.Errors:
+				t.Fatal(err)
+			case <-deadline:
+				return false
+			}
+		}
+	}
+	if closeWrite(4 * copyProbeInterval) {
+		t.Fatal("CloseWrite while the file is still open")
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !closeWrite(5 * time.Second) {
+		t.Fatal("no CloseWrite after closing the file")
+	}
+}
+
+func TestWindowsShareMode(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		tmp := t.TempDir()
+		dir := join(tmp, "dir")
+		mkdir(t, dir)
+		w := newCollector(t, dir)
+		if spec := w.w.Export().Watches[0]; spec.ShareMode != 0 {
+			t.Errorf("ShareMode in spec: %v", spec.ShareMode)
+		}
+		w.collect(t)
+
+		// Deleting the directory works while it's watched, and the parent can
+		// be removed once the watcher has seen it.
+		if err := os.Remove(dir); err != nil {
+			t.Fatal(err)
+		}
+		events := w.stop(t)
+		if len(events) == 0 || events[len(events)-1].Name != dir || !events[len(events)-1].Has(Remove) {
+			t.Errorf("no Remove for the directory:\n%s", events)
+		}
+		if err := os.Remove(tmp); err != nil {
+			t.Errorf("removing parent: %s", err)
+		}
+	})
+
+	t.Run("without ShareDelete", func(t *testing.T) {
+		tmp := t.TempDir()
+		dir := join(tmp, "dir")
+		mkdir(t, dir)
+		w, err := NewWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		if err := w.AddWith(dir, WithShareMode(ShareRead|ShareWrite)); err != nil {
+			t.Fatal(err)
+		}
+		if spec := w.Export().Watches[0]; spec.ShareMode != ShareRead|ShareWrite {
+			t.Errorf("wrong ShareMode in spec: %v", spec.ShareMode)
+		}
+
+		if err := os.Rename(dir, dir+"2"); !errors.Is(err, windows.ERROR_SHARING_VIOLATION) {
+			t.Errorf("wrong error for rename: %v", err)
+		}
+		if err := os.Remove(dir); !errors.Is(err, windows.ERROR_SHARING_VIOLATION) {
+			t.Errorf("wrong error for remove: %v", err)
+		}
+		// Files in it can still be removed.
+		touch(t, dir, "file", noWait)
+		if err := os.Remove(join(dir, "file")); err != nil {
+			t.Error(err)
+		}
+
+		if err := w.Remove(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(dir); err != nil {
+			t.Errorf("remove after unwatching: %s", err)
+		}
+	})
+	t.Run("without ShareRead", func(t *testing.T) {
+		tmp := t.TempDir()
+		dir := join(tmp, "dir")
+		mkdir(t, dir)
+		w, err := NewWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		if err := w.AddWith(dir, WithShareMode(ShareWrite|ShareDelete)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Remove can't open the directory again to find the watch.
+		if err := w.Remove(dir); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+//go:build linux && !appengine
+// +build linux,!appengine
+
+package fsnotify
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// WatchBudget returns the maximum number of inotify watches for this user (the
+// fs.inotify.max_user_watches sysctl) and how many are currently used by all
+// processes of this user, so that an application can check if there are enough
+// watches left before adding a large directory tree, instead of failing
+// halfway through.
+//
+// The number in use is counted from /proc, and may be too low if not all
+// processes can be read (e.g. with hidepid). On other platforms this returns 0
+// for both, meaning there is no such limit.
+func WatchBudget() (limit, used int, err error) {
+	data, err := os.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		return 0, 0, err
+	}
+	limit, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	uid := uint32(os.Getuid())
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return limit, 0, err
+	}
+	for _, p := range procs {
+		if _, err := strconv.Atoi(p.Name()); err != nil {
+			continue
+		}
+		// Processes can exit while we're reading, so ignore all errors.
+		dir := filepath.Join("/proc", p.Name())
+		if fi, err := os.Stat(dir); err != nil || fi.Sys().(*syscall.Stat_t).Uid != uid {
+			continue
+		}
+		fds, _ := os.ReadDir(filepath.Join(dir, "fd"))
+		for _, fd := range fds {
+			if l, _ := os.Readlink(filepath.Join(dir, "fd", fd.Name())); l == "anon_inode:inotify" {
+				used += countInotifyWatches(filepath.Join(dir, "fdinfo", fd.Name()))
+			}
+		}
+	}
+	return limit, used, nil
+}
+
+// countInotifyWatches counts the "inotify wd:" lines in a /proc fdinfo file.
+func countInotifyWatches(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	return strings.Count(string(data), "inotify wd:")
+}
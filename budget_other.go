@@ -0,0 +1,15 @@
+//go:build !linux || appengine
+// +build !linux appengine
+
+package fsnotify
+
+// WatchBudget returns the maximum number of inotify watches for this user (the
+// fs.inotify.max_user_watches sysctl) and how many are currently used by all
+// processes of this user, so that an application can check if there are enough
+// watches left before adding a large directory tree, instead of failing
+// halfway through.
+//
+// The number in use is counted from /proc, and may be too low if not all
+// processes can be read (e.g. with hidepid). On other platforms this returns 0
+// for both, meaning there is no such limit.
+func WatchBudget() (limit, used int, err error) { return 0, 0, nil }
@@ -0,0 +1,58 @@
+package fsnotify
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// bursts counts the events for every watch to send BurstStart and BurstEnd;
+// see WithBurstMarks.
+type bursts struct {
+	mu        sync.Mutex
+	threshold int // 0 if WithBurstMarks isn't used.
+	counts    map[string]int
+	active    map[string]struct{} // Watches in a burst.
+}
+
+// count counts e for the watch it's for.
+func (b *bursts) count(e Event) {
+	if b.threshold == 0 {
+		return
+	}
+	root := e.WatchRoot
+	if root == "" {
+		root = filepath.Dir(e.Name)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.counts == nil {
+		b.counts, b.active = make(map[string]int), make(map[string]struct{})
+	}
+	b.counts[root]++
+}
+
+// flush returns the BurstStart and BurstEnd events for the interval that
+// ended, sorted by path, and starts a new interval.
+func (b *bursts) flush() []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var events []Event
+	for root, n := range b.counts {
+		if _, ok := b.active[root]; !ok && n > b.threshold {
+			b.active[root] = struct{}{}
+			events = append(events, Event{Name: root, Op: BurstStart, WatchRoot: root})
+		}
+	}
+	for root := range b.active {
+		if b.counts[root] < b.threshold/2 {
+			delete(b.active, root)
+			events = append(events, Event{Name: root, Op: BurstEnd, WatchRoot: root})
+		}
+	}
+	b.counts = make(map[string]int, len(b.counts))
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
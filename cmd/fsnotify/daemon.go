@@ -0,0 +1,408 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/camille-sound4/fsnotify"
+)
+
+// Run commands when files change, as configured in a YAML file; for example:
+//
+//	rules:
+//	  - name: build
+//	    paths: [./cmd, ./internal]
+//	    recursive: true
+//	    ops: [create, write, remove, rename]
+//	    include: ["*.go"]
+//	    exclude: ["*_test.go"]
+//	    debounce: 200ms
+//	    command: go build ./...
+//	    output: build.log
+//
+// Every rule has its own watcher. The command is run with "sh -c" (or "cmd /C"
+// on Windows) once the rule had no events for the debounce time, with the
+// changed paths in $FSNOTIFY_PATHS (separated by newlines) and the rule name in
+// $FSNOTIFY_RULE. The debounce time is 100ms if it's not set. Without a command
+// the events are just printed. The events and the output of the command are
+// written to output, which can be "stdout" (the default), "stderr", or a file
+// to append to.
+func daemon(args ...string) {
+	var (
+		flags  = flag.NewFlagSet("daemon", flag.ExitOnError)
+		config = flags.String("config", "fsnotify.yaml", "config file")
+	)
+	flags.Parse(args)
+
+	data, err := os.ReadFile(*config)
+	if err != nil {
+		exit("%s", err)
+	}
+	rules, err := parseDaemonConfig(string(data))
+	if err != nil {
+		exit("%s: %s", *config, err)
+	}
+
+	for _, r := range rules {
+		err := r.start()
+		if err != nil {
+			exit("rule %q: %s", r.Name, err)
+		}
+	}
+
+	printTime("ready; running %d rules; press ^C to exit", len(rules))
+	<-make(chan struct{}) // Block forever
+}
+
+// defaultDebounce is the debounce time for rules that don't set one.
+const defaultDebounce = 100 * time.Millisecond
+
+type daemonRule struct {
+	Name      string
+	Paths     []string
+	Recursive bool
+	Ops       fsnotify.Op
+	Include   []string // Glob patterns for the filename; all files if empty.
+	Exclude   []string
+	Debounce  time.Duration
+	Command   string
+	Output    string
+
+	w   *fsnotify.Watcher
+	out io.Writer
+}
+
+// parseDaemonConfig parses the YAML config for the daemon command.
+func parseDaemonConfig(data string) ([]*daemonRule, error) {
+	doc, err := parseYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	top, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf(`expected a mapping with "rules"`)
+	}
+	list, ok := top["rules"].([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf(`"rules" must be a list with at least one rule`)
+	}
+
+	rules := make([]*daemonRule, 0, len(list))
+	for i, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("rule %d: not a mapping", i+1)
+		}
+		r, err := newDaemonRule(m)
+		if err != nil {
+			if r.Name == "" {
+				return nil, fmt.Errorf("rule %d: %w", i+1, err)
+			}
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func newDaemonRule(m map[string]interface{}) (*daemonRule, error) {
+	r := &daemonRule{Output: "stdout", Debounce: defaultDebounce}
+	for k, v := range m {
+		var err error
+		switch k {
+		default:
+			err = fmt.Errorf("unknown key %q", k)
+		case "name":
+			r.Name, err = yamlString(k, v)
+		case "paths":
+			r.Paths, err = yamlStrings(k, v)
+		case "include":
+			r.Include, err = yamlStrings(k, v)
+		case "exclude":
+			r.Exclude, err = yamlStrings(k, v)
+		case "command":
+			r.Command, err = yamlString(k, v)
+		case "output":
+			r.Output, err = yamlString(k, v)
+		case "recursive":
+			var s string
+			if s, err = yamlString(k, v); err == nil {
+				switch s {
+				case "true", "yes":
+					r.Recursive = true
+				case "false", "no":
+				default:
+					err = fmt.Errorf("%q: not a boolean: %q", k, s)
+				}
+			}
+		case "debounce":
+			var s string
+			if s, err = yamlString(k, v); err == nil {
+				r.Debounce, err = time.ParseDuration(s)
+			}
+		case "ops":
+			var ops []string
+			if ops, err = yamlStrings(k, v); err == nil {
+				r.Ops, err = parseOps(ops)
+			}
+		}
+		if err != nil {
+			return r, err
+		}
+	}
+
+	if len(r.Paths) == 0 {
+		return r, fmt.Errorf(`need at least one path in "paths"`)
+	}
+	for _, p := range append(r.Include, r.Exclude...) {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return r, fmt.Errorf("%q: %w", p, err)
+		}
+	}
+	return r, nil
+}
+
+func yamlString(k string, v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%q must be a string", k)
+	}
+	return s, nil
+}
+
+// yamlStrings accepts a single string or a list of strings.
+func yamlStrings(k string, v interface{}) ([]string, error) {
+	if s, ok := v.(string); ok {
+		return []string{s}, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%q must be a string or list of strings", k)
+	}
+	strs := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%q must be a string or list of strings", k)
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+func parseOps(ops []string) (fsnotify.Op, error) {
+	var op fsnotify.Op
+	for _, o := range ops {
+		switch strings.ToLower(o) {
+		case "create":
+			op |= fsnotify.Create
+		case "write":
+			op |= fsnotify.Write
+		case "remove":
+			op |= fsnotify.Remove
+		case "rename":
+			op |= fsnotify.Rename
+		case "chmod":
+			op |= fsnotify.Chmod
+		case "closewrite", "close_write":
+			op |= fsnotify.CloseWrite
+		case "truncate":
+			op |= fsnotify.Truncate
+		default:
+			return 0, fmt.Errorf("unknown op %q", o)
+		}
+	}
+	return op, nil
+}
+
+// start the watcher for this rule and the goroutine to handle its events.
+func (r *daemonRule) start() error {
+	switch r.Output {
+	case "stdout":
+		r.out = os.Stdout
+	case "stderr":
+		r.out = os.Stderr
+	default:
+		fp, err := os.OpenFile(r.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		r.out = fp
+	}
+
+	ops := r.Ops
+	if ops == 0 {
+		ops = fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename | fsnotify.Chmod
+	}
+	w, err := fsnotify.NewWatcherWith(fsnotify.WithOps(ops))
+	if err != nil {
+		return err
+	}
+	r.w = w
+
+	for _, p := range r.Paths {
+		if err := r.add(p); err != nil {
+			w.Close()
+			return err
+		}
+	}
+
+	go r.loop()
+	return nil
+}
+
+// add the path, and all directories in it if the rule is recursive.
+//
+// For recursive rules it first checks that there are enough inotify watches
+// left for all directories, and removes the directories it already added if
+// adding one fails, so a tree is never partially watched.
+func (r *daemonRule) add(path string) error {
+	if !r.Recursive {
+		return r.w.Add(path)
+	}
+
+	var dirs []string
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if limit, used, err := fsnotify.WatchBudget(); err == nil && limit > 0 && len(dirs) > limit-used {
+		return fmt.Errorf("%q has %d directories, but only %d of the %d inotify watches are left; "+
+			"increase the fs.inotify.max_user_watches sysctl", path, len(dirs), limit-used, limit)
+	}
+
+	watched := make(map[string]bool)
+	for _, p := range r.w.WatchList() {
+		watched[p] = true
+	}
+	for i, d := range dirs {
+		if err := r.w.Add(d); err != nil {
+			for _, added := range dirs[:i] {
+				if !watched[added] {
+					r.w.Remove(added)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// match reports if the event should be handled according to the include and
+// exclude patterns.
+func (r *daemonRule) match(name string) bool {
+	base := filepath.Base(name)
+	for _, p := range r.Exclude {
+		if ok, _ := filepath.Match(p, base); ok {
+			return false
+		}
+	}
+	if len(r.Include) == 0 {
+		return true
+	}
+	for _, p := range r.Include {
+		if ok, _ := filepath.Match(p, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *daemonRule) loop() {
+	var (
+		pending []string
+		seen    = make(map[string]bool)
+		timer   = time.NewTimer(time.Hour)
+	)
+	timer.Stop()
+
+	for {
+		select {
+		case err, ok := <-r.w.Errors:
+			if !ok {
+				return
+			}
+			r.printf("ERROR: %s", err)
+		case e, ok := <-r.w.Events:
+			if !ok {
+				return
+			}
+
+			// Watch new directories in recursive rules. This is racy: files
+			// created in the directory before it's watched are missed.
+			if r.Recursive && e.Has(fsnotify.Create) {
+				if fi, err := os.Lstat(e.Name); err == nil && fi.IsDir() {
+					if err := r.add(e.Name); err != nil {
+						r.printf("ERROR: %s", err)
+					}
+				}
+			}
+			if !r.match(e.Name) {
+				continue
+			}
+
+			r.printf("%s", e)
+			if r.Command == "" {
+				continue
+			}
+			if !seen[e.Name] {
+				seen[e.Name] = true
+				pending = append(pending, e.Name)
+			}
+			timer.Reset(r.Debounce)
+		case <-timer.C:
+			r.run(pending)
+			pending, seen = nil, make(map[string]bool)
+		}
+	}
+}
+
+var outputMu sync.Mutex
+
+func (r *daemonRule) printf(format string, a ...interface{}) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	fmt.Fprintf(r.out, "%s [%s] %s\n", time.Now().Format("15:04:05.0000"), r.Name, fmt.Sprintf(format, a...))
+}
+
+// run the command. This runs on the goroutine that reads the events, so the
+// command never runs more than once at the same time for a rule.
+func (r *daemonRule) run(paths []string) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", r.Command)
+	} else {
+		cmd = exec.Command("sh", "-c", r.Command)
+	}
+	cmd.Env = append(os.Environ(),
+		"FSNOTIFY_RULE="+r.Name,
+		"FSNOTIFY_PATHS="+strings.Join(paths, "\n"))
+	out, err := cmd.CombinedOutput()
+
+	outputMu.Lock()
+	r.out.Write(out)
+	outputMu.Unlock()
+	if err != nil {
+		r.printf("ERROR: running %q: %s", r.Command, err)
+	}
+}
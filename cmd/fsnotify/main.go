@@ -17,8 +17,17 @@ https://github.com/camille-sound4/fsnotify
 Commands:
 
     watch [paths]  Watch the paths for changes and print the events.
+                   -one-shot     Exit after the first event.
+                   -timeout 10s  Exit with status 1 if there are no events
+                                 for this long.
+                   -watch-file f Read paths or globs from f, one per line
+                                 (- for stdin); reload f on SIGHUP.
     file  [file]   Watch a single file for changes.
     dedup [paths]  Watch the paths for changes, suppressing duplicate events.
+    tui   [paths]  Show a live overview of event rates and the noisiest paths.
+    daemon         Run commands when files change, as configured in a YAML
+                   file; see daemon.go for the format.
+                   -config f     Config file; default fsnotify.yaml.
 `[1:]
 
 func exit(format string, a ...interface{}) {
@@ -61,5 +70,9 @@ func main() {
 		file(args...)
 	case "dedup":
 		dedup(args...)
+	case "tui":
+		tui(args...)
+	case "daemon":
+		daemon(args...)
 	}
 }
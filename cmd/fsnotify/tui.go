@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/camille-sound4/fsnotify"
+)
+
+// Show a live overview of the events, similar to top: the event rate per
+// directory, the paths with the most events, and the last few events. This is
+// mostly useful to find out what's generating all those events.
+//
+// This doesn't use any terminal library; the screen is redrawn every second
+// with ANSI escape codes, and the filter is read from stdin a line at a time.
+func tui(paths ...string) {
+	if len(paths) < 1 {
+		exit("must specify at least one path to watch")
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		exit("creating a new watcher: %s", err)
+	}
+	defer w.Close()
+
+	for _, p := range paths {
+		err = w.Add(p)
+		if err != nil {
+			exit("%q: %s", p, err)
+		}
+	}
+
+	// Type a filter and press Enter to only show paths containing that text;
+	// an empty line clears the filter.
+	filter := make(chan string)
+	go func() {
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			filter <- strings.TrimSpace(s.Text())
+		}
+	}()
+
+	var (
+		top    = newTUIStats()
+		ticker = time.NewTicker(time.Second)
+	)
+	defer ticker.Stop()
+	top.draw(w, paths)
+	for {
+		select {
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			top.error(err)
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			top.event(e)
+		case f := <-filter:
+			top.filter = f
+			top.draw(w, paths)
+		case <-ticker.C:
+			top.draw(w, paths)
+			top.tick()
+		}
+	}
+}
+
+type tuiStats struct {
+	filter    string
+	start     time.Time
+	total     int
+	overflows int
+	lastErr   string
+	perDir    map[string]int // Events per directory since the last tick.
+	perPath   map[string]int // Events per path since start.
+	recent    []fsnotify.Event
+}
+
+func newTUIStats() *tuiStats {
+	return &tuiStats{
+		start:   time.Now(),
+		perDir:  make(map[string]int),
+		perPath: make(map[string]int),
+	}
+}
+
+func (t *tuiStats) event(e fsnotify.Event) {
+	t.total++
+	t.perDir[filepath.Dir(e.Name)]++
+	t.perPath[e.Name]++
+
+	t.recent = append(t.recent, e)
+	if len(t.recent) > 10 {
+		t.recent = t.recent[1:]
+	}
+}
+
+func (t *tuiStats) error(err error) {
+	if errors.Is(err, fsnotify.ErrEventOverflow) {
+		t.overflows++
+	}
+	t.lastErr = time.Now().Format("15:04:05") + " " + err.Error()
+}
+
+// tick resets the per-second counters.
+func (t *tuiStats) tick() {
+	t.perDir = make(map[string]int)
+}
+
+func (t *tuiStats) match(name string) bool {
+	return t.filter == "" || strings.Contains(name, t.filter)
+}
+
+// topN returns the n keys with the highest count in m that match the filter.
+func (t *tuiStats) topN(m map[string]int, n int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if t.match(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] == m[keys[j]] {
+			return keys[i] < keys[j]
+		}
+		return m[keys[i]] > m[keys[j]]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+func (t *tuiStats) draw(w *fsnotify.Watcher, paths []string) {
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J") // Move to top left and clear screen.
+
+	st := w.Stats()
+	fmt.Fprintf(&b, "fsnotify tui — %s — up %s\n", strings.Join(paths, " "),
+		time.Since(t.start).Round(time.Second))
+	fmt.Fprintf(&b, "events: %d   watches: %d   dropped: %d   latency p99: %s",
+		t.total, st.Watches, st.Dropped, st.LatencyP99)
+	if t.overflows > 0 {
+		fmt.Fprintf(&b, "   \x1b[1;31mOVERFLOW ×%d\x1b[0m", t.overflows)
+	}
+	b.WriteString("\n")
+	if t.filter != "" {
+		fmt.Fprintf(&b, "filter: %q\n", t.filter)
+	}
+	if t.lastErr != "" {
+		fmt.Fprintf(&b, "last error: %s\n", t.lastErr)
+	}
+
+	b.WriteString("\n\x1b[1mEVENTS/S  DIRECTORY\x1b[0m\n")
+	for _, d := range t.topN(t.perDir, 10) {
+		fmt.Fprintf(&b, "%8d  %s\n", t.perDir[d], d)
+	}
+
+	b.WriteString("\n\x1b[1m  EVENTS  PATH\x1b[0m\n")
+	for _, p := range t.topN(t.perPath, 10) {
+		fmt.Fprintf(&b, "%8d  %s\n", t.perPath[p], p)
+	}
+
+	b.WriteString("\n\x1b[1mRECENT\x1b[0m\n")
+	for _, e := range t.recent {
+		if t.match(e.Name) {
+			b.WriteString(e.String() + "\n")
+		}
+	}
+
+	b.WriteString("\ntype a filter and press Enter; empty line to clear; ^C to exit\n")
+	fmt.Print(b.String())
+}
@@ -1,11 +1,35 @@
 package main
 
-import "github.com/camille-sound4/fsnotify"
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/camille-sound4/fsnotify"
+)
 
 // This is the most basic example: it prints events to the terminal as we
 // receive them.
-func watch(paths ...string) {
-	if len(paths) < 1 {
+//
+// With -one-shot it exits after the first event, and with -timeout it exits
+// with status 1 if there are no events for that long, so it can be used in
+// shell scripts to wait for a change:
+//
+//	fsnotify watch -one-shot -timeout 30s /path/to/dir || echo "nothing happened"
+//
+// With -watch-file the paths are read from a file instead, and the file is read
+// again on SIGHUP; see watchfile.go.
+func watch(args ...string) {
+	var (
+		flags     = flag.NewFlagSet("watch", flag.ExitOnError)
+		oneShot   = flags.Bool("one-shot", false, "exit with status 0 after the first event")
+		timeout   = flags.Duration("timeout", 0, "exit with status 1 if there are no events for this long")
+		watchFile = flags.String("watch-file", "", "read paths from this file (- for stdin), and reload on SIGHUP")
+	)
+	flags.Parse(args)
+	paths := flags.Args()
+	if len(paths) < 1 && *watchFile == "" {
 		exit("must specify at least one path to watch")
 	}
 
@@ -16,9 +40,6 @@ func watch(paths ...string) {
 	}
 	defer w.Close()
 
-	// Start listening for events.
-	go watchLoop(w)
-
 	// Add all paths from the commandline.
 	for _, p := range paths {
 		err = w.Add(p)
@@ -26,12 +47,30 @@ func watch(paths ...string) {
 			exit("%q: %s", p, err)
 		}
 	}
+	if *watchFile != "" {
+		err := watchList(w, *watchFile)
+		if err != nil {
+			exit("%s", err)
+		}
+	}
 
-	printTime("ready; press ^C to exit")
-	<-make(chan struct{}) // Block forever
+	if !*oneShot {
+		printTime("ready; press ^C to exit")
+	}
+	watchLoop(w, *oneShot, *timeout)
 }
 
-func watchLoop(w *fsnotify.Watcher) {
+func watchLoop(w *fsnotify.Watcher, oneShot bool, timeout time.Duration) {
+	// A nil channel blocks forever, so there's no timeout if it's not set.
+	var (
+		timer   *time.Timer
+		expired <-chan time.Time
+	)
+	if timeout > 0 {
+		timer = time.NewTimer(timeout)
+		expired = timer.C
+	}
+
 	i := 0
 	for {
 		select {
@@ -47,10 +86,27 @@ func watchLoop(w *fsnotify.Watcher) {
 				return
 			}
 
+			if oneShot {
+				fmt.Println(e)
+				return
+			}
+
 			// Just print the event nicely aligned, and keep track how many
 			// events we've seen.
 			i++
 			printTime("%3d %s", i, e)
+
+			// Restart the timeout, so it's the time without events.
+			if timer != nil {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(timeout)
+			}
+		case <-expired:
+			fmt.Fprintf(os.Stderr, "no events in %s\n", timeout)
+			w.Close()
+			os.Exit(1)
 		}
 	}
 }
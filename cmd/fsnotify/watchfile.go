@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/camille-sound4/fsnotify"
+)
+
+// watchList adds the paths listed in the file, one path or glob pattern per
+// line; empty lines and lines starting with # are ignored. The file is read
+// again on SIGHUP: paths that were removed from the list are removed from the
+// watcher, and new paths are added. This way the paths can be managed by other
+// tools without having to restart.
+//
+// If the file is "-" the list is read from stdin once; there is no way to read
+// it again.
+func watchList(w *fsnotify.Watcher, file string) error {
+	var (
+		mu      sync.Mutex
+		watched = make(map[string]struct{})
+	)
+	load := func() error {
+		paths, err := readWatchList(file)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for p := range watched {
+			if _, ok := paths[p]; !ok {
+				w.Remove(p)
+				delete(watched, p)
+				printTime("removed %q", p)
+			}
+		}
+		for p := range paths {
+			if _, ok := watched[p]; ok {
+				continue
+			}
+			err := w.Add(p)
+			if err != nil {
+				// Don't exit on reload, as it may be something transient
+				// like a directory that doesn't exist yet.
+				printTime("ERROR: %q: %s", p, err)
+				continue
+			}
+			watched[p] = struct{}{}
+		}
+		return nil
+	}
+
+	if err := load(); err != nil {
+		return err
+	}
+	if file == "-" {
+		return nil
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			printTime("reloading %q", file)
+			if err := load(); err != nil {
+				printTime("ERROR: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// readWatchList reads the list of paths from file, expanding any glob patterns.
+func readWatchList(file string) (map[string]struct{}, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		fp, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		r = fp
+	}
+
+	paths := make(map[string]struct{})
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		matches, err := filepath.Glob(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q: %w", file, line, err)
+		}
+		// Keep paths without a match, so that Add reports the error.
+		if len(matches) == 0 {
+			matches = []string{line}
+		}
+		for _, m := range matches {
+			paths[filepath.Clean(m)] = struct{}{}
+		}
+	}
+	return paths, s.Err()
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the small subset of YAML that's needed for the daemon
+// config, so that the module doesn't need a dependency on a YAML library:
+// block mappings and sequences, flow sequences of scalars ("[a, b]"), plain and
+// quoted scalars, and comments. Anchors, multi-line strings, flow mappings, and
+// multiple documents aren't supported.
+//
+// Mappings are returned as map[string]interface{}, sequences as
+// []interface{}, and scalars as string.
+func parseYAML(data string) (interface{}, error) {
+	var p yamlParser
+	for i, l := range strings.Split(data, "\n") {
+		l = stripComment(strings.TrimRight(l, " \t\r"))
+		content := strings.TrimLeft(l, " ")
+		if content == "" || content == "---" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(l) - len(content), content: content})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+
+	v, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return v, nil
+}
+
+type (
+	yamlParser struct {
+		lines []yamlLine
+		pos   int
+	}
+	yamlLine struct {
+		num     int
+		indent  int
+		content string
+	}
+)
+
+func (p *yamlParser) errorf(format string, a ...interface{}) error {
+	l := p.lines[len(p.lines)-1]
+	if p.pos < len(p.lines) {
+		l = p.lines[p.pos]
+	}
+	return fmt.Errorf("line %d: "+format, append([]interface{}{l.num}, a...)...)
+}
+
+func isSeqItem(s string) bool { return s == "-" || strings.HasPrefix(s, "- ") }
+
+// block parses a mapping or sequence at indent.
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if isSeqItem(p.lines[p.pos].content) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) ([]interface{}, error) {
+	var seq []interface{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isSeqItem(p.lines[p.pos].content) {
+		l := p.lines[p.pos]
+		rest := strings.TrimLeft(l.content[1:], " ")
+		switch {
+		case rest == "":
+			p.pos++
+			v, err := p.nested(indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		case isSeqItem(rest) || isMapItem(rest):
+			// "- key: value" starts a mapping; continue parsing it as if
+			// "key: value" was on its own line.
+			p.lines[p.pos] = yamlLine{num: l.num, indent: l.indent + len(l.content) - len(rest), content: rest}
+			v, err := p.block(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		default:
+			v, err := scalar(rest)
+			if err != nil {
+				return nil, p.errorf("%s", err)
+			}
+			p.pos++
+			seq = append(seq, v)
+		}
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		l := p.lines[p.pos]
+		if isSeqItem(l.content) {
+			return nil, p.errorf("unexpected sequence item")
+		}
+		if !isMapItem(l.content) {
+			return nil, p.errorf("expected \"key: value\"")
+		}
+		key, val := splitMapItem(l.content)
+		if _, ok := m[key]; ok {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+
+		if val != "" {
+			v, err := scalar(val)
+			if err != nil {
+				return nil, p.errorf("%s", err)
+			}
+			m[key] = v
+			p.pos++
+			continue
+		}
+
+		p.pos++
+		// A sequence can be at the same indentation as the key.
+		if p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isSeqItem(p.lines[p.pos].content) {
+			v, err := p.sequence(indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+			continue
+		}
+		v, err := p.nested(indent)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// nested parses the block after a key or "-" without value, which must be
+// indented more than indent; it returns nil if there is no such block.
+func (p *yamlParser) nested(indent int) (interface{}, error) {
+	if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+		return nil, nil
+	}
+	return p.block(p.lines[p.pos].indent)
+}
+
+func isMapItem(s string) bool {
+	if strings.HasPrefix(s, `"`) || strings.HasPrefix(s, `'`) || strings.HasPrefix(s, "[") {
+		return false
+	}
+	return strings.HasSuffix(s, ":") || strings.Contains(s, ": ")
+}
+
+func splitMapItem(s string) (string, string) {
+	if i := strings.Index(s, ": "); i > -1 {
+		return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+2:])
+	}
+	return strings.TrimSpace(strings.TrimSuffix(s, ":")), ""
+}
+
+// scalar parses a plain or quoted scalar, or a flow sequence of scalars.
+func scalar(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated flow sequence: %s", s)
+		}
+		seq := []interface{}{}
+		s = strings.TrimSpace(s[1 : len(s)-1])
+		if s == "" {
+			return seq, nil
+		}
+		for _, f := range splitFlow(s) {
+			v, err := scalar(strings.TrimSpace(f))
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := v.(string); !ok {
+				return nil, fmt.Errorf("nested flow sequences aren't supported: %s", s)
+			}
+			seq = append(seq, v)
+		}
+		return seq, nil
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted string: %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, `'`):
+		if len(s) < 2 || !strings.HasSuffix(s, `'`) {
+			return nil, fmt.Errorf("invalid quoted string: %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], `''`, `'`), nil
+	default:
+		return s, nil
+	}
+}
+
+// splitFlow splits the items of a flow sequence on commas outside quotes.
+func splitFlow(s string) []string {
+	var (
+		items []string
+		quote byte
+		start int
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			switch {
+			case quote == '"' && c == '\\':
+				i++ // Skip the escaped character.
+			case quote == '\'' && c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+				i++ // '' is an escaped quote.
+			case c == quote:
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// startsScalar reports if a scalar starts after the text before; quotes in
+// the middle of a plain scalar (e.g. "don't") don't start a quoted string.
+func startsScalar(before string) bool {
+	before = strings.TrimRight(before, " ")
+	return before == "" || strings.HasSuffix(before, ":") || strings.HasSuffix(before, "-") ||
+		strings.HasSuffix(before, "[") || strings.HasSuffix(before, ",")
+}
+
+// stripComment removes a "# comment" from the line, if it's not in a quoted
+// string.
+func stripComment(l string) string {
+	var quote byte
+	for i := 0; i < len(l); i++ {
+		switch c := l[i]; {
+		case quote != 0:
+			switch {
+			case quote == '"' && c == '\\':
+				i++ // Skip the escaped character.
+			case quote == '\'' && c == '\'' && i+1 < len(l) && l[i+1] == '\'':
+				i++ // '' is an escaped quote.
+			case c == quote:
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && startsScalar(l[:i]):
+			quote = c
+		case c == '#' && (i == 0 || l[i-1] == ' ' || l[i-1] == '\t'):
+			return strings.TrimRight(l[:i], " \t")
+		}
+	}
+	return l
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/camille-sound4/fsnotify"
+)
+
+func TestParseYAML(t *testing.T) {
+	type (
+		m = map[string]interface{}
+		s = []interface{}
+	)
+	tests := []struct {
+		name    string
+		in      string
+		want    interface{}
+		wantErr string
+	}{
+		{"empty", "", nil, ""},
+		{"only comments", "# comment\n---\n", nil, ""},
+		{"mapping", "a: 1\nb: two", m{"a": "1", "b": "two"}, ""},
+		{"nested mapping", "a:\n  b:\n    c: d\n  e: f", m{"a": m{"b": m{"c": "d"}, "e": "f"}}, ""},
+		{"sequence", "- a\n- b", s{"a", "b"}, ""},
+		{"sequence under key", "k:\n  - a\n  - b", m{"k": s{"a", "b"}}, ""},
+		{"sequence at key indent", "k:\n- a\n- b\nl: c", m{"k": s{"a", "b"}, "l": "c"}, ""},
+		{"nested sequences", "- - a\n  - b\n- -\n    - c\n- d",
+			s{s{"a", "b"}, s{s{"c"}}, "d"}, ""},
+		{"key item", "rules:\n  - name: a\n    paths: [x, y]\n  - name: b\n    debounce: 1s",
+			m{"rules": s{m{"name": "a", "paths": s{"x", "y"}}, m{"name": "b", "debounce": "1s"}}}, ""},
+		{"key item with block", "- k:\n    - a\n  l: b", s{m{"k": s{"a"}, "l": "b"}}, ""},
+		{"empty item", "-\n- a", s{nil, "a"}, ""},
+		{"empty value", "a:\nb: c", m{"a": nil, "b": "c"}, ""},
+		{"flow sequence", `k: [a, "b, c", 'd']`, m{"k": s{"a", "b, c", "d"}}, ""},
+		{"empty flow sequence", "k: []", m{"k": s{}}, ""},
+
+		{"double quotes", `k: "a: b # c\t"`, m{"k": "a: b # c\t"}, ""},
+		{"single quotes", `k: 'it''s # x'`, m{"k": "it's # x"}, ""},
+		{"escaped double quote", `k: "a\" # b"`, m{"k": `a" # b`}, ""},
+		{"escaped quotes in flow", `k: ['a'', b', "c\", d"]`, m{"k": s{"a', b", `c", d`}}, ""},
+		{"quote in plain scalar", `k: don't # comment`, m{"k": "don't"}, ""},
+		{"quoted item", `- "a"`, s{"a"}, ""},
+		{"comment", "# c\nk: v # comment\n  # indented comment\nl: w", m{"k": "v", "l": "w"}, ""},
+		{"hash in value", "k: a#b", m{"k": "a#b"}, ""},
+		{"trailing whitespace", "k: v \t\r\n", m{"k": "v"}, ""},
+
+		{"tab indent", "k:\n\tl: v", nil, "line 2: tabs can't be used for indentation"},
+		{"tab after spaces", "k:\n  \tl: v", nil, "line 2: tabs can't be used for indentation"},
+		{"duplicate key", "a: 1\nb: 2\na: 3", nil, `line 3: duplicate key "a"`},
+		{"duplicate nested key", "a:\n  b: 1\n  b: 2", nil, `line 3: duplicate key "b"`},
+		{"bad indent", "a:\n    b: 1\n  c: 2", nil, "line 3: unexpected indentation"},
+		{"sequence in mapping", "a: 1\n- b", nil, "line 2: unexpected sequence item"},
+		{"not a key", "a: 1\nb", nil, `line 2: expected "key: value"`},
+		{"bad double quotes", `k: "a`, nil, "line 1: invalid quoted string"},
+		{"bad single quotes", `k: 'a`, nil, "line 1: invalid quoted string"},
+		{"unterminated flow", `k: [a, b`, nil, "line 1: unterminated flow sequence"},
+		{"nested flow", `k: [[a]]`, nil, "line 1: nested flow sequences"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			have, err := parseYAML(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("\nhave: %#v\nwant: %#v", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDaemonConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []*daemonRule
+		wantErr string
+	}{
+		{"defaults", "rules:\n  - paths: dir", []*daemonRule{{
+			Name: "rule1", Paths: []string{"dir"}, Debounce: defaultDebounce, Output: "stdout",
+		}}, ""},
+		{"all keys", `
+rules:
+  - name: build      # Comment.
+    paths: [./cmd, "./internal"]
+    recursive: yes
+    ops: [create, write]
+    include: ["*.go"]
+    exclude:
+      - "*_test.go"
+      - '*.pb.go'
+    debounce: 0s
+    command: go build ./...
+    output: build.log
+  - paths:
+    - a
+    - b
+`, []*daemonRule{{
+			Name: "build", Paths: []string{"./cmd", "./internal"}, Recursive: true,
+			Ops:     fsnotify.Create | fsnotify.Write,
+			Include: []string{"*.go"}, Exclude: []string{"*_test.go", "*.pb.go"},
+			Command: "go build ./...", Output: "build.log",
+		}, {
+			Name: "rule2", Paths: []string{"a", "b"}, Debounce: defaultDebounce, Output: "stdout",
+		}}, ""},
+
+		{"no rules", "other: 1", nil, `"rules" must be a list`},
+		{"empty rules", "rules: []", nil, `"rules" must be a list`},
+		{"not a mapping", "- a", nil, `expected a mapping with "rules"`},
+		{"rule not a mapping", "rules:\n  - a", nil, "rule 1: not a mapping"},
+		{"no paths", "rules:\n  - name: x", nil, `rule "x": need at least one path`},
+		{"unknown key", "rules:\n  - paths: a\n    foo: bar", nil, `rule 1: unknown key "foo"`},
+		{"bad debounce", "rules:\n  - paths: a\n    debounce: soon", nil, "rule 1: time: invalid duration"},
+		{"bad boolean", "rules:\n  - paths: a\n    recursive: maybe", nil, `rule 1: "recursive": not a boolean`},
+		{"bad pattern", "rules:\n  - paths: a\n    include: ['[']", nil, `rule 1: "[": syntax error`},
+		{"duplicate key", "rules:\n  - paths: a\n    paths: b", nil, `line 3: duplicate key "paths"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			have, err := parseDaemonConfig(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("\nhave: %s\nwant: %s", fmtRules(have), fmtRules(tt.want))
+			}
+		})
+	}
+}
+
+func fmtRules(rules []*daemonRule) string {
+	var b strings.Builder
+	for _, r := range rules {
+		fmt.Fprintf(&b, "%+v\n", *r)
+	}
+	return b.String()
+}
+
+func TestDaemonPrintf(t *testing.T) {
+	var buf bytes.Buffer
+	r := &daemonRule{Name: "100%", out: &buf}
+	r.printf("x=%d", 1)
+	if have := buf.String(); !strings.HasSuffix(have, " [100%] x=1\n") {
+		t.Errorf("wrong output: %q", have)
+	}
+}
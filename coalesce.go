@@ -0,0 +1,94 @@
+package fsnotify
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// coalescer coalesces the events for paths with a lot of events; see
+// WithCoalesceHot.
+type coalescer struct {
+	mu        sync.Mutex
+	threshold int // 0 if WithCoalesceHot isn't used.
+	counts    map[string]int
+	hot       map[string]*Event // Coalesced event to send for hot paths.
+}
+
+// absorb reports if e is for a hot path and was added to its coalesced event,
+// rather than being sent.
+func (c *coalescer) absorb(e Event) bool {
+	if c.threshold == 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts, c.hot = make(map[string]int), make(map[string]*Event)
+	}
+	c.counts[e.Name]++
+
+	h, ok := c.hot[e.Name]
+	if !ok {
+		if c.counts[e.Name] <= c.threshold {
+			return false
+		}
+		h = &Event{Name: e.Name, WatchRoot: e.WatchRoot, Device: e.Device}
+		c.hot[e.Name] = h
+	}
+	h.Op |= e.Op
+	h.Coalesced++
+	return true
+}
+
+// flush returns the coalesced events since the previous call, sorted by path,
+// and starts a new interval. Paths that had no more than the threshold of
+// events in the interval that ended are no longer hot.
+func (c *coalescer) flush() []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var events []Event
+	for name, h := range c.hot {
+		if h.Coalesced > 0 {
+			events = append(events, *h)
+		}
+		if c.counts[name] <= c.threshold {
+			delete(c.hot, name)
+		} else {
+			h.Op, h.Coalesced = 0, 0
+		}
+	}
+	c.counts = make(map[string]int, len(c.counts))
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
+
+// sendEvery sends the events returned by flush every interval until the
+// watcher is closed; see WithCoalesceHot, WithSummaries, and WithBurstMarks.
+func (w *Watcher) sendEvery(interval time.Duration, flush func() []Event) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.Done():
+			return
+		case <-t.C:
+		}
+
+		events := flush()
+		if len(events) == 0 {
+			continue
+		}
+		if !w.replays.start() {
+			return
+		}
+		for _, e := range events {
+			if w.replay(e) != nil {
+				break
+			}
+		}
+		w.replays.wg.Done()
+	}
+}
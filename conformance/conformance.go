@@ -0,0 +1,409 @@
+// Package conformance tests that a watcher implements the behaviour documented
+// by fsnotify, so that the built-in backends and other implementations of the
+// same API are held to the same standard.
+//
+// fsnotify has no way to register a backend; an implementation is anything
+// that satisfies the Watcher interface below, described by a Backend:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, conformance.Backend{
+//			Name: "mywatcher",
+//			New: func() (conformance.Watcher, error) {
+//				return mywatcher.New()
+//			},
+//			Caps: conformance.Chmod,
+//		})
+//	}
+//
+// Use Default to test the fsnotify.Watcher for the current platform.
+//
+// Backends can send more events than a case expects (for example a Write after
+// a Create); a case only fails if one of the expected events is missing or out
+// of order. Cases for behaviour that not every backend supports only run if
+// the Backend has the Capability for it.
+package conformance
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/camille-sound4/fsnotify"
+)
+
+// Watcher is the API that is tested.
+type Watcher interface {
+	Add(name string) error
+	Remove(name string) error
+	Close() error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+}
+
+// Capability is behaviour that only some backends support.
+type Capability uint
+
+const (
+	// Adding "dir/..." watches dir and all directories in it.
+	Recursive Capability = 1 << iota
+
+	// A rename in a watched directory sets Event.RenamedFrom on the Create
+	// for the new name.
+	RenamePairing
+
+	// Changing the permissions of a watched file sends a Chmod event.
+	Chmod
+)
+
+func (c Capability) String() string {
+	var b strings.Builder
+	for _, n := range []struct {
+		c    Capability
+		name string
+	}{{Recursive, "Recursive"}, {RenamePairing, "RenamePairing"}, {Chmod, "Chmod"}} {
+		if c&n.c != 0 {
+			b.WriteString("|" + n.name)
+		}
+	}
+	if b.Len() == 0 {
+		return "0"
+	}
+	return b.String()[1:]
+}
+
+// Backend is a watcher implementation to test.
+type Backend struct {
+	Name string
+	New  func() (Watcher, error) // Create a new watcher for every case.
+	Caps Capability
+}
+
+// Default returns the Backend for fsnotify.Watcher on the current platform.
+func Default() Backend {
+	var caps Capability
+	switch runtime.GOOS {
+	case "linux":
+		caps = RenamePairing | Chmod
+	case "windows":
+		caps = RenamePairing
+	default: // kqueue and FEN.
+		caps = Chmod
+	}
+	return Backend{
+		Name: runtime.GOOS,
+		New: func() (Watcher, error) {
+			w, err := fsnotify.NewWatcher()
+			if err != nil {
+				return nil, err
+			}
+			return Wrap(w), nil
+		},
+		Caps: caps,
+	}
+}
+
+// Wrap returns a Watcher for an fsnotify.Watcher.
+func Wrap(w *fsnotify.Watcher) Watcher { return wrapped{w} }
+
+type wrapped struct{ w *fsnotify.Watcher }
+
+func (w wrapped) Add(name string) error         { return w.w.Add(name) }
+func (w wrapped) Remove(name string) error      { return w.w.Remove(name) }
+func (w wrapped) Close() error                  { return w.w.Close() }
+func (w wrapped) Events() <-chan fsnotify.Event { return w.w.Events }
+func (w wrapped) Errors() <-chan error          { return w.w.Errors }
+
+// Case is a single conformance test.
+type Case struct {
+	Name string
+	Need Capability // Skipped if the backend doesn't have all of these.
+
+	// Run the operations in dir, a new temporary directory.
+	Ops func(t *testing.T, w Watcher, dir string)
+
+	// Events that must be sent, in this order. Names are relative to dir. Op is
+	// compared with Has(), and RenamedFrom only if it's set.
+	Want []fsnotify.Event
+}
+
+// Cases are the cases that Run runs.
+var Cases = []Case{
+	{
+		Name: "create",
+		Ops: func(t *testing.T, w Watcher, dir string) {
+			add(t, w, dir)
+			write(t, dir, "file", "")
+		},
+		Want: []fsnotify.Event{{Name: "file", Op: fsnotify.Create}},
+	},
+	{
+		Name: "write",
+		Ops: func(t *testing.T, w Watcher, dir string) {
+			write(t, dir, "file", "")
+			add(t, w, dir)
+			write(t, dir, "file", "data")
+		},
+		Want: []fsnotify.Event{{Name: "file", Op: fsnotify.Write}},
+	},
+	{
+		Name: "remove",
+		Ops: func(t *testing.T, w Watcher, dir string) {
+			write(t, dir, "file", "")
+			add(t, w, dir)
+			remove(t, dir, "file")
+		},
+		Want: []fsnotify.Event{{Name: "file", Op: fsnotify.Remove}},
+	},
+	{
+		Name: "remove watched file",
+		Ops: func(t *testing.T, w Watcher, dir string) {
+			write(t, dir, "file", "")
+			add(t, w, filepath.Join(dir, "file"))
+			remove(t, dir, "file")
+		},
+		Want: []fsnotify.Event{{Name: "file", Op: fsnotify.Remove}},
+	},
+	{
+		Name: "rename",
+		Ops: func(t *testing.T, w Watcher, dir string) {
+			write(t, dir, "file", "")
+			add(t, w, dir)
+			rename(t, dir, "file", "renamed")
+		},
+		Want: []fsnotify.Event{
+			{Name: "file", Op: fsnotify.Rename},
+			{Name: "renamed", Op: fsnotify.Create},
+		},
+	},
+	{
+		Name: "rename pairing",
+		Need: RenamePairing,
+		Ops: func(t *testing.T, w Watcher, dir string) {
+			write(t, dir, "file", "")
+			add(t, w, dir)
+			rename(t, dir, "file", "renamed")
+		},
+		Want: []fsnotify.Event{{Name: "renamed", Op: fsnotify.Create, RenamedFrom: "file"}},
+	},
+	{
+		Name: "chmod",
+		Need: Chmod,
+		Ops: func(t *testing.T, w Watcher, dir string) {
+			write(t, dir, "file", "")
+			add(t, w, dir)
+			if err := os.Chmod(filepath.Join(dir, "file"), 0o700); err != nil {
+				t.Fatal(err)
+			}
+		},
+		Want: []fsnotify.Event{{Name: "file", Op: fsnotify.Chmod}},
+	},
+	{
+		Name: "recursive",
+		Need: Recursive,
+		Ops: func(t *testing.T, w Watcher, dir string) {
+			if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			add(t, w, filepath.Join(dir, "..."))
+			write(t, dir, "a/b/file", "")
+		},
+		Want: []fsnotify.Event{{Name: "a/b/file", Op: fsnotify.Create}},
+	},
+	{
+		Name: "recursive new directory",
+		Need: Recursive,
+		Ops: func(t *testing.T, w Watcher, dir string) {
+			add(t, w, filepath.Join(dir, "..."))
+			if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(50 * time.Millisecond) // Give the watcher time to add it.
+			write(t, dir, "sub/file", "")
+		},
+		Want: []fsnotify.Event{
+			{Name: "sub", Op: fsnotify.Create},
+			{Name: "sub/file", Op: fsnotify.Create},
+		},
+	},
+}
+
+// Run all Cases and the error handling tests against the backend.
+func Run(t *testing.T, b Backend) {
+	t.Helper()
+	t.Logf("backend %s with capabilities %s", b.Name, b.Caps)
+
+	for _, c := range Cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			if b.Caps&c.Need != c.Need {
+				t.Skipf("needs %s", c.Need&^b.Caps)
+			}
+			runCase(t, b, c)
+		})
+	}
+
+	t.Run("add nonexistent", func(t *testing.T) {
+		w := newWatcher(t, b)
+		defer w.Close()
+		err := w.Add(filepath.Join(t.TempDir(), "nonexistent"))
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("wrong error: %v; want one that wraps fs.ErrNotExist", err)
+		}
+	})
+	t.Run("remove not watched", func(t *testing.T) {
+		w := newWatcher(t, b)
+		defer w.Close()
+		err := w.Remove(t.TempDir())
+		if !errors.Is(err, fsnotify.ErrNonExistentWatch) {
+			t.Errorf("wrong error: %v; want one that wraps fsnotify.ErrNonExistentWatch", err)
+		}
+	})
+	t.Run("close", func(t *testing.T) {
+		w := newWatcher(t, b)
+		add(t, w, t.TempDir())
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for _, ch := range []func() bool{
+			func() bool { _, ok := <-w.Events(); return ok },
+			func() bool { _, ok := <-w.Errors(); return ok },
+		} {
+			done := make(chan bool)
+			go func() { done <- ch() }()
+			select {
+			case ok := <-done:
+				if ok {
+					t.Error("received a value after Close; want closed channels")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("channel not closed 5 seconds after Close")
+			}
+		}
+		if err := w.Add(t.TempDir()); !errors.Is(err, fsnotify.ErrClosed) {
+			t.Errorf("wrong error from Add after Close: %v; want fsnotify.ErrClosed", err)
+		}
+	})
+}
+
+func runCase(t *testing.T, b Backend, c Case) {
+	var (
+		dir  = t.TempDir()
+		w    = newWatcher(t, b)
+		done = make(chan []fsnotify.Event)
+	)
+	go func() {
+		var have []fsnotify.Event
+		for {
+			select {
+			case err, ok := <-w.Errors():
+				if !ok {
+					done <- have
+					return
+				}
+				t.Errorf("error from watcher: %s", err)
+			case e, ok := <-w.Events():
+				if !ok {
+					done <- have
+					return
+				}
+				have = append(have, e)
+			}
+		}
+	}()
+
+	c.Ops(t, w, dir)
+	// There's no way to know when all events are sent; this is what the
+	// fsnotify tests use, too.
+	time.Sleep(500 * time.Millisecond)
+	if err := w.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+	have := <-done
+
+	missing, ok := match(dir, have, c.Want)
+	if !ok {
+		var b strings.Builder
+		for _, e := range have {
+			b.WriteString("\n\t" + e.String())
+		}
+		t.Errorf("event %s %q not sent (RenamedFrom %q); have:%s",
+			missing.Op, missing.Name, missing.RenamedFrom, b.String())
+	}
+}
+
+// match reports if all events in want are in have, in the same order.
+// Otherwise it returns the first one that isn't.
+func match(dir string, have, want []fsnotify.Event) (fsnotify.Event, bool) {
+	rel := func(p string) string {
+		if r, err := filepath.Rel(dir, p); err == nil {
+			return filepath.ToSlash(r)
+		}
+		return p
+	}
+
+	i := 0
+	for _, w := range want {
+		for ; i < len(have); i++ {
+			h := have[i]
+			if rel(h.Name) == w.Name && h.Has(w.Op) &&
+				(w.RenamedFrom == "" || rel(h.RenamedFrom) == w.RenamedFrom) {
+				break
+			}
+		}
+		if i == len(have) {
+			return w, false
+		}
+		i++
+	}
+	return fsnotify.Event{}, true
+}
+
+func newWatcher(t *testing.T, b Backend) Watcher {
+	t.Helper()
+	w, err := b.New()
+	if err != nil {
+		t.Fatalf("creating %s watcher: %s", b.Name, err)
+	}
+	return w
+}
+
+func add(t *testing.T, w Watcher, path string) {
+	t.Helper()
+	if err := w.Add(path); err != nil {
+		t.Fatalf("Add(%q): %s", path, err)
+	}
+}
+
+// Sleep a bit after every operation, so that the backends that do some work in
+// the background to pick up changes (such as kqueue reading the directory to
+// find new files) don't see several operations at once.
+const opDelay = 50 * time.Millisecond
+
+func write(t *testing.T, dir, name, data string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(opDelay)
+}
+
+func remove(t *testing.T, dir, name string) {
+	t.Helper()
+	if err := os.Remove(filepath.Join(dir, name)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(opDelay)
+}
+
+func rename(t *testing.T, dir, from, to string) {
+	t.Helper()
+	if err := os.Rename(filepath.Join(dir, from), filepath.Join(dir, to)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(opDelay)
+}
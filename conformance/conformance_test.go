@@ -0,0 +1,11 @@
+package conformance_test
+
+import (
+	"testing"
+
+	"github.com/camille-sound4/fsnotify/conformance"
+)
+
+func TestDefault(t *testing.T) {
+	conformance.Run(t, conformance.Default())
+}
@@ -0,0 +1,118 @@
+//go:build windows
+// +build windows
+
+package fsnotify
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// How long a file must be without events before it's probed, and how often
+// files that are still open are probed again; see WithCopyCompleteDetection.
+const copyProbeInterval = 250 * time.Millisecond
+
+// openWrite is a file that had a Create or Write, and may still be open.
+type openWrite struct {
+	watch *watch
+	last  time.Time // Time of the last event.
+}
+
+// trackWrite records that the file name in watch was created or written to, or
+// forgets it if it was removed or renamed away.
+//
+// Must run within the I/O thread.
+func (w *Watcher) trackWrite(watch *watch, name, fullname string, action uint32) {
+	switch action {
+	case windows.FILE_ACTION_REMOVED, windows.FILE_ACTION_RENAMED_OLD_NAME:
+		delete(w.writing, fullname)
+		return
+	case windows.FILE_ACTION_ADDED, windows.FILE_ACTION_MODIFIED, windows.FILE_ACTION_RENAMED_NEW_NAME:
+	default:
+		return
+	}
+	if watch.mask == 0 && watch.names[name] == 0 {
+		return
+	}
+
+	if w.writing == nil {
+		w.writing = make(map[string]openWrite)
+	}
+	w.writing[fullname] = openWrite{watch: watch, last: time.Now()}
+	w.scheduleProbe()
+}
+
+// scheduleProbe schedules probeWrites, unless it's already scheduled or there
+// is nothing to probe.
+//
+// Must run within the I/O thread.
+func (w *Watcher) scheduleProbe() {
+	if w.probing || len(w.writing) == 0 {
+		return
+	}
+	w.probing = true
+	time.AfterFunc(copyProbeInterval, func() {
+		if w.isClosed() {
+			return
+		}
+		w.input <- &input{op: opProbeWrites}
+		w.wakeupReader()
+	})
+}
+
+// probeWrites sends CloseWrite for the files that no other process has open.
+//
+// Must run within the I/O thread.
+func (w *Watcher) probeWrites() {
+	w.probing = false
+	now := time.Now()
+	for fullname, f := range w.writing {
+		if f.watch.mask == 0 && f.watch.names[filepath.Base(fullname)] == 0 { // Watch was removed.
+			delete(w.writing, fullname)
+			continue
+		}
+		if now.Sub(f.last) < copyProbeInterval {
+			continue
+		}
+
+		switch err := probeExclusive(fullname, f.watch.hydrate); err {
+		case nil:
+			delete(w.writing, fullname)
+			root := f.watch.path
+			if f.watch.mask == 0 {
+				root = fullname
+			}
+			w.sendRenameEvent(f.watch, fullname, "", root, sysFSCLOSEWRITE, false)
+		case windows.ERROR_SHARING_VIOLATION, windows.ERROR_LOCK_VIOLATION:
+			// Still open; try again later.
+		default:
+			// Removed, a directory, or we can't read it: nothing we can do.
+			delete(w.writing, fullname)
+		}
+	}
+	w.scheduleProbe()
+}
+
+// probeExclusive opens path without sharing, and closes it right away. This
+// returns ERROR_SHARING_VIOLATION if another process has the file open.
+func probeExclusive(path string, hydrate bool) error {
+	flags := uint32(windows.FILE_ATTRIBUTE_NORMAL)
+	if !hydrate {
+		flags |= windows.FILE_FLAG_OPEN_NO_RECALL
+	}
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	h, err := windows.CreateFile(p, windows.GENERIC_READ, 0, nil, windows.OPEN_EXISTING, flags, 0)
+	if err != nil {
+		return err
+	}
+	if err := windows.CloseHandle(h); err != nil {
+		return os.NewSyscallError("CloseHandle", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package fsnotify
+
+import (
+	"sync"
+	"time"
+)
+
+// dedup drops events that are identical to the previous event for the same
+// path; see WithDedup.
+type dedup struct {
+	mu      sync.Mutex
+	window  time.Duration // 0 if WithDedup isn't used.
+	last    map[string]dedupEvent
+	pruned  time.Time
+	dropped int
+	queue   *queueStats // To count the dropped events for the watch.
+
+	// The previous event from the current read of the kernel buffer; see
+	// WithMergeOverlapping. Only used on the goroutine reading the events.
+	merge bool
+	prev  Event
+}
+
+type dedupEvent struct {
+	op Op
+	at time.Time
+}
+
+// drop reports if e should be dropped.
+func (d *dedup) drop(e Event) bool {
+	if d.window == 0 {
+		return false
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.last == nil {
+		d.last = make(map[string]dedupEvent)
+	}
+
+	if l, ok := d.last[e.Name]; ok && l.op == e.Op && now.Sub(l.at) < d.window {
+		d.dropped++
+		d.queue.lose(e)
+		return true
+	}
+	d.last[e.Name] = dedupEvent{op: e.Op, at: now}
+
+	// Forget about paths that are outside the window, so this doesn't keep
+	// growing.
+	if now.Sub(d.pruned) >= d.window {
+		for name, l := range d.last {
+			if now.Sub(l.at) >= d.window {
+				delete(d.last, name)
+			}
+		}
+		d.pruned = now
+	}
+	return false
+}
+
+// overlap reports if e is the same event as the previous event from the same
+// read, but for a different watch; see WithMergeOverlapping. The kernel sends
+// these right after each other.
+func (d *dedup) overlap(e Event) bool {
+	if !d.merge {
+		return false
+	}
+	if d.prev.Name == e.Name && d.prev.Op == e.Op && d.prev.WatchRoot != e.WatchRoot {
+		d.mu.Lock()
+		d.dropped++
+		d.mu.Unlock()
+		return true
+	}
+	d.prev = e
+	return false
+}
+
+// reset forgets the previous event; this is called for every read from the
+// kernel.
+func (d *dedup) reset() { d.prev = Event{} }
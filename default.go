@@ -0,0 +1,182 @@
+package fsnotify
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// The watcher used by the package-level Add and Unwatch; it's created on the
+// first Add, and closed when the last channel is removed.
+var std struct {
+	mu   sync.Mutex
+	w    *Watcher
+	pool *Pool
+	subs map[string][]*subscriber // Absolute path → subscribers.
+}
+
+type subscriber struct {
+	path string
+	ch   chan Event
+	done chan struct{} // Closed by Unwatch, to stop a blocked send.
+
+	mu     sync.Mutex // Held while sending on ch.
+	closed bool
+}
+
+// Add watches path with a watcher that's shared by the entire program, and
+// returns a channel with the events for it. This is useful for small programs
+// and tools that don't want to manage a [Watcher]:
+//
+//	events, err := fsnotify.Add("/path/to/dir")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	for e := range events {
+//		log.Println(e)
+//	}
+//
+// Every call returns a new channel, also for the same path; the path is
+// watched until all channels for it are removed with [Unwatch]. The watcher is
+// created on the first call to Add and closed when the last channel is
+// removed.
+//
+// Event names are always absolute. The events are sent to all channels one at
+// a time, so a channel that isn't read blocks the events for all other
+// channels. Errors are dropped; use a Watcher if you need them, or need any
+// options.
+func Add(path string) (<-chan Event, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	if std.w == nil {
+		w, err := NewWatcherWith(WithAbsolutePaths(), WithPool(std.pool))
+		if err != nil {
+			return nil, err
+		}
+		std.w, std.subs = w, make(map[string][]*subscriber)
+		go dispatchStd(w)
+	}
+	if len(std.subs[abs]) == 0 {
+		if err := std.w.Add(abs); err != nil {
+			if len(std.subs) == 0 {
+				w := std.w
+				std.w = nil
+				go w.Close() // Close waits for dispatchStd, which needs std.mu.
+			}
+			return nil, err
+		}
+	}
+
+	s := &subscriber{path: abs, ch: make(chan Event), done: make(chan struct{})}
+	std.subs[abs] = append(std.subs[abs], s)
+	return s.ch, nil
+}
+
+// SetDefaultPool reads the events for the watcher used by [Add] on the
+// goroutine of pool; see [WithPool]. This takes effect the next time the
+// watcher is created, so it should be called before the first Add. Use nil to
+// start a new goroutine again, which is the default.
+func SetDefaultPool(pool *Pool) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.pool = pool
+}
+
+// Unwatch stops sending events on a channel returned by [Add], and closes it.
+// The path is no longer watched once all channels for it are removed.
+//
+// Returns [ErrNonExistentWatch] if the channel isn't from Add, or was already
+// removed.
+func Unwatch(ch <-chan Event) error {
+	std.mu.Lock()
+	var s *subscriber
+	for path, subs := range std.subs {
+		for i, sub := range subs {
+			if sub.ch == ch {
+				s = sub
+				std.subs[path] = append(subs[:i:i], subs[i+1:]...)
+				break
+			}
+		}
+	}
+	if s == nil {
+		std.mu.Unlock()
+		return fmt.Errorf("%w: channel is not from fsnotify.Add", ErrNonExistentWatch)
+	}
+
+	var (
+		err     error
+		toClose *Watcher
+	)
+	if len(std.subs[s.path]) == 0 {
+		delete(std.subs, s.path)
+		err = std.w.Remove(s.path)
+	}
+	if len(std.subs) == 0 {
+		toClose, std.w = std.w, nil
+	}
+	std.mu.Unlock()
+
+	s.stop()
+	if toClose != nil {
+		if cErr := toClose.Close(); err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// stop sending and close the channel.
+func (s *subscriber) stop() {
+	close(s.done)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	close(s.ch)
+}
+
+func (s *subscriber) send(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.ch <- e:
+	case <-s.done:
+	}
+}
+
+// dispatchStd sends the events of w to the subscribers of the path they're for.
+func dispatchStd(w *Watcher) {
+	go func() {
+		for range w.Errors {
+		}
+	}()
+
+	for e := range w.Events {
+		std.mu.Lock()
+		var subs []*subscriber
+		if std.w == w {
+			subs = append(subs, std.subs[e.WatchRoot]...)
+			// Not all backends set WatchRoot; the event can be for the watched
+			// path itself or for a file in it.
+			if e.WatchRoot == "" {
+				subs = append(subs, std.subs[e.Name]...)
+				if dir := filepath.Dir(e.Name); dir != e.Name {
+					subs = append(subs, std.subs[dir]...)
+				}
+			}
+		}
+		std.mu.Unlock()
+
+		for _, s := range subs {
+			s.send(e)
+		}
+	}
+}
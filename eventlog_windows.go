@@ -0,0 +1,96 @@
+//go:build windows
+// +build windows
+
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// Event IDs for WithEventLog; keep in sync with the documentation there.
+const (
+	evCreated        = 1
+	evClosed         = 2
+	evOverflow       = 10
+	evDisconnected   = 11
+	evReconnected    = 12
+	evAccessLost     = 13
+	evAccessRestored = 14
+	evTemporary      = 20
+	evError          = 21
+)
+
+// evlog writes to the Windows Event Log; see WithEventLog. All methods are
+// no-ops on a nil *evlog, which is what the Watcher has without it.
+type evlog struct {
+	l *eventlog.Log
+}
+
+func openEventLog(source string) (*evlog, error) {
+	if source == "" {
+		return nil, nil
+	}
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("fsnotify: opening event log %q: %w", source, err)
+	}
+	return &evlog{l: l}, nil
+}
+
+func (l *evlog) close() {
+	if l != nil {
+		l.l.Close()
+	}
+}
+
+func (l *evlog) info(id uint32, msg string) {
+	if l != nil {
+		l.l.Info(id, msg)
+	}
+}
+
+// report an error sent on Watcher.Errors.
+func (l *evlog) report(err error) {
+	if l == nil {
+		return
+	}
+	id, severity := eventLogID(err)
+	switch severity {
+	case windows.EVENTLOG_INFORMATION_TYPE:
+		l.l.Info(id, err.Error())
+	case windows.EVENTLOG_WARNING_TYPE:
+		l.l.Warning(id, err.Error())
+	default:
+		l.l.Error(id, err.Error())
+	}
+}
+
+// eventLogID returns the event ID and the EVENTLOG_*_TYPE to log err with.
+func eventLogID(err error) (uint32, uint16) {
+	var (
+		disconnected   *Disconnected
+		reconnected    *Reconnected
+		accessLost     *AccessLost
+		accessRestored *AccessRestored
+	)
+	switch {
+	case errors.Is(err, ErrEventOverflow):
+		return evOverflow, windows.EVENTLOG_WARNING_TYPE
+	case errors.As(err, &disconnected):
+		return evDisconnected, windows.EVENTLOG_WARNING_TYPE
+	case errors.As(err, &reconnected):
+		return evReconnected, windows.EVENTLOG_INFORMATION_TYPE
+	case errors.As(err, &accessLost):
+		return evAccessLost, windows.EVENTLOG_WARNING_TYPE
+	case errors.As(err, &accessRestored):
+		return evAccessRestored, windows.EVENTLOG_INFORMATION_TYPE
+	case isTemporary(err):
+		return evTemporary, windows.EVENTLOG_WARNING_TYPE
+	default:
+		return evError, windows.EVENTLOG_ERROR_TYPE
+	}
+}
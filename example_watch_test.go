@@ -0,0 +1,34 @@
+package fsnotify_test
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/camille-sound4/fsnotify"
+)
+
+func ExampleWatch() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Watch the current directory and everything in it, for new files only.
+	events, errs, err := fsnotify.Watch(ctx, []string{"./..."}, fsnotify.WithOps(fsnotify.Create))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			log.Println("created:", e.Name)
+		case err, ok := <-errs:
+			if !ok {
+				return
+			}
+			log.Println("error:", err)
+		}
+	}
+}
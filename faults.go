@@ -0,0 +1,87 @@
+package fsnotify
+
+import (
+	"errors"
+	"sync"
+)
+
+// System calls that errors can be injected in with faults.
+const (
+	// Reading events: read() on the inotify fd on Linux, kevent() on kqueue,
+	// and port_get() on illumos.
+	faultRead = "read"
+
+	// ReadDirectoryChangesW when (re-)starting the read for a watch on Windows.
+	faultReadDirectoryChanges = "ReadDirectoryChanges"
+
+	// The error from GetQueuedCompletionStatus for a completed read on Windows.
+	// The data that was read is discarded if this fails.
+	faultCompletion = "GetQueuedCompletionStatus"
+)
+
+// errShortRead can be injected in faultRead on Linux to make the read return
+// only half of the bytes that were read.
+var errShortRead = errors.New("fsnotify: injected short read")
+
+// faults injects errors in the system calls of a backend, so that tests can
+// exercise the error handling and recovery paths that are hard to trigger for
+// real, such as a failing ReadDirectoryChangesW or a storm of EINTRs.
+//
+// It's set with the withFaults option; all methods are no-ops on a nil
+// *faults, which is what the Watcher has otherwise.
+type faults struct {
+	mu    sync.Mutex
+	queue map[string][]error
+}
+
+// withFaults injects the errors queued in f. This is only for tests, and can
+// only be used with NewWatcherWith.
+func withFaults(f *faults) addOpt {
+	return func(opt *withOpts) { opt.faults = f }
+}
+
+// add queues errs for the next calls to call, one error per call. Once they're
+// used up the call works as normal again. A nil error lets one call through.
+func (f *faults) add(call string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.queue == nil {
+		f.queue = make(map[string][]error)
+	}
+	f.queue[call] = append(f.queue[call], errs...)
+}
+
+// next returns the error to inject for this call to call, or nil to make the
+// real call.
+func (f *faults) next(call string) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := f.queue[call]
+	if len(q) == 0 {
+		return nil
+	}
+	f.queue[call] = q[1:]
+	return q[0]
+}
+
+// pending returns the number of errors that haven't been injected yet.
+func (f *faults) pending(call string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.queue[call])
+}
+
+// read applies faultRead to the result of a read that returned n and err.
+func (f *faults) read(n int, err error) (int, error) {
+	switch fault := f.next(faultRead); {
+	case fault == nil:
+		return n, err
+	case fault == errShortRead:
+		return n / 2, err
+	default:
+		return 0, fault
+	}
+}
@@ -0,0 +1,130 @@
+package fsnotify
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FilterPreset is a set of patterns for paths to drop the events for; see
+// [WithFilterPresets].
+//
+// Patterns are matched against the end of the path, with "/" as the separator
+// on all platforms. A "*" or other [path.Match] pattern matches within a
+// single path component, and "**" matches any number of components. For
+// example "*.swp" matches a file in any directory, ".git/*.lock" matches
+// "/src/.git/index.lock" but not "/src/.git/refs/main.lock", and "a/**"
+// matches "a" and everything below it.
+type FilterPreset struct {
+	Name     string
+	Version  int // Incremented when the patterns change.
+	Patterns []string
+}
+
+// FilterPresetEditors is the temporary, swap, and backup files that text
+// editors and office suites write while editing or saving a file.
+var FilterPresetEditors = FilterPreset{
+	Name:    "editors",
+	Version: 1,
+	Patterns: []string{
+		// Vim: the "4913" probe to check if it can create files in the
+		// directory, and swap, undo, and backup files.
+		"4913", "*.sw[a-p]", "*.un~", "*~",
+		// Emacs lock and auto-save files.
+		".#*", "#*#",
+		// Kate, GNOME (gedit) atomic saves, and JetBrains IDEs "safe write".
+		"*.kate-swp", ".goutputstream-*", "*___jb_tmp___", "*___jb_old___",
+		// Microsoft Office and LibreOffice lock and temporary files.
+		"~$*", "~*.tmp", ".~lock.*#",
+	},
+}
+
+// FilterPresetVCS is the lock and temporary files that version control
+// systems write in their own directories. Other changes there, such as
+// .git/HEAD when switching branches, are still sent.
+var FilterPresetVCS = FilterPreset{
+	Name:    "vcs",
+	Version: 1,
+	Patterns: []string{
+		// index.lock, HEAD.lock, refs/heads/main.lock, etc., and objects
+		// that are being written.
+		".git/**/*.lock", ".git/objects/**/tmp_obj_*", ".git/objects/pack/tmp_*",
+		// Mercurial wlock, lock, and store/lock, and the transaction journal.
+		".hg/**/*lock", ".hg/**/journal*",
+		".svn/tmp/**", ".svn/wc.db-journal",
+	},
+}
+
+// FilterPresetBuildArtifacts is the output and cache directories of build
+// tools and compilers. This drops all events for node_modules, so don't use
+// it if that needs to be watched.
+var FilterPresetBuildArtifacts = FilterPreset{
+	Name:    "build-artifacts",
+	Version: 1,
+	Patterns: []string{
+		"*.o", "*.obj", "*.pyc", "*.pyo", "*.class",
+		"__pycache__/**",
+		"node_modules/**",
+		".gradle/**",
+		".zig-cache/**", "zig-cache/**",
+		"bazel-out/**",
+		".next/cache/**",
+	},
+}
+
+// filter drops the events that match a FilterPreset; see WithFilterPresets.
+type filter struct {
+	patterns [][]string // Patterns split into components.
+
+	mu      sync.Mutex
+	dropped int
+}
+
+func (f *filter) add(p FilterPreset) {
+	for _, pat := range p.Patterns {
+		f.patterns = append(f.patterns, strings.Split(pat, "/"))
+	}
+}
+
+// drop reports if e should be dropped.
+func (f *filter) drop(e Event) bool {
+	if len(f.patterns) == 0 || e.Name == "" {
+		return false
+	}
+
+	name := strings.Split(filepath.ToSlash(e.Name), "/")
+	for _, pat := range f.patterns {
+		for i := range name {
+			if matchComponents(pat, name[i:]) {
+				f.mu.Lock()
+				f.dropped++
+				f.mu.Unlock()
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchComponents reports if all of the path components in name match pat.
+func matchComponents(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchComponents(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -10,10 +10,15 @@
 package fsnotify
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/fs"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 // Event represents a file system notification.
@@ -30,6 +35,80 @@ type Event struct {
 	// This is a bitmask and some systems may send multiple operations at once.
 	// Use the Event.Has() method instead of comparing with ==.
 	Op Op
+
+	// Set on a Create if the new path is a hard link to a file that already
+	// has other links; see [DetectHardLinks].
+	HardLink bool
+
+	// Set on a Create if the new path is the new name of a rename, and the old
+	// name is known. Currently only supported on Linux, if both are in watched
+	// directories of the same Watcher, and Windows, if both are in the same
+	// directory.
+	//
+	// A Rename for the old name is still sent.
+	RenamedFrom string
+
+	// Attributes that changed on a Chmod; see [DetectAttrChanges]. This is 0
+	// if it's not known.
+	Attrs AttrChange
+
+	// The previous and new owner if Attrs has AttrOwner; nil otherwise.
+	Owner *OwnerChange
+
+	// Inode number of the file; see [DetectFileIDs]. This is 0 if it's not
+	// known.
+	FileID uint64
+
+	// Device (st_dev) or volume serial number (on Windows) of the watched path
+	// the event was sent for. Applications watching more than one filesystem
+	// can use this to partition events, or to tell that a file was moved to
+	// another filesystem, which is a Create and Remove rather than a Rename.
+	// This is 0 if it's not known; currently only set on Linux, kqueue (macOS,
+	// BSD), and Windows.
+	Device uint64
+
+	// Set on Windows if the path is a cloud placeholder (e.g. from OneDrive or
+	// Dropbox) whose data isn't stored locally; see [DetectPlaceholders]. A Write
+	// for a placeholder is a change to its sync state, such as the local copy
+	// being removed to free up space, rather than to its contents.
+	Placeholder bool
+
+	// Path of the watch the event was sent for, as it was passed to Add (or
+	// the absolute path with [WithAbsolutePaths]).
+	//
+	// A path can be covered by more than one watch, for example if both a
+	// file and its parent directory are watched. An event is sent for every
+	// watch, each with its own WatchRoot, unless [WithMergeOverlapping] is
+	// used. Currently only set on Linux and Windows.
+	WatchRoot string
+
+	// Number of dropped events on an [OverflowMark].
+	Dropped int
+
+	// Number of events this event stands for if the path was coalesced with
+	// [WithCoalesceHot] or held with [WithLockfileConvention]; 0 for other
+	// events. Op has the operations of all those events.
+	Coalesced int
+
+	// The aggregate of the events for the directory in Name with
+	// [WithSummaries]; nil for other events.
+	Summary *Summary
+
+	// The number of entries and their size for [ThresholdExceeded]; nil for
+	// other events.
+	Usage *DirUsage
+
+	// Sequence number of the event, in the order the watcher read them from
+	// the kernel; see [Watcher.ListConsistent]. This is 0 for events that
+	// weren't read from the kernel, such as from [Watcher.Replay], marks,
+	// summaries, and coalesced events.
+	Seq uint64
+}
+
+// OwnerChange is the previous and new owner of a file; see Event.Owner.
+type OwnerChange struct {
+	OldUID, OldGID int
+	NewUID, NewGID int
 }
 
 // Op describes a set of file operations.
@@ -60,15 +139,272 @@ const (
 	// get triggered very frequently by some software. For example, Spotlight
 	// indexing on macOS, anti-virus software, backup software, etc.
 	Chmod
+
+	// A file that was opened for writing was closed.
+	//
+	// Unlike the operations above this isn't sent by default; use [WithOps]
+	// to listen for it. Currently only sent on inotify (Linux).
+	CloseWrite
+
+	// The filesystem the path is on was unmounted; the watch will be removed.
+	//
+	// Unlike the operations above this isn't sent by default; use [WithOps]
+	// to listen for it. Currently only sent on inotify (Linux).
+	Unmount
+
+	// Events for the watch in Name were dropped; Event.Dropped is the number
+	// of events since the previous OverflowMark for it. This is only sent with
+	// [WithOverflowMarks].
+	OverflowMark
+
+	// The watch in Name started or stopped having a lot of events, for
+	// example because of a "git checkout". This is only sent with
+	// [WithBurstMarks].
+	BurstStart
+	BurstEnd
+
+	// The directory in Name went over the limit set with [Watcher.SetLimit];
+	// the usage is in Event.Usage.
+	ThresholdExceeded
+
+	// The file was truncated.
+	//
+	// Unlike the operations above this isn't sent by default; use [WithOps]
+	// to listen for it. Currently only sent on OpenBSD and illumos; other
+	// platforms don't report a truncate separately from a write, and send
+	// Write instead.
+	Truncate
+)
+
+// AttrChange describes which file attributes changed on a Chmod event.
+type AttrChange uint8
+
+// The attributes that can be reported in Event.Attrs.
+const (
+	AttrMode  AttrChange = 1 << iota // Permissions or other mode bits.
+	AttrOwner                        // User or group.
+	AttrTimes                        // Modification time.
+	AttrXattr                        // Extended attributes.
+	AttrLinks                        // Number of hard links.
 )
 
+func (a AttrChange) String() string {
+	var b strings.Builder
+	for _, n := range []struct {
+		a    AttrChange
+		name string
+	}{{AttrMode, "mode"}, {AttrOwner, "owner"}, {AttrTimes, "times"}, {AttrXattr, "xattr"}, {AttrLinks, "links"}} {
+		if a&n.a != 0 {
+			b.WriteString("|" + n.name)
+		}
+	}
+	if other := a &^ (AttrMode | AttrOwner | AttrTimes | AttrXattr | AttrLinks); other != 0 {
+		fmt.Fprintf(&b, "|0x%x", uint8(other))
+	}
+	if b.Len() == 0 {
+		return "[unknown]"
+	}
+	return b.String()[1:]
+}
+
+// The bit values of the operations above will never change. Bits below UserOp
+// are reserved for operations fsnotify may add in the future, and the bits from
+// UserOp up are free for applications to define their own "synthetic"
+// operations, for example when merging or debouncing events:
+//
+//	const Settled = fsnotify.UserOp << 0
+//
+// fsnotify will never send these, and [Op.String] prints them as hex.
+const UserOp Op = 1 << 16
+
 // Common errors that can be reported.
 var (
 	ErrNonExistentWatch = errors.New("fsnotify: can't remove non-existent watch")
 	ErrEventOverflow    = errors.New("fsnotify: queue or buffer overflow")
-	ErrClosed           = errors.New("fsnotify: watcher already closed")
+
+	// Returned by the methods that add paths after the watcher is closed;
+	// see [Watcher.IsClosed].
+	ErrClosed = errors.New("fsnotify: watcher already closed")
+
+	// Returned by Add for paths that can never be watched, such as named
+	// pipes and devices on Windows.
+	ErrUnsupportedPath = errors.New("fsnotify: path can't be watched")
+
+	// Wrapped by WatchLimitError.
+	ErrWatchLimit = errors.New("fsnotify: watch limit reached")
+
+	// Returned by Add if the path is already watched and [WithExclusive] is
+	// used.
+	ErrAlreadyWatched = errors.New("fsnotify: path is already watched")
+
+	// Returned by Add if the path contains a symlink with [WithNoFollow], or
+	// resolves to outside the root with [WithResolveBeneath].
+	ErrUnsafePath = errors.New("fsnotify: path is not safe to watch")
+
+	// Returned by Add if the path is another path to a file or directory that's
+	// already watched with a different path, such as a symlink, bind mount,
+	// junction, or SUBST drive. The kernel only has one watch for both, so
+	// there's no way to tell which path an event was for. This is only
+	// detected on Linux and Windows; other backends watch both paths.
+	ErrAliasWatch = errors.New("fsnotify: path is an alias of a watched path")
+
+	// Sent on Watcher.Errors if an event read from the kernel doesn't fit in
+	// the buffer, for example a name length that goes past the end of it. The
+	// rest of the buffer is skipped, so events have likely been missed.
+	ErrInvalidEvent = errors.New("fsnotify: invalid event from the kernel")
+
+	// Returned if an option or method would access the filesystem after Add
+	// on a watcher created with [WithRestricted], or if restricted mode isn't
+	// supported on this platform.
+	ErrRestricted = errors.New("fsnotify: not allowed with WithRestricted")
+
+	// Returned by Watcher.ListConsistent if the directory changed while it
+	// was read every time it was tried.
+	ErrDirChanging = errors.New("fsnotify: directory kept changing while listing it")
 )
 
+// WatchLimitError is returned if adding a path would create more kernel watches
+// than allowed by [WithMaxWatches]. It wraps [ErrWatchLimit].
+type WatchLimitError struct {
+	Limit   int      // The WithMaxWatches limit.
+	Skipped []string // Paths that aren't watched.
+}
+
+func (e *WatchLimitError) Error() string {
+	if len(e.Skipped) == 1 {
+		return fmt.Sprintf("%s (%d): not watching %q", ErrWatchLimit, e.Limit, e.Skipped[0])
+	}
+	return fmt.Sprintf("%s (%d): not watching %d paths in %q", ErrWatchLimit, e.Limit,
+		len(e.Skipped), filepath.Dir(e.Skipped[0]))
+}
+
+func (e *WatchLimitError) Unwrap() error { return ErrWatchLimit }
+
+// Disconnected is sent on Watcher.Errors if a watched directory on a network
+// share became unreachable, for example because the server went away or the
+// session or its credentials expired. The watch isn't removed: it's re-opened
+// with a backoff until that works, after which [Reconnected] is sent.
+//
+// Currently only sent on Windows.
+type Disconnected struct {
+	Dir string // The watched directory.
+	Err error  // The error from the system.
+}
+
+func (e *Disconnected) Error() string {
+	return fmt.Sprintf("fsnotify: disconnected from %q: %s", e.Dir, e.Err)
+}
+
+func (e *Disconnected) Unwrap() error   { return e.Err }
+func (e *Disconnected) Temporary() bool { return true }
+func (e *Disconnected) Path() string    { return e.Dir }
+
+// Reconnected is sent on Watcher.Errors once a watch is working again after
+// [Disconnected]. Changes while it was disconnected weren't seen, so
+// applications that keep state should rescan the directory.
+type Reconnected struct {
+	Dir string // The watched directory.
+}
+
+func (e *Reconnected) Error() string {
+	return fmt.Sprintf("fsnotify: reconnected to %q; changes may have been missed", e.Dir)
+}
+
+func (e *Reconnected) Temporary() bool { return true }
+func (e *Reconnected) Path() string    { return e.Dir }
+
+// AccessLost is sent on Watcher.Errors if a watched directory can no longer be
+// read, for example after "chmod 000" or an ACL change. The watch isn't
+// removed: on Windows it's re-opened with a backoff until that works, and on
+// kqueue and illumos the directory is read again when its permissions change.
+// [AccessRestored] is sent once it works again.
+//
+// This isn't sent on Linux, as inotify keeps sending events for a watch after
+// losing access to the directory.
+type AccessLost struct {
+	Dir string // The watched directory.
+	Err error  // The error from the system.
+}
+
+func (e *AccessLost) Error() string {
+	return fmt.Sprintf("fsnotify: lost access to %q: %s", e.Dir, e.Err)
+}
+
+func (e *AccessLost) Unwrap() error   { return e.Err }
+func (e *AccessLost) Temporary() bool { return true }
+func (e *AccessLost) Path() string    { return e.Dir }
+
+// AccessRestored is sent on Watcher.Errors once a directory can be read again
+// after [AccessLost]. Changes while access was lost may have been missed, so
+// applications that keep state should rescan the directory.
+type AccessRestored struct {
+	Dir string // The watched directory.
+}
+
+func (e *AccessRestored) Error() string {
+	return fmt.Sprintf("fsnotify: access to %q restored; changes may have been missed", e.Dir)
+}
+
+func (e *AccessRestored) Temporary() bool { return true }
+func (e *AccessRestored) Path() string    { return e.Dir }
+
+// All errors sent on Watcher.Errors implement this interface:
+//
+//	interface {
+//		Temporary() bool // The condition is likely transient.
+//		Path() string    // Path the error is about; "" if not known.
+//	}
+//
+// A "temporary" error means the watcher or watch is still working or may work
+// again if added again (e.g. an overflow, or an interrupted system call). A
+// supervisor can use this to re-add watches on temporary errors, and alert on
+// the others, without having to inspect the underlying error.
+//
+// Use errors.Is() or errors.As() to get at the underlying error.
+type watchError struct {
+	err       error
+	path      string
+	temporary bool
+}
+
+func (e *watchError) Error() string   { return e.err.Error() }
+func (e *watchError) Unwrap() error   { return e.err }
+func (e *watchError) Temporary() bool { return e.temporary }
+func (e *watchError) Path() string    { return e.path }
+
+// newError wraps err so it can be sent on Watcher.Errors; path can be "" if it's
+// not known, in which case it's taken from a fs.PathError in the chain (if
+// any).
+func newError(err error, path string) error {
+	if _, ok := err.(interface {
+		Temporary() bool
+		Path() string
+	}); ok {
+		return err
+	}
+	if path == "" {
+		var pErr *fs.PathError
+		if errors.As(err, &pErr) {
+			path = pErr.Path
+		}
+	}
+	return &watchError{err: err, path: path, temporary: isTemporary(err)}
+}
+
+// isTemporary reports if err is likely transient.
+func isTemporary(err error) bool {
+	if errors.Is(err, ErrEventOverflow) || errors.Is(err, ErrInvalidEvent) {
+		return true
+	}
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// isSpecial reports if fi is a socket, named pipe, or device.
+func isSpecial(fi fs.FileInfo) bool {
+	return fi.Mode()&(fs.ModeSocket|fs.ModeNamedPipe|fs.ModeDevice|fs.ModeCharDevice) != 0
+}
+
 func (o Op) String() string {
 	var b strings.Builder
 	if o.Has(Create) {
@@ -86,6 +422,31 @@ func (o Op) String() string {
 	if o.Has(Chmod) {
 		b.WriteString("|CHMOD")
 	}
+	if o.Has(CloseWrite) {
+		b.WriteString("|CLOSE_WRITE")
+	}
+	if o.Has(Unmount) {
+		b.WriteString("|UNMOUNT")
+	}
+	if o.Has(OverflowMark) {
+		b.WriteString("|OVERFLOW_MARK")
+	}
+	if o.Has(BurstStart) {
+		b.WriteString("|BURST_START")
+	}
+	if o.Has(BurstEnd) {
+		b.WriteString("|BURST_END")
+	}
+	if o.Has(ThresholdExceeded) {
+		b.WriteString("|THRESHOLD_EXCEEDED")
+	}
+	if o.Has(Truncate) {
+		b.WriteString("|TRUNCATE")
+	}
+	if other := o &^ (Create | Remove | Write | Rename | Chmod | CloseWrite | Unmount | OverflowMark |
+		BurstStart | BurstEnd | ThresholdExceeded | Truncate); other != 0 {
+		fmt.Fprintf(&b, "|0x%x", uint32(other))
+	}
 	if b.Len() == 0 {
 		return "[no events]"
 	}
@@ -93,27 +454,107 @@ func (o Op) String() string {
 }
 
 // Has reports if this operation has the given operation.
+//
+// If h has more than one operation set, it reports if any of them are set;
+// [Op.HasAny] is the same, but makes that clearer at the call site.
 func (o Op) Has(h Op) bool { return o&h != 0 }
 
+// HasAny reports if this operation has any of the operations in h. This is the
+// same as [Op.Has]; use it when h has more than one operation, to make it clear
+// that not all of them need to be set.
+func (o Op) HasAny(h Op) bool { return o.Has(h) }
+
 // Has reports if this event has the given operation.
 func (e Event) Has(op Op) bool { return e.Op.Has(op) }
 
 // String returns a string representation of the event with their path.
 func (e Event) String() string {
-	return fmt.Sprintf("%-13s %q", e.Op.String(), e.Name)
+	s := fmt.Sprintf("%-13s %q", e.Op.String(), e.Name)
+	if e.RenamedFrom != "" {
+		s += fmt.Sprintf(" (renamed from %q)", e.RenamedFrom)
+	}
+	if e.HardLink {
+		s += " (hard link)"
+	}
+	if e.Placeholder {
+		s += " (placeholder)"
+	}
+	if e.Dropped != 0 {
+		s += fmt.Sprintf(" (%d dropped)", e.Dropped)
+	}
+	if e.Coalesced != 0 {
+		s += fmt.Sprintf(" (%d coalesced)", e.Coalesced)
+	}
+	if e.Summary != nil {
+		s += " (summary)"
+	}
+	if u := e.Usage; u != nil {
+		s += fmt.Sprintf(" (%d entries, %d bytes)", u.Entries, u.Bytes)
+	}
+	if e.Attrs != 0 {
+		s += " (" + e.Attrs.String() + ")"
+	}
+	if o := e.Owner; o != nil {
+		s += fmt.Sprintf(" (owner %d:%d -> %d:%d)", o.OldUID, o.OldGID, o.NewUID, o.NewGID)
+	}
+	return s
 }
 
 type (
 	addOpt   func(opt *withOpts)
 	withOpts struct {
 		bufsize          int
+		op               Op
 		withoutdir       bool
 		preferclosewrite bool
+		longnames        bool
+		normalize        func(name string) string
+		hardlinks        bool
+		absolute         bool
+		nofollow         bool
+		symlinks         linkMode
+		exclusive        bool
+		hydrate          bool
+		placeholders     bool
+		copyComplete     bool
+		share            ShareMode
+		priority         Priority
+		beneath          string
+		attrs            bool
+		fileIDs          bool
+		nodelchmod       bool
+		slowQueued       int            // Only for NewWatcherWith
+		slowAfter        time.Duration  // Only for NewWatcherWith
+		dispatch         func(Event)    // Only for NewWatcherWith
+		pool             *Pool          // Only for NewWatcherWith
+		queueSize        int            // Only for NewWatcherWith
+		queuePolicy      QueuePolicy    // Only for NewWatcherWith
+		drain            time.Duration  // Only for NewWatcherWith
+		dedup            time.Duration  // Only for NewWatcherWith
+		merge            bool           // Only for NewWatcherWith
+		markEvery        time.Duration  // Only for NewWatcherWith
+		coalesceN        int            // Only for NewWatcherWith
+		coalesceEvery    time.Duration  // Only for NewWatcherWith
+		summaryEvery     time.Duration  // Only for NewWatcherWith
+		burstN           int            // Only for NewWatcherWith
+		burstEvery       time.Duration  // Only for NewWatcherWith
+		lockPatterns     []string       // Only for NewWatcherWith
+		filters          []FilterPreset // Only for NewWatcherWith
+		quietAfter       time.Duration  // Only for NewWatcherWith
+		quietProbe       bool           // Only for NewWatcherWith
+		maxWatches       int            // Only for NewWatcherWith
+		faults           *faults        // Only for NewWatcherWith
+		port, portKey    uintptr        // Only for NewWatcherWith
+		eventLog         string         // Only for NewWatcherWith
+		restricted       bool           // Only for NewWatcherWith
+		retry            func(attempt int) time.Duration
 	}
 )
 
 var defaultOpts = withOpts{
-	bufsize: 65536, // 64K
+	bufsize:   65536, // 64K
+	op:        Create | Write | Remove | Rename | Chmod,
+	queueSize: 1024,
 }
 
 func getOptions(opts ...addOpt) withOpts {
@@ -138,18 +579,1033 @@ func WithBufferSize(bytes int) addOpt {
 	return func(opt *withOpts) { opt.bufsize = bytes }
 }
 
+// WithOps sets which operations to listen for. The default is [Create],
+// [Write], [Remove], [Rename], and [Chmod].
+//
+// Excluding operations you're not interested in can save quite a bit of CPU
+// time and kernel buffer space; on inotify and Windows only the operations
+// that are asked for are requested from the kernel, and other backends filter
+// the events before sending them.
+//
+// Watching the same path more than once adds to the set of operations rather
+// than replacing it.
+func WithOps(op Op) addOpt {
+	return func(opt *withOpts) { opt.op = op }
+}
+
 // WithoutDirectories filters out directory events.
+//
+// This only applies to the path it's added with; other watches are unaffected.
+// Whether a path is a directory is taken from the event itself where the
+// system reports it, so events for directories that no longer exist are also
+// filtered.
+//
+// The Remove event for a watched directory itself is still sent, so you can
+// tell the watch is gone.
 func WithoutDirectories() addOpt {
 	return func(opt *withOpts) { opt.withoutdir = true }
 }
 
 // PreferCloseWrite will trigger Write event on close write for systems which supports it.
 //
-// Currently supported with inotify (Linux) only
+// Currently supported with inotify (Linux) only. Like [WithoutDirectories],
+// this only applies to the path it's added with.
 func PreferCloseWrite() addOpt {
 	return func(opt *withOpts) { opt.preferclosewrite = true }
 }
 
+// ResolveShortNames resolves 8.3 short names (e.g. "PROGRA~1") in event names
+// to the long name, so they can be compared with the paths you added.
+//
+// Windows reports names the way the program that made the change used them,
+// so some programs cause events with short names. Resolved names are cached,
+// and only names with a "~" are looked up.
+//
+// This only has effect on Windows systems, and is a no-op for other backends.
+func ResolveShortNames() addOpt {
+	return func(opt *withOpts) { opt.longnames = true }
+}
+
+// WithNormalizer sets a function that is applied to the names of all events
+// before they're sent, for example to Unicode-normalize them.
+//
+// HFS+ on macOS stores names decomposed (NFD), and APFS keeps names as they
+// were created, so event names may not byte-compare with the (usually composed,
+// NFC) names the application used. This doesn't add a dependency on
+// golang.org/x/text, so you can use it with:
+//
+//	w.AddWith("/path", fsnotify.WithNormalizer(norm.NFC.String))
+//
+// Only the kqueue (macOS, BSD) backend uses this; it's a no-op for other
+// backends, which report names as-is. The function isn't included by
+// [Watcher.Export].
+func WithNormalizer(fn func(name string) string) addOpt {
+	return func(opt *withOpts) { opt.normalize = fn }
+}
+
+// DetectHardLinks sets Event.HardLink on a Create for a regular file that has
+// more than one link, so that tools that index or deduplicate files don't have
+// to treat every new link as new content. This costs an lstat() for every
+// Create.
+//
+// This is best-effort: the link count is read after the event, so a file that
+// was created and then linked elsewhere before the event was read is also
+// reported as a hard link, and a link that was removed again is missed.
+//
+// This only has effect on Linux and kqueue (macOS, BSD), and is a no-op for
+// other backends.
+func DetectHardLinks() addOpt {
+	return func(opt *withOpts) { opt.hardlinks = true }
+}
+
+// DetectAttrChanges sets Event.Attrs on a Chmod to the attributes that changed,
+// so that applications can ignore the modification time updates that make up
+// most Chmod events.
+//
+// The kernel doesn't report this, so the watcher keeps the mode, owner, link
+// count, modification time, and a checksum of the extended attributes of the
+// watched path and all files in it, and compares them on every Chmod.
+// Event.Owner is set to the previous and new owner if that changed.
+// Event.Attrs is 0 if the file wasn't seen before, or if it was already removed
+// when the event was read. Changes that aren't in this list (such as the access
+// time) also give 0. Extended attributes are only compared on Linux and macOS.
+//
+// This only has effect on Linux and kqueue (macOS, BSD), and is a no-op for
+// other backends.
+func DetectAttrChanges() addOpt {
+	return func(opt *withOpts) { opt.attrs = true }
+}
+
+// WithSuppressDeleteChmod doesn't send the Chmod that Linux sends when a file
+// is removed (the number of links changed), which is the first event for a
+// removed file that's still open, as the Remove is only sent once it's
+// closed.
+//
+// A Chmod is dropped if the file no longer exists when the event is read, so
+// a real Chmod right before the file is removed is dropped too. With
+// [DetectAttrChanges] a Chmod for only a change in the number of links is
+// also dropped, which includes adding and removing hard links.
+//
+// This only has effect on Linux, and is a no-op for other backends.
+func WithSuppressDeleteChmod() addOpt {
+	return func(opt *withOpts) { opt.nodelchmod = true }
+}
+
+// DetectFileIDs sets Event.FileID to the inode number of the file, so that
+// applications can track a file across renames (the Rename and Create have the
+// same FileID), and tell a file that was replaced by a rename (the FileID
+// changes) apart from one that was modified in place.
+//
+// The kernel doesn't report this, so the watcher keeps the inode number of the
+// watched path and all files in it, to set it on Remove and Rename events for
+// files that no longer exist. The cache is filled when the path is added and
+// on every Create; FileID is 0 for files it doesn't know about that were
+// already removed when the event was read.
+//
+// This only has effect on Linux and kqueue (macOS, BSD), and is a no-op for
+// other backends.
+func DetectFileIDs() addOpt {
+	return func(opt *withOpts) { opt.fileIDs = true }
+}
+
+// WithAbsolutePaths makes the path absolute when it's added, so that
+// Event.Name is always an absolute path, even if the process changes its
+// working directory while watching. Without this option the names of events
+// are relative if the path was added as a relative path, and refer to a
+// different file after a chdir().
+//
+// The path is resolved against the working directory at the time it's added,
+// and [Watcher.WatchList] and [Watcher.Export] return the absolute path. Pass
+// the absolute path to [Watcher.Remove].
+func WithAbsolutePaths() addOpt {
+	return func(opt *withOpts) { opt.absolute = true }
+}
+
+// WithExclusive makes Add return [ErrAlreadyWatched] if the path is already
+// watched by this watcher, rather than adding to the existing watch. This is
+// useful to find bugs where the same path is added twice.
+//
+// On Linux this uses IN_MASK_CREATE (Linux 4.18 or newer), so a different path
+// to an already watched file or directory (e.g. a hard link or symlink) also
+// returns ErrAlreadyWatched. Other backends and older kernels only compare the
+// path.
+func WithExclusive() addOpt {
+	return func(opt *withOpts) { opt.exclusive = true }
+}
+
+// AllowHydration allows the watcher to cause cloud placeholder files to be
+// downloaded.
+//
+// Cloud storage (OneDrive, Dropbox, and others using the Cloud Files API or
+// Projected File System) keeps placeholders for files and directories that
+// are downloaded when they're opened. By default the watcher never does this:
+// directories are opened with FILE_FLAG_OPEN_NO_RECALL, and placeholder
+// directories aren't listed for [WithoutDirectories] (directories are then
+// only detected as they change). Use [DetectPlaceholders] to tell writes for
+// placeholders apart from changes to the contents.
+//
+// [Watcher.Replay] lists directories, and may still cause downloads.
+//
+// This only has effect on Windows systems, and is a no-op for other backends.
+func AllowHydration() addOpt {
+	return func(opt *withOpts) { opt.hydrate = true }
+}
+
+// DetectPlaceholders sets [Event.Placeholder] on Write events for cloud
+// placeholders (see [AllowHydration]). Cloud sync engines report changes to
+// the sync state of a placeholder, such as removing the local copy to free up
+// space, as a modification.
+//
+// This reads the attributes of the file for every Write, which doesn't cause
+// it to be downloaded.
+//
+// This only has effect on Windows systems, and is a no-op for other backends.
+func DetectPlaceholders() addOpt {
+	return func(opt *withOpts) { opt.placeholders = true }
+}
+
+// WithCopyCompleteDetection sends a [CloseWrite] event once a file that was
+// created or written to is no longer open for writing, so that the end of a
+// large copy can be detected without waiting for the stream of Write events to
+// stop.
+//
+// Windows has no notification for closing a file; this is a heuristic that
+// tries to open the file without sharing once there were no events for it for
+// a short while. This fails with a sharing violation while another process has
+// the file open, and the file is probed again later. The handle is closed right
+// away, but a program that opens the file at the same moment may briefly see a
+// sharing violation itself.
+//
+// CloseWrite is sent even if it's not in [WithOps], but only for files that
+// had Create or Write events.
+//
+// This only has effect on Windows systems, and is a no-op for other backends;
+// use [WithOps] with CloseWrite on Linux.
+func WithCopyCompleteDetection() addOpt {
+	return func(opt *withOpts) { opt.copyComplete = true }
+}
+
+// ShareMode is the share mode of the directory handles on Windows; see
+// [WithShareMode]. The values are the same as FILE_SHARE_*.
+type ShareMode uint32
+
+const (
+	ShareRead   ShareMode = 0x1 // FILE_SHARE_READ
+	ShareWrite  ShareMode = 0x2 // FILE_SHARE_WRITE
+	ShareDelete ShareMode = 0x4 // FILE_SHARE_DELETE
+
+	// DefaultShareMode is used if WithShareMode isn't.
+	DefaultShareMode = ShareRead | ShareWrite | ShareDelete
+)
+
+// WithShareMode sets the share mode of the handle that's opened for the
+// watched directory (or the directory of a watched file).
+//
+// Directories are opened with:
+//
+//	CreateFile(path, FILE_LIST_DIRECTORY, share, nil, OPEN_EXISTING,
+//	           FILE_FLAG_BACKUP_SEMANTICS|FILE_FLAG_OVERLAPPED|FILE_FLAG_OPEN_NO_RECALL, 0)
+//
+// where share is [DefaultShareMode], and FILE_FLAG_OPEN_NO_RECALL is left out
+// with [AllowHydration]. This doesn't prevent other programs from doing
+// anything with the directory, but deleting it only marks it for deletion
+// until the watcher notices and closes the handle: until then the name can't
+// be used again and the parent directory isn't empty. Newer versions of
+// Windows 10 and NTFS remove the name right away for most programs.
+//
+// Leaving out ShareDelete prevents the directory from being deleted or renamed
+// while it's watched; this fails with a sharing violation instead. Leaving out
+// ShareWrite or ShareRead fails Add if another program has the directory open
+// for that access. Files in the directory aren't affected.
+//
+// If a directory is watched more than once (for example for different files in
+// it) the share mode of the first Add is used. A zero share mode is the same as
+// DefaultShareMode.
+//
+// This only has effect on Windows, and is a no-op for other backends.
+func WithShareMode(share ShareMode) addOpt {
+	return func(opt *withOpts) { opt.share = share }
+}
+
+// WithNoFollow refuses to watch a path that has a symlink in any of its
+// components, including the last one, and returns [ErrUnsafePath] instead.
+// This prevents a symlink from redirecting a watch to somewhere else. Without
+// it, Add follows symlinks; see the "Symlinks" section of [Watcher.Add].
+//
+// On Linux this uses openat2() with RESOLVE_NO_SYMLINKS, which was added in
+// Linux 5.6; Add returns an error on older kernels. Other backends check every
+// component with lstat() before adding the path, which still leaves a small
+// window where a component can be replaced with a symlink.
+func WithNoFollow() addOpt {
+	return func(opt *withOpts) { opt.nofollow = true }
+}
+
+// linkMode is what Add does with a symlink; see FollowSymlinks.
+type linkMode uint8
+
+const (
+	linkDefault  linkMode = iota // Follow, with the names the backend uses.
+	linkFollow                   // Follow, with the name passed to Add.
+	linkNoFollow                 // Watch the link itself.
+)
+
+// FollowSymlinks sets what Add does with a path that is a symlink.
+//
+// With true, the file or directory the link points to is watched, and events
+// use the path of the link: for a symlink "link" to a directory, a file created
+// in the directory is sent as "link/file". Adding a symlink that can't be
+// resolved returns an error. This is the default on all backends except kqueue,
+// which uses the path the link points to ("dir/file") unless this is set.
+//
+// With false, the link itself is watched rather than what it points to, so
+// that only changes to the link are sent (e.g. removing it), and not writes to
+// the file it points to. This is only supported on Linux, macOS, and illumos;
+// other backends return [ErrUnsupportedPath] for a symlink.
+//
+// This only affects the path passed to Add; see the "Symlinks" section of
+// [Watcher.Add] for symlinks in watched directories.
+func FollowSymlinks(follow bool) addOpt {
+	return func(opt *withOpts) {
+		opt.symlinks = linkNoFollow
+		if follow {
+			opt.symlinks = linkFollow
+		}
+	}
+}
+
+// WithResolveBeneath refuses to watch a path that isn't in the directory root,
+// or that resolves to outside root through symlinks or "..", and returns
+// [ErrUnsafePath] instead. This is useful to keep watches inside a sandbox
+// directory when the paths come from untrusted input.
+//
+// Relative paths are relative to the working directory, as usual, not root.
+//
+// On Linux this uses openat2() with RESOLVE_BENEATH, which was added in Linux
+// 5.6; Add returns an error on older kernels. Other backends resolve the
+// symlinks before adding the path, which still leaves a small window where a
+// component can be replaced with a symlink.
+func WithResolveBeneath(root string) addOpt {
+	return func(opt *withOpts) { opt.beneath = root }
+}
+
+// WithRetry retries re-arming a watch that failed with an error that may be
+// transient (e.g. anti-virus software briefly locking a directory, or a hiccup
+// on a network filesystem), instead of removing the watch and sending the
+// error.
+//
+// The backoff function is called with the attempt number, starting at 1, and
+// returns how long to wait before the next attempt; return a negative duration
+// to give up, after which the watch is removed and the error is sent on
+// Watcher.Errors. The attempt number is reset once the watch works again.
+//
+// Only the Windows and FEN (illumos) backends need to re-arm watches; this is a
+// no-op for other backends.
+func WithRetry(backoff func(attempt int) time.Duration) addOpt {
+	return func(opt *withOpts) { opt.retry = backoff }
+}
+
+// WithSlowConsumer sends a [SlowConsumer] warning on Watcher.Errors if at
+// least queued events have been waiting in the Events channel for longer than
+// after; an unbuffered channel is considered backed up if sending an event
+// takes longer than after. Warnings are sent at most once a second (or once
+// every after, if that's longer).
+//
+// This can be used to find out the application is too slow to keep up before
+// the kernel buffers overflow and events are lost.
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithSlowConsumer(queued int, after time.Duration) addOpt {
+	return func(opt *withOpts) { opt.slowQueued, opt.slowAfter = queued, after }
+}
+
+// WithDirectDispatch calls handler for every event on the goroutine that reads
+// the events from the kernel, instead of sending them on Watcher.Events. This
+// saves a channel send and goroutine switch for every event, which can matter
+// for applications where latency is critical and there are few events.
+//
+// The trade-off is that no events are read while the handler runs, so a slow
+// handler makes the kernel buffers overflow sooner (the events aren't queued
+// in the Events channel either). The handler must not call [Watcher.Close],
+// or [Watcher.Add] and [Watcher.Remove] on Windows, as that will deadlock.
+// Errors are still sent on Watcher.Errors.
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithDirectDispatch(handler func(Event)) addOpt {
+	return func(opt *withOpts) { opt.dispatch = handler }
+}
+
+// WithPool reads events for the watcher on the goroutine of pool, shared with
+// all other watchers created with the same pool, rather than starting a new
+// goroutine for every watcher. This is useful for applications with many
+// watchers.
+//
+// The trade-off is that a watcher whose Events aren't read blocks all other
+// watchers in the pool; use [WithDirectDispatch] or a buffered channel if
+// that's a problem.
+//
+// This only has effect on Linux, and is a no-op for other backends. Sharing
+// one I/O completion port on Windows isn't implemented; use
+// [WithCompletionPort] to read several watchers from a completion port of the
+// application. This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithPool(pool *Pool) addOpt {
+	return func(opt *withOpts) { opt.pool = pool }
+}
+
+// WithDedup drops an event if the previous event for the same path had the same
+// Op and was less than window ago. For example Windows often sends several
+// Write events for what the application sees as one write.
+//
+// Unlike debouncing, this never delays events, and only drops exact
+// duplicates: a Write, Chmod, Write is sent as-is, and a Write is still sent
+// after a Remove and Create for the same path. The window starts at the first
+// event, so a file that's being written to continuously still sends a Write
+// every window. Dropped events are counted in [Stats].
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithDedup(window time.Duration) addOpt {
+	return func(opt *withOpts) { opt.dedup = window }
+}
+
+// WithOverflowMarks sends an [OverflowMark] event every interval for every
+// watch that had events dropped since the previous mark, with the number of
+// dropped events in Event.Dropped. This gives applications that keep their
+// own state (an index, a cache) a precise trigger to rescan just that path.
+//
+// Dropped events are events that were dropped because the queue was full (see
+// [WithEventQueue]), the watcher was closed (see [DrainOnClose]), or they were
+// duplicates (see [WithDedup]). The running total for every watch is in
+// Stats.DroppedByWatch. The kernel doesn't report how many events are lost
+// if its buffer overflows; that's still only reported as [ErrEventOverflow].
+//
+// The marks are sent like events from [Watcher.Replay], and are not filtered
+// by [WithOps]. The watch is the Event.WatchRoot of the dropped events, or
+// the directory of the event on backends that don't set it.
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithOverflowMarks(interval time.Duration) addOpt {
+	return func(opt *withOpts) { opt.markEvery = interval }
+}
+
+// WithBurstMarks sends a [BurstStart] event for a watch once it has more than
+// threshold events in interval, and a [BurstEnd] event once it has fewer than
+// half that in an interval. This lets applications switch strategies during
+// mass operations such as "git checkout" or "npm install"; for example to stop
+// updating an index for every event and rescan once the burst ends.
+//
+// Name and WatchRoot are the path of the watch; events are counted by
+// Event.WatchRoot, or by directory on backends that don't set it. The marks are
+// sent at the end of an interval, like events from [Watcher.Replay], so the
+// first events of a burst are sent before the BurstStart. The events are still
+// sent as normal.
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithBurstMarks(threshold int, interval time.Duration) addOpt {
+	return func(opt *withOpts) { opt.burstN, opt.burstEvery = threshold, interval }
+}
+
+// WithCoalesceHot coalesces the events for paths that have more than threshold
+// events in interval: instead of every event, a single event is sent for the
+// path every interval, with the number of events in Event.Coalesced and all
+// their operations in Event.Op; for example "Write with Coalesced=500" for a
+// log file that's written 500 times a second. Paths with fewer events are
+// still sent as normal, so a busy path doesn't drown out the others and
+// consumers are protected without debouncing everything.
+//
+// A path goes back to normal once it has no more than threshold events in an
+// interval. The events are counted per Event.Name, not per watch; use
+// [Watcher.TopPaths] to find noisy watches.
+//
+// As the Op can include both Create and Remove, the order of the operations
+// is lost, and applications should check the current state of the path. The
+// coalesced events are sent like events from [Watcher.Replay]; events that
+// weren't sent yet are dropped when the watcher is closed.
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithCoalesceHot(threshold int, interval time.Duration) addOpt {
+	return func(opt *withOpts) { opt.coalesceN, opt.coalesceEvery = threshold, interval }
+}
+
+// WithFilterPresets drops the events for paths that match the patterns in the
+// presets, such as [FilterPresetEditors] for the swap and backup files of
+// editors. Use the option more than once, or a FilterPreset with your own
+// patterns, to add more. The number of dropped events is in Stats.Filtered.
+//
+// The presets are only for events; the directories are still watched.
+// [Watcher.Replay] also skips the paths.
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithFilterPresets(presets ...FilterPreset) addOpt {
+	return func(opt *withOpts) { opt.filters = append(opt.filters, presets...) }
+}
+
+// WithLockfileConvention holds the events for a file while its lock file
+// exists, and sends them as a single event once the lock file is removed, so
+// that an application doesn't see the intermediate states of a file that's
+// being saved by an office suite or package manager.
+//
+// The pattern is the name of the lock file with a single "*" for the name of
+// the file it locks, in the same directory; for example ".~lock.*#" for
+// LibreOffice, or "*.lock" if "data.lock" is the lock for "data". Patterns
+// without exactly one "*" are ignored. Use the option more than once for more
+// than one pattern.
+//
+// The held event has the operations of all the held events in Event.Op, and
+// their number in Event.Coalesced; it's sent right before the event for
+// removing (or renaming) the lock file. Events for the lock file itself are
+// sent as normal. Only lock files created while the directory is watched are
+// seen. Held events are dropped when the watcher is closed or the watch for the
+// directory is removed, and are sent anyway if the lock file still exists after
+// a minute, in case the application that created it crashed.
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithLockfileConvention(pattern string) addOpt {
+	return func(opt *withOpts) { opt.lockPatterns = append(opt.lockPatterns, pattern) }
+}
+
+// WithSummaries sends a summary of the events for every directory every
+// interval, instead of the individual events, for consumers that only need to
+// know that something in a directory changed, such as dashboards or cache
+// invalidation.
+//
+// The summary is an event with the directory in Name, all operations in Op,
+// and the number of events for every operation and the paths that changed in
+// Event.Summary. The directory is the parent directory of the paths, so a
+// change to a watched directory itself is in the summary for its parent.
+//
+// The summaries are sent like events from [Watcher.Replay]; events that
+// weren't sent yet are dropped when the watcher is closed.
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithSummaries(interval time.Duration) addOpt {
+	return func(opt *withOpts) { opt.summaryEvery = interval }
+}
+
+// WithQuiescentWarning sends a [Quiescent] warning on Watcher.Errors if there
+// were no events for after, so that a filesystem that's frozen for a backup
+// (fsfreeze on Linux, a VSS snapshot on Windows) isn't mistaken for lost
+// events, or a broken watcher.
+//
+// With probe the warning is only sent if a filesystem is frozen: a temporary
+// file is created and removed in every watched directory, and a directory
+// where that doesn't finish within a second is reported in Quiescent.Frozen.
+// The probe files start with ".fsnotify-probe-", and cause events like any
+// other file. A probe that blocks on a frozen filesystem finishes once it's
+// thawed.
+//
+// The warning is sent once until there are new events.
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithQuiescentWarning(after time.Duration, probe bool) addOpt {
+	return func(opt *withOpts) { opt.quietAfter, opt.quietProbe = after, probe }
+}
+
+// WithMergeOverlapping sends an event only once if a path is covered by more
+// than one watch, for example if both a file and its parent directory are
+// watched. By default an event is sent for every watch, with a different
+// [Event.WatchRoot]; with this only the first is sent. The Name may still
+// differ if the paths were added in a different form (e.g. "dir" and
+// "./dir/file"); use [WithAbsolutePaths] to avoid that. Dropped events are
+// counted as deduplicated in [Stats].
+//
+// This only has effect on Linux and Windows; other backends already send the
+// event once. This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithMergeOverlapping() addOpt {
+	return func(opt *withOpts) { opt.merge = true }
+}
+
+// WithMaxWatches limits the number of kernel watches the watcher creates to n,
+// so that one large directory can't use up the system-wide limit (e.g. the
+// fs.inotify.max_user_watches sysctl on Linux). Adding a path over the limit
+// returns a [*WatchLimitError].
+//
+// What counts as a watch depends on the backend: on Linux and Windows every
+// added path (or on Windows, every directory) is one watch. kqueue (macOS, BSD)
+// opens a file descriptor for every file in a watched directory; files over
+// the limit aren't opened, so only Create and Remove are sent for them, and the
+// directory is still watched even though Add returns a WatchLimitError listing
+// the skipped files. This is a no-op for other backends.
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithMaxWatches(n int) addOpt {
+	return func(opt *withOpts) { opt.maxWatches = n }
+}
+
+// DrainOnClose keeps sending events that were already read from the kernel
+// after [Watcher.Close] is called, for up to timeout, rather than dropping
+// them. Close doesn't return until all these events are sent or the timeout
+// expires, so the application must keep reading from Watcher.Events (e.g. on
+// another goroutine) until it's closed.
+//
+// Without this option events that were read but not yet sent when Close is
+// called are dropped. Either way, events that weren't sent are counted in
+// [Stats].
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func DrainOnClose(timeout time.Duration) addOpt {
+	return func(opt *withOpts) { opt.drain = timeout }
+}
+
+// QueuePolicy is what to do when the event queue is full; see
+// [WithEventQueue].
+type QueuePolicy uint8
+
+const (
+	// Stop reading events from the kernel until there is space in the queue.
+	QueueBlock QueuePolicy = iota
+
+	// Drop the new event.
+	QueueDropNewest
+
+	// Drop the oldest event in the queue to make room for the new event.
+	QueueDropOldest
+)
+
+// WithEventQueue sets the size of the queue between reading events from the
+// kernel and sending them on Watcher.Events, and what to do when it's full. The
+// default is 1024 events and [QueueBlock].
+//
+// Events are read from the kernel and queued as soon as possible, so the
+// kernel can collect the next events while the application reads them. If the
+// application is too slow the queue fills up: [QueueBlock] stops reading from
+// the kernel, after which the kernel buffer will overflow and events are lost
+// (sending [ErrEventOverflow]). The drop policies lose events earlier, but
+// keep the kernel buffer from overflowing for watches that are still read. An
+// [ErrEventOverflow] error is sent on the first drop, and all dropped events
+// are counted in [Stats].
+//
+// This only has effect on Windows, and is a no-op for other backends. This
+// applies to the entire watcher, and can only be used with [NewWatcherWith].
+func WithEventQueue(size int, policy QueuePolicy) addOpt {
+	return func(opt *withOpts) { opt.queueSize, opt.queuePolicy = size, policy }
+}
+
+// Priority is the priority of the events for a watch; see [WithPriority].
+type Priority uint8
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+	PriorityLow
+)
+
+// priorities lists the priorities from highest to lowest.
+var priorities = [...]Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// higher reports if p is a higher priority than other.
+func (p Priority) higher(other Priority) bool {
+	rank := func(p Priority) int {
+		for i, pp := range priorities {
+			if p == pp {
+				return i
+			}
+		}
+		return len(priorities)
+	}
+	return rank(p) < rank(other)
+}
+
+// WithPriority sets the priority for the events of this watch. The default is
+// [PriorityNormal].
+//
+// Every priority has its own queue (see [WithEventQueue]), and queued events
+// with a higher priority are sent on Watcher.Events before those with a lower
+// priority. This way the events for a small number of important paths (such as
+// the application's own config file) aren't stuck behind the events for a
+// large directory tree if the application can't keep up. Events of the same
+// priority are sent in order, but events for different priorities may be sent
+// out of order.
+//
+// If a directory is watched more than once (for example for different files
+// in it) the highest priority is used.
+//
+// This only has effect on Windows, and is a no-op for other backends.
+func WithPriority(p Priority) addOpt {
+	return func(opt *withOpts) { opt.priority = p }
+}
+
+// WithCompletionPort makes the watcher use the I/O completion port handle port
+// with the completion key key, rather than creating its own port and a thread
+// to read from it. This is for applications that already have a loop reading
+// from a completion port, and don't want a second port and thread just for
+// the watcher.
+//
+// The application must call Watcher.HandleCompletion for every packet with
+// this key; see the documentation on that method for the details.
+//
+// This only has effect on Windows, and is a no-op for other backends. This
+// applies to the entire watcher, and can only be used with [NewWatcherWith].
+func WithCompletionPort(port, key uintptr) addOpt {
+	return func(opt *withOpts) { opt.port, opt.portKey = port, key }
+}
+
+// WithEventLog writes events to the Windows Event Log with the given source
+// name, so that services that watch files can be monitored with the standard
+// Windows tooling. The events are:
+//
+//	1    Information  The watcher was created.
+//	2    Information  The watcher was closed.
+//	10   Warning      An overflow; see [ErrEventOverflow].
+//	11   Warning      A watched directory was disconnected; see [Disconnected].
+//	12   Information  A watched directory was reconnected; see [Reconnected].
+//	13   Warning      Access to a watched directory was lost; see [AccessLost].
+//	14   Information  Access to a watched directory was restored; see [AccessRestored].
+//	20   Warning      Any other temporary error sent on Watcher.Errors.
+//	21   Error        Any other error sent on Watcher.Errors.
+//
+// The event source should be registered first (for example with New-EventLog
+// in PowerShell, as Administrator), or the Event Viewer can't show the message
+// text. Creating the watcher fails if the event log can't be opened.
+//
+// This only has effect on Windows, and is a no-op for other backends. This
+// applies to the entire watcher, and can only be used with [NewWatcherWith].
+func WithEventLog(source string) addOpt {
+	return func(opt *withOpts) { opt.eventLog = source }
+}
+
+// WithRestricted makes sure the watcher doesn't access the filesystem by path
+// once Add returns, so a program can add its watches and then apply a tight
+// seccomp filter or Landlock ruleset while still receiving events.
+//
+// All paths are opened in Add (and AddFile, AddAt); after that, events are
+// read from the kernel by file descriptor only. Options and methods that stat
+// or list files while events are read return [ErrRestricted]: these are
+// [DetectAttrChanges], [DetectFileIDs], [DetectHardLinks],
+// [WithSuppressDeleteChmod], the probe of [WithQuiescentWarning], and
+// [Watcher.SetLimit]. Add needs access to the path, so add all watches before
+// applying the policy.
+//
+// This is only supported on Linux; NewWatcherWith returns ErrRestricted on
+// other platforms. The system calls used, besides the ones the Go runtime
+// needs for goroutines, timers, and memory (futex, mmap, nanosleep, etc.), are:
+//
+//	NewWatcherWith         inotify_init1, fcntl, epoll_ctl
+//	                       (with WithPool: epoll_create1, eventfd2, epoll_ctl)
+//	Add, AddWith           inotify_add_watch, newfstatat
+//	                       (with WithNoFollow or WithResolveBeneath: openat2, close)
+//	AddFile                inotify_add_watch, newfstatat
+//	AddAt                  openat, readlinkat, inotify_add_watch, newfstatat, close
+//	reading events         read, epoll_pwait (with WithPool: epoll_wait or
+//	                       epoll_pwait, read)
+//	Remove                 inotify_rm_watch
+//	Close                  epoll_ctl, close
+//
+// The Go runtime waits for the inotify file descriptor with the same epoll
+// instance it uses for the network and pipes.
+//
+// This applies to the entire watcher, and can only be used with
+// [NewWatcherWith].
+func WithRestricted() addOpt {
+	return func(opt *withOpts) { opt.restricted = true }
+}
+
+// setOptions sets the options from NewWatcherWith; this must be called before
+// the reader goroutine is started. It doesn't start any goroutines, so nothing
+// needs to be cleaned up if creating the watcher fails after it; use
+// startOptions for that once the watcher is created.
+func (w *Watcher) setOptions(opts []addOpt) {
+	// Copy, so that len == cap and append() in AddWith always allocates.
+	w.defaults = make([]addOpt, len(opts))
+	copy(w.defaults, opts)
+
+	with := getOptions(opts...)
+	if with.slowAfter > 0 {
+		w.queue.setSlow(with.slowQueued, with.slowAfter)
+	}
+	w.queue.drain = with.drain
+	w.dedup.window = with.dedup
+	w.dedup.merge = with.merge
+	w.dedup.queue = &w.queue
+	w.maxWatch = with.maxWatches
+	w.dispatch = with.dispatch
+	w.faults = with.faults
+	if with.coalesceN > 0 && with.coalesceEvery > 0 {
+		w.coalesce.threshold = with.coalesceN
+	}
+	if with.burstN > 0 && with.burstEvery > 0 {
+		w.bursts.threshold = with.burstN
+	}
+	if with.summaryEvery > 0 {
+		w.summary.on = true
+	}
+	for _, p := range with.lockPatterns {
+		w.locks.add(p)
+	}
+	for _, p := range with.filters {
+		w.filter.add(p)
+	}
+}
+
+// startOptions starts the goroutines for the options set with setOptions; they
+// stop once the watcher is closed.
+func (w *Watcher) startOptions() {
+	with := getOptions(w.defaults...)
+	if with.markEvery > 0 {
+		go w.sendMarks(with.markEvery)
+	}
+	if with.coalesceN > 0 && with.coalesceEvery > 0 {
+		go w.sendEvery(with.coalesceEvery, w.coalesce.flush)
+	}
+	if with.burstN > 0 && with.burstEvery > 0 {
+		go w.sendEvery(with.burstEvery, w.bursts.flush)
+	}
+	if with.summaryEvery > 0 {
+		go w.sendEvery(with.summaryEvery, w.summary.flush)
+	}
+	if len(w.locks.patterns) > 0 {
+		go w.sendEvery(maxLockHold/4, w.locks.expire)
+	}
+	if with.quietAfter > 0 {
+		go w.watchQuiet(with.quietAfter, with.quietProbe)
+	}
+}
+
+// checkRestricted returns an error if o has options that access the filesystem
+// after Add, and WithRestricted is used.
+func (o withOpts) checkRestricted() error {
+	if !o.restricted {
+		return nil
+	}
+	var opt string
+	switch {
+	case o.attrs:
+		opt = "DetectAttrChanges"
+	case o.fileIDs:
+		opt = "DetectFileIDs"
+	case o.hardlinks:
+		opt = "DetectHardLinks"
+	case o.nodelchmod:
+		opt = "WithSuppressDeleteChmod"
+	case o.quietProbe:
+		opt = "WithQuiescentWarning with probe"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: %s stats files while reading events", ErrRestricted, opt)
+}
+
+// watchPath returns the path to watch for name; this is the absolute path if
+// WithAbsolutePaths is set.
+func (o withOpts) watchPath(name string) (string, error) {
+	if !o.absolute {
+		return name, nil
+	}
+	return filepath.Abs(name)
+}
+
+// beneathPath returns name relative to root, or ErrUnsafePath if it's not in
+// root. This only looks at the path, not at the symlinks in it.
+func beneathPath(root, name string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absName, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, absName)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %q is not in %q", ErrUnsafePath, name, root)
+	}
+	return rel, nil
+}
+
+// checkPath checks name for WithNoFollow and WithResolveBeneath with lstat()
+// and by resolving symlinks; this is for backends that don't have something
+// like openat2().
+func (o withOpts) checkPath(name string) error {
+	if o.nofollow {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return err
+		}
+		for p := abs; ; p = filepath.Dir(p) {
+			fi, err := os.Lstat(p)
+			if err != nil {
+				return err
+			}
+			if fi.Mode()&fs.ModeSymlink != 0 {
+				return fmt.Errorf("%w: %q is a symlink", ErrUnsafePath, p)
+			}
+			if filepath.Dir(p) == p {
+				break
+			}
+		}
+	}
+
+	if o.beneath != "" {
+		if _, err := beneathPath(o.beneath, name); err != nil {
+			return err
+		}
+		root, err := filepath.EvalSymlinks(o.beneath)
+		if err != nil {
+			return err
+		}
+		resolved, err := filepath.EvalSymlinks(name)
+		if err != nil {
+			return err
+		}
+		if _, err := beneathPath(root, resolved); err != nil {
+			return fmt.Errorf("%w: %q resolves to outside %q", ErrUnsafePath, name, o.beneath)
+		}
+	}
+	return nil
+}
+
+// eventName returns name after applying WithNormalizer, if set.
+func (o withOpts) eventName(name string) string {
+	if o.normalize == nil {
+		return name
+	}
+	return o.normalize(name)
+}
+
+// WatchSet is a serializable description of the paths a [Watcher] watches and
+// the options they were added with, as returned by [Watcher.Export].
+//
+// It can be encoded with encoding/json or similar, and used to create an
+// equivalent watcher with [NewWatcherFromSet]; for example after the watcher
+// failed with a fatal error, or in a child process.
+type WatchSet struct {
+	Watches []WatchSpec `json:"watches"`
+}
+
+// WatchSpec describes a single path in a [WatchSet].
+//
+// The functions from [WithRetry] and [WithNormalizer] can't be serialized and
+// aren't included; pass them to [NewWatcherFromSet] again if you need them.
+type WatchSpec struct {
+	Path               string    `json:"path"`
+	Ops                Op        `json:"ops"`
+	BufferSize         int       `json:"buffer_size,omitempty"`
+	WithoutDirectories bool      `json:"without_directories,omitempty"`
+	PreferCloseWrite   bool      `json:"prefer_close_write,omitempty"`
+	ResolveShortNames  bool      `json:"resolve_short_names,omitempty"`
+	DetectHardLinks    bool      `json:"detect_hard_links,omitempty"`
+	DetectAttrChanges  bool      `json:"detect_attr_changes,omitempty"`
+	ShareMode          ShareMode `json:"share_mode,omitempty"` // Only set with WithShareMode.
+}
+
+func (o withOpts) spec(path string) WatchSpec {
+	return WatchSpec{
+		Path:               path,
+		Ops:                o.op,
+		BufferSize:         o.bufsize,
+		WithoutDirectories: o.withoutdir,
+		PreferCloseWrite:   o.preferclosewrite,
+		ResolveShortNames:  o.longnames,
+		DetectHardLinks:    o.hardlinks,
+		DetectAttrChanges:  o.attrs,
+		ShareMode:          o.share,
+	}
+}
+
+func (s WatchSpec) opts() []addOpt {
+	opts := []addOpt{WithOps(s.Ops)}
+	if s.Ops == 0 {
+		opts[0] = WithOps(defaultOpts.op)
+	}
+	if s.BufferSize > 0 {
+		opts = append(opts, WithBufferSize(s.BufferSize))
+	}
+	if s.WithoutDirectories {
+		opts = append(opts, WithoutDirectories())
+	}
+	if s.PreferCloseWrite {
+		opts = append(opts, PreferCloseWrite())
+	}
+	if s.ResolveShortNames {
+		opts = append(opts, ResolveShortNames())
+	}
+	if s.DetectHardLinks {
+		opts = append(opts, DetectHardLinks())
+	}
+	if s.DetectAttrChanges {
+		opts = append(opts, DetectAttrChanges())
+	}
+	if s.ShareMode != 0 {
+		opts = append(opts, WithShareMode(s.ShareMode))
+	}
+	return opts
+}
+
+// Export returns a description of all paths explicitly added with
+// [Watcher.Add] or [Watcher.AddWith] (and are not yet removed), and the options
+// they were added with. The watches are sorted by path.
+//
+// Returns an empty WatchSet if [Watcher.Close] was called.
+func (w *Watcher) Export() WatchSet {
+	watches := w.exportWatches()
+	ws := WatchSet{Watches: make([]WatchSpec, 0, len(watches))}
+	for path, with := range watches {
+		ws.Watches = append(ws.Watches, with.spec(path))
+	}
+	sort.Slice(ws.Watches, func(i, j int) bool { return ws.Watches[i].Path < ws.Watches[j].Path })
+	return ws
+}
+
+// AddContext is like [Watcher.AddWith], but removes the watch when ctx is
+// cancelled, so that watches for a request or session can't be leaked by
+// forgetting to call [Watcher.Remove].
+//
+// Returns ctx.Err() if ctx is already cancelled, without adding the path. The
+// watch is removed from a new goroutine; errors from Remove aren't reported,
+// as the path may already have been removed. If the path is removed and added
+// again before ctx is cancelled, the new watch is removed too.
+func (w *Watcher) AddContext(ctx context.Context, path string, opts ...addOpt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := w.AddWith(path, opts...); err != nil {
+		return err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.Remove(path)
+		case <-w.Done():
+		}
+	}()
+	return nil
+}
+
+// NewWatcherFromSet creates a new Watcher and adds all the paths in ws to it,
+// with the options they were exported with.
+//
+// Any opts are applied to every path after the options from ws; for example to
+// add [WithRetry] again.
+//
+// If any of the paths can't be added the watcher is closed and the error is
+// returned; paths that no longer exist are not skipped.
+func NewWatcherFromSet(ws WatchSet, opts ...addOpt) (*Watcher, error) {
+	w, err := NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range ws.Watches {
+		err := w.AddWith(s.Path, append(s.opts(), opts...)...)
+		if err != nil {
+			w.Close()
+			return nil, fmt.Errorf("fsnotify: restoring watch: %w", err)
+		}
+	}
+	return w, nil
+}
+
 // Check if this path is recursive (ends with "/..." or "\..."), and return the
 // path with the /... stripped.
 func recursivePath(path string) (string, bool) {
@@ -1,6 +1,8 @@
 package fsnotify
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -1132,21 +1134,48 @@ func TestClose(t *testing.T) {
 
 		tmp := t.TempDir()
 		w := newWatcher(t, tmp)
+		if w.IsClosed() {
+			t.Fatal("IsClosed before Close")
+		}
 		if err := w.Close(); err != nil {
 			t.Fatal(err)
 		}
+		if !w.IsClosed() {
+			t.Fatal("IsClosed false after Close")
+		}
 
 		file := join(tmp, "file")
 		touch(t, file)
 		if err := w.Add(file); !errors.Is(err, ErrClosed) {
 			t.Fatalf("wrong error for Add: %#v", err)
 		}
+		if err := w.AddWith(join(tmp, "non-existent")); !errors.Is(err, ErrClosed) {
+			t.Fatalf("wrong error for AddWith: %#v", err)
+		}
+		if err := w.AddContext(context.Background(), file); !errors.Is(err, ErrClosed) {
+			t.Fatalf("wrong error for AddContext: %#v", err)
+		}
+		if h, err := w.AddEx(file); h != nil || !errors.Is(err, ErrClosed) {
+			t.Fatalf("wrong error for AddEx: %#v", err)
+		}
+		if err := w.Replay(tmp); !errors.Is(err, ErrClosed) {
+			t.Fatalf("wrong error for Replay: %#v", err)
+		}
 		if err := w.Remove(file); err != nil {
 			t.Fatalf("wrong error for Remove: %#v", err)
 		}
 		if l := w.WatchList(); l != nil { // Should return an error, but meh :-/
 			t.Fatalf("WatchList not nil: %#v", l)
 		}
+		if ws := w.Export(); len(ws.Watches) != 0 {
+			t.Fatalf("Export not empty: %v", ws)
+		}
+		if err := w.Stop(); err != nil {
+			t.Fatalf("wrong error for Stop: %#v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("wrong error for Close: %#v", err)
+		}
 	})
 }
 
@@ -1229,6 +1258,86 @@ func TestAdd(t *testing.T) {
 	})
 }
 
+func TestWithoutDirectories(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "a")
+	mkdir(t, tmp, "b")
+
+	w := newCollector(t)
+	w.collect(t)
+	if err := w.w.AddWith(join(tmp, "a"), WithoutDirectories()); err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w.w, tmp, "b")
+
+	// The option only applies to the watch it was given to, and also filters
+	// events for directories that no longer exist.
+	mkdir(t, tmp, "a", "sub")
+	mkdir(t, tmp, "b", "sub")
+	touch(t, tmp, "a", "file")
+	touch(t, tmp, "b", "file")
+	rmAll(t, tmp, "a", "sub")
+	rmAll(t, tmp, "b", "sub")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /b/sub
+		create  /a/file
+		create  /b/file
+		remove  /b/sub
+	`))
+}
+
+func TestWithOps(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+
+	w := newCollector(t)
+	w.collect(t)
+	if err := w.w.AddWith(tmp, WithOps(Create|Remove)); err != nil {
+		t.Fatal(err)
+	}
+
+	touch(t, tmp, "file")
+	cat(t, "data", tmp, "file")
+	chmod(t, 0o700, tmp, "file")
+	mv(t, join(tmp, "file"), tmp, "rename")
+	rm(t, tmp, "rename")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /file
+		create  /rename
+		remove  /rename
+	`))
+}
+
+func TestRemoveRoot(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dir := join(tmp, "dir")
+	mkdir(t, dir)
+
+	// The Remove for the watched directory itself is always sent, even with
+	// WithoutDirectories, and the watch is removed.
+	w := newCollector(t)
+	w.collect(t)
+	if err := w.w.AddWith(dir, WithoutDirectories()); err != nil {
+		t.Fatal(err)
+	}
+	rmAll(t, dir)
+	waitForEvents()
+
+	if l := w.w.WatchList(); len(l) != 0 {
+		t.Errorf("WatchList not empty: %s", l)
+	}
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		remove  /dir
+	`))
+}
+
 // TODO: should also check internal state is correct/cleaned up; e.g. no
 // left-over file descriptors or whatnot.
 func TestRemove(t *testing.T) {
@@ -1376,16 +1485,30 @@ func TestEventString(t *testing.T) {
 		want string
 	}{
 		{Event{}, `[no events]   ""`},
-		{Event{"/file", 0}, `[no events]   "/file"`},
+		{Event{Name: "/file", Op: 0}, `[no events]   "/file"`},
 
-		{Event{"/file", Chmod | Create},
+		{Event{Name: "/file", Op: Chmod | Create},
 			`CREATE|CHMOD  "/file"`},
-		{Event{"/file", Rename},
+		{Event{Name: "/file", Op: Rename},
 			`RENAME        "/file"`},
-		{Event{"/file", Remove},
+		{Event{Name: "/file", Op: Remove},
 			`REMOVE        "/file"`},
-		{Event{"/file", Write | Chmod},
+		{Event{Name: "/file", Op: Write | Chmod},
 			`WRITE|CHMOD   "/file"`},
+		{Event{Name: "/file", Op: Write | CloseWrite},
+			`WRITE|CLOSE_WRITE "/file"`},
+		{Event{Name: "/file", Op: Unmount},
+			`UNMOUNT       "/file"`},
+		{Event{Name: "/file", Op: Write | Truncate},
+			`WRITE|TRUNCATE "/file"`},
+		{Event{Name: "/file", Op: Create | UserOp<<1},
+			`CREATE|0x20000 "/file"`},
+		{Event{Name: "/file", Op: UserOp},
+			`0x10000       "/file"`},
+		{Event{Name: "/file", Op: Create, HardLink: true},
+			`CREATE        "/file" (hard link)`},
+		{Event{Name: "/file", Op: Chmod, Attrs: AttrMode | AttrTimes},
+			`CHMOD         "/file" (mode|times)`},
 	}
 
 	for _, tt := range tests {
@@ -1398,186 +1521,2313 @@ func TestEventString(t *testing.T) {
 	}
 }
 
-// Verify the watcher can keep up with file creations/deletions when under load.
-func TestWatchStress(t *testing.T) {
-	if isCI() {
-		t.Skip("fails too often on the CI") // TODO
+func TestErrorTemporary(t *testing.T) {
+	tests := []struct {
+		in        error
+		path      string
+		wantPath  string
+		temporary bool
+	}{
+		{ErrEventOverflow, "", "", true},
+		{fmt.Errorf("wrap: %w", ErrEventOverflow), "/dir", "/dir", true},
+		{syscall.EINTR, "/file", "/file", true},
+		{syscall.ENOENT, "/file", "/file", false},
+		{&fs.PathError{Op: "open", Path: "/path", Err: syscall.ENOENT}, "", "/path", false},
+		{errors.New("oh no"), "", "", false},
 	}
 
-	// On NetBSD ioutil.ReadDir in sendDirectoryChangeEvents() returns EINVAL
-	// ~80% of the time:
-	//
-	//    readdirent /tmp/TestWatchStress3584363325/001: invalid argument
-	//
-	// This ends up calling getdents(), the manpage says:
-	//
-	// [EINVAL]  A directory was being read on NFS, but it was modified on the
-	//           server while it was being read.
-	//
-	// Which is, eh, odd? Maybe I read the code wrong and it's calling another
-	// function too(?)
-	//
-	// Because this happens on the Errors channel we can't "skip" it like with
-	// other kqueue platorms, so just skip the entire test for now.
-	//
-	// TODO: fix this.
-	if runtime.GOOS == "netbsd" {
-		t.Skip("broken on NetBSD")
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			err := newError(tt.in, tt.path)
+			e, ok := err.(interface {
+				Temporary() bool
+				Path() string
+			})
+			if !ok {
+				t.Fatalf("doesn't implement interface: %T", err)
+			}
+			if !errors.Is(err, tt.in) {
+				t.Errorf("errors.Is() is false")
+			}
+			if e.Temporary() != tt.temporary {
+				t.Errorf("Temporary(): have %t; want %t", e.Temporary(), tt.temporary)
+			}
+			if e.Path() != tt.wantPath {
+				t.Errorf("Path(): have %q; want %q", e.Path(), tt.wantPath)
+			}
+			if err.Error() != tt.in.Error() {
+				t.Errorf("Error(): have %q; want %q", err.Error(), tt.in.Error())
+			}
+		})
 	}
+}
 
-	Errorf := func(t *testing.T, msg string, args ...interface{}) {
-		if !isKqueue() {
-			t.Errorf(msg, args...)
-			return
-		}
+func TestExport(t *testing.T) {
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	touch(t, tmp, "file")
 
-		// On kqueue platforms it doesn't seem to sync properly; see comment for
-		// the sleep below.
-		//
-		// TODO: fix this.
-		t.Logf(msg, args...)
-		t.Skip("flaky on kqueue; allowed to fail")
+	w := newWatcher(t)
+	defer w.Close()
+	if err := w.AddWith(join(tmp, "dir"), WithOps(Create|Remove), WithoutDirectories()); err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp, "file")
+
+	ws := w.Export()
+	want := WatchSet{Watches: []WatchSpec{
+		{Path: join(tmp, "dir"), Ops: Create | Remove, BufferSize: defaultOpts.bufsize, WithoutDirectories: true},
+		{Path: join(tmp, "file"), Ops: defaultOpts.op, BufferSize: defaultOpts.bufsize},
+	}}
+	if !reflect.DeepEqual(ws, want) {
+		t.Fatalf("\nhave: %#v\nwant: %#v", ws, want)
+	}
+
+	j, err := json.Marshal(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ws2 WatchSet
+	if err := json.Unmarshal(j, &ws2); err != nil {
+		t.Fatal(err)
 	}
 
+	w2, err := NewWatcherFromSet(ws2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	if have := w2.Export(); !reflect.DeepEqual(have, want) {
+		t.Fatalf("\nhave: %#v\nwant: %#v", have, want)
+	}
+
+	w.Close()
+	if have := w.Export(); len(have.Watches) != 0 {
+		t.Errorf("not empty after Close(): %#v", have)
+	}
+
+	_, err = NewWatcherFromSet(WatchSet{Watches: []WatchSpec{{Path: join(tmp, "nonexistent")}}})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("wrong error: %#v", err)
+	}
+}
+
+func TestNewWatcherWith(t *testing.T) {
 	tmp := t.TempDir()
-	w := newCollector(t, tmp)
-	w.collect(t)
 
-	fmtNum := func(n int) string {
-		s := fmt.Sprintf("%09d", n)
-		return s[:3] + "_" + s[3:6] + "_" + s[6:]
+	w, err := NewWatcherWith(WithOps(Create))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp)
+	if err := w.AddWith(join(tmp), WithOps(Remove)); err != nil {
+		t.Fatal(err)
 	}
 
-	var (
-		numFiles = 1_500_000
-		runFor   = 30 * time.Second
-	)
-	if testing.Short() {
-		runFor = time.Second
+	ws := w.Export()
+	if len(ws.Watches) != 1 || ws.Watches[0].Ops != Create|Remove {
+		t.Errorf("wrong ops: %#v", ws)
 	}
+}
 
-	// Otherwise platforms with low limits such as as OpenBSD and NetBSD will
-	// fail, since every watched file uses a file descriptor. Need superuser
-	// permissions and twiddling with /etc/login.conf to adjust them, so we
-	// can't "just increase it".
-	if isKqueue() && uint64(numFiles) > internal.Maxfiles() {
-		numFiles = int(internal.Maxfiles()) - 100
-		t.Logf("limiting files to %d due to max open files limit", numFiles)
+func TestWithSlowConsumer(t *testing.T) {
+	tmp := t.TempDir()
+
+	w, err := NewWatcherWith(WithSlowConsumer(1, 50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer w.Close()
+	addWatch(t, w, tmp)
 
-	var (
-		prefix = "xyz-prefix-"
-		done   = make(chan struct{})
-	)
-	// testing.Short()
-	go func() {
-		numFiles = createFiles(t, tmp, prefix, numFiles, runFor)
+	// Don't read anything while the events come in.
+	for i := 0; i < 15; i++ {
+		touch(t, tmp, fmt.Sprintf("file%d", i))
+		time.Sleep(20 * time.Millisecond)
+	}
 
-		// TODO: this shouldn't be needed; and if this is too short some very
-		//       odd events happen:
-		//
-		//         fsnotify_test.go:837: saw 42 unexpected events:
-		//             REMOVE               ""
-		//             CREATE               "."
-		//             REMOVE               ""
-		//             CREATE               "."
-		//             REMOVE               ""
-		//             ...
-		//
-		//         fsnotify_test.go:848: expected the following 3175 events, but didn't see them (showing first 100 only)
-		//             REMOVE               "/xyz-prefix-000_015_080"
-		//             REMOVE               "/xyz-prefix-000_014_536"
-		//             CREATE               "/xyz-prefix-000_015_416"
-		//             CREATE               "/xyz-prefix-000_015_406"
-		//             ...
-		//
-		// Should really add a Sync() method which processes all outstanding
-		// events.
-		if isKqueue() {
-			time.Sleep(1000 * time.Millisecond)
-			if !testing.Short() {
-				time.Sleep(1000 * time.Millisecond)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-w.Events:
+		case err := <-w.Errors:
+			var slow *SlowConsumer
+			if !errors.As(err, &slow) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if slow.Duration < 50*time.Millisecond {
+				t.Errorf("duration too short: %s", slow.Duration)
+			}
+			if !isTemporary(err) {
+				t.Error("not temporary")
+			}
+			if s := w.Stats(); s.SlowConsumer != 1 {
+				t.Errorf("wrong Stats.SlowConsumer: %d", s.SlowConsumer)
 			}
+			return
+		case <-timeout:
+			t.Fatal("no SlowConsumer warning")
 		}
+	}
+}
 
-		close(done)
-	}()
-	<-done
+func TestWithDirectDispatch(t *testing.T) {
+	tmp := t.TempDir()
 
-	have := w.stopWait(t, 10*time.Second)
+	var (
+		mu     sync.Mutex
+		events Events
+	)
+	w, err := NewWatcherWith(WithDirectDispatch(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp)
 
-	// Do some work to get reasonably nice error reports; what cmpEvents() gives
-	// us is nice if you have just a few events, but with thousands it qiuckly
-	// gets unwieldy.
+	touch(t, tmp, "file")
+	rm(t, tmp, "file")
+	waitForEvents()
 
-	want := make(map[Event]struct{})
-	for i := 0; i < numFiles; i++ {
-		n := "/" + prefix + fmtNum(i)
-		want[Event{Name: n, Op: Remove}] = struct{}{}
-		want[Event{Name: n, Op: Create}] = struct{}{}
+	select {
+	case e := <-w.Events:
+		t.Errorf("event sent on channel: %s", e)
+	default:
 	}
 
-	var extra Events
-	for _, h := range have {
-		h.Name = filepath.ToSlash(strings.TrimPrefix(h.Name, tmp))
-		_, ok := want[h]
-		if ok {
-			delete(want, h)
-		} else {
-			extra = append(extra, h)
-		}
+	mu.Lock()
+	defer mu.Unlock()
+	cmpEvents(t, tmp, events, newEvents(t, `
+		create  /file
+		remove  /file
+	`))
+}
+
+func TestWithPool(t *testing.T) {
+	pool, err := NewPool()
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer pool.Close()
 
-	if len(extra) > 0 {
-		if len(extra) > 100 {
-			Errorf(t, "saw %d unexpected events (showing first 100 only):\n%s", len(extra), extra[:100])
-		} else {
-			Errorf(t, "saw %d unexpected events:\n%s", len(extra), extra)
+	var (
+		tmps []string
+		ws   []*Watcher
+	)
+	for i := 0; i < 3; i++ {
+		tmp := t.TempDir()
+		w, err := NewWatcherWith(WithPool(pool))
+		if err != nil {
+			t.Fatal(err)
 		}
+		addWatch(t, w, tmp)
+		tmps, ws = append(tmps, tmp), append(ws, w)
 	}
 
-	if len(want) != 0 {
-		wantE := make(Events, 0, len(want))
-		for k := range want {
-			wantE = append(wantE, k)
+	// Make sure the watchers don't get each other's events, and that closing a
+	// watcher doesn't affect the others.
+	if err := ws[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(ws); i++ {
+		touch(t, tmps[i], "file")
+		select {
+		case e := <-ws[i].Events:
+			if have, want := e.Name, join(tmps[i], "file"); have != want {
+				t.Errorf("wrong event for watcher %d: %s", i, e)
+			}
+		case err := <-ws[i].Errors:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout for watcher %d", i)
 		}
+	}
 
-		if len(wantE) > 100 {
-			Errorf(t, "expected the following %d events, but didn't see them (showing first 100 only)\n%s", len(wantE), wantE[:100])
-		} else {
-			Errorf(t, "expected the following %d events, but didn't see them\n%s", len(wantE), wantE)
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range ws {
+		select {
+		case _, ok := <-w.Events:
+			if ok {
+				t.Error("Events not closed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
 		}
 	}
 }
 
-func TestWatchList(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		// TODO: probably should I guess...
-		t.Skip("WatchList has always been broken on Windows and I don't feel like fixing it")
+func TestDrainOnClose(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []addOpt
+		drain bool
+	}{
+		{"drop", nil, false},
+		{"drain", []addOpt{DrainOnClose(5 * time.Second)}, true},
 	}
 
-	t.Parallel()
-
-	tmp := t.TempDir()
-	file := join(tmp, "file")
-	other := join(tmp, "other")
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			w, err := NewWatcherWith(tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addWatch(t, w, tmp)
 
-	touch(t, file)
-	touch(t, other)
+			// Don't read anything yet, so that the reader is blocked on
+			// sending the first event when Close is called.
+			touch(t, tmp, "file")
+			waitForEvents()
+
+			var (
+				n    int
+				done = make(chan struct{})
+			)
+			read := func() {
+				defer close(done)
+				for range w.Events {
+					n++
+				}
+			}
+			// Without DrainOnClose the pending event is dropped, so only
+			// start reading after Close.
+			if tt.drain {
+				go read()
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.drain {
+				go read()
+			}
 
-	w := newWatcher(t, file, tmp)
-	defer w.Close()
+			// Nothing is sent after Close returns: Events must be closed.
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("Events not closed after Close returned")
+			}
 
-	have := w.WatchList()
-	sort.Strings(have)
-	want := []string{tmp, file}
-	if !reflect.DeepEqual(have, want) {
-		t.Errorf("\nhave: %s\nwant: %s", have, want)
+			s := w.Stats()
+			if tt.drain && (n == 0 || s.Dropped != 0) {
+				t.Errorf("events not drained: received %d, dropped %d", n, s.Dropped)
+			}
+			if !tt.drain && (n != 0 || s.Dropped == 0) {
+				t.Errorf("events not dropped: received %d, dropped %d", n, s.Dropped)
+			}
+		})
 	}
 }
 
-func TestOpHas(t *testing.T) {
-	tests := []struct {
+func TestStopWait(t *testing.T) {
+	tmp := t.TempDir()
+	w, err := NewWatcherWith(DrainOnClose(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp)
+
+	touch(t, tmp, "file")
+	waitForEvents()
+
+	if err := w.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(tmp); !errors.Is(err, ErrClosed) {
+		t.Errorf("Add after Stop: %v", err)
+	}
+
+	// The event that was already read is still waiting to be sent, so the
+	// watcher isn't done yet. Events is buffered on Windows.
+	if runtime.GOOS != "windows" {
+		select {
+		case <-w.Done():
+			t.Fatal("Done closed before the events were sent")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	var n int
+	for range w.Events {
+		n++
+	}
+	if n == 0 {
+		t.Error("no events after Stop")
+	}
+	select {
+	case <-w.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done not closed after Events was closed")
+	}
+	w.Wait()
+	if err := w.Close(); err != nil {
+		t.Errorf("Close after Stop: %v", err)
+	}
+}
+
+func TestDefaultWatcher(t *testing.T) {
+	tmp := t.TempDir()
+	dir1, dir2 := join(tmp, "dir1"), join(tmp, "dir2")
+	mkdir(t, dir1)
+	mkdir(t, dir2)
+
+	ch1, err := Add(dir1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch2, err := Add(dir1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch3, err := Add(dir2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recv := func(ch <-chan Event, want string) {
+		t.Helper()
+		select {
+		case e := <-ch:
+			if e.Name != want {
+				t.Errorf("wrong name: %q; want %q", e.Name, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event for %q", want)
+		}
+	}
+	touch(t, dir1, "file")
+	recv(ch1, join(dir1, "file"))
+	recv(ch2, join(dir1, "file"))
+	touch(t, dir2, "file")
+	recv(ch3, join(dir2, "file"))
+
+	// dir1 is still watched for ch2.
+	if err := Unwatch(ch1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-ch1; ok {
+		t.Error("ch1 not closed")
+	}
+	if err := Unwatch(ch1); !errors.Is(err, ErrNonExistentWatch) {
+		t.Errorf("wrong error removing twice: %v", err)
+	}
+	rm(t, dir1, "file")
+	recv(ch2, join(dir1, "file"))
+
+	if err := Unwatch(ch2); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unwatch(ch3); err != nil {
+		t.Fatal(err)
+	}
+	std.mu.Lock()
+	closed := std.w == nil
+	std.mu.Unlock()
+	if !closed {
+		t.Error("watcher not closed after removing all channels")
+	}
+
+	// Created again on the next Add.
+	ch, err := Add(dir2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Unwatch(ch)
+	rm(t, dir2, "file")
+	recv(ch, join(dir2, "file"))
+}
+
+func TestAddContext(t *testing.T) {
+	tmp := t.TempDir()
+	w := newWatcher(t)
+	defer w.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := w.AddContext(ctx, tmp); err != nil {
+		t.Fatal(err)
+	}
+	if l := w.WatchList(); len(l) != 1 {
+		t.Fatalf("wrong watch list after AddContext: %q", l)
+	}
+
+	cancel()
+	for i := 0; len(w.WatchList()) > 0; i++ {
+		if i > 100 {
+			t.Fatalf("not removed after cancel: %q", w.WatchList())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := w.AddContext(ctx, tmp); !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error for cancelled context: %v", err)
+	}
+	if l := w.WatchList(); len(l) != 0 {
+		t.Errorf("added with cancelled context: %q", l)
+	}
+}
+
+func TestAccessLost(t *testing.T) {
+	err := newError(&AccessLost{Dir: "/dir", Err: fs.ErrPermission}, "")
+	if !isTemporary(err) || err.(interface{ Path() string }).Path() != "/dir" {
+		t.Errorf("wrong Temporary() or Path() for %v", err)
+	}
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("doesn't wrap the system error: %v", err)
+	}
+
+	switch {
+	case runtime.GOOS == "linux":
+		t.Skip("inotify keeps sending events after losing access")
+	case runtime.GOOS == "windows":
+		t.Skip("chmod doesn't change the ACL on Windows")
+	case os.Geteuid() == 0:
+		t.Skip("root can always read the directory")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t, tmp)
+	defer w.Close()
+	go func() {
+		for range w.Events {
+		}
+	}()
+	t.Cleanup(func() { os.Chmod(tmp, 0o700) })
+
+	wait := func(want error) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case err := <-w.Errors:
+				if reflect.TypeOf(err) == reflect.TypeOf(want) {
+					if err.(interface{ Path() string }).Path() != tmp {
+						t.Errorf("wrong path: %v", err)
+					}
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timeout waiting for %T", want)
+			}
+		}
+	}
+
+	chmod(t, 0o000, tmp)
+	wait(&AccessLost{})
+	chmod(t, 0o700, tmp)
+	wait(&AccessRestored{})
+}
+
+func TestSupervise(t *testing.T) {
+	tmp := t.TempDir()
+
+	fatal := make(chan error, 1)
+	s, err := Supervise(NewWatcher, func(err error) { fatal <- err })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close the underlying watcher, as if it failed.
+	s.mu.Lock()
+	old := s.w
+	s.mu.Unlock()
+	old.Close()
+
+	select {
+	case err := <-fatal:
+		if !errors.Is(err, errStopped) {
+			t.Errorf("wrong error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("onFatal not called")
+	}
+
+	// The path must be watched again by the new watcher.
+	for {
+		s.mu.Lock()
+		w := s.w
+		s.mu.Unlock()
+		if w != old {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if have := s.WatchList(); len(have) != 1 || have[0] != tmp {
+		t.Errorf("wrong WatchList(): %q", have)
+	}
+
+	touch(t, tmp, "file")
+	select {
+	case e := <-s.Events:
+		if !e.Has(Create) || e.Name != join(tmp, "file") {
+			t.Errorf("wrong event: %s", e)
+		}
+	case err := <-s.Errors:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event after recreating the watcher")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-s.Events; ok {
+		t.Error("Events not closed")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	touch(t, tmp, "dir", "file")
+	touch(t, tmp, "file")
+
+	w := newCollector(t)
+	w.collect(t)
+	if err := w.w.Replay(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	have := w.stop(t)
+	cmpEvents(t, tmp, have, newEvents(t, `
+		create  /dir
+		create  /dir/file
+		create  /file
+	`))
+	// Must be in lexical order; cmpEvents() sorts them.
+	if len(have) == 3 && filepath.ToSlash(have[1].Name) != "/dir/file" {
+		t.Errorf("wrong order:\n%s", have)
+	}
+
+	if err := w.w.Replay(tmp); !errors.Is(err, ErrClosed) {
+		t.Errorf("wrong error after Close: %v", err)
+	}
+}
+
+func TestWithMaxWatches(t *testing.T) {
+	if isSolaris() {
+		t.Skip("WithMaxWatches not supported on " + runtime.GOOS)
+	}
+
+	tmp := t.TempDir()
+	dir1, dir2 := join(tmp, "dir1"), join(tmp, "dir2")
+	mkdir(t, dir1)
+	mkdir(t, dir2)
+
+	w, err := NewWatcherWith(WithMaxWatches(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	addWatch(t, w, dir1)
+	err = w.Add(dir2)
+	var limitErr *WatchLimitError
+	if !errors.As(err, &limitErr) || !errors.Is(err, ErrWatchLimit) {
+		t.Fatalf("wrong error: %#v", err)
+	}
+	if limitErr.Limit != 1 || len(limitErr.Skipped) != 1 || limitErr.Skipped[0] != dir2 {
+		t.Errorf("wrong error: %#v", limitErr)
+	}
+	if have := w.WatchList(); len(have) != 1 || have[0] != dir1 {
+		t.Errorf("wrong WatchList(): %q", have)
+	}
+
+	// Room for one more after removing a watch.
+	if err := w.Remove(dir1); err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, dir2)
+}
+
+func TestRenamedFrom(t *testing.T) {
+	if isKqueue() || isSolaris() {
+		t.Skip("RenamedFrom not supported on " + runtime.GOOS)
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dir1, dir2 := join(tmp, "dir1"), join(tmp, "dir2")
+	mkdir(t, dir1)
+	mkdir(t, dir2)
+	touch(t, dir1, "file")
+
+	w := newCollector(t, dir1, dir2)
+	w.collect(t)
+	mv(t, join(dir1, "file"), dir1, "renamed")
+	mv(t, join(dir1, "renamed"), dir2, "moved")
+
+	var have []string
+	for _, e := range w.stop(t) {
+		if e.Has(Create) {
+			have = append(have, e.RenamedFrom)
+		}
+	}
+	want := []string{join(dir1, "file"), join(dir1, "renamed")}
+	if runtime.GOOS == "windows" {
+		// Moves between directories are a remove and create.
+		want[1] = ""
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+}
+
+func TestWithDedup(t *testing.T) {
+	tmp := t.TempDir()
+	file := join(tmp, "file")
+	touch(t, file)
+
+	ww, err := NewWatcherWith(WithDedup(time.Minute), WithOps(Write|Remove))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &eventCollector{w: ww, done: make(chan struct{})}
+	addWatch(t, w.w, tmp)
+	w.collect(t)
+
+	cat(t, "data", file)
+	cat(t, "data", file)
+	cat(t, "data", file)
+	rm(t, file)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write   /file
+		remove  /file
+	`))
+	if s := w.w.Stats(); s.Deduplicated == 0 {
+		t.Error("Stats.Deduplicated is 0")
+	}
+}
+
+func TestOverflowMarks(t *testing.T) {
+	tmp := t.TempDir()
+	file := join(tmp, "file")
+	touch(t, file)
+
+	ww, err := NewWatcherWith(WithDedup(time.Minute), WithOps(Write), WithOverflowMarks(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &eventCollector{w: ww, done: make(chan struct{})}
+	addWatch(t, w.w, tmp)
+	w.collect(t)
+
+	cat(t, "data", file)
+	cat(t, "data", file)
+	cat(t, "data", file)
+	waitForEvents()
+
+	var dropped int
+	for _, e := range w.stop(t) {
+		if !e.Has(OverflowMark) {
+			continue
+		}
+		if e.Name != tmp {
+			t.Errorf("wrong name for OverflowMark: %q", e.Name)
+		}
+		dropped += e.Dropped
+	}
+	s := w.w.Stats()
+	if dropped == 0 || dropped != s.Deduplicated {
+		t.Errorf("dropped in OverflowMark events is %d; Stats.Deduplicated is %d", dropped, s.Deduplicated)
+	}
+	if s.DroppedByWatch[tmp] != dropped {
+		t.Errorf("Stats.DroppedByWatch is %v; want %d for %q", s.DroppedByWatch, dropped, tmp)
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	c := coalescer{threshold: 2}
+	send := func(name string, op Op) bool { return c.absorb(Event{Name: name, Op: op}) }
+
+	if send("/hot", Create) || send("/hot", Write) || send("/quiet", Write) {
+		t.Fatal("absorbed event under threshold")
+	}
+	if !send("/hot", Write) || !send("/hot", Remove) {
+		t.Fatal("didn't absorb event over threshold")
+	}
+	want := []Event{{Name: "/hot", Op: Write | Remove, Coalesced: 2}}
+	if have := c.flush(); !reflect.DeepEqual(have, want) {
+		t.Fatalf("\nhave: %v\nwant: %v", have, want)
+	}
+
+	// Still hot, as it had more than 2 events in the previous interval.
+	if !send("/hot", Write) {
+		t.Fatal("path not hot anymore")
+	}
+	want = []Event{{Name: "/hot", Op: Write, Coalesced: 1}}
+	if have := c.flush(); !reflect.DeepEqual(have, want) {
+		t.Fatalf("\nhave: %v\nwant: %v", have, want)
+	}
+
+	// Back to normal after an interval with 1 event.
+	if have := c.flush(); len(have) != 0 {
+		t.Fatalf("have %v", have)
+	}
+	if send("/hot", Write) {
+		t.Fatal("path still hot")
+	}
+}
+
+func TestCoalesceHot(t *testing.T) {
+	tmp := t.TempDir()
+	ww, err := NewWatcherWith(WithCoalesceHot(3, 500*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &eventCollector{w: ww, done: make(chan struct{})}
+	addWatch(t, w.w, tmp)
+	w.collect(t)
+
+	fp, err := os.Create(join(tmp, "hot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		fp.WriteString("x")
+		time.Sleep(time.Millisecond)
+	}
+	fp.Close()
+	touch(t, tmp, "quiet")
+	time.Sleep(time.Second)
+
+	var single, coalesced int
+	for _, e := range w.stop(t) {
+		switch filepath.Base(e.Name) {
+		case "hot":
+			if e.Coalesced > 0 {
+				coalesced += e.Coalesced
+			} else {
+				single++
+			}
+		case "quiet":
+			if e.Coalesced != 0 {
+				t.Errorf("quiet path coalesced: %s", e)
+			}
+		}
+	}
+	if single > 3 || coalesced == 0 {
+		t.Errorf("%d single and %d coalesced events for hot path", single, coalesced)
+	}
+}
+
+func TestBursts(t *testing.T) {
+	b := bursts{threshold: 4}
+	send := func(root string, n int) {
+		for i := 0; i < n; i++ {
+			b.count(Event{Name: root + "/file", WatchRoot: root})
+		}
+	}
+	check := func(want ...Event) {
+		t.Helper()
+		if have := b.flush(); !reflect.DeepEqual(have, want) {
+			t.Fatalf("\nhave: %v\nwant: %v", have, want)
+		}
+	}
+
+	send("/busy", 5)
+	send("/quiet", 4)
+	check(Event{Name: "/busy", Op: BurstStart, WatchRoot: "/busy"})
+
+	// Still in a burst until fewer than half the threshold.
+	send("/busy", 2)
+	check()
+	send("/busy", 1)
+	check(Event{Name: "/busy", Op: BurstEnd, WatchRoot: "/busy"})
+	check()
+
+	// Directory if there's no WatchRoot.
+	b.count(Event{Name: "/dir/a"})
+	send("/dir", 4)
+	check(Event{Name: "/dir", Op: BurstStart, WatchRoot: "/dir"})
+}
+
+func TestBurstMarks(t *testing.T) {
+	tmp := t.TempDir()
+	ww, err := NewWatcherWith(WithBurstMarks(20, 200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &eventCollector{w: ww, done: make(chan struct{})}
+	addWatch(t, w.w, tmp)
+	w.collect(t)
+
+	for i := 0; i < 100; i++ {
+		touch(t, tmp, fmt.Sprintf("file%d", i), noWait)
+	}
+	time.Sleep(time.Second)
+
+	var marks []Op
+	for _, e := range w.stop(t) {
+		if e.Has(BurstStart) || e.Has(BurstEnd) {
+			if e.Name != tmp {
+				t.Errorf("wrong name: %s", e)
+			}
+			marks = append(marks, e.Op)
+		}
+	}
+	if !reflect.DeepEqual(marks, []Op{BurstStart, BurstEnd}) {
+		t.Errorf("wrong marks: %v", marks)
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	tmp := t.TempDir()
+	touch(t, tmp, "existing")
+	w := newCollector(t, tmp)
+	if err := w.w.SetLimit(tmp, DirLimit{Entries: 3, Bytes: 10}); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	touch(t, tmp, "file1")
+	touch(t, tmp, "file2")
+	touch(t, tmp, "file3") // Over the entry limit.
+	touch(t, tmp, "file4")
+	rm(t, tmp, "file3")
+	rm(t, tmp, "file4")                 // Back to the limit.
+	cat(t, "0123456789x", tmp, "file1") // Over the size limit.
+
+	var usage []DirUsage
+	for _, e := range w.stop(t) {
+		if e.Has(ThresholdExceeded) {
+			if e.Name != tmp || e.Usage == nil {
+				t.Fatalf("wrong event: %s", e)
+			}
+			usage = append(usage, *e.Usage)
+		}
+	}
+	want := []DirUsage{{Entries: 4}, {Entries: 3, Bytes: 11}}
+	if !reflect.DeepEqual(usage, want) {
+		t.Errorf("\nhave: %v\nwant: %v", usage, want)
+	}
+
+	if err := w.w.SetLimit(join(tmp, "nonexistent"), DirLimit{Entries: 1}); err == nil {
+		t.Error("no error for nonexistent directory")
+	}
+}
+
+func TestSummarizer(t *testing.T) {
+	s := summarizer{on: true}
+	s.absorb(Event{Name: "/a/file1", Op: Create})
+	s.absorb(Event{Name: "/a/file1", Op: Write})
+	s.absorb(Event{Name: "/a/file2", Op: Write | Chmod})
+	s.absorb(Event{Name: "/b/x", Op: Remove})
+	for i := 0; i < summaryNames+5; i++ {
+		s.absorb(Event{Name: fmt.Sprintf("/c/%03d", i), Op: Create})
+	}
+
+	have := s.flush()
+	if len(have) != 3 {
+		t.Fatalf("want 3 summaries, have %d: %v", len(have), have)
+	}
+	want := Event{Name: "/a", Op: Create | Write | Chmod, Summary: &Summary{
+		Counts: map[Op]int{Create: 1, Write: 2, Chmod: 1},
+		Names:  []string{"/a/file1", "/a/file2"},
+	}}
+	if !reflect.DeepEqual(have[0], want) {
+		t.Errorf("\nhave: %v %+v\nwant: %v %+v", have[0], have[0].Summary, want, want.Summary)
+	}
+	if have[1].Name != "/b" || have[1].Summary.Counts[Remove] != 1 {
+		t.Errorf("wrong summary for /b: %+v", have[1].Summary)
+	}
+	if c := have[2].Summary; len(c.Names) != summaryNames || c.More != 5 || c.Names[0] != "/c/000" {
+		t.Errorf("wrong summary for /c: %d names, %d more", len(c.Names), c.More)
+	}
+
+	if have := s.flush(); len(have) != 0 {
+		t.Errorf("not reset: %v", have)
+	}
+}
+
+func TestSummaries(t *testing.T) {
+	tmp := t.TempDir()
+	ww, err := NewWatcherWith(WithSummaries(200 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &eventCollector{w: ww, done: make(chan struct{})}
+	addWatch(t, w.w, tmp)
+	w.collect(t)
+
+	touch(t, tmp, "file1", noWait)
+	touch(t, tmp, "file2", noWait)
+	rm(t, tmp, "file1", noWait)
+	time.Sleep(500 * time.Millisecond)
+
+	var (
+		names = make(map[string]struct{})
+		ops   Op
+	)
+	for _, e := range w.stop(t) {
+		if e.Summary == nil || e.Name != tmp {
+			t.Errorf("not a summary for the directory: %s", e)
+			continue
+		}
+		for _, n := range e.Summary.Names {
+			names[filepath.Base(n)] = struct{}{}
+		}
+		ops |= e.Op
+	}
+	if len(names) != 2 || !ops.Has(Create) || !ops.Has(Remove) {
+		t.Errorf("wrong summaries: %v %s", names, ops)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	var (
+		r      routes
+		called string
+	)
+	handler := func(name string) func(Event) { return func(Event) { called = name } }
+	r.set("/srv", handler("srv"))
+	r.set("/srv/data", handler("data"))
+	r.set("rel", handler("rel"))
+
+	tests := []struct {
+		name, want string
+	}{
+		{"/srv/data/file", "data"},
+		{"/srv/data", "data"},
+		{"/srv/database", "srv"},
+		{"/srv/file", "srv"},
+		{"/srv", "srv"},
+		{"/other", ""},
+		{"rel/file", "rel"},
+		{"release", ""},
+	}
+	for _, tt := range tests {
+		called = ""
+		if ok := r.route(Event{Name: tt.name}); ok != (tt.want != "") || called != tt.want {
+			t.Errorf("%q: have %q (%t); want %q", tt.name, called, ok, tt.want)
+		}
+	}
+
+	r.set("/srv/data", nil)
+	called = ""
+	if r.route(Event{Name: "/srv/data/file"}); called != "srv" {
+		t.Errorf("after removing: have %q", called)
+	}
+}
+
+func TestWatcherRoute(t *testing.T) {
+	tmp := t.TempDir()
+	mkdir(t, tmp, "sub")
+	w := newCollector(t, tmp, join(tmp, "sub"))
+
+	var (
+		mu     sync.Mutex
+		routed []string
+	)
+	w.w.Route(join(tmp, "sub"), func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		routed = append(routed, e.Name)
+	})
+	w.collect(t)
+
+	touch(t, tmp, "file")
+	touch(t, tmp, "sub", "file")
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create /file
+	`))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(routed) == 0 {
+		t.Fatal("no events routed")
+	}
+	for _, n := range routed {
+		if n != join(tmp, "sub", "file") && n != join(tmp, "sub") {
+			t.Errorf("wrong event routed: %q", n)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	var f filter
+	f.add(FilterPresetEditors)
+	f.add(FilterPresetVCS)
+	f.add(FilterPresetBuildArtifacts)
+
+	tests := []struct {
+		name string
+		drop bool
+	}{
+		{"/src/main.go", false},
+		{"/src/4913", true},
+		{"/src/.main.go.swp", true},
+		{"/src/main.go~", true},
+		{"/src/.#main.go", true},
+		{"/src/~$report.docx", true},
+		{"/src/report.docx", false},
+		{"/src/.git/index.lock", true},
+		{"/src/.git/refs/heads/main.lock", true},
+		{"/src/.git/HEAD", false},
+		{"/src/.git/objects/ab/tmp_obj_123", true},
+		{"/src/.git/objects/ab/cdef", false},
+		{"/src/vendor.lock", false},
+		{"/src/node_modules", true},
+		{"/src/node_modules/pkg/index.js", true},
+		{"/src/my_node_modules/index.js", false},
+		{"/src/pkg/__pycache__/mod.cpython-311.pyc", true},
+		{"main.o", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if have := f.drop(Event{Name: filepath.FromSlash(tt.name)}); have != tt.drop {
+			t.Errorf("%q: have %t; want %t", tt.name, have, tt.drop)
+		}
+	}
+}
+
+func TestFilterPresets(t *testing.T) {
+	tmp := t.TempDir()
+	ww, err := NewWatcherWith(WithFilterPresets(FilterPresetEditors))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &eventCollector{w: ww, done: make(chan struct{})}
+	addWatch(t, w.w, tmp)
+	w.collect(t)
+
+	touch(t, tmp, "4913")
+	touch(t, tmp, ".file.swp")
+	touch(t, tmp, "file")
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create /file
+	`))
+	if s := ww.Stats(); s.Filtered < 2 {
+		t.Errorf("Filtered is %d", s.Filtered)
+	}
+}
+
+func TestListings(t *testing.T) {
+	var l listings
+	if seq := l.count(Event{Name: "/dir/a"}); seq != 1 {
+		t.Errorf("wrong seq: %d", seq)
+	}
+
+	l.start("/dir")
+	cutoff := l.current()
+	l.count(Event{Name: "/other/a"})
+	if l.changed("/dir", cutoff) {
+		t.Error("changed after event for other directory")
+	}
+	l.count(Event{Name: "/dir"})
+	if !l.changed("/dir", cutoff) {
+		t.Error("not changed after event for the directory itself")
+	}
+	cutoff = l.current()
+	if l.changed("/dir", cutoff) {
+		t.Error("changed with new cutoff")
+	}
+	l.count(Event{Name: "/dir/b"})
+	if !l.changed("/dir", cutoff) {
+		t.Error("not changed after event in the directory")
+	}
+
+	l.stop("/dir")
+	if len(l.active) != 0 || len(l.last) != 0 {
+		t.Errorf("not removed: %v %v", l.active, l.last)
+	}
+}
+
+func TestListConsistent(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t, tmp)
+	w.collect(t)
+
+	touch(t, tmp, "a")
+	touch(t, tmp, "b")
+	list, err := w.w.ListConsistent(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range list.Entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, " ") != "a b" {
+		t.Errorf("wrong entries: %q", names)
+	}
+	touch(t, tmp, "c")
+
+	events := w.stop(t)
+	for _, e := range events {
+		after := e.Name == join(tmp, "c")
+		if e.Seq == 0 || (e.Seq > list.Cutoff) != after {
+			t.Errorf("wrong Seq %d for %s with cutoff %d", e.Seq, e, list.Cutoff)
+		}
+	}
+
+	if _, err := w.w.ListConsistent(join(tmp, "nonexistent")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	var p pipeline
+	if e, ok := p.apply(Event{Name: "/a", Op: Create}); !ok || e.Name != "/a" {
+		t.Errorf("wrong result without functions: %v %v", e, ok)
+	}
+
+	p.add(func(e Event) (Event, bool) {
+		e.Name += "/1"
+		e.Op = Remove
+		return e, true
+	})
+	p.add(func(e Event) (Event, bool) {
+		e.Name += "/2"
+		return e, !strings.HasPrefix(e.Name, "/drop")
+	})
+	if e, ok := p.apply(Event{Name: "/a", Op: Create}); !ok || e.Name != "/a/1/2" || e.Op != Create {
+		t.Errorf("wrong result: %v %v", e, ok)
+	}
+	if e, ok := p.apply(Event{Name: "/drop", Op: Create}); ok {
+		t.Errorf("not dropped: %v", e)
+	}
+}
+
+func TestUse(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t, tmp)
+	w.w.Use(func(e Event) (Event, bool) {
+		return e, !strings.HasSuffix(e.Name, ".tmp")
+	})
+	w.w.Use(func(e Event) (Event, bool) {
+		e.Name += ".seen"
+		return e, true
+	})
+	w.collect(t)
+
+	touch(t, tmp, "file.tmp")
+	touch(t, tmp, "file")
+	events := w.stop(t)
+	if len(events) == 0 || events[0].Name != join(tmp, "file.seen") || !events[0].Has(Create) {
+		t.Fatalf("wrong events:\n%s", events)
+	}
+	for _, e := range events {
+		if e.Name != join(tmp, "file.seen") {
+			t.Errorf("wrong event: %s", e)
+		}
+	}
+}
+
+func TestLockfiles(t *testing.T) {
+	var l lockfiles
+	l.add(".~lock.*#")
+	l.add("*.lock")
+	l.add("no-star")
+	l.add("*two*")
+	if len(l.patterns) != 2 {
+		t.Fatalf("wrong patterns: %v", l.patterns)
+	}
+	send := func(name string, op Op) (bool, *Event) { return l.hold(Event{Name: name, Op: op}) }
+
+	if held, _ := send("/dir/.~lock.doc.odt#", Create); held {
+		t.Fatal("held lock file")
+	}
+	if held, _ := send("/dir/doc.odt", Write); !held {
+		t.Fatal("didn't hold locked file")
+	}
+	if held, _ := send("/dir/doc.odt", Chmod); !held {
+		t.Fatal("didn't hold locked file")
+	}
+	if held, _ := send("/dir/other.odt", Write); held {
+		t.Fatal("held file that isn't locked")
+	}
+	if held, _ := send("/other/doc.odt", Write); held {
+		t.Fatal("held file in other directory")
+	}
+
+	held, released := send("/dir/.~lock.doc.odt#", Remove)
+	want := &Event{Name: "/dir/doc.odt", Op: Write | Chmod, Coalesced: 2}
+	if held || !reflect.DeepEqual(released, want) {
+		t.Fatalf("\nhave: %v (held: %t)\nwant: %v", released, held, want)
+	}
+	if held, _ := send("/dir/doc.odt", Write); held {
+		t.Fatal("held file after lock was removed")
+	}
+
+	// Nothing to release if there were no events.
+	send("/dir/data.lock", Create)
+	if _, released := send("/dir/data.lock", Rename); released != nil {
+		t.Fatalf("released %v", released)
+	}
+
+	// Held events are sent once the lock file is older than maxHold, and the
+	// file isn't held any more after that.
+	l.maxHold = 50 * time.Millisecond
+	send("/dir/data.lock", Create)
+	send("/dir/data", Write)
+	if have := l.expire(); len(have) != 0 {
+		t.Fatalf("expired too soon: %v", have)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if have, want := l.expire(), []Event{{Name: "/dir/data", Op: Write, Coalesced: 1}}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("\nhave: %v\nwant: %v", have, want)
+	}
+	if held, _ := send("/dir/data", Write); held {
+		t.Fatal("held file after lock expired")
+	}
+
+	// Removing the watch for the directory drops the held events.
+	send("/dir/data.lock", Create)
+	send("/dir/data", Write)
+	l.remove(filepath.FromSlash("/dir"))
+	if held, _ := send("/dir/data", Write); held {
+		t.Fatal("held file after watch was removed")
+	}
+	if _, released := send("/dir/data.lock", Remove); released != nil {
+		t.Fatalf("released %v after watch was removed", released)
+	}
+}
+
+func TestLockfileConvention(t *testing.T) {
+	tmp := t.TempDir()
+	ww, err := NewWatcherWith(WithLockfileConvention("*.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &eventCollector{w: ww, done: make(chan struct{})}
+	addWatch(t, w.w, tmp)
+	w.collect(t)
+
+	touch(t, tmp, "data.lock")
+	for i := 0; i < 5; i++ {
+		cat(t, "x", tmp, "data")
+	}
+	rm(t, tmp, "data.lock")
+	touch(t, tmp, "other")
+
+	var (
+		events   = w.stop(t)
+		released = -1
+	)
+	for i, e := range events {
+		if filepath.Base(e.Name) != "data" {
+			continue
+		}
+		if released > -1 || e.Coalesced == 0 {
+			t.Fatalf("event for locked file wasn't held: %s\n%v", e, events)
+		}
+		released = i
+	}
+	if released == -1 {
+		t.Fatalf("no event for locked file:\n%v", events)
+	}
+	e := events[released]
+	if !e.Has(Create) || !e.Has(Write) {
+		t.Errorf("wrong operations for held event: %s", e)
+	}
+	if released+1 == len(events) || filepath.Base(events[released+1].Name) != "data.lock" ||
+		!events[released+1].Has(Remove) {
+		t.Errorf("held event not sent before removing the lock file: %v", events)
+	}
+}
+
+func TestWatchFunc(t *testing.T) {
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	mkdir(t, tmp, "flat")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, errs, err := Watch(ctx,
+		[]string{join(tmp, "dir", "..."), join(tmp, "flat")}, WithOps(Create))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	wait := func(name string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for !seen[name] {
+			select {
+			case e := <-events:
+				seen[e.Name] = true
+			case err := <-errs:
+				t.Fatal(err)
+			case <-timeout:
+				t.Fatalf("no event for %q; have %v", name, seen)
+			}
+		}
+	}
+	mkdir(t, tmp, "dir", "sub")
+	wait(join(tmp, "dir", "sub"))
+	touch(t, tmp, "dir", "sub", "file")
+	wait(join(tmp, "dir", "sub", "file"))
+	touch(t, tmp, "flat", "file")
+	wait(join(tmp, "flat", "file"))
+
+	cancel()
+	timeout := time.After(5 * time.Second)
+	for events != nil || errs != nil {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+			}
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+			}
+		case <-timeout:
+			t.Fatal("channels not closed after cancelling ctx")
+		}
+	}
+
+	t.Run("error", func(t *testing.T) {
+		_, _, err := Watch(context.Background(), []string{join(tmp, "flat"), join(tmp, "nonexistent")})
+		if err == nil || !strings.Contains(err.Error(), "nonexistent") {
+			t.Errorf("wrong error: %v", err)
+		}
+	})
+}
+
+func TestAddEx(t *testing.T) {
+	tmp := t.TempDir()
+	w := newCollector(t)
+	h, err := w.w.AddEx(tmp, WithOps(Create|Remove))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Path() != tmp {
+		t.Errorf("wrong path: %q", h.Path())
+	}
+	if h.Watches() == 0 {
+		t.Error("Watches is 0")
+	}
+	if spec := h.Spec(); spec.Path != tmp || spec.Ops != Create|Remove {
+		t.Errorf("wrong spec: %+v", spec)
+	}
+	h2, err := w.w.AddEx(tmp+string(filepath.Separator), WithOps(Create|Remove))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2.Path() != tmp {
+		t.Errorf("wrong path for second handle: %q", h2.Path())
+	}
+	if h2.Watches() != 0 {
+		t.Errorf("Watches for second handle is %d", h2.Watches())
+	}
+	w.collect(t)
+
+	touch(t, tmp, "file1")
+	if err := h.Suspend(); err != nil {
+		t.Fatal(err)
+	}
+	if !h.Suspended() || len(w.w.WatchList()) != 0 {
+		t.Fatalf("not suspended: %v", w.w.WatchList())
+	}
+	touch(t, tmp, "file2")
+	if err := h.Resume(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.SetBufferSize(8192); err != nil {
+		t.Fatal(err)
+	}
+	if spec := h.Spec(); spec.BufferSize != 8192 || spec.Ops != Create|Remove {
+		t.Errorf("wrong spec after SetBufferSize: %+v", spec)
+	}
+	touch(t, tmp, "file3")
+
+	if err := h.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if l := w.w.WatchList(); len(l) != 0 {
+		t.Errorf("still watched: %v", l)
+	}
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create /file1
+		create /file3
+	`))
+}
+
+func TestQuiescentWarning(t *testing.T) {
+	tmp := t.TempDir()
+
+	t.Run("no probe", func(t *testing.T) {
+		w, err := NewWatcherWith(WithQuiescentWarning(50*time.Millisecond, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		addWatch(t, w, tmp)
+
+		select {
+		case err := <-w.Errors:
+			var q *Quiescent
+			if !errors.As(err, &q) {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if q.Frozen != nil {
+				t.Errorf("Frozen set without probe: %q", q.Frozen)
+			}
+		case e := <-w.Events:
+			t.Fatalf("unexpected event: %s", e)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no Quiescent warning")
+		}
+	})
+
+	// The probe finishes, so the filesystem isn't frozen.
+	t.Run("probe", func(t *testing.T) {
+		w, err := NewWatcherWith(WithQuiescentWarning(50*time.Millisecond, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		addWatch(t, w, tmp)
+
+		timeout := time.After(500 * time.Millisecond)
+		for {
+			select {
+			case err := <-w.Errors:
+				t.Fatalf("unexpected error: %v", err)
+			case <-w.Events:
+			case <-timeout:
+				return
+			}
+		}
+	})
+}
+
+func TestDetectHardLinks(t *testing.T) {
+	switch runtime.GOOS {
+	case "windows", "illumos", "solaris":
+		t.Skip("DetectHardLinks not supported on " + runtime.GOOS)
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, DetectHardLinks(), WithOps(Create)); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	if err := os.Link(join(tmp, "file"), join(tmp, "link")); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, tmp, "new")
+
+	events := w.stop(t)
+	links := make(map[string]bool)
+	for _, e := range events {
+		links[filepath.Base(e.Name)] = e.HardLink
+	}
+	if len(links) != 2 || !links["link"] || links["new"] {
+		t.Errorf("wrong events:\n%s", events)
+	}
+}
+
+func TestDetectAttrChanges(t *testing.T) {
+	switch runtime.GOOS {
+	case "windows", "illumos", "solaris":
+		t.Skip("DetectAttrChanges not supported on " + runtime.GOOS)
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := join(tmp, "file")
+	touch(t, file)
+
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, DetectAttrChanges(), WithOps(Chmod)); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	if err := os.Chmod(file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+	mtime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	events := w.stop(t)
+	if len(events) != 2 || events[0].Attrs != AttrMode || events[1].Attrs != AttrTimes {
+		t.Errorf("wrong events:\n%s", events)
+	}
+}
+
+func TestDetectAttrChangesOwner(t *testing.T) {
+	switch runtime.GOOS {
+	case "windows", "illumos", "solaris":
+		t.Skip("DetectAttrChanges not supported on " + runtime.GOOS)
+	}
+	if os.Getuid() != 0 {
+		t.Skip("need root to chown")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := join(tmp, "file")
+	touch(t, file)
+
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, DetectAttrChanges(), WithOps(Chmod)); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	if err := os.Lchown(file, 1234, 5678); err != nil {
+		t.Fatal(err)
+	}
+
+	events := w.stop(t)
+	if len(events) != 1 || events[0].Attrs&AttrOwner == 0 || events[0].Owner == nil {
+		t.Fatalf("wrong events:\n%s", events)
+	}
+	if o := *events[0].Owner; o.NewUID != 1234 || o.NewGID != 5678 || o.OldUID != 0 {
+		t.Errorf("wrong owner: %+v", o)
+	}
+}
+
+// Not parallel, as it changes the working directory of the process.
+func TestDetectFileIDs(t *testing.T) {
+	switch runtime.GOOS {
+	case "windows", "illumos", "solaris":
+		t.Skip("DetectFileIDs not supported on " + runtime.GOOS)
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "a")
+
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, DetectFileIDs(), WithOps(Create|Rename|Remove)); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	mv(t, join(tmp, "a"), tmp, "b") // Same file, new name.
+	touch(t, tmp, "c")
+	mv(t, join(tmp, "c"), tmp, "b") // Replaces b.
+	rm(t, tmp, "b")
+
+	ids := make(map[string][]uint64)
+	for _, e := range w.stop(t) {
+		k := e.Op.String() + " " + filepath.Base(e.Name)
+		ids[k] = append(ids[k], e.FileID)
+	}
+	var (
+		renameA = ids["RENAME a"]
+		renameC = ids["RENAME c"]
+		createB = ids["CREATE b"]
+		removeB = ids["REMOVE b"]
+	)
+	if len(renameA) != 1 || len(renameC) != 1 || len(createB) != 2 || len(removeB) == 0 {
+		t.Fatalf("wrong events: %v", ids)
+	}
+	if renameA[0] == 0 || renameA[0] != createB[0] {
+		t.Errorf("rename a → b: FileID not the same: %v", ids)
+	}
+	if renameC[0] != createB[1] || createB[1] == createB[0] {
+		t.Errorf("rename c → b: FileID wrong: %v", ids)
+	}
+	if last := removeB[len(removeB)-1]; last != createB[1] {
+		t.Errorf("remove b: FileID wrong: %v", ids)
+	}
+}
+
+func TestEventDevice(t *testing.T) {
+	switch runtime.GOOS {
+	case "illumos", "solaris":
+		t.Skip("Event.Device not supported on " + runtime.GOOS)
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t, tmp)
+	w.collect(t)
+
+	touch(t, tmp, "file")
+	rm(t, tmp, "file")
+
+	events := w.stop(t)
+	if len(events) == 0 {
+		t.Fatal("no events")
+	}
+	for _, e := range events {
+		if e.Device == 0 || e.Device != events[0].Device {
+			t.Errorf("wrong Device: %d: %s", e.Device, e)
+		}
+	}
+}
+
+func TestWithAbsolutePaths(t *testing.T) {
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	mkdir(t, tmp, "other")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newCollector(t)
+	if err := w.w.AddWith("dir", WithAbsolutePaths()); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	// Events must still refer to the directory in tmp after a chdir.
+	if err := os.Chdir(join(tmp, "other")); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, tmp, "dir", "file")
+
+	list := w.w.WatchList()
+	if len(list) != 1 || list[0] != join(tmp, "dir") {
+		t.Fatalf("wrong WatchList: %q", list)
+	}
+	events := w.stop(t)
+	if len(events) == 0 {
+		t.Fatal("no events")
+	}
+	for _, e := range events {
+		if e.Name != filepath.Join(list[0], "file") {
+			t.Errorf("not an absolute path: %s", e)
+		}
+	}
+}
+
+// Add on a symlink to a directory with FollowSymlinks(true) watches the
+// directory the link points to, and events are for the path of the link on all
+// platforms.
+func TestAddSymlinkDir(t *testing.T) {
+	if !internal.HasPrivilegesForSymlink() {
+		t.Skip("does not have privileges for symlink on this OS")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	symlink(t, "dir", tmp, "link") // Relative target.
+	symlink(t, "missing", tmp, "broken")
+
+	w := newCollector(t)
+	if err := w.w.AddWith(join(tmp, "broken"), FollowSymlinks(true)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Add on broken symlink: wrong error\nhave: %v\nwant: %v", err, fs.ErrNotExist)
+	}
+	if err := w.w.AddWith(join(tmp, "link"), FollowSymlinks(true)); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	touch(t, tmp, "dir", "file")
+	eventSeparator()
+	if err := w.w.Remove(join(tmp, "link")); err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+	touch(t, tmp, "dir", "file2")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /link/file
+	`))
+}
+
+// FollowSymlinks(false) watches the link itself, not the file it points to.
+func TestFollowSymlinksFalse(t *testing.T) {
+	if !internal.HasPrivilegesForSymlink() {
+		t.Skip("does not have privileges for symlink on this OS")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+	symlink(t, join(tmp, "file"), tmp, "link")
+
+	w := newCollector(t)
+	err := w.w.AddWith(join(tmp, "link"), FollowSymlinks(false))
+	switch runtime.GOOS {
+	case "linux", "darwin", "illumos", "solaris":
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		if !errors.Is(err, ErrUnsupportedPath) {
+			t.Fatalf("wrong error\nhave: %v\nwant: %v", err, ErrUnsupportedPath)
+		}
+		return
+	}
+	w.collect(t)
+
+	cat(t, "data", tmp, "file")
+	rm(t, tmp, "link")
+
+	events := w.stop(t)
+	for _, e := range events {
+		if e.Has(Write) {
+			t.Errorf("write to the file the link points to was sent: %s", e)
+		}
+	}
+	if len(events) == 0 || !events[len(events)-1].Has(Remove) || events[len(events)-1].Name != join(tmp, "link") {
+		t.Errorf("no Remove for the link; have:\n%s", events)
+	}
+}
+
+func TestUnsafePath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need special permissions on Windows")
+	}
+	t.Parallel()
+
+	// TempDir may be in a symlink (e.g. /var on macOS).
+	tmp, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdirAll(t, tmp, "root", "dir")
+	mkdir(t, tmp, "outside")
+	symlink(t, join(tmp, "outside"), tmp, "root", "escape")
+	symlink(t, "dir", tmp, "root", "link")
+
+	tests := []struct {
+		path string
+		opt  addOpt
+		want error
+	}{
+		{join(tmp, "root", "dir"), WithNoFollow(), nil},
+		{join(tmp, "root", "link"), WithNoFollow(), ErrUnsafePath},
+		{join(tmp, "root", "escape"), WithNoFollow(), ErrUnsafePath},
+
+		{join(tmp, "root", "dir"), WithResolveBeneath(join(tmp, "root")), nil},
+		{join(tmp, "root", "link"), WithResolveBeneath(join(tmp, "root")), nil},
+		{join(tmp, "root", "escape"), WithResolveBeneath(join(tmp, "root")), ErrUnsafePath},
+		{join(tmp, "outside"), WithResolveBeneath(join(tmp, "root")), ErrUnsafePath},
+		{join(tmp, "root", "..", "outside"), WithResolveBeneath(join(tmp, "root")), ErrUnsafePath},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			w := newWatcher(t)
+			defer w.Close()
+
+			err := w.AddWith(tt.path, tt.opt)
+			if errors.Is(err, syscall.ENOSYS) {
+				t.Skip("openat2 not supported")
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%s: wrong error\nhave: %v\nwant: %v", tt.path, err, tt.want)
+			}
+			if err == nil && len(w.WatchList()) != 1 {
+				t.Errorf("%s: not watched", tt.path)
+			}
+
+			// Also test the lstat() version on Linux.
+			if err := getOptions(tt.opt).checkPath(tt.path); !errors.Is(err, tt.want) {
+				t.Errorf("%s: wrong error from checkPath\nhave: %v\nwant: %v", tt.path, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithExclusive(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t)
+	defer w.Close()
+
+	if err := w.AddWith(tmp, WithExclusive()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddWith(tmp, WithExclusive()); !errors.Is(err, ErrAlreadyWatched) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if err := w.Add(tmp); err != nil {
+		t.Errorf("Add without WithExclusive: %v", err)
+	}
+	if l := w.WatchList(); len(l) != 1 {
+		t.Errorf("wrong WatchList: %q", l)
+	}
+}
+
+func TestWatchRoot(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "windows":
+	default:
+		t.Skip("WatchRoot not supported on " + runtime.GOOS)
+	}
+
+	for _, merge := range []bool{false, true} {
+		merge := merge
+		t.Run(fmt.Sprintf("merge=%t", merge), func(t *testing.T) {
+			t.Parallel()
+
+			tmp := t.TempDir()
+			file := join(tmp, "file")
+			touch(t, file)
+
+			var opts []addOpt
+			if merge {
+				opts = append(opts, WithMergeOverlapping())
+			}
+			ww, err := NewWatcherWith(append(opts, WithOps(Write))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := &eventCollector{w: ww, done: make(chan struct{})}
+			addWatch(t, w.w, tmp)
+			addWatch(t, w.w, file)
+			w.collect(t)
+
+			cat(t, "data", file)
+
+			roots := make(map[string]int)
+			for _, e := range w.stop(t) {
+				if e.Name != file {
+					t.Errorf("wrong Name: %s", e)
+				}
+				roots[e.WatchRoot]++
+			}
+			if merge {
+				if len(roots) != 1 {
+					t.Errorf("events for more than one WatchRoot: %v", roots)
+				}
+				if s := w.w.Stats(); s.Deduplicated == 0 {
+					t.Error("Stats.Deduplicated is 0")
+				}
+			} else if roots[tmp] == 0 || roots[file] == 0 {
+				t.Errorf("wanted events for both watches: %v", roots)
+			}
+		})
+	}
+}
+
+func TestAliasWatch(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "windows":
+	default:
+		t.Skip("ErrAliasWatch not supported on " + runtime.GOOS)
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dir := join(tmp, "dir")
+	mkdir(t, dir)
+	if err := os.Symlink(dir, join(tmp, "link")); err != nil {
+		t.Skip(err) // Needs privileges on Windows.
+	}
+
+	w := newCollector(t)
+	addWatch(t, w.w, dir)
+	if err := w.w.Add(join(tmp, "link")); !errors.Is(err, ErrAliasWatch) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if l := w.w.WatchList(); len(l) != 1 || l[0] != dir {
+		t.Errorf("wrong WatchList: %q", l)
+	}
+
+	// Events are still sent for the first path.
+	w.collect(t)
+	touch(t, dir, "file")
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /dir/file
+	`))
+}
+
+func TestStatsLatency(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Events channel is buffered on Windows")
+	}
+
+	tmp := t.TempDir()
+	w := newWatcher(t, tmp)
+	defer w.Close()
+
+	touch(t, tmp, "file")
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-w.Events:
+	case err := <-w.Errors:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// Stats are updated after the send returns.
+	s := w.Stats()
+	for i := 0; i < 100 && s.LatencyMax == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		s = w.Stats()
+	}
+	if s.LatencyMax < 100*time.Millisecond || s.LatencyP99 > s.LatencyMax || s.LatencyP50 > s.LatencyP99 {
+		t.Errorf("wrong latency: %+v", s)
+	}
+}
+
+func TestHotPaths(t *testing.T) {
+	var (
+		h     hotPaths
+		start = time.Unix(1700000000, 0)
+	)
+	if have := h.top(3, start); have != nil {
+		t.Errorf("empty: %v", have)
+	}
+
+	for i := 0; i < 5; i++ {
+		h.add("/logs", start)
+	}
+	h.add("/src", start)
+	h.add("/cache", start.Add(30*time.Second))
+	h.add("/cache", start.Add(30*time.Second))
+	h.add("/src", start.Add(40*time.Second))
+
+	want := []PathCount{{"/logs", 5}, {"/cache", 2}, {"/src", 2}}
+	if have := h.top(5, start.Add(45*time.Second)); !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+	if have := h.top(1, start.Add(45*time.Second)); !reflect.DeepEqual(have, want[:1]) {
+		t.Errorf("n=1: %v", have)
+	}
+
+	// The events at start expired.
+	want = []PathCount{{"/cache", 2}, {"/src", 1}}
+	if have := h.top(5, start.Add(hotWindow+10*time.Second)); !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+
+	// The bucket is re-used.
+	h.add("/new", start.Add(2*hotWindow))
+	want = []PathCount{{"/new", 1}}
+	if have := h.top(5, start.Add(2*hotWindow)); !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+}
+
+// Verify the watcher can keep up with file creations/deletions when under load.
+func TestWatchStress(t *testing.T) {
+	if isCI() {
+		t.Skip("fails too often on the CI") // TODO
+	}
+
+	// On NetBSD ioutil.ReadDir in sendDirectoryChangeEvents() returns EINVAL
+	// ~80% of the time:
+	//
+	//    readdirent /tmp/TestWatchStress3584363325/001: invalid argument
+	//
+	// This ends up calling getdents(), the manpage says:
+	//
+	// [EINVAL]  A directory was being read on NFS, but it was modified on the
+	//           server while it was being read.
+	//
+	// Which is, eh, odd? Maybe I read the code wrong and it's calling another
+	// function too(?)
+	//
+	// Because this happens on the Errors channel we can't "skip" it like with
+	// other kqueue platorms, so just skip the entire test for now.
+	//
+	// TODO: fix this.
+	if runtime.GOOS == "netbsd" {
+		t.Skip("broken on NetBSD")
+	}
+
+	Errorf := func(t *testing.T, msg string, args ...interface{}) {
+		if !isKqueue() {
+			t.Errorf(msg, args...)
+			return
+		}
+
+		// On kqueue platforms it doesn't seem to sync properly; see comment for
+		// the sleep below.
+		//
+		// TODO: fix this.
+		t.Logf(msg, args...)
+		t.Skip("flaky on kqueue; allowed to fail")
+	}
+
+	tmp := t.TempDir()
+	w := newCollector(t, tmp)
+	w.collect(t)
+
+	fmtNum := func(n int) string {
+		s := fmt.Sprintf("%09d", n)
+		return s[:3] + "_" + s[3:6] + "_" + s[6:]
+	}
+
+	var (
+		numFiles = 1_500_000
+		runFor   = 30 * time.Second
+	)
+	if testing.Short() {
+		runFor = time.Second
+	}
+
+	// Otherwise platforms with low limits such as as OpenBSD and NetBSD will
+	// fail, since every watched file uses a file descriptor. Need superuser
+	// permissions and twiddling with /etc/login.conf to adjust them, so we
+	// can't "just increase it".
+	if isKqueue() && uint64(numFiles) > internal.Maxfiles() {
+		numFiles = int(internal.Maxfiles()) - 100
+		t.Logf("limiting files to %d due to max open files limit", numFiles)
+	}
+
+	var (
+		prefix = "xyz-prefix-"
+		done   = make(chan struct{})
+	)
+	// testing.Short()
+	go func() {
+		numFiles = createFiles(t, tmp, prefix, numFiles, runFor)
+
+		// TODO: this shouldn't be needed; and if this is too short some very
+		//       odd events happen:
+		//
+		//         fsnotify_test.go:837: saw 42 unexpected events:
+		//             REMOVE               ""
+		//             CREATE               "."
+		//             REMOVE               ""
+		//             CREATE               "."
+		//             REMOVE               ""
+		//             ...
+		//
+		//         fsnotify_test.go:848: expected the following 3175 events, but didn't see them (showing first 100 only)
+		//             REMOVE               "/xyz-prefix-000_015_080"
+		//             REMOVE               "/xyz-prefix-000_014_536"
+		//             CREATE               "/xyz-prefix-000_015_416"
+		//             CREATE               "/xyz-prefix-000_015_406"
+		//             ...
+		//
+		// Should really add a Sync() method which processes all outstanding
+		// events.
+		if isKqueue() {
+			time.Sleep(1000 * time.Millisecond)
+			if !testing.Short() {
+				time.Sleep(1000 * time.Millisecond)
+			}
+		}
+
+		close(done)
+	}()
+	<-done
+
+	have := w.stopWait(t, 10*time.Second)
+
+	// Do some work to get reasonably nice error reports; what cmpEvents() gives
+	// us is nice if you have just a few events, but with thousands it qiuckly
+	// gets unwieldy.
+
+	want := make(map[Event]struct{})
+	for i := 0; i < numFiles; i++ {
+		n := "/" + prefix + fmtNum(i)
+		want[Event{Name: n, Op: Remove}] = struct{}{}
+		want[Event{Name: n, Op: Create}] = struct{}{}
+	}
+
+	var extra Events
+	for _, h := range have {
+		h.Name = filepath.ToSlash(strings.TrimPrefix(h.Name, tmp))
+		h.WatchRoot, h.Device, h.Seq = "", 0, 0
+		_, ok := want[h]
+		if ok {
+			delete(want, h)
+		} else {
+			extra = append(extra, h)
+		}
+	}
+
+	if len(extra) > 0 {
+		if len(extra) > 100 {
+			Errorf(t, "saw %d unexpected events (showing first 100 only):\n%s", len(extra), extra[:100])
+		} else {
+			Errorf(t, "saw %d unexpected events:\n%s", len(extra), extra)
+		}
+	}
+
+	if len(want) != 0 {
+		wantE := make(Events, 0, len(want))
+		for k := range want {
+			wantE = append(wantE, k)
+		}
+
+		if len(wantE) > 100 {
+			Errorf(t, "expected the following %d events, but didn't see them (showing first 100 only)\n%s", len(wantE), wantE[:100])
+		} else {
+			Errorf(t, "expected the following %d events, but didn't see them\n%s", len(wantE), wantE)
+		}
+	}
+}
+
+func TestWatchList(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		// TODO: probably should I guess...
+		t.Skip("WatchList has always been broken on Windows and I don't feel like fixing it")
+	}
+
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := join(tmp, "file")
+	other := join(tmp, "other")
+
+	touch(t, file)
+	touch(t, other)
+
+	w := newWatcher(t, file, tmp)
+	defer w.Close()
+
+	have := w.WatchList()
+	sort.Strings(have)
+	want := []string{tmp, file}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestNativeOps(t *testing.T) {
+	for _, op := range []Op{Create, Write, Remove, Rename, Chmod, CloseWrite} {
+		if have := OpFromInotify(InotifyFromOp(op)); have != op {
+			t.Errorf("inotify: %s → 0x%x → %s", op, InotifyFromOp(op), have)
+		}
+	}
+	for _, op := range []Op{Remove, Rename, Chmod} {
+		if have := OpFromKqueue(KqueueFromOp(op)) &^ Write; have != op {
+			t.Errorf("kqueue: %s → 0x%x → %s", op, KqueueFromOp(op), have)
+		}
+	}
+
+	tests := []struct {
+		have Op
+		want Op
+	}{
+		{OpFromInotify(0x100 | 0x40000000), Create}, // IN_CREATE|IN_ISDIR
+		{OpFromInotify(0x1), 0},                     // IN_ACCESS
+		{OpFromKqueue(0x1 | 0x2), Remove},           // NOTE_DELETE|NOTE_WRITE
+		{OpFromWindowsAction(5), Create},            // FILE_ACTION_RENAMED_NEW_NAME
+		{OpFromWindowsAction(4), Rename},            // FILE_ACTION_RENAMED_OLD_NAME
+		{OpFromWindowsAction(42), 0},
+	}
+	for _, tt := range tests {
+		if tt.have != tt.want {
+			t.Errorf("have %s; want %s", tt.have, tt.want)
+		}
+	}
+	if f := WindowsFilterFromOp(Chmod); f != 0 {
+		t.Errorf("WindowsFilterFromOp(Chmod) = 0x%x", f)
+	}
+}
+
+func TestTee(t *testing.T) {
+	in := make(chan Event)
+	ch := Tee(in,
+		TeeQueue{Size: 1, Policy: QueueBlock},
+		TeeQueue{Size: 2, Policy: QueueDropNewest},
+		TeeQueue{Size: 2, Policy: QueueDropOldest})
+
+	// Only the first channel is read; the others are full after two events,
+	// but don't block it.
+	go func() {
+		for i := 0; i < 5; i++ {
+			in <- Event{Name: fmt.Sprintf("file%d", i), Op: Create}
+		}
+		close(in)
+	}()
+	var names []string
+	for e := range ch[0] {
+		names = append(names, e.Name)
+	}
+	if len(names) != 5 {
+		t.Errorf("wrong events for QueueBlock: %q", names)
+	}
+
+	read := func(ch <-chan Event) []string {
+		var names []string
+		for e := range ch {
+			names = append(names, e.Name)
+		}
+		return names
+	}
+	if have := read(ch[1]); !reflect.DeepEqual(have, []string{"file0", "file1"}) {
+		t.Errorf("wrong events for QueueDropNewest: %q", have)
+	}
+	if have := read(ch[2]); !reflect.DeepEqual(have, []string{"file3", "file4"}) {
+		t.Errorf("wrong events for QueueDropOldest: %q", have)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	tmp := t.TempDir()
+	dir1, dir2 := join(tmp, "dir1"), join(tmp, "dir2")
+	mkdir(t, dir1)
+	mkdir(t, dir2)
+
+	w1, w2 := newWatcher(t, dir1), newWatcher(t, dir2)
+	ctx, cancel := context.WithCancel(context.Background())
+	g := NewGroup(ctx, w1, w2)
+
+	touch(t, dir1, "file")
+	touch(t, dir2, "file")
+	seen := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for !seen[join(dir1, "file")] || !seen[join(dir2, "file")] {
+		select {
+		case e := <-g.Events:
+			seen[e.Name] = true
+		case err := <-g.Errors:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatalf("timeout; seen: %v", seen)
+		}
+	}
+	for _, w := range []*Watcher{w1, w2} {
+		w.filter.mu.Lock()
+		w.filter.dropped++
+		w.filter.mu.Unlock()
+	}
+	if s := g.Stats(); s.Watches != 2 || s.Filtered != 2 {
+		t.Errorf("Stats.Watches is %d and Stats.Filtered is %d; want 2 and 2", s.Watches, s.Filtered)
+	}
+
+	// Don't read the remaining events; cancelling still closes everything.
+	touch(t, dir1, "file2")
+	cancel()
+	select {
+	case <-w1.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher not closed after cancel")
+	}
+	<-w2.Done()
+	for range g.Events {
+	}
+	if err := g.Close(); err != nil {
+		t.Errorf("Close after cancel: %v", err)
+	}
+}
+
+func TestOpHas(t *testing.T) {
+	tests := []struct {
 		name string
 		o    Op
 		h    Op
@@ -1607,12 +3857,27 @@ func TestOpHas(t *testing.T) {
 			h:    Chmod,
 			want: false,
 		},
+		{
+			name: "any of two bits",
+			o:    Create,
+			h:    Create | Write,
+			want: true,
+		},
+		{
+			name: "user op",
+			o:    Create | UserOp,
+			h:    UserOp,
+			want: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if got := tt.o.Has(tt.h); got != tt.want {
 				t.Errorf("Has() = %v, want %v", got, tt.want)
 			}
+			if got := tt.o.HasAny(tt.h); got != tt.want {
+				t.Errorf("HasAny() = %v, want %v", got, tt.want)
+			}
 		})
 	}
 }
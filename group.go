@@ -0,0 +1,140 @@
+package fsnotify
+
+import (
+	"context"
+	"sync"
+)
+
+// Group owns several watchers, for example watchers created with different
+// options for different sets of paths, and merges their events and errors.
+type Group struct {
+	// Events sends the events of all watchers in the group.
+	Events chan Event
+
+	// Errors sends the errors of all watchers in the group.
+	Errors chan error
+
+	watchers []*Watcher
+	wg       sync.WaitGroup // Running forward goroutines.
+	once     sync.Once
+	done     chan struct{} // Closed by Close.
+}
+
+// NewGroup creates a new group with the watchers, which must not be read from
+// by anything else.
+//
+// The group and all watchers in it are closed when ctx is cancelled or Close is
+// called. The Events and Errors channels are closed once the channels of all
+// watchers are closed; a watcher that's closed on its own is no longer part of
+// the merged stream, but the rest keep working.
+//
+// Every watcher is read from on its own goroutine, so events from different
+// watchers may be sent out of order.
+func NewGroup(ctx context.Context, watchers ...*Watcher) *Group {
+	g := &Group{
+		Events:   make(chan Event),
+		Errors:   make(chan error),
+		watchers: watchers,
+		done:     make(chan struct{}),
+	}
+	g.wg.Add(len(watchers))
+	for _, w := range watchers {
+		go g.forward(w)
+	}
+	go func() {
+		g.wg.Wait()
+		close(g.Events)
+		close(g.Errors)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			g.Close()
+		case <-g.done:
+		}
+	}()
+	return g
+}
+
+// forward sends the events and errors of w on the group's channels until w is
+// closed. After the group is closed they're read and discarded, so that
+// Watcher.Close doesn't block on them.
+func (g *Group) forward(w *Watcher) {
+	defer g.wg.Done()
+
+	events, errs := w.Events, w.Errors
+	for events != nil || errs != nil {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			select {
+			case g.Events <- e:
+			case <-g.done:
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case g.Errors <- err:
+			case <-g.done:
+			}
+		}
+	}
+}
+
+// Watchers returns the watchers in the group.
+func (g *Group) Watchers() []*Watcher {
+	return append([]*Watcher(nil), g.watchers...)
+}
+
+// Close closes all watchers in the group, and returns the first error.
+func (g *Group) Close() error {
+	var err error
+	g.once.Do(func() {
+		close(g.done)
+		for _, w := range g.watchers {
+			if cErr := w.Close(); cErr != nil && err == nil {
+				err = cErr
+			}
+		}
+	})
+	return err
+}
+
+// Stats returns the statistics of all watchers combined: the counts are added
+// up, and the high water mark and latencies are the highest of any watcher.
+func (g *Group) Stats() Stats {
+	var s Stats
+	for _, w := range g.watchers {
+		ws := w.Stats()
+		s.Watches += ws.Watches
+		s.SlowConsumer += ws.SlowConsumer
+		s.Dropped += ws.Dropped
+		s.Deduplicated += ws.Deduplicated
+		s.Filtered += ws.Filtered
+		if ws.EventsHighWater > s.EventsHighWater {
+			s.EventsHighWater = ws.EventsHighWater
+		}
+		if ws.LatencyP50 > s.LatencyP50 {
+			s.LatencyP50 = ws.LatencyP50
+		}
+		if ws.LatencyP99 > s.LatencyP99 {
+			s.LatencyP99 = ws.LatencyP99
+		}
+		if ws.LatencyMax > s.LatencyMax {
+			s.LatencyMax = ws.LatencyMax
+		}
+		for k, v := range ws.DroppedByWatch {
+			if s.DroppedByWatch == nil {
+				s.DroppedByWatch = make(map[string]int)
+			}
+			s.DroppedByWatch[k] += v
+		}
+	}
+	return s
+}
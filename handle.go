@@ -0,0 +1,136 @@
+package fsnotify
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// WatchHandle is a path added with [Watcher.AddEx].
+type WatchHandle struct {
+	w       *Watcher
+	path    string
+	opts    []addOpt
+	with    withOpts
+	watches int
+
+	mu        sync.Mutex
+	suspended bool
+}
+
+// AddEx is like [Watcher.AddWith], but returns a handle for the path that was
+// added, so it can be removed or changed later without keeping track of the
+// path and options.
+//
+// The handle is for the path, not the registration: adding the same path again
+// with AddWith changes the options for both, and Remove on the Watcher removes
+// it for all handles.
+func (w *Watcher) AddEx(name string, opts ...addOpt) (*WatchHandle, error) {
+	if w.IsClosed() {
+		return nil, ErrClosed
+	}
+	with := getOptions(append(w.defaults, opts...)...)
+	path, err := with.watchPath(filepath.Clean(name))
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := w.addWith(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &WatchHandle{w: w, path: path, opts: opts, with: with, watches: n}, nil
+}
+
+// Path returns the path that was added; this is the absolute path if
+// [WithAbsolutePaths] was used.
+func (h *WatchHandle) Path() string { return h.path }
+
+// Spec returns the effective options for the path: the options given to AddEx
+// applied to the defaults and the options from [NewWatcherWith].
+func (h *WatchHandle) Spec() WatchSpec {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.with.spec(h.path)
+}
+
+// Watches returns the number of kernel watches that were created when the
+// path was added; see Stats.Watches for what's counted. This is 0 if the path
+// was already watched.
+func (h *WatchHandle) Watches() int { return h.watches }
+
+// Remove stops watching the path; see [Watcher.Remove].
+func (h *WatchHandle) Remove() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.suspended {
+		h.suspended = false
+		return nil
+	}
+	return h.w.Remove(h.path)
+}
+
+// Suspend stops watching the path until Resume is called. This removes the
+// kernel watch, and changes while it's suspended are not reported.
+//
+// Does nothing if it's already suspended.
+func (h *WatchHandle) Suspend() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.suspended {
+		return nil
+	}
+	if err := h.w.Remove(h.path); err != nil {
+		return err
+	}
+	h.suspended = true
+	return nil
+}
+
+// Resume adds the path again with the same options after Suspend.
+//
+// Does nothing if it's not suspended.
+func (h *WatchHandle) Resume() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.suspended {
+		return nil
+	}
+	if err := h.w.AddWith(h.path, h.opts...); err != nil {
+		return err
+	}
+	h.suspended = false
+	return nil
+}
+
+// Suspended reports if the path is suspended.
+func (h *WatchHandle) Suspended() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.suspended
+}
+
+// SetBufferSize changes the buffer size for the path (see [WithBufferSize]) by
+// removing and adding it again; events in between are lost. If the path can't
+// be added with the new size it's added again with the old size. If it's
+// suspended the new size is used when it's resumed.
+//
+// The buffer size only has effect on Windows.
+func (h *WatchHandle) SetBufferSize(bytes int) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	opts := append(h.opts[:len(h.opts):len(h.opts)], WithBufferSize(bytes))
+	if !h.suspended {
+		if err := h.w.Remove(h.path); err != nil {
+			return err
+		}
+		if err := h.w.AddWith(h.path, opts...); err != nil {
+			if err2 := h.w.AddWith(h.path, h.opts...); err2 != nil {
+				h.suspended = true // So Resume can try again.
+			}
+			return err
+		}
+	}
+	h.opts = opts
+	h.with.bufsize = bytes
+	return nil
+}
@@ -0,0 +1,136 @@
+package fsnotify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// HandoffEnv is the environment variable that [Watcher.Handoff] uses to pass
+// the watches to the child process.
+const HandoffEnv = "FSNOTIFY_HANDOFF"
+
+// handoff is what's passed in HandoffEnv.
+type handoff struct {
+	Watches WatchSet `json:"watches"`
+	Ready   uintptr  `json:"ready"` // File descriptor or handle of the pipe.
+}
+
+// Handoff starts cmd with the same watches as w, for restarting a daemon (for
+// example to upgrade it) without missing events. The child process creates its
+// watcher with [InheritWatcher].
+//
+// This works like systemd socket activation: the [WatchSet] is passed in the
+// environment, and the child signals it added all watches over a pipe it
+// inherits. Handoff returns once it did, and the caller should keep handling
+// events until then, and close w after. Changes that happen in between are
+// seen by both processes, so an event may be handled twice, but none are
+// missed. To also catch up on changes from before the handoff (for example
+// from a journal), the child can use [Watcher.Replay].
+//
+// Returns an error if cmd can't be started, or if the child exits or fails to
+// add the watches before signalling it's ready; the child isn't stopped in
+// either case. Returns ctx.Err() if ctx is done first.
+//
+// The functions from [WithRetry] and [WithNormalizer] can't be passed to the
+// child; see [WatchSpec]. cmd.Env is set to the current environment if it's
+// nil.
+func (w *Watcher) Handoff(ctx context.Context, cmd *exec.Cmd) error {
+	if w.IsClosed() {
+		return ErrClosed
+	}
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	fd, err := passFile(cmd, wr)
+	if err != nil {
+		wr.Close()
+		return err
+	}
+	env, err := json.Marshal(handoff{Watches: w.Export(), Ready: fd})
+	if err != nil {
+		wr.Close()
+		return err
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, HandoffEnv+"="+string(env))
+
+	err = cmd.Start()
+	wr.Close() // Only the child has it open now, so we get EOF if it exits.
+	if err != nil {
+		return err
+	}
+
+	msg := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(rd)
+		msg <- string(b)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case m := <-msg:
+		switch {
+		case m == "ready\n":
+			return nil
+		case strings.HasPrefix(m, "error: "):
+			return fmt.Errorf("fsnotify: handoff: %s", strings.TrimSuffix(m[7:], "\n"))
+		default:
+			return errors.New("fsnotify: handoff: child process didn't call InheritWatcher")
+		}
+	}
+}
+
+// InheritWatcher creates a watcher with the watches from the parent process
+// that started this process with [Watcher.Handoff], and signals the parent
+// that it's ready. The opts are passed to [NewWatcherFromSet].
+//
+// It returns a nil Watcher and no error if this process wasn't started with
+// Handoff, so that a daemon can do:
+//
+//	w, err := fsnotify.InheritWatcher()
+//	if err == nil && w == nil {
+//		w, err = fsnotify.NewWatcher()
+//		// Add paths...
+//	}
+//
+// [HandoffEnv] is removed from the environment, so that it's not passed on to
+// processes this process starts.
+func InheritWatcher(opts ...addOpt) (*Watcher, error) {
+	env, ok := os.LookupEnv(HandoffEnv)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(HandoffEnv)
+
+	var h handoff
+	if err := json.Unmarshal([]byte(env), &h); err != nil {
+		return nil, fmt.Errorf("fsnotify: parsing $%s: %w", HandoffEnv, err)
+	}
+	ready := os.NewFile(h.Ready, "fsnotify-handoff")
+	if ready == nil {
+		return nil, fmt.Errorf("fsnotify: invalid file descriptor %d in $%s", h.Ready, HandoffEnv)
+	}
+	defer ready.Close()
+
+	w, err := NewWatcherFromSet(h.Watches, opts...)
+	if err != nil {
+		fmt.Fprintf(ready, "error: %s\n", err)
+		return nil, err
+	}
+	if _, err := io.WriteString(ready, "ready\n"); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("fsnotify: signalling parent process: %w", err)
+	}
+	return w, nil
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package fsnotify
+
+import (
+	"os"
+	"os/exec"
+)
+
+// passFile makes f inheritable by cmd, and returns the file descriptor in the
+// child.
+func passFile(cmd *exec.Cmd, f *os.File) (uintptr, error) {
+	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	return uintptr(2 + len(cmd.ExtraFiles)), nil // After stdin, stdout, stderr.
+}
@@ -0,0 +1,80 @@
+package fsnotify
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandoff(t *testing.T) {
+	// The child process: wait for an event, and print it.
+	if _, ok := os.LookupEnv(HandoffEnv); ok {
+		w, err := InheritWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := os.LookupEnv(HandoffEnv); ok {
+			t.Fatalf("$%s still set", HandoffEnv)
+		}
+		defer w.Close()
+		select {
+		case e := <-w.Events:
+			os.Stdout.WriteString("CHILD " + e.Op.String() + " " + e.Name + "\n")
+		case err := <-w.Errors:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+		}
+		return
+	}
+
+	switch runtime.GOOS {
+	case "js", "ios", "android":
+		t.Skip("can't start a child process on " + runtime.GOOS)
+	}
+
+	tmp := t.TempDir()
+	w := newWatcher(t, tmp)
+	defer w.Close()
+
+	var out bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandoff$")
+	cmd.Stdout, cmd.Stderr = &out, &out
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := w.Handoff(ctx, cmd); err != nil {
+		t.Fatalf("%s\n%s", err, out.String())
+	}
+	w.Close()
+
+	touch(t, tmp, "file")
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%s\n%s", err, out.String())
+	}
+	if want := "CHILD CREATE " + join(tmp, "file") + "\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("child didn't see the event; output:\n%s", out.String())
+	}
+
+	t.Run("no handoff", func(t *testing.T) {
+		w, err := InheritWatcher()
+		if w != nil || err != nil {
+			t.Errorf("have %v, %v; want nil, nil", w, err)
+		}
+	})
+
+	t.Run("child fails", func(t *testing.T) {
+		w := newWatcher(t, tmp)
+		defer w.Close()
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		err := w.Handoff(context.Background(), cmd)
+		if err == nil || !strings.Contains(err.Error(), "didn't call InheritWatcher") {
+			t.Errorf("wrong error: %v", err)
+		}
+		cmd.Wait()
+	})
+}
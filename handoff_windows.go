@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+package fsnotify
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// passFile makes f inheritable by cmd, and returns the handle in the child.
+func passFile(cmd *exec.Cmd, f *os.File) (uintptr, error) {
+	h := windows.Handle(f.Fd())
+	err := windows.SetHandleInformation(h, windows.HANDLE_FLAG_INHERIT, windows.HANDLE_FLAG_INHERIT)
+	if err != nil {
+		return 0, os.NewSyscallError("SetHandleInformation", err)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.AdditionalInheritedHandles = append(cmd.SysProcAttr.AdditionalInheritedHandles, syscall.Handle(h))
+	return uintptr(h), nil
+}
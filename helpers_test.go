@@ -545,6 +545,12 @@ func newEvents(t *testing.T, s string) Events {
 					op |= Rename
 				case "CHMOD":
 					op |= Chmod
+				case "CLOSE_WRITE":
+					op |= CloseWrite
+				case "UNMOUNT":
+					op |= Unmount
+				case "TRUNCATE":
+					op |= Truncate
 				default:
 					t.Fatalf("newEvents: line %d has unknown event %q: %s", no, ee, line)
 				}
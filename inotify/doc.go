@@ -0,0 +1,10 @@
+// Package inotify is a thin wrapper around the Linux inotify API, for programs
+// that need the raw masks and cookies that the fsnotify.Watcher hides, but
+// don't want to deal with the system calls and parsing the event buffer.
+//
+// Unlike fsnotify.Watcher this doesn't keep track of watches: event names are
+// relative to the watch descriptor's path, and IN_IGNORED and IN_Q_OVERFLOW are
+// returned as-is. Use the IN_* constants from golang.org/x/sys/unix for masks.
+//
+// This package is only available on Linux.
+package inotify
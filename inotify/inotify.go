@@ -0,0 +1,135 @@
+//go:build linux && !appengine
+// +build linux,!appengine
+
+package inotify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Event is a single inotify event.
+type Event struct {
+	Wd     int    // Watch descriptor, as returned by AddWatch; -1 for IN_Q_OVERFLOW.
+	Mask   uint32 // IN_* flags.
+	Cookie uint32 // Connects the IN_MOVED_FROM and IN_MOVED_TO events of a rename.
+	Name   string // Name of the file in a watched directory; "" for the watched path itself.
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("wd=%d mask=0x%x cookie=%d name=%q", e.Wd, e.Mask, e.Cookie, e.Name)
+}
+
+// ErrShortRead is returned by ParseEvents if the buffer ends with a partial
+// event; this should never happen with the buffer from a read().
+var ErrShortRead = errors.New("inotify: short read")
+
+// Inotify is an inotify instance.
+type Inotify struct {
+	fd   int
+	file *os.File
+	buf  []byte
+}
+
+// New creates a new inotify instance, with the IN_CLOEXEC and IN_NONBLOCK
+// flags.
+//
+// The file descriptor is non-blocking so that a [Inotify.Read] that's waiting
+// for events returns when [Inotify.Close] is called.
+func New() (*Inotify, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if fd == -1 {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	// ParseEvents copies the headers, so the buffer doesn't need to be
+	// aligned.
+	return &Inotify{
+		fd:   fd,
+		file: os.NewFile(uintptr(fd), "inotify"),
+		buf:  make([]byte, unix.SizeofInotifyEvent*4096),
+	}, nil
+}
+
+// Fd returns the inotify file descriptor, for example to use with epoll.
+func (in *Inotify) Fd() int { return in.fd }
+
+// AddWatch adds a watch for path, or modifies the watch if path is already
+// watched, and returns the watch descriptor. This is inotify_add_watch(2).
+func (in *Inotify) AddWatch(path string, mask uint32) (int, error) {
+	wd, err := unix.InotifyAddWatch(in.fd, path, mask)
+	if wd == -1 {
+		return -1, &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+	}
+	return wd, nil
+}
+
+// RmWatch removes the watch descriptor wd; an IN_IGNORED event is sent for it.
+// This is inotify_rm_watch(2).
+func (in *Inotify) RmWatch(wd int) error {
+	success, err := unix.InotifyRmWatch(in.fd, uint32(wd))
+	if success == -1 {
+		return os.NewSyscallError("inotify_rm_watch", err)
+	}
+	return nil
+}
+
+// Read waits for events and returns them.
+//
+// It returns an error wrapping [os.ErrClosed] if [Inotify.Close] was called.
+// Read must not be called from more than one goroutine at a time, as the same
+// buffer is used for all reads.
+func (in *Inotify) Read() ([]Event, error) {
+	n, err := in.file.Read(in.buf)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEvents(in.buf[:n])
+}
+
+// Close closes the inotify instance, which removes all watches.
+func (in *Inotify) Close() error {
+	return in.file.Close()
+}
+
+// ParseEvents parses the raw events in buf, as read from an inotify file
+// descriptor.
+//
+// The events before a partial event at the end of the buffer are returned,
+// with ErrShortRead.
+func ParseEvents(buf []byte) ([]Event, error) {
+	var events []Event
+	for len(buf) > 0 {
+		if len(buf) < unix.SizeofInotifyEvent {
+			return events, ErrShortRead
+		}
+
+		// Copy the header, as buf may not be aligned.
+		var raw unix.InotifyEvent
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&raw)), unix.SizeofInotifyEvent), buf)
+		// Compare as uint64, as int(raw.Len) can be negative on 32-bit systems.
+		if uint64(raw.Len) > uint64(len(buf)-unix.SizeofInotifyEvent) {
+			return events, ErrShortRead
+		}
+		end := unix.SizeofInotifyEvent + int(raw.Len)
+
+		// The name is padded with NUL bytes.
+		name := buf[unix.SizeofInotifyEvent:end]
+		if i := bytes.IndexByte(name, 0); i > -1 {
+			name = name[:i]
+		}
+		events = append(events, Event{
+			Wd:     int(raw.Wd),
+			Mask:   raw.Mask,
+			Cookie: raw.Cookie,
+			Name:   string(name),
+		})
+		buf = buf[end:]
+	}
+	return events, nil
+}
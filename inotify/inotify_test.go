@@ -0,0 +1,124 @@
+//go:build linux && !appengine
+// +build linux,!appengine
+
+package inotify
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestInotify(t *testing.T) {
+	tmp := t.TempDir()
+
+	in, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	wd, err := in.AddWatch(tmp, unix.IN_CREATE|unix.IN_MOVED_FROM|unix.IN_MOVED_TO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "file"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(tmp, "file"), filepath.Join(tmp, "new")); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Event
+	for len(events) < 3 {
+		ev, err := in.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev...)
+	}
+
+	if e := events[0]; e.Wd != wd || e.Mask != unix.IN_CREATE || e.Name != "file" {
+		t.Errorf("wrong event: %s", e)
+	}
+	from, to := events[1], events[2]
+	if from.Mask != unix.IN_MOVED_FROM || from.Name != "file" || to.Mask != unix.IN_MOVED_TO || to.Name != "new" {
+		t.Errorf("wrong events: %s, %s", from, to)
+	}
+	if from.Cookie == 0 || from.Cookie != to.Cookie {
+		t.Errorf("cookies don't match: %s, %s", from, to)
+	}
+
+	if err := in.RmWatch(wd); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := in.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ev) != 1 || ev[0].Mask != unix.IN_IGNORED {
+		t.Errorf("wrong events: %v", ev)
+	}
+}
+
+func TestCloseRead(t *testing.T) {
+	in, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := in.Read()
+		done <- err
+	}()
+	in.Close()
+	if err := <-done; !errors.Is(err, os.ErrClosed) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestParseEvents(t *testing.T) {
+	event := func(wd int32, mask, cookie uint32, name string, pad int) []byte {
+		b := make([]byte, unix.SizeofInotifyEvent+len(name)+pad)
+		binary.LittleEndian.PutUint32(b[0:], uint32(wd))
+		binary.LittleEndian.PutUint32(b[4:], mask)
+		binary.LittleEndian.PutUint32(b[8:], cookie)
+		binary.LittleEndian.PutUint32(b[12:], uint32(len(name)+pad))
+		copy(b[unix.SizeofInotifyEvent:], name)
+		return b
+	}
+	if x := uint16(1); *(*byte)(unsafe.Pointer(&x)) != 1 {
+		t.Skip("test buffers are little-endian")
+	}
+
+	buf := append(event(1, unix.IN_CREATE, 0, "a", 3), event(2, unix.IN_DELETE_SELF, 0, "", 0)...)
+	events, err := ParseEvents(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Name != "a" || events[0].Wd != 1 || events[1].Wd != 2 || events[1].Name != "" {
+		t.Errorf("wrong events: %v", events)
+	}
+
+	events, err = ParseEvents(buf[:len(buf)-1])
+	if !errors.Is(err, ErrShortRead) || len(events) != 1 {
+		t.Errorf("wrong result for short buffer: %v, %v", events, err)
+	}
+	events, err = ParseEvents(buf[:unix.SizeofInotifyEvent+2])
+	if !errors.Is(err, ErrShortRead) || len(events) != 0 {
+		t.Errorf("wrong result for truncated name: %v, %v", events, err)
+	}
+
+	bad := event(1, unix.IN_CREATE, 0, "a", 3)
+	binary.LittleEndian.PutUint32(bad[12:], 0xfffffff0)
+	events, err = ParseEvents(bad)
+	if !errors.Is(err, ErrShortRead) || len(events) != 0 {
+		t.Errorf("wrong result for huge name length: %v, %v", events, err)
+	}
+}
@@ -0,0 +1,52 @@
+package fsnotify
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// inotifyEvent is struct inotify_event from inotify(7), without the name.
+type inotifyEvent struct {
+	Wd     int32
+	Mask   uint32
+	Cookie uint32
+	Len    uint32 // Length of the name, including NUL padding.
+}
+
+const inotifyEventSize = int(unsafe.Sizeof(inotifyEvent{}))
+
+// parseInotify calls fn for every struct inotify_event in buf, as read from an
+// inotify file descriptor, with the name that follows it; the name is padded
+// with NUL bytes, and empty for events on the watched path itself. It stops if
+// fn returns false.
+//
+// If the header or name of an event doesn't fit in buf it returns an error
+// that wraps ErrInvalidEvent, after calling fn for the events before it. The
+// kernel never returns partial events, so that means something went wrong.
+//
+// The header is copied out of buf, so it doesn't need to be aligned. This isn't
+// in backend_inotify.go so that it can be tested and fuzzed on all platforms.
+func parseInotify(buf []byte, fn func(ev inotifyEvent, name []byte) bool) error {
+	for offset := 0; offset < len(buf); {
+		rest := len(buf) - offset
+		if rest < inotifyEventSize {
+			return fmt.Errorf("%w: partial event of %d bytes at offset %d",
+				ErrInvalidEvent, rest, offset)
+		}
+
+		var ev inotifyEvent
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&ev)), inotifyEventSize), buf[offset:])
+		// Compare as uint64, as int(ev.Len) can be negative on 32-bit systems.
+		if uint64(ev.Len) > uint64(rest-inotifyEventSize) {
+			return fmt.Errorf("%w: name of %d bytes at offset %d, but only %d bytes left",
+				ErrInvalidEvent, ev.Len, offset+inotifyEventSize, rest-inotifyEventSize)
+		}
+
+		start, end := offset+inotifyEventSize, offset+inotifyEventSize+int(ev.Len)
+		if !fn(ev, buf[start:end:end]) {
+			return nil
+		}
+		offset = end
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+//go:build go1.18
+// +build go1.18
+
+package fsnotify
+
+import (
+	"errors"
+	"testing"
+)
+
+// Run with:
+//
+//	go test -run - -fuzz FuzzParseInotify
+func FuzzParseInotify(f *testing.F) {
+	f.Add(inotifyRaw(1, inCreate, 0, "file", 12))
+	f.Add(inotifyRaw(1, inDeleteSelf, 0, "", 0))
+	f.Add(append(inotifyRaw(1, inMovedFrom, 42, "a", 15), inotifyRaw(2, inMovedTo, 42, "b", 15)...))
+	f.Add(inotifyRaw(1, inModify, 0, "abc", 0))
+	f.Add(inotifyRaw(1, inCreate, 0, "file", 12)[:20])
+	f.Add(inotifyRaw(1, inCreate, 0, "", 0)[:10])
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		var size int
+		err := parseInotify(buf, func(ev inotifyEvent, name []byte) bool {
+			if len(name) != int(ev.Len) || cap(name) != len(name) {
+				t.Fatalf("name of %d bytes (cap %d) for Len %d", len(name), cap(name), ev.Len)
+			}
+			size += inotifyEventSize + len(name)
+			return true
+		})
+		if err != nil && !errors.Is(err, ErrInvalidEvent) {
+			t.Fatalf("doesn't wrap ErrInvalidEvent: %v", err)
+		}
+		// Without an error every byte is part of an event.
+		if err == nil && size != len(buf) {
+			t.Fatalf("parsed %d of %d bytes without error", size, len(buf))
+		}
+		if size > len(buf) {
+			t.Fatalf("parsed %d bytes from a %d byte buffer", size, len(buf))
+		}
+	})
+}
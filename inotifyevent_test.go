@@ -0,0 +1,114 @@
+package fsnotify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"unsafe"
+)
+
+// inotifyRaw returns a struct inotify_event with the name and pad NUL bytes.
+func inotifyRaw(wd int32, mask, cookie uint32, name string, pad int) []byte {
+	ev := inotifyEvent{Wd: wd, Mask: mask, Cookie: cookie, Len: uint32(len(name) + pad)}
+	b := append([]byte(nil), (*[inotifyEventSize]byte)(unsafe.Pointer(&ev))[:]...)
+	b = append(b, name...)
+	return append(b, make([]byte, pad)...)
+}
+
+func TestParseInotify(t *testing.T) {
+	concat := func(b ...[]byte) []byte { return bytes.Join(b, nil) }
+	huge := inotifyRaw(1, inCreate, 0, "", 0)
+	copy(huge[12:], []byte{0xf0, 0xff, 0xff, 0xff})
+
+	tests := []struct {
+		name    string
+		buf     []byte
+		want    []string
+		wantErr bool
+	}{
+		{"empty", nil, nil, false},
+		{"one", inotifyRaw(1, inCreate, 0, "file", 12), []string{"1 0x100 0 file"}, false},
+		{"no name", inotifyRaw(1, inDeleteSelf, 0, "", 0), []string{"1 0x400 0 "}, false},
+		{"two", concat(
+			inotifyRaw(1, inMovedFrom, 42, "a", 15),
+			inotifyRaw(2, inMovedTo, 42, "b", 15),
+		), []string{"1 0x40 42 a", "2 0x80 42 b"}, false},
+		{"unaligned name length", concat(
+			inotifyRaw(1, inModify, 0, "abc", 0),
+			inotifyRaw(1, inAttrib, 0, "", 0),
+		), []string{"1 0x2 0 abc", "1 0x4 0 "}, false},
+
+		{"partial header", inotifyRaw(1, inCreate, 0, "", 0)[:10], nil, true},
+		{"partial second header", concat(
+			inotifyRaw(1, inCreate, 0, "a", 3),
+			inotifyRaw(2, inCreate, 0, "", 0)[:15],
+		), []string{"1 0x100 0 a"}, true},
+		{"truncated name", inotifyRaw(1, inCreate, 0, "file", 12)[:20], nil, true},
+		{"huge name length", huge, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var have []string
+			err := parseInotify(tt.buf, func(ev inotifyEvent, name []byte) bool {
+				have = append(have, fmt.Sprintf("%d 0x%x %d %s", ev.Wd, ev.Mask, ev.Cookie, bytes.TrimRight(name, "\x00")))
+				return true
+			})
+			if tt.wantErr != (err != nil) {
+				t.Errorf("wrong error: %v", err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidEvent) {
+				t.Errorf("doesn't wrap ErrInvalidEvent: %v", err)
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("wrong events\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+
+	t.Run("stop", func(t *testing.T) {
+		var n int
+		buf := concat(inotifyRaw(1, inCreate, 0, "", 0), inotifyRaw(2, inCreate, 0, "", 0))
+		err := parseInotify(buf, func(inotifyEvent, []byte) bool { n++; return false })
+		if err != nil || n != 1 {
+			t.Errorf("didn't stop: %d events, %v", n, err)
+		}
+	})
+}
+
+// Properties of translating between inotify masks and Op, for any mask or Op.
+func TestInotifyOpProperties(t *testing.T) {
+	const (
+		ops   = Create | Write | Remove | Rename | Chmod | CloseWrite
+		flags = inCreate | inModify | inDelete | inDeleteSelf | inMovedFrom | inMovedTo |
+			inMoveSelf | inAttrib | inCloseWrite
+	)
+
+	// Translating an Op to a mask and back gives the same Op.
+	roundTrip := func(op Op) bool {
+		op &= ops
+		return OpFromInotify(InotifyFromOp(op)) == op
+	}
+	// The mask for the Op of an event includes the flags it was sent for.
+	covers := func(mask uint32) bool {
+		return InotifyFromOp(OpFromInotify(mask))&(mask&flags) == mask&flags
+	}
+	// Flags that don't map to an Op don't change the result.
+	ignored := func(mask uint32) bool {
+		return OpFromInotify(mask) == OpFromInotify(mask&(flags|inUnmount))
+	}
+	// Only known operations are returned.
+	known := func(mask uint32) bool {
+		return OpFromInotify(mask)&^(ops|Unmount) == 0
+	}
+
+	for name, f := range map[string]interface{}{
+		"round trip": roundTrip, "covers": covers, "ignored": ignored, "known": known,
+	} {
+		if err := quick.Check(f, &quick.Config{MaxCount: 10000}); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
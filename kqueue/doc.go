@@ -0,0 +1,10 @@
+// Package kqueue is a small wrapper around kqueue vnode monitoring
+// (EVFILT_VNODE), for programs that need the NOTE_* flags that the
+// fsnotify.Watcher hides.
+//
+// It opens files with the right flags for watching, registers them, and waits
+// for events; it doesn't keep track of which file descriptor belongs to which
+// path, or watch the files in a directory.
+//
+// This package is only available on macOS and the BSDs.
+package kqueue
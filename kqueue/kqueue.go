@@ -0,0 +1,174 @@
+//go:build freebsd || openbsd || netbsd || dragonfly || darwin
+// +build freebsd openbsd netbsd dragonfly darwin
+
+package kqueue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// AllNotes are the NOTE_* flags for all vnode events that are available on
+// every system.
+const AllNotes = unix.NOTE_DELETE | unix.NOTE_WRITE | unix.NOTE_EXTEND |
+	unix.NOTE_ATTRIB | unix.NOTE_LINK | unix.NOTE_RENAME | unix.NOTE_REVOKE
+
+// Event is a vnode event for a registered file descriptor.
+type Event struct {
+	Fd     int
+	Fflags uint32 // NOTE_* flags.
+}
+
+func (e Event) String() string { return fmt.Sprintf("fd=%d %s", e.Fd, Notes(e.Fflags)) }
+
+// Open opens path for watching with kqueue; this uses O_EVTONLY on macOS, so
+// it doesn't prevent unmounting the volume, and O_RDONLY|O_NONBLOCK on BSD.
+//
+// open() is retried on EINTR, which happens in practice on macOS.
+func Open(path string) (int, error) {
+	for {
+		fd, err := unix.Open(path, OpenMode, 0)
+		if err == nil {
+			return fd, nil
+		}
+		if !errors.Is(err, unix.EINTR) {
+			return -1, &os.PathError{Op: "open", Path: path, Err: err}
+		}
+	}
+}
+
+// Kqueue is a kqueue instance.
+type Kqueue struct {
+	kq        int
+	closepipe [2]int
+}
+
+// New creates a new kqueue.
+//
+// This also registers a pipe that's closed by [Kqueue.Close], so that a
+// [Kqueue.Wait] that's waiting for events returns.
+func New() (*Kqueue, error) {
+	kq, err := unix.Kqueue()
+	if kq == -1 {
+		return nil, os.NewSyscallError("kqueue", err)
+	}
+
+	k := &Kqueue{kq: kq}
+	err = unix.Pipe(k.closepipe[:])
+	if err != nil {
+		unix.Close(kq)
+		return nil, os.NewSyscallError("pipe", err)
+	}
+	unix.CloseOnExec(k.closepipe[0])
+	unix.CloseOnExec(k.closepipe[1])
+
+	changes := make([]unix.Kevent_t, 1)
+	unix.SetKevent(&changes[0], k.closepipe[0], unix.EVFILT_READ, unix.EV_ADD|unix.EV_ENABLE|unix.EV_ONESHOT)
+	ok, err := unix.Kevent(kq, changes, nil, nil)
+	if ok == -1 {
+		unix.Close(kq)
+		unix.Close(k.closepipe[0])
+		unix.Close(k.closepipe[1])
+		return nil, os.NewSyscallError("kevent", err)
+	}
+	return k, nil
+}
+
+// Fd returns the kqueue file descriptor.
+func (k *Kqueue) Fd() int { return k.kq }
+
+// Register starts watching fd for the events in fflags (NOTE_* flags). The
+// events are edge-triggered (EV_CLEAR). Registering an fd again replaces the
+// flags.
+func (k *Kqueue) Register(fd int, fflags uint32) error {
+	return k.kevent(fd, unix.EV_ADD|unix.EV_CLEAR|unix.EV_ENABLE, fflags)
+}
+
+// Unregister stops watching fd. Closing fd also removes it from the kqueue.
+func (k *Kqueue) Unregister(fd int) error {
+	return k.kevent(fd, unix.EV_DELETE, 0)
+}
+
+func (k *Kqueue) kevent(fd, flags int, fflags uint32) error {
+	changes := make([]unix.Kevent_t, 1)
+	unix.SetKevent(&changes[0], fd, unix.EVFILT_VNODE, flags)
+	changes[0].Fflags = fflags
+	ok, err := unix.Kevent(k.kq, changes, nil, nil)
+	if ok == -1 {
+		return os.NewSyscallError("kevent", err)
+	}
+	return nil
+}
+
+// Wait waits for events, and reads up to len(buf) of them in to buf.
+//
+// It returns [os.ErrClosed] if [Kqueue.Close] was called.
+func (k *Kqueue) Wait(buf []unix.Kevent_t) ([]Event, error) {
+	for {
+		n, err := unix.Kevent(k.kq, nil, buf, nil)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if errors.Is(err, unix.EBADF) { // Closed before kevent() was called.
+			return nil, os.ErrClosed
+		}
+		if err != nil {
+			return nil, os.NewSyscallError("kevent", err)
+		}
+
+		events := make([]Event, 0, n)
+		for _, kev := range buf[:n] {
+			if int(kev.Ident) == k.closepipe[0] {
+				return nil, os.ErrClosed
+			}
+			events = append(events, Event{Fd: int(kev.Ident), Fflags: kev.Fflags})
+		}
+		return events, nil
+	}
+}
+
+// Close closes the kqueue; registered file descriptors aren't closed.
+func (k *Kqueue) Close() error {
+	// Wake up Wait first; the kqueue is closed after that.
+	unix.Close(k.closepipe[1])
+	unix.Close(k.closepipe[0])
+	err := unix.Close(k.kq)
+	if err != nil {
+		return os.NewSyscallError("close", err)
+	}
+	return nil
+}
+
+// Notes returns the names of the NOTE_* flags in fflags, separated by "|".
+// Unknown flags are printed as hex.
+func Notes(fflags uint32) string {
+	var b strings.Builder
+	for _, n := range []struct {
+		flag uint32
+		name string
+	}{
+		{unix.NOTE_DELETE, "NOTE_DELETE"},
+		{unix.NOTE_WRITE, "NOTE_WRITE"},
+		{unix.NOTE_EXTEND, "NOTE_EXTEND"},
+		{unix.NOTE_ATTRIB, "NOTE_ATTRIB"},
+		{unix.NOTE_LINK, "NOTE_LINK"},
+		{unix.NOTE_RENAME, "NOTE_RENAME"},
+		{unix.NOTE_REVOKE, "NOTE_REVOKE"},
+	} {
+		if fflags&n.flag != 0 {
+			b.WriteString("|" + n.name)
+			fflags &^= n.flag
+		}
+	}
+	if fflags != 0 {
+		fmt.Fprintf(&b, "|0x%x", fflags)
+	}
+	if b.Len() == 0 {
+		return "[none]"
+	}
+	return b.String()[1:]
+}
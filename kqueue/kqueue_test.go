@@ -0,0 +1,73 @@
+//go:build freebsd || openbsd || netbsd || dragonfly || darwin
+// +build freebsd openbsd netbsd dragonfly darwin
+
+package kqueue
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestKqueue(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if err := k.Register(fd, AllNotes); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(file, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	events, err := k.Wait(make([]unix.Kevent_t, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Fd != fd || events[0].Fflags&unix.NOTE_WRITE == 0 {
+		t.Errorf("wrong events: %v", events)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := k.Wait(make([]unix.Kevent_t, 10))
+		done <- err
+	}()
+	if err := k.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, os.ErrClosed) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestNotes(t *testing.T) {
+	tests := []struct {
+		in   uint32
+		want string
+	}{
+		{0, "[none]"},
+		{unix.NOTE_DELETE, "NOTE_DELETE"},
+		{unix.NOTE_WRITE | unix.NOTE_ATTRIB, "NOTE_WRITE|NOTE_ATTRIB"},
+		{unix.NOTE_RENAME | 0x8000_0000, "NOTE_RENAME|0x80000000"},
+	}
+	for _, tt := range tests {
+		if have := Notes(tt.in); have != tt.want {
+			t.Errorf("Notes(0x%x) = %q; want %q", tt.in, have, tt.want)
+		}
+	}
+}
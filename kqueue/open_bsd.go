@@ -0,0 +1,13 @@
+//go:build freebsd || openbsd || netbsd || dragonfly
+// +build freebsd openbsd netbsd dragonfly
+
+package kqueue
+
+import "golang.org/x/sys/unix"
+
+// OpenMode are the flags Open uses.
+const OpenMode = unix.O_NONBLOCK | unix.O_RDONLY | unix.O_CLOEXEC
+
+// NoFollowMode are the flags to open a symlink itself rather than the file it
+// points to; this isn't supported on BSD, so it's 0.
+const NoFollowMode = 0
@@ -0,0 +1,13 @@
+//go:build darwin
+// +build darwin
+
+package kqueue
+
+import "golang.org/x/sys/unix"
+
+// OpenMode are the flags Open uses; O_EVTONLY isn't defined on BSD.
+const OpenMode = unix.O_EVTONLY | unix.O_CLOEXEC
+
+// NoFollowMode are the flags to open a symlink itself rather than the file it
+// points to.
+const NoFollowMode = OpenMode | unix.O_SYMLINK
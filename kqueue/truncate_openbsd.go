@@ -0,0 +1,9 @@
+//go:build openbsd
+// +build openbsd
+
+package kqueue
+
+import "golang.org/x/sys/unix"
+
+// NoteTruncate is the fflag for a truncated file.
+const NoteTruncate = unix.NOTE_TRUNCATE
@@ -0,0 +1,8 @@
+//go:build freebsd || netbsd || dragonfly || darwin
+// +build freebsd netbsd dragonfly darwin
+
+package kqueue
+
+// NoteTruncate is the fflag for a truncated file; this isn't supported on
+// other platforms than OpenBSD, so it's 0.
+const NoteTruncate = 0
@@ -0,0 +1,186 @@
+package fsnotify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often the directories with a limit are listed to correct the counts.
+const limitReconcile = time.Minute
+
+// DirLimit is the limit for a directory; see [Watcher.SetLimit]. A zero field
+// means no limit.
+type DirLimit struct {
+	Entries int   // Number of files and directories in it, not recursive.
+	Bytes   int64 // Total size of the files in it, not recursive.
+}
+
+// DirUsage is the number of entries and their total size in a directory, as
+// sent in Event.Usage with [ThresholdExceeded].
+type DirUsage struct {
+	Entries int
+	Bytes   int64
+}
+
+// SetLimit sends a [ThresholdExceeded] event for dir once the number of
+// entries or their total size goes over the limit; for example for a spool
+// directory or upload inbox that's filling up faster than it's processed. The
+// event is sent again after it was under the limit. A zero DirLimit removes the
+// limit.
+//
+// dir must be watched for Create, Remove, Rename, and Write events (see
+// [WithOps]); the counts are kept up to date from the events, and are
+// corrected every minute by listing the directory, in case events were missed.
+// The usage is in Event.Usage; Name and WatchRoot are dir.
+//
+// Returns an error if dir can't be read, or [ErrRestricted] with
+// [WithRestricted].
+func (w *Watcher) SetLimit(dir string, limit DirLimit) error {
+	if getOptions(w.defaults...).restricted {
+		return fmt.Errorf("%w: SetLimit lists directories", ErrRestricted)
+	}
+	dir = filepath.Clean(dir)
+	if limit == (DirLimit{}) {
+		w.limits.mu.Lock()
+		delete(w.limits.dirs, dir)
+		w.limits.mu.Unlock()
+		return nil
+	}
+
+	sizes, err := listSizes(dir)
+	if err != nil {
+		return fmt.Errorf("fsnotify: %w", err)
+	}
+	w.limits.mu.Lock()
+	if w.limits.dirs == nil {
+		w.limits.dirs = make(map[string]*limitDir)
+		go w.sendEvery(limitReconcile, w.limits.reconcile)
+	}
+	d := &limitDir{limit: limit, sizes: sizes}
+	for _, s := range sizes {
+		d.bytes += s
+	}
+	w.limits.dirs[dir] = d
+	e, ok := d.check(dir)
+	w.limits.mu.Unlock()
+	if ok {
+		w.sendLater(e)
+	}
+	return nil
+}
+
+// limits keeps track of the directories with a limit; see SetLimit.
+type limits struct {
+	mu   sync.Mutex
+	dirs map[string]*limitDir
+}
+
+type limitDir struct {
+	limit    DirLimit
+	sizes    map[string]int64 // Size by entry name; 0 for directories.
+	bytes    int64
+	exceeded bool // ThresholdExceeded was sent, and it's still over the limit.
+}
+
+// check returns ThresholdExceeded if d went over the limit.
+func (d *limitDir) check(dir string) (Event, bool) {
+	over := (d.limit.Entries > 0 && len(d.sizes) > d.limit.Entries) ||
+		(d.limit.Bytes > 0 && d.bytes > d.limit.Bytes)
+	if !over || d.exceeded {
+		d.exceeded = over
+		return Event{}, false
+	}
+	d.exceeded = true
+	return Event{Name: dir, Op: ThresholdExceeded, WatchRoot: dir,
+		Usage: &DirUsage{Entries: len(d.sizes), Bytes: d.bytes}}, true
+}
+
+func (d *limitDir) set(name string, size int64) {
+	d.bytes += size - d.sizes[name]
+	d.sizes[name] = size
+}
+
+func (d *limitDir) remove(name string) {
+	d.bytes -= d.sizes[name]
+	delete(d.sizes, name)
+}
+
+// count updates the counts for the directory of e, and returns
+// ThresholdExceeded if it went over its limit.
+func (l *limits) count(e Event) (Event, bool) {
+	if !e.Op.HasAny(Create | Remove | Rename | Write) {
+		return Event{}, false
+	}
+	dir, name := filepath.Split(e.Name)
+	dir = filepath.Clean(dir)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d, ok := l.dirs[dir]
+	if !ok {
+		return Event{}, false
+	}
+	if fi, err := os.Lstat(e.Name); err != nil {
+		d.remove(name)
+	} else if fi.Mode().IsRegular() {
+		d.set(name, fi.Size())
+	} else {
+		d.set(name, 0)
+	}
+	return d.check(dir)
+}
+
+// reconcile lists all directories with a limit to correct the counts, and
+// returns ThresholdExceeded for the directories that went over their limit.
+func (l *limits) reconcile() []Event {
+	l.mu.Lock()
+	dirs := make([]string, 0, len(l.dirs))
+	for dir := range l.dirs {
+		dirs = append(dirs, dir)
+	}
+	l.mu.Unlock()
+	sort.Strings(dirs)
+
+	var events []Event
+	for _, dir := range dirs {
+		sizes, err := listSizes(dir)
+		if err != nil {
+			continue
+		}
+		l.mu.Lock()
+		if d, ok := l.dirs[dir]; ok {
+			d.sizes, d.bytes = sizes, 0
+			for _, s := range sizes {
+				d.bytes += s
+			}
+			if e, ok := d.check(dir); ok {
+				events = append(events, e)
+			}
+		}
+		l.mu.Unlock()
+	}
+	return events
+}
+
+// listSizes returns the size of every entry in dir; 0 for directories and other
+// files that aren't regular files.
+func listSizes(dir string) (map[string]int64, error) {
+	ls, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(ls))
+	for _, f := range ls {
+		sizes[f.Name()] = 0
+		if f.Type().IsRegular() {
+			if fi, err := f.Info(); err == nil {
+				sizes[f.Name()] = fi.Size()
+			}
+		}
+	}
+	return sizes, nil
+}
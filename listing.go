@@ -0,0 +1,113 @@
+package fsnotify
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// How often ListConsistent reads a directory before giving up.
+const listRetries = 10
+
+// Listing is a directory listing from [Watcher.ListConsistent].
+type Listing struct {
+	Entries []fs.DirEntry // Sorted by name, like os.ReadDir.
+
+	// Event.Seq of the last event that was read before the listing. The
+	// listing has the changes from all events up to and including Cutoff;
+	// events with a higher Seq may or may not be in it, and should be applied
+	// on top of it.
+	Cutoff uint64
+}
+
+// ListConsistent lists dir, and lists it again if there were events for it (or
+// for dir itself) while it was read, until a listing is read without events;
+// for example to build a snapshot of a directory that's changing, and keep it
+// up to date from the events. Without this the listing may have some changes
+// from a rename or "rm; create" but not others, as os.ReadDir can take a while
+// for large directories.
+//
+// dir should be watched, and passed the same way as to Add, so it matches the
+// path in Event.Name. There is no way to tell if the kernel has sent all
+// events for the time the listing was read, so events may still arrive after
+// ListConsistent returns; apply the events with Event.Seq higher than
+// Listing.Cutoff on top of the listing.
+//
+// Returns [ErrDirChanging] if dir changed during every read, and the error from
+// os.ReadDir if it can't be read.
+func (w *Watcher) ListConsistent(dir string) (Listing, error) {
+	dir = filepath.Clean(dir)
+	w.listings.start(dir)
+	defer w.listings.stop(dir)
+
+	for i := 0; i < listRetries; i++ {
+		cutoff := w.listings.current()
+		ls, err := os.ReadDir(dir)
+		if err != nil {
+			return Listing{}, err
+		}
+		if !w.listings.changed(dir, cutoff) {
+			return Listing{Entries: ls, Cutoff: cutoff}, nil
+		}
+	}
+	return Listing{}, fmt.Errorf("%w: %s", ErrDirChanging, dir)
+}
+
+// listings numbers the events for Event.Seq, and keeps track of the events for
+// directories that are being listed; see ListConsistent.
+type listings struct {
+	mu     sync.Mutex
+	seq    uint64
+	active map[string]int    // Directories being listed → number of callers.
+	last   map[string]uint64 // Seq of the last event for active directories.
+}
+
+// count returns the Seq for e.
+func (l *listings) count(e Event) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	if len(l.active) > 0 {
+		for _, dir := range [...]string{filepath.Dir(e.Name), e.Name} {
+			if _, ok := l.active[dir]; ok {
+				l.last[dir] = l.seq
+			}
+		}
+	}
+	return l.seq
+}
+
+// current returns the Seq of the last event.
+func (l *listings) current() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// changed reports if there were events for dir after the event with Seq
+// cutoff.
+func (l *listings) changed(dir string, cutoff uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last[dir] > cutoff
+}
+
+func (l *listings) start(dir string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active == nil {
+		l.active, l.last = make(map[string]int), make(map[string]uint64)
+	}
+	l.active[dir]++
+}
+
+func (l *listings) stop(dir string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[dir]--; l.active[dir] <= 0 {
+		delete(l.active, dir)
+		delete(l.last, dir)
+	}
+}
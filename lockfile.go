@@ -0,0 +1,129 @@
+package fsnotify
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLockHold is how long events are held for a lock file before they're sent
+// anyway; see WithLockfileConvention.
+const maxLockHold = time.Minute
+
+// lockfiles holds the events for files while their lock file exists; see
+// WithLockfileConvention.
+type lockfiles struct {
+	mu       sync.Mutex
+	patterns []lockPattern
+	maxHold  time.Duration    // Send held events after this; maxLockHold if 0.
+	locked   map[string]*lock // By target path.
+}
+
+// lock is a lock file that was seen, and the event held for its target.
+type lock struct {
+	held Event     // Op is 0 if nothing is held.
+	at   time.Time // When the lock file was created.
+}
+
+// lockPattern is a WithLockfileConvention pattern, split at the "*".
+type lockPattern struct{ prefix, suffix string }
+
+func (l *lockfiles) add(pattern string) {
+	i := strings.IndexByte(pattern, '*')
+	if i == -1 || strings.IndexByte(pattern[i+1:], '*') > -1 {
+		return
+	}
+	l.patterns = append(l.patterns, lockPattern{prefix: pattern[:i], suffix: pattern[i+1:]})
+}
+
+// target returns the name of the file that the lock file name is for.
+func (l *lockfiles) target(name string) (string, bool) {
+	for _, p := range l.patterns {
+		if len(name) > len(p.prefix)+len(p.suffix) &&
+			strings.HasPrefix(name, p.prefix) && strings.HasSuffix(name, p.suffix) {
+			return name[len(p.prefix) : len(name)-len(p.suffix)], true
+		}
+	}
+	return "", false
+}
+
+// hold reports if e is for a locked file and was added to its held event,
+// rather than being sent. If e is for a lock file that was removed, the event
+// held for its target is returned, and should be sent before e.
+func (l *lockfiles) hold(e Event) (bool, *Event) {
+	if len(l.patterns) == 0 {
+		return false, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	dir, name := filepath.Split(e.Name)
+	if target, ok := l.target(name); ok {
+		target = filepath.Join(dir, target)
+		switch {
+		case e.Has(Remove) || e.Has(Rename):
+			lk := l.locked[target]
+			delete(l.locked, target)
+			if lk != nil && lk.held.Op != 0 {
+				return false, &lk.held
+			}
+		case e.Has(Create):
+			if l.locked == nil {
+				l.locked = make(map[string]*lock)
+			}
+			if _, ok := l.locked[target]; !ok {
+				l.locked[target] = &lock{at: time.Now()}
+			}
+		}
+		return false, nil
+	}
+
+	lk, ok := l.locked[e.Name]
+	if !ok {
+		return false, nil
+	}
+	h := &lk.held
+	h.Name, h.WatchRoot, h.Device = e.Name, e.WatchRoot, e.Device
+	h.Op |= e.Op
+	h.Coalesced++
+	return true, nil
+}
+
+// expire returns the held events for lock files that exist for longer than
+// maxHold, for example because the application that created them crashed, and
+// stops holding events for them.
+func (l *lockfiles) expire() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	maxHold := l.maxHold
+	if maxHold == 0 {
+		maxHold = maxLockHold
+	}
+
+	var events []Event
+	for target, lk := range l.locked {
+		if time.Since(lk.at) < maxHold {
+			continue
+		}
+		if lk.held.Op != 0 {
+			events = append(events, lk.held)
+		}
+		delete(l.locked, target)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
+
+// remove drops the lock files for the watch on path, and the events held for
+// them; it's called when the watch is removed.
+func (l *lockfiles) remove(path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for target := range l.locked {
+		if target == path || filepath.Dir(target) == path {
+			delete(l.locked, target)
+		}
+	}
+}
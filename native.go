@@ -0,0 +1,170 @@
+package fsnotify
+
+// Translate between the event masks of the kernel APIs and Op, for tools that
+// also read events from other sources (audit logs, eBPF, their own inotify
+// file descriptor) and want to use the same Op for them.
+//
+// These are available on all platforms, as the values are fixed by the kernel
+// ABI; this way a log recorded on one system can be read on another.
+
+// inotify(7) flags.
+const (
+	inModify     = 0x2
+	inAttrib     = 0x4
+	inCloseWrite = 0x8
+	inMovedFrom  = 0x40
+	inMovedTo    = 0x80
+	inCreate     = 0x100
+	inDelete     = 0x200
+	inDeleteSelf = 0x400
+	inMoveSelf   = 0x800
+	inUnmount    = 0x2000
+)
+
+// OpFromInotify returns the Op for an inotify event mask, in the same way as
+// the inotify backend without [PreferCloseWrite]. Flags that don't map to an
+// Op (such as IN_ACCESS or IN_ISDIR) are ignored.
+func OpFromInotify(mask uint32) Op {
+	var op Op
+	if mask&(inCreate|inMovedTo) != 0 {
+		op |= Create
+	}
+	if mask&inModify != 0 {
+		op |= Write
+	}
+	if mask&(inDelete|inDeleteSelf) != 0 {
+		op |= Remove
+	}
+	if mask&(inMovedFrom|inMoveSelf) != 0 {
+		op |= Rename
+	}
+	if mask&inAttrib != 0 {
+		op |= Chmod
+	}
+	if mask&inCloseWrite != 0 {
+		op |= CloseWrite
+	}
+	if mask&inUnmount != 0 {
+		op |= Unmount
+	}
+	return op
+}
+
+// InotifyFromOp returns the inotify mask to listen for the operations in op.
+// Unmount doesn't need a flag, as the kernel always sends it.
+func InotifyFromOp(op Op) uint32 {
+	var mask uint32
+	if op.Has(Create) {
+		mask |= inCreate | inMovedTo
+	}
+	if op.Has(Write) {
+		mask |= inModify
+	}
+	if op.Has(Remove) {
+		mask |= inDelete | inDeleteSelf
+	}
+	if op.Has(Rename) {
+		mask |= inMovedFrom | inMoveSelf
+	}
+	if op.Has(Chmod) {
+		mask |= inAttrib
+	}
+	if op.Has(CloseWrite) {
+		mask |= inCloseWrite
+	}
+	return mask
+}
+
+// Windows FILE_ACTION_* and FILE_NOTIFY_CHANGE_* values.
+const (
+	fileActionAdded          = 0x1
+	fileActionRemoved        = 0x2
+	fileActionModified       = 0x3
+	fileActionRenamedOldName = 0x4
+	fileActionRenamedNewName = 0x5
+
+	fileNotifyChangeFileName  = 0x1
+	fileNotifyChangeDirName   = 0x2
+	fileNotifyChangeLastWrite = 0x10
+)
+
+// OpFromWindowsAction returns the Op for the Action of a Windows
+// FILE_NOTIFY_INFORMATION, in the same way as the Windows backend; the new
+// name of a rename is a Create. Returns 0 for unknown actions.
+func OpFromWindowsAction(action uint32) Op {
+	switch action {
+	case fileActionAdded, fileActionRenamedNewName:
+		return Create
+	case fileActionRemoved:
+		return Remove
+	case fileActionModified:
+		return Write
+	case fileActionRenamedOldName:
+		return Rename
+	}
+	return 0
+}
+
+// WindowsFilterFromOp returns the FILE_NOTIFY_CHANGE_* filter for
+// ReadDirectoryChangesW to listen for the operations in op. Chmod isn't sent
+// on Windows, so it doesn't add a flag.
+func WindowsFilterFromOp(op Op) uint32 {
+	var filter uint32
+	if op.Has(Write) {
+		filter |= fileNotifyChangeLastWrite
+	}
+	if op.HasAny(Create | Remove | Rename) {
+		filter |= fileNotifyChangeFileName | fileNotifyChangeDirName
+	}
+	return filter
+}
+
+// kqueue EVFILT_VNODE fflags; these are the same on macOS and all BSD systems.
+const (
+	noteDelete = 0x1
+	noteWrite  = 0x2
+	noteAttrib = 0x8
+	noteRename = 0x20
+)
+
+// OpFromKqueue returns the Op for the fflags of a kqueue EVFILT_VNODE event, in
+// the same way as the kqueue backend: a Write is dropped if the file was also
+// deleted. A Write on a directory is how kqueue reports a change in it, which
+// the kqueue backend turns in to Create and Remove events for the files by
+// reading the directory; that's not done here.
+func OpFromKqueue(fflags uint32) Op {
+	var op Op
+	if fflags&noteDelete != 0 {
+		op |= Remove
+	}
+	if fflags&noteWrite != 0 && fflags&noteDelete == 0 {
+		op |= Write
+	}
+	if fflags&noteRename != 0 {
+		op |= Rename
+	}
+	if fflags&noteAttrib != 0 {
+		op |= Chmod
+	}
+	return op
+}
+
+// KqueueFromOp returns the EVFILT_VNODE fflags to listen for the operations in
+// op. NOTE_WRITE is also needed to get a Create or Remove for the files in a
+// directory.
+func KqueueFromOp(op Op) uint32 {
+	var fflags uint32
+	if op.HasAny(Write | Create | Remove) {
+		fflags |= noteWrite
+	}
+	if op.Has(Remove) {
+		fflags |= noteDelete
+	}
+	if op.Has(Rename) {
+		fflags |= noteRename
+	}
+	if op.Has(Chmod) {
+		fflags |= noteAttrib
+	}
+	return fflags
+}
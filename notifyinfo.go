@@ -0,0 +1,53 @@
+package fsnotify
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Size of FILE_NOTIFY_INFORMATION without the FileName.
+const notifyInfoSize = 12
+
+// parseNotifyInfo calls fn for every FILE_NOTIFY_INFORMATION in buf, as filled
+// by ReadDirectoryChangesW, with the Action and the raw UTF-16 FileName.
+//
+// The buffer isn't trusted: if an entry, its name, or the offset of the next
+// entry isn't inside buf (e.g. a malformed response from an SMB server) it
+// returns an error that wraps ErrInvalidEvent, after calling fn for the entries
+// before it. Names can be up to 32K UTF-16 characters with \\?\ paths, which
+// only fit if the buffer is large enough; see WithBufferSize.
+//
+// The fields are read with encoding/binary rather than by pointing a struct at
+// the buffer, so it doesn't need to be aligned. This isn't in
+// backend_windows.go so that it can be tested and fuzzed on all platforms.
+func parseNotifyInfo(buf []byte, fn func(action uint32, name []byte)) error {
+	var offset uint64
+	for {
+		rest := uint64(len(buf)) - offset
+		if rest < notifyInfoSize {
+			return fmt.Errorf("%w: entry at offset %d doesn't fit in %d bytes",
+				ErrInvalidEvent, offset, len(buf))
+		}
+		var (
+			next    = uint64(binary.LittleEndian.Uint32(buf[offset:]))
+			action  = binary.LittleEndian.Uint32(buf[offset+4:])
+			nameLen = uint64(binary.LittleEndian.Uint32(buf[offset+8:]))
+		)
+		if nameLen > rest-notifyInfoSize {
+			return fmt.Errorf("%w: name of %d bytes at offset %d doesn't fit in %d bytes",
+				ErrInvalidEvent, nameLen, offset+notifyInfoSize, len(buf))
+		}
+
+		start := offset + notifyInfoSize
+		fn(action, buf[start:start+nameLen:start+nameLen])
+
+		if next == 0 {
+			return nil
+		}
+		if next < notifyInfoSize+nameLen || next >= rest || next%4 != 0 {
+			return fmt.Errorf("%w: bad offset %d for the next entry after offset %d in %d bytes",
+				ErrInvalidEvent, next, offset, len(buf))
+		}
+		offset += next
+	}
+}
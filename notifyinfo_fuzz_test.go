@@ -0,0 +1,40 @@
+//go:build go1.18
+// +build go1.18
+
+package fsnotify
+
+import (
+	"errors"
+	"testing"
+)
+
+// Run with:
+//
+//	go test -run - -fuzz FuzzParseNotifyInfo
+func FuzzParseNotifyInfo(f *testing.F) {
+	f.Add(notifyInfo(fileActionAdded, "file", 0, -1))
+	f.Add(append(notifyInfo(fileActionRenamedOldName, "old", 20, -1), notifyInfo(fileActionRenamedNewName, "new", 0, -1)...))
+	f.Add(notifyInfo(fileActionAdded, "file", 0, 7))
+	f.Add(notifyInfo(fileActionAdded, "file", 4, -1))
+	f.Add(notifyInfo(fileActionAdded, "file", 0xfffffffc, -1))
+	f.Add(notifyInfo(fileActionAdded, "file", 0, 0xffffffff))
+	f.Add(notifyInfo(fileActionAdded, "file", 0, -1)[:15])
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		var entries, names int
+		err := parseNotifyInfo(buf, func(action uint32, name []byte) {
+			entries++
+			names += len(name)
+			if cap(name) != len(name) {
+				t.Fatalf("name can be appended to: len %d, cap %d", len(name), cap(name))
+			}
+		})
+		if err != nil && !errors.Is(err, ErrInvalidEvent) {
+			t.Fatalf("doesn't wrap ErrInvalidEvent: %v", err)
+		}
+		// Entries can't overlap, so they must all fit in the buffer.
+		if entries*notifyInfoSize+names > len(buf) {
+			t.Fatalf("%d entries with %d bytes of names in a %d byte buffer", entries, names, len(buf))
+		}
+	})
+}
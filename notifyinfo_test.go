@@ -0,0 +1,90 @@
+package fsnotify
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// notifyInfo returns a FILE_NOTIFY_INFORMATION with the name, and the given
+// NextEntryOffset and FileNameLength (the real length if -1).
+func notifyInfo(action uint32, name string, next uint32, nameLen int64) []byte {
+	u := utf16.Encode([]rune(name))
+	if nameLen < 0 {
+		nameLen = int64(len(u) * 2)
+	}
+	buf := make([]byte, notifyInfoSize, notifyInfoSize+len(u)*2)
+	binary.LittleEndian.PutUint32(buf[0:], next)
+	binary.LittleEndian.PutUint32(buf[4:], action)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(nameLen))
+	for _, c := range u {
+		buf = append(buf, byte(c), byte(c>>8))
+	}
+	return buf
+}
+
+func TestParseNotifyInfo(t *testing.T) {
+	long := strings.Repeat("x", 32767) // Longest name with \\?\ paths.
+	concat := func(b ...[]byte) []byte {
+		var all []byte
+		for _, bb := range b {
+			all = append(all, bb...)
+		}
+		return all
+	}
+
+	tests := []struct {
+		name    string
+		buf     []byte
+		want    []string
+		wantErr bool
+	}{
+		{"one", notifyInfo(fileActionAdded, "file", 0, -1), []string{"1 file"}, false},
+		{"long name", notifyInfo(fileActionAdded, long, 0, -1), []string{"1 " + long}, false},
+		{"two", concat(
+			notifyInfo(fileActionRenamedOldName, "file", 20, -1),
+			notifyInfo(fileActionRenamedNewName, "ファイル", 0, -1),
+		), []string{"4 file", "5 ファイル"}, false},
+		{"padding", concat(
+			notifyInfo(fileActionAdded, "a", 20, -1), make([]byte, 6),
+			notifyInfo(fileActionRemoved, "b", 0, -1),
+		), []string{"1 a", "2 b"}, false},
+		{"odd name length", notifyInfo(fileActionAdded, "file", 0, 7), []string{"1 fil"}, false},
+		{"empty name", notifyInfo(fileActionModified, "", 0, -1), []string{"3 "}, false},
+
+		{"empty", nil, nil, true},
+		{"short header", notifyInfo(fileActionAdded, "file", 0, -1)[:10], nil, true},
+		{"name past end", notifyInfo(fileActionAdded, "file", 0, 10), nil, true},
+		{"name overflows", notifyInfo(fileActionAdded, "file", 0, 0xffffffff), nil, true},
+		{"truncated", notifyInfo(fileActionAdded, "file", 0, -1)[:19], nil, true},
+		{"next overlaps", notifyInfo(fileActionAdded, "file", 4, -1), []string{"1 file"}, true},
+		{"next past end", notifyInfo(fileActionAdded, "file", 100, -1), []string{"1 file"}, true},
+		{"next unaligned", concat(notifyInfo(fileActionAdded, "file", 22, -1), make([]byte, 16)), []string{"1 file"}, true},
+		{"next overflows", notifyInfo(fileActionAdded, "file", 0xfffffffc, -1), []string{"1 file"}, true},
+		{"next entry short", concat(notifyInfo(fileActionAdded, "file", 20, -1), make([]byte, 8)), []string{"1 file"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var have []string
+			err := parseNotifyInfo(tt.buf, func(action uint32, name []byte) {
+				u := make([]uint16, len(name)/2)
+				for i := range u {
+					u[i] = binary.LittleEndian.Uint16(name[i*2:])
+				}
+				have = append(have, string(rune('0'+action))+" "+string(utf16.Decode(u)))
+			})
+			if tt.wantErr != (err != nil) {
+				t.Errorf("wrong error: %v", err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidEvent) {
+				t.Errorf("doesn't wrap ErrInvalidEvent: %v", err)
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("wrong entries\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+// Package onchange reports when a file changes, for configuration libraries
+// that reload a file and don't care about the individual events.
+//
+// Watching a file directly with fsnotify has a number of well-known problems:
+// editors that save by writing a new file and renaming it over the old one
+// remove the watch; the file is reported while it's only partly written; and
+// Kubernetes ConfigMap and Secret volumes update a file by swapping a symlink
+// ("..data") in the parent directory, which never touches the file itself.
+// This package watches the parent directory instead, waits for the writes to
+// settle, and reports a change only if the file the path resolves to was
+// actually changed.
+package onchange
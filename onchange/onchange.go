@@ -0,0 +1,139 @@
+package onchange
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/camille-sound4/fsnotify"
+)
+
+// How long to wait after the last event in the directory before checking if
+// the file was changed, so that a file that's being written is only reported
+// once.
+const settle = 100 * time.Millisecond
+
+// File returns a channel that receives a value every time path is changed,
+// replaced, removed, or created again. See FileContext.
+//
+// The watch is never stopped; use FileContext to stop it.
+func File(path string) (<-chan struct{}, error) {
+	return FileContext(context.Background(), path)
+}
+
+// FileContext is like File, but stops watching and closes the channel once ctx
+// is done.
+//
+// The channel is buffered, and changes are coalesced: if the previous change
+// wasn't received yet, no new value is sent. Read the file after receiving
+// from the channel, rather than assuming a single change happened.
+//
+// The parent directory of path must exist, but path itself doesn't need to. If
+// path is a symlink the directory of the file it points to is watched too.
+// Errors from the watcher (such as an overflow) are reported as a change, as
+// the file may have changed.
+func FileContext(ctx context.Context, path string) (<-chan struct{}, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcherWith(fsnotify.WithOps(fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename))
+	if err != nil {
+		return nil, err
+	}
+	f := &file{path: path, w: w}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("onchange: %w", err)
+	}
+	f.last = f.stat()
+
+	ch := make(chan struct{}, 1)
+	go f.run(ctx, ch)
+	return ch, nil
+}
+
+type file struct {
+	path     string
+	w        *fsnotify.Watcher
+	last     state
+	force    bool   // Report a change even if the state is the same.
+	extraDir string // Directory of the symlink target, if it's watched.
+}
+
+// state is what's compared to decide if the file was changed.
+type state struct {
+	real string // Path with all symlinks resolved; "" if it doesn't exist.
+	fi   os.FileInfo
+}
+
+func (s state) equal(o state) bool {
+	if s.real != o.real || (s.fi == nil) != (o.fi == nil) {
+		return false
+	}
+	return s.fi == nil || (os.SameFile(s.fi, o.fi) &&
+		s.fi.Size() == o.fi.Size() && s.fi.ModTime().Equal(o.fi.ModTime()))
+}
+
+// stat returns the current state of the file, and watches the directory of the
+// symlink target if it's outside the parent directory.
+func (f *file) stat() state {
+	real, err := filepath.EvalSymlinks(f.path)
+	if err != nil {
+		return state{}
+	}
+	fi, err := os.Stat(real)
+	if err != nil {
+		return state{}
+	}
+
+	dir := filepath.Dir(real)
+	if dir == filepath.Dir(f.path) {
+		dir = ""
+	}
+	if dir != f.extraDir {
+		if f.extraDir != "" {
+			f.w.Remove(f.extraDir)
+		}
+		f.extraDir = ""
+		if dir != "" && f.w.Add(dir) == nil {
+			f.extraDir = dir
+		}
+	}
+	return state{real: real, fi: fi}
+}
+
+func (f *file) run(ctx context.Context, ch chan struct{}) {
+	defer close(ch)
+	defer f.w.Close()
+
+	t := time.NewTimer(settle)
+	t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-f.w.Events:
+			if !ok {
+				return
+			}
+			t.Reset(settle)
+		case _, ok := <-f.w.Errors:
+			if !ok {
+				return
+			}
+			f.force = true
+			t.Reset(settle)
+		case <-t.C:
+			if s := f.stat(); f.force || !s.equal(f.last) {
+				f.last, f.force = s, false
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
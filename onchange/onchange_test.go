@@ -0,0 +1,127 @@
+package onchange
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func write(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// changed reports if there was a value on ch before timeout.
+func changed(ch <-chan struct{}, timeout time.Duration) bool {
+	select {
+	case _, ok := <-ch:
+		return ok
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestFile(t *testing.T) {
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "app.conf")
+	write(t, path, "a = 1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := FileContext(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write(t, filepath.Join(tmp, "other"), "x")
+	if changed(ch, 3*settle) {
+		t.Fatal("change for other file")
+	}
+
+	write(t, path, "a = 2")
+	if !changed(ch, 5*time.Second) {
+		t.Fatal("no change after write")
+	}
+
+	// Atomic save: write a new file and rename it over the old one.
+	write(t, path+".tmp", "a = 3")
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+	if !changed(ch, 5*time.Second) {
+		t.Fatal("no change after rename")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if !changed(ch, 5*time.Second) {
+		t.Fatal("no change after remove")
+	}
+	write(t, path, "a = 4")
+	if !changed(ch, 5*time.Second) {
+		t.Fatal("no change after creating again")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("value after cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+}
+
+// Kubernetes ConfigMap volumes: app.conf is a symlink to ..data/app.conf, and
+// ..data is a symlink to a timestamped directory, which is replaced on updates.
+func TestFileKubernetes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need special permissions on Windows")
+	}
+
+	tmp := t.TempDir()
+	if err := os.Mkdir(filepath.Join(tmp, "..2024_01"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write(t, filepath.Join(tmp, "..2024_01", "app.conf"), "a = 1")
+	if err := os.Symlink("..2024_01", filepath.Join(tmp, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "app.conf"), filepath.Join(tmp, "app.conf")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := FileContext(ctx, filepath.Join(tmp, "app.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(filepath.Join(tmp, "..2024_02"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write(t, filepath.Join(tmp, "..2024_02", "app.conf"), "a = 2")
+	if err := os.Symlink("..2024_02", filepath.Join(tmp, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(tmp, "..data_tmp"), filepath.Join(tmp, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if !changed(ch, 5*time.Second) {
+		t.Fatal("no change after swapping ..data")
+	}
+	if err := os.RemoveAll(filepath.Join(tmp, "..2024_01")); err != nil {
+		t.Fatal(err)
+	}
+	if changed(ch, 3*settle) {
+		t.Fatal("change after removing the old directory")
+	}
+}
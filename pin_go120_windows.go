@@ -0,0 +1,12 @@
+//go:build windows && !go1.21
+// +build windows,!go1.21
+
+package fsnotify
+
+// pinner is a no-op before Go 1.21, which doesn't have runtime.Pinner; the
+// garbage collector doesn't move heap objects, and Watcher.reads keeps them
+// from being freed.
+type pinner struct{}
+
+func (p *pinner) pin(v interface{}) {}
+func (p *pinner) unpin()            {}
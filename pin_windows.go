@@ -0,0 +1,13 @@
+//go:build windows && go1.21
+// +build windows,go1.21
+
+package fsnotify
+
+import "runtime"
+
+// pinner pins the OVERLAPPED and buffer of a pending read, so the garbage
+// collector can't move or free them while the kernel writes to them.
+type pinner struct{ p runtime.Pinner }
+
+func (p *pinner) pin(v interface{}) { p.p.Pin(v) }
+func (p *pinner) unpin()            { p.p.Unpin() }
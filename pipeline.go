@@ -0,0 +1,57 @@
+package fsnotify
+
+import "sync"
+
+// Use adds fn to the functions that every event is passed through before it's
+// sent, so that events can be changed (e.g. to rewrite paths) or dropped
+// without wrapping the Events channel. fn returns the event to send, or false
+// to drop it. The functions are called in the order they were added, each
+// with the event returned by the previous one.
+//
+// The functions are called after the events are filtered with [WithOps] and
+// the other options that drop or merge events, such as [WithFilterPresets] and
+// [WithDedup], and before [Watcher.Route] and [WithDirectDispatch]. Events from
+// [Watcher.Replay] and synthetic events such as from [WithOverflowMarks] are
+// passed through them too.
+//
+// The Op can't be changed, as the options before it already acted on it; the
+// Op of the returned event is ignored. Use false to drop events for an Op.
+//
+// fn is called on the goroutine that reads the events, and shouldn't block for
+// long. There is no way to remove a function.
+func (w *Watcher) Use(fn func(Event) (Event, bool)) {
+	w.pipeline.add(fn)
+}
+
+// pipeline is the list of functions from Use.
+type pipeline struct {
+	mu  sync.RWMutex
+	fns []func(Event) (Event, bool)
+}
+
+func (p *pipeline) add(fn func(Event) (Event, bool)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Copy, so apply can use the old slice without holding the lock.
+	fns := make([]func(Event) (Event, bool), len(p.fns), len(p.fns)+1)
+	copy(fns, p.fns)
+	p.fns = append(fns, fn)
+}
+
+// apply passes e through all functions, and returns false if one of them
+// dropped it.
+func (p *pipeline) apply(e Event) (Event, bool) {
+	p.mu.RLock()
+	fns := p.fns
+	p.mu.RUnlock()
+
+	op := e.Op
+	for _, fn := range fns {
+		var ok bool
+		if e, ok = fn(e); !ok {
+			return e, false
+		}
+		e.Op = op
+	}
+	return e, true
+}
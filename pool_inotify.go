@@ -0,0 +1,251 @@
+//go:build linux && !appengine
+// +build linux,!appengine
+
+package fsnotify
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Pool reads events for several watchers on a single goroutine; see
+// [WithPool].
+//
+// On Linux all watchers in the pool share one epoll instance and goroutine,
+// rather than every watcher having its own goroutine. Other platforms don't
+// support this yet, and every watcher uses its own goroutine; on Windows,
+// [WithCompletionPort] can be used to read several watchers from one I/O
+// completion port instead.
+//
+// If the pool can't wait for events any more, the error is sent on the Errors
+// channel of every watcher in the pool, the watchers are closed, and the pool
+// is stopped.
+type Pool struct {
+	epfd   int
+	wake   int // eventfd to wake up the loop.
+	mu     sync.Mutex
+	fds    map[int]*Watcher // inotify fd → watcher.
+	remove []*Watcher       // Closed watchers to finish.
+	closed bool             // Don't accept new watchers.
+	stop   bool             // Stop the loop.
+	failed bool             // The loop stopped after an error; see fail.
+	done   chan struct{}    // Closed when the loop exits.
+}
+
+// NewPool creates a new Pool.
+func NewPool() (*Pool, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	wake, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		unix.Close(epfd)
+		return nil, os.NewSyscallError("eventfd", err)
+	}
+	err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, wake, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(wake)})
+	if err != nil {
+		unix.Close(epfd)
+		unix.Close(wake)
+		return nil, os.NewSyscallError("epoll_ctl", err)
+	}
+
+	p := &Pool{
+		epfd: epfd,
+		wake: wake,
+		fds:  make(map[int]*Watcher),
+		done: make(chan struct{}),
+	}
+	go p.loop()
+	return p, nil
+}
+
+// Close closes all watchers in the pool and stops the goroutine.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	ws := make([]*Watcher, 0, len(p.fds))
+	for _, w := range p.fds {
+		ws = append(ws, w)
+	}
+	p.mu.Unlock()
+
+	for _, w := range ws {
+		w.Close()
+	}
+
+	p.mu.Lock()
+	p.stop = true
+	err := p.wakeup()
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	<-p.done
+	return nil
+}
+
+// Stats returns statistics about the watchers in the pool.
+//
+// Every watcher in the pool has its own inotify instance, so the kernel limits
+// apply to every watcher separately; use [WithMaxWatches] to limit the number
+// of watches for every watcher, and Stats to report the total.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	ws := make([]*Watcher, 0, len(p.fds))
+	for _, w := range p.fds {
+		ws = append(ws, w)
+	}
+	p.mu.Unlock()
+
+	s := PoolStats{Watchers: len(ws)}
+	for _, w := range ws {
+		s.Watches += w.watchCount()
+	}
+	return s
+}
+
+func (p *Pool) add(w *Watcher) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+
+	err := unix.EpollCtl(p.epfd, unix.EPOLL_CTL_ADD, w.fd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(w.fd)})
+	if err != nil {
+		return os.NewSyscallError("epoll_ctl", err)
+	}
+	p.fds[w.fd] = w
+	return nil
+}
+
+// del removes the watcher from the pool; the inotify fd and channels are closed
+// from the loop once it's done with the watcher. Called from Watcher.Stop.
+func (p *Pool) del(w *Watcher) error {
+	p.mu.Lock()
+	if p.failed {
+		p.mu.Unlock()
+		w.inotifyFile.Close()
+		w.closeChannels()
+		return nil
+	}
+	if _, ok := p.fds[w.fd]; ok {
+		_ = unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, w.fd, nil)
+		delete(p.fds, w.fd)
+	}
+	p.remove = append(p.remove, w)
+	err := p.wakeup()
+	p.mu.Unlock()
+	return err
+}
+
+// wakeup wakes up the loop; p.mu must be held, so that the loop can't close the
+// eventfd in the meantime.
+func (p *Pool) wakeup() error {
+	_, err := unix.Write(p.wake, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	if err != nil && !errors.Is(err, unix.EAGAIN) {
+		return os.NewSyscallError("write", err)
+	}
+	return nil
+}
+
+func (p *Pool) loop() {
+	defer func() {
+		p.mu.Lock()
+		unix.Close(p.wake)
+		unix.Close(p.epfd)
+		p.mu.Unlock()
+		close(p.done)
+	}()
+
+	var (
+		buf    = newInotifyBuffer()
+		events = make([]unix.EpollEvent, 64)
+		drain  = make([]byte, 8)
+	)
+	for {
+		n, err := unix.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			// Only EBADF, EFAULT, and EINVAL, which should never happen.
+			p.fail(os.NewSyscallError("epoll_wait", err))
+			return
+		}
+
+		for _, ev := range events[:n] {
+			fd := int(ev.Fd)
+			if fd == p.wake {
+				unix.Read(p.wake, drain)
+				continue
+			}
+
+			p.mu.Lock()
+			w := p.fds[fd]
+			p.mu.Unlock()
+			if w == nil || w.isClosed() {
+				continue
+			}
+
+			// The inotify fd is non-blocking, so this won't block.
+			n, err := unix.Read(fd, buf)
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+			if err != nil {
+				err = os.NewSyscallError("read", err)
+			}
+			// Returns false if the watcher was closed; p.remove takes care of
+			// that.
+			w.handleEvents(buf, n, err)
+		}
+
+		p.mu.Lock()
+		remove, stop := p.remove, p.stop
+		p.remove = nil
+		p.mu.Unlock()
+		for _, w := range remove {
+			w.inotifyFile.Close()
+			w.closeChannels()
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// fail stops the pool after an error from which the loop can't recover. No more
+// events can be read for the watchers in the pool, so the error is sent to all
+// of them, and they're closed.
+func (p *Pool) fail(err error) {
+	p.mu.Lock()
+	p.closed, p.failed = true, true
+	ws := make([]*Watcher, 0, len(p.fds))
+	for fd, w := range p.fds {
+		ws = append(ws, w)
+		delete(p.fds, fd)
+	}
+	remove := p.remove
+	p.remove = nil
+	p.mu.Unlock()
+
+	for _, w := range remove {
+		w.inotifyFile.Close()
+		w.closeChannels()
+	}
+	for _, w := range ws {
+		// Blocks until the error is read or the watcher is closed, the same as
+		// any other error; Stop closes the watcher with del.
+		w.sendError(err)
+		w.Stop()
+	}
+}
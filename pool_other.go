@@ -0,0 +1,23 @@
+//go:build !linux || appengine
+// +build !linux appengine
+
+package fsnotify
+
+// Pool reads events for several watchers on a single goroutine; see
+// [WithPool].
+//
+// On Linux all watchers in the pool share one epoll instance and goroutine,
+// rather than every watcher having its own goroutine. Other platforms don't
+// support this yet, and every watcher uses its own goroutine; on Windows,
+// [WithCompletionPort] can be used to read several watchers from one I/O
+// completion port instead.
+type Pool struct{}
+
+// NewPool creates a new Pool.
+func NewPool() (*Pool, error) { return &Pool{}, nil }
+
+// Close closes all watchers in the pool and stops the goroutine.
+func (p *Pool) Close() error { return nil }
+
+// Stats returns statistics about the watchers in the pool.
+func (p *Pool) Stats() PoolStats { return PoolStats{} }
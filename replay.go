@@ -0,0 +1,126 @@
+package fsnotify
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sync"
+)
+
+// Replay sends a Create event for every file and directory in path,
+// recursively, as if they were all just created. The events are sent on the
+// Events channel like any other event (or to the [WithDirectDispatch] handler),
+// so an application can rebuild its state after a failure with the same code
+// that handles the events.
+//
+// Entries are sent in lexical order, with directories before their contents;
+// the Create for path itself isn't sent. Names are relative to path in the
+// same way as other events. The path doesn't need to be watched, and Replay can
+// be called at any time; events for real changes may be interleaved with the
+// replayed events.
+//
+// Replay blocks until all events are sent. Directories that can't be read are
+// skipped, and the first such error is returned after the rest of the tree was
+// sent. Returns [ErrClosed] if [Watcher.Close] was called, in which case the
+// events that weren't sent are counted as dropped in [Stats].
+//
+// The WithDirectDispatch handler is called on the goroutine that calls Replay,
+// and may run concurrently with the handler for other events.
+func (w *Watcher) Replay(path string) error {
+	if !w.replays.start() {
+		return ErrClosed
+	}
+	defer w.replays.wg.Done()
+
+	var firstErr error
+	err := filepath.WalkDir(path, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == path {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			return nil
+		}
+		if name == path {
+			return nil
+		}
+		return w.replay(Event{Name: name, Op: Create})
+	})
+	if err != nil {
+		return err
+	}
+	return firstErr
+}
+
+func (w *Watcher) replay(e Event) error {
+	if w.filter.drop(e) {
+		return nil
+	}
+	e, ok := w.pipeline.apply(e)
+	if !ok || w.routes.route(e) {
+		return nil
+	}
+	if w.dispatch != nil {
+		w.dispatch(e)
+		return nil
+	}
+	select {
+	case w.Events <- e:
+		return nil
+	case <-w.replays.stop:
+		w.queue.drop(e)
+		return ErrClosed
+	}
+}
+
+// sendLater sends e from a new goroutine, for events that are generated while
+// reading other events.
+func (w *Watcher) sendLater(e Event) {
+	if !w.replays.start() {
+		return
+	}
+	go func() {
+		defer w.replays.wg.Done()
+		w.replay(e)
+	}()
+}
+
+// replays keeps track of running Replay calls, so that the Events channel isn't
+// closed while they're sending on it.
+type replays struct {
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+	stop   chan struct{}
+	closed bool
+}
+
+// start registers a new Replay call; returns false if the watcher is closed.
+func (r *replays) start() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	if r.stop == nil {
+		r.stop = make(chan struct{})
+	}
+	r.wg.Add(1)
+	return true
+}
+
+// close stops all running Replay calls and waits for them to return. This must
+// be called before closing the Events channel.
+func (r *replays) close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	if r.stop != nil {
+		close(r.stop)
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
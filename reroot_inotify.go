@@ -0,0 +1,92 @@
+//go:build linux && !appengine
+// +build linux,!appengine
+
+package fsnotify
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reroot translates the paths of the watches for a process that entered a
+// chroot or a new mount namespace (e.g. with pivot_root) after adding them;
+// root is the path of the new root directory before entering it. Container
+// runtimes and sandboxing tools can set up the watches first, and then drop
+// access to the rest of the filesystem.
+//
+// The inotify watches keep working, as they refer to the inodes rather than the
+// paths, but Event.Name would still be the path outside the new root. After
+// Reroot the watches under root are reported, listed, and removed by their
+// path inside it: with root "/srv/jail" the watch on "/srv/jail/etc" becomes
+// "/etc". Watches outside root can't be reached from inside it, and are
+// removed.
+//
+// Call it right after entering the new root, before adding new watches. Events
+// that were already read from the kernel may still have the old path. This is
+// only supported on Linux.
+func (w *Watcher) Reroot(root string) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if !filepath.IsAbs(root) {
+		return fmt.Errorf("fsnotify: Reroot: not an absolute path: %q", root)
+	}
+	root = filepath.Clean(root)
+
+	type moved struct {
+		from, to       string
+		attrs, fileIDs bool
+	}
+	var (
+		outside []uint32
+		renamed []moved
+	)
+	w.watches.mu.Lock()
+	wds := w.watches.wd
+	w.watches.wd = make(map[uint32]*watch, len(wds))
+	w.watches.path = make(map[string]uint32, len(wds))
+	for wd, watch := range wds {
+		path, ok := rerootPath(root, watch.path)
+		if !ok {
+			outside = append(outside, wd)
+			continue
+		}
+		// readEvents may be using the old watch; don't change it.
+		n := *watch
+		n.path, n.lastName = path, ""
+		w.watches.wd[wd], w.watches.path[path] = &n, wd
+		if n.attrs || n.fileIDs {
+			renamed = append(renamed, moved{watch.path, path, n.attrs, n.fileIDs})
+		}
+	}
+	w.watches.mu.Unlock()
+
+	for _, wd := range outside {
+		unix.InotifyRmWatch(w.fd, wd)
+		w.attrs.remove(wds[wd].path)
+		w.fileIDs.remove(wds[wd].path)
+	}
+	for _, m := range renamed {
+		w.attrs.remove(m.from)
+		w.fileIDs.remove(m.from)
+		if m.attrs {
+			w.attrs.addAll(m.to)
+		}
+		if m.fileIDs {
+			w.fileIDs.addAll(m.to)
+		}
+	}
+	return nil
+}
+
+// rerootPath returns path relative to root, as an absolute path, and false if
+// it's not in root.
+func rerootPath(root, path string) (string, bool) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || len(rel) > 2 && rel[:3] == "../" {
+		return "", false
+	}
+	return filepath.Join("/", rel), true
+}
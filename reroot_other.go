@@ -0,0 +1,29 @@
+//go:build !linux || appengine
+// +build !linux appengine
+
+package fsnotify
+
+import (
+	"errors"
+	"runtime"
+)
+
+// Reroot translates the paths of the watches for a process that entered a
+// chroot or a new mount namespace (e.g. with pivot_root) after adding them;
+// root is the path of the new root directory before entering it. Container
+// runtimes and sandboxing tools can set up the watches first, and then drop
+// access to the rest of the filesystem.
+//
+// The inotify watches keep working, as they refer to the inodes rather than the
+// paths, but Event.Name would still be the path outside the new root. After
+// Reroot the watches under root are reported, listed, and removed by their
+// path inside it: with root "/srv/jail" the watch on "/srv/jail/etc" becomes
+// "/etc". Watches outside root can't be reached from inside it, and are
+// removed.
+//
+// Call it right after entering the new root, before adding new watches. Events
+// that were already read from the kernel may still have the old path. This is
+// only supported on Linux.
+func (w *Watcher) Reroot(root string) error {
+	return errors.New("fsnotify: Reroot is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,76 @@
+package fsnotify
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// Route sends the events for paths in prefix to handler, instead of sending
+// them on the Events channel, so that events can be directed to different
+// parts of an application without a big switch on Event.Name.
+//
+// If more than one prefix matches an event the longest one is used; prefixes
+// only match entire path components, so "/srv/data" matches "/srv/data/file"
+// but not "/srv/database". The prefix is compared to Event.Name as it is, after
+// filepath.Clean, so use the same form of the path as with [Watcher.Add] (or
+// use [WithAbsolutePaths]). Use "/" (or "." for relative paths) to handle all
+// events. Events that don't match any prefix are sent as normal.
+//
+// Adding a prefix again replaces the handler; a nil handler removes the route.
+//
+// The handler is called on the goroutine that reads the events, in the same
+// way as with [WithDirectDispatch], and shouldn't block for long. Events from
+// [Watcher.Replay] and the synthetic events from options such as
+// [WithOverflowMarks] are routed too.
+func (w *Watcher) Route(prefix string, handler func(Event)) {
+	w.routes.set(filepath.Clean(prefix), handler)
+}
+
+// routes is the routing table for Route.
+type routes struct {
+	mu sync.RWMutex
+	m  map[string]func(Event)
+}
+
+func (r *routes) set(prefix string, handler func(Event)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if handler == nil {
+		delete(r.m, prefix)
+		return
+	}
+	if r.m == nil {
+		r.m = make(map[string]func(Event))
+	}
+	r.m[prefix] = handler
+}
+
+// route calls the handler with the longest prefix for e, and reports if there
+// was one.
+func (r *routes) route(e Event) bool {
+	h := r.lookup(e.Name)
+	if h == nil {
+		return false
+	}
+	h(e)
+	return true
+}
+
+// lookup returns the handler with the longest prefix for name, or nil.
+func (r *routes) lookup(name string) func(Event) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.m) == 0 {
+		return nil
+	}
+	for p := filepath.Clean(name); ; {
+		if h, ok := r.m[p]; ok {
+			return h
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return nil
+		}
+		p = parent
+	}
+}
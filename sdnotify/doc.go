@@ -0,0 +1,8 @@
+// Package sdnotify ties a fsnotify watcher into systemd: it sends watchdog
+// keep-alives only while the watcher is healthy, and reads the paths to watch
+// from the unit's environment, similar to a path unit.
+//
+// Everything in this package is a no-op if the process wasn't started by
+// systemd (or something compatible, such as s6 with $NOTIFY_SOCKET), so it's
+// safe to use unconditionally.
+package sdnotify
@@ -0,0 +1,190 @@
+package sdnotify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/camille-sound4/fsnotify"
+)
+
+// Notify sends state to systemd, for example "READY=1" or "WATCHDOG=1"; see
+// sd_notify(3).
+//
+// It returns false and no error if $NOTIFY_SOCKET isn't set.
+func Notify(state string) (bool, error) {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return false, nil
+	}
+	if sock[0] == '@' { // Abstract socket.
+		sock = "\x00" + sock[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the watchdog timeout from $WATCHDOG_USEC (the
+// WatchdogSec= setting of the unit), or 0 if the watchdog isn't enabled for
+// this process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("sdnotify: invalid $WATCHDOG_USEC: %q", usec)
+	}
+
+	// Set if the watchdog is for a specific process; it's not for us if this
+	// is a child of the process systemd started.
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" {
+		p, err := strconv.Atoi(pid)
+		if err != nil {
+			return 0, fmt.Errorf("sdnotify: invalid $WATCHDOG_PID: %q", pid)
+		}
+		if p != os.Getpid() {
+			return 0, nil
+		}
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// Watchdog sends "WATCHDOG=1" every half watchdog timeout while healthy
+// returns true, until ctx is done. If healthy returns false the keep-alive is
+// skipped, so systemd restarts the service if it stays unhealthy for longer
+// than WatchdogSec=. The STATUS is set when the health changes, so it shows up
+// in "systemctl status".
+//
+// It returns nil right away if the watchdog isn't enabled for this process,
+// and ctx.Err() once ctx is done. healthy is usually [Healthy].
+func Watchdog(ctx context.Context, healthy func() bool) error {
+	interval, err := WatchdogInterval()
+	if err != nil || interval == 0 {
+		return err
+	}
+
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+	wasHealthy := true
+	for {
+		ok := healthy()
+		if ok {
+			if _, err := Notify("WATCHDOG=1"); err != nil {
+				return err
+			}
+		}
+		if ok != wasHealthy {
+			status := "STATUS=watcher healthy"
+			if !ok {
+				status = "STATUS=watcher unhealthy"
+			}
+			if _, err := Notify(status); err != nil {
+				return err
+			}
+			wasHealthy = ok
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Healthy returns a function for [Watchdog] that reports if w is still running;
+// it returns false once w is closed or stopped because of a fatal error.
+//
+// The application should still read w.Errors; use your own function to also
+// take errors into account, or the [fsnotify.Stats].
+func Healthy(w *fsnotify.Watcher) func() bool {
+	return func() bool {
+		select {
+		case <-w.Done():
+			return false
+		default:
+			return true
+		}
+	}
+}
+
+// WatchEnv is the environment variable that [WatchSetFromEnv] reads.
+const WatchEnv = "FSNOTIFY_WATCH"
+
+// WatchSetFromEnv reads the paths to watch from $FSNOTIFY_WATCH, so they can be
+// set in the unit file instead of the application's configuration, in the
+// same way as a path unit:
+//
+//	[Service]
+//	Environment="FSNOTIFY_WATCH=PathChanged=/etc/app.conf PathModified=/srv/spool"
+//
+// This is a list of paths separated by whitespace, with an optional directive
+// from systemd.path(5) to set the operations:
+//
+//	PathChanged=   Create, Remove, Rename, and Chmod, with writes reported
+//	               once the file is closed (see fsnotify.PreferCloseWrite).
+//	PathModified=  As PathChanged, but every write is reported. This is the
+//	               default without a directive.
+//
+// Paths with whitespace can't be used in this format; if the value starts with
+// "{" it's parsed as the JSON encoding of a [fsnotify.WatchSet] instead.
+//
+// The result can be passed to [fsnotify.NewWatcherFromSet]. It returns false if
+// $FSNOTIFY_WATCH isn't set.
+func WatchSetFromEnv() (fsnotify.WatchSet, bool, error) {
+	env, ok := os.LookupEnv(WatchEnv)
+	if !ok {
+		return fsnotify.WatchSet{}, false, nil
+	}
+	ws, err := parseWatchSet(env)
+	if err != nil {
+		return fsnotify.WatchSet{}, true, fmt.Errorf("sdnotify: $%s: %w", WatchEnv, err)
+	}
+	return ws, true, nil
+}
+
+func parseWatchSet(s string) (fsnotify.WatchSet, error) {
+	var ws fsnotify.WatchSet
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		err := json.Unmarshal([]byte(s), &ws)
+		return ws, err
+	}
+
+	const changed = fsnotify.Create | fsnotify.Remove | fsnotify.Rename | fsnotify.Chmod
+	for _, f := range strings.Fields(s) {
+		spec := fsnotify.WatchSpec{Path: f, Ops: changed | fsnotify.Write}
+		if i := strings.IndexByte(f, '='); i > -1 {
+			switch f[:i] {
+			case "PathChanged":
+				spec.Ops, spec.PreferCloseWrite = changed|fsnotify.Write, true
+			case "PathModified":
+			default:
+				return ws, fmt.Errorf("unknown directive %q", f[:i])
+			}
+			spec.Path = f[i+1:]
+		}
+		if spec.Path == "" {
+			return ws, fmt.Errorf("no path in %q", f)
+		}
+		ws.Watches = append(ws.Watches, spec)
+	}
+	if len(ws.Watches) == 0 {
+		return ws, fmt.Errorf("no paths")
+	}
+	return ws, nil
+}
@@ -0,0 +1,160 @@
+package sdnotify
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/camille-sound4/fsnotify"
+)
+
+// listen sets $NOTIFY_SOCKET to a new socket, and returns a function to get the
+// messages that were sent to it.
+func listen(t *testing.T) func() []string {
+	t.Helper()
+	if runtime.GOOS == "windows" || runtime.GOOS == "js" {
+		t.Skip("no unixgram sockets on " + runtime.GOOS)
+	}
+
+	sock := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", sock)
+
+	return func() []string {
+		var msgs []string
+		buf := make([]byte, 256)
+		for {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, err := conn.Read(buf)
+			if err != nil {
+				return msgs
+			}
+			msgs = append(msgs, string(buf[:n]))
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if ok, err := Notify("READY=1"); ok || err != nil {
+		t.Fatalf("without $NOTIFY_SOCKET: %t, %v", ok, err)
+	}
+
+	read := listen(t)
+	if ok, err := Notify("READY=1"); !ok || err != nil {
+		t.Fatalf("%t, %v", ok, err)
+	}
+	if have := read(); !reflect.DeepEqual(have, []string{"READY=1"}) {
+		t.Errorf("have %q", have)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	read := listen(t)
+
+	t.Setenv("WATCHDOG_USEC", "")
+	if err := Watchdog(context.Background(), func() bool { return true }); err != nil {
+		t.Fatalf("not enabled: %v", err)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	t.Setenv("WATCHDOG_USEC", "20000")
+	if err := Watchdog(context.Background(), func() bool { return true }); err != nil {
+		t.Fatalf("other process: %v", err)
+	}
+	t.Setenv("WATCHDOG_PID", "")
+
+	// Healthy for the first 3 checks.
+	var checks int32
+	healthy := func() bool { return atomic.AddInt32(&checks, 1) <= 3 }
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := Watchdog(ctx, healthy); err != context.DeadlineExceeded {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	want := []string{"WATCHDOG=1", "WATCHDOG=1", "WATCHDOG=1", "STATUS=watcher unhealthy"}
+	if have := read(); !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Skip(err)
+	}
+	healthy := Healthy(w)
+	if !healthy() {
+		t.Error("not healthy before Close")
+	}
+	w.Close()
+	<-w.Done()
+	if healthy() {
+		t.Error("healthy after Close")
+	}
+}
+
+func TestParseWatchSet(t *testing.T) {
+	const changed = fsnotify.Create | fsnotify.Remove | fsnotify.Rename | fsnotify.Chmod
+	tests := []struct {
+		in      string
+		want    []fsnotify.WatchSpec
+		wantErr string
+	}{
+		{"/etc/app.conf", []fsnotify.WatchSpec{{Path: "/etc/app.conf", Ops: changed | fsnotify.Write}}, ""},
+		{" PathChanged=/a\tPathModified=/b  /c ", []fsnotify.WatchSpec{
+			{Path: "/a", Ops: changed | fsnotify.Write, PreferCloseWrite: true},
+			{Path: "/b", Ops: changed | fsnotify.Write},
+			{Path: "/c", Ops: changed | fsnotify.Write},
+		}, ""},
+		{`{"watches": [{"path": "/with space", "ops": 1}]}`, []fsnotify.WatchSpec{
+			{Path: "/with space", Ops: fsnotify.Create},
+		}, ""},
+
+		{"", nil, "no paths"},
+		{"PathExists=/a", nil, `unknown directive "PathExists"`},
+		{"PathChanged=", nil, `no path in "PathChanged="`},
+		{"{", nil, "unexpected end of JSON input"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have, err := parseWatchSet(tt.in)
+			if !errorContains(err, tt.wantErr) {
+				t.Fatalf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+			if tt.wantErr == "" && !reflect.DeepEqual(have.Watches, tt.want) {
+				t.Errorf("\nhave: %+v\nwant: %+v", have.Watches, tt.want)
+			}
+		})
+	}
+
+	t.Run("env", func(t *testing.T) {
+		if _, ok, err := WatchSetFromEnv(); ok || err != nil {
+			t.Errorf("not set: %t, %v", ok, err)
+		}
+		t.Setenv(WatchEnv, "PathFoo=/x")
+		if _, ok, err := WatchSetFromEnv(); !ok || !errorContains(err, "$FSNOTIFY_WATCH") {
+			t.Errorf("invalid: %t, %v", ok, err)
+		}
+	})
+}
+
+func errorContains(err error, s string) bool {
+	if err == nil {
+		return s == ""
+	}
+	if s == "" {
+		return false
+	}
+	return strings.Contains(err.Error(), s)
+}
@@ -0,0 +1,197 @@
+package fsnotify
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSoak runs a random workload of creating, writing, renaming, and removing
+// files in a watched directory, and checks that the contents of the directory
+// can be reconstructed from the events after every round. This catches missed
+// or reordered events that only show up once in a while.
+//
+// It runs for a few seconds with the other tests. Select it with -run to keep
+// going until shortly before the -timeout:
+//
+//	go test -run Soak -timeout 1h
+//
+// The seed is logged; set FSNOTIFY_SOAK_SEED to repeat a run.
+func TestSoak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("long test")
+	}
+
+	seed := time.Now().UnixNano()
+	if s, ok := os.LookupEnv("FSNOTIFY_SOAK_SEED"); ok {
+		var err error
+		seed, err = strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			t.Fatalf("FSNOTIFY_SOAK_SEED: %s", err)
+		}
+	}
+	runFor := soakTime(t)
+	t.Logf("seed %d; running for %s", seed, runFor)
+
+	var (
+		rnd  = rand.New(rand.NewSource(seed))
+		tmp  = t.TempDir()
+		w    = newWatcher(t, tmp)
+		st   = &soakState{names: make(map[string]struct{}), last: time.Now()}
+		live []string // Files that exist.
+		num  int      // For new filenames; names are never re-used.
+	)
+	defer w.Close()
+	go st.read(t, w, tmp)
+
+	newName := func() string {
+		num++
+		return fmt.Sprintf("file-%06d", num)
+	}
+	for round, end := 1, time.Now().Add(runFor); time.Now().Before(end); round++ {
+		for i := 0; i < 200; i++ {
+			var (
+				op = rnd.Intn(100)
+				j  = -1
+			)
+			if len(live) > 0 {
+				j = rnd.Intn(len(live))
+			}
+			switch {
+			case j == -1 || (op < 35 && len(live) < 100): // Create
+				name := newName()
+				cat(t, "data", tmp, name, noWait)
+				live = append(live, name)
+			case op < 65: // Write
+				fp, err := os.OpenFile(join(tmp, live[j]), os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fmt.Fprintf(fp, "write %d\n", i)
+				fp.Close()
+			case op < 80: // Rename
+				name := newName()
+				mv(t, join(tmp, live[j]), tmp, name, noWait)
+				live[j] = name
+			default: // Remove
+				rm(t, tmp, live[j], noWait)
+				live = append(live[:j], live[j+1:]...)
+			}
+		}
+
+		st.settle(t)
+		if missing, extra := st.diff(t, tmp); len(missing) > 0 || len(extra) > 0 {
+			t.Fatalf("round %d (seed %d): state from events doesn't match the directory\n"+
+				"missing: %s\nextra:   %s", round, seed, missing, extra)
+		}
+		if t.Failed() {
+			t.FailNow()
+		}
+	}
+}
+
+// soakTime returns how long TestSoak runs: until a minute before the deadline
+// if it was selected with -run, and a few seconds otherwise.
+func soakTime(t *testing.T) time.Duration {
+	if f := flag.Lookup("test.run"); f == nil || !strings.Contains(f.Value.String(), "Soak") {
+		return 3 * time.Second
+	}
+	d, ok := t.Deadline()
+	if !ok {
+		return time.Hour
+	}
+	if left := time.Until(d) - time.Minute; left > 3*time.Second {
+		return left
+	}
+	return 3 * time.Second
+}
+
+// soakState is the contents of the directory according to the events.
+type soakState struct {
+	mu    sync.Mutex
+	names map[string]struct{}
+	last  time.Time // Time of the last event.
+}
+
+func (st *soakState) read(t *testing.T, w *Watcher, dir string) {
+	for {
+		select {
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			t.Error(err)
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			name := strings.TrimPrefix(e.Name, dir+string(filepath.Separator))
+			if name == e.Name {
+				continue // The directory itself.
+			}
+
+			st.mu.Lock()
+			st.last = time.Now()
+			switch {
+			case e.Has(Remove) || e.Has(Rename):
+				delete(st.names, name)
+			case e.Has(Create):
+				st.names[name] = struct{}{}
+			}
+			st.mu.Unlock()
+		}
+	}
+}
+
+// settle waits until no events were seen for a while.
+func (st *soakState) settle(t *testing.T) {
+	quiet := 500 * time.Millisecond
+	if isKqueue() {
+		quiet = time.Second // Directories are read again after changes.
+	}
+	for start := time.Now(); time.Since(start) < 30*time.Second; {
+		time.Sleep(50 * time.Millisecond)
+		st.mu.Lock()
+		last := st.last
+		st.mu.Unlock()
+		if time.Since(last) > quiet {
+			return
+		}
+	}
+	t.Fatal("events kept coming for 30 seconds")
+}
+
+// diff returns the files that exist in dir but not in the state, and the other
+// way around.
+func (st *soakState) diff(t *testing.T, dir string) (missing, extra []string) {
+	ls, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	have := make(map[string]struct{}, len(ls))
+	for _, f := range ls {
+		have[f.Name()] = struct{}{}
+		if _, ok := st.names[f.Name()]; !ok {
+			missing = append(missing, f.Name())
+		}
+	}
+	for n := range st.names {
+		if _, ok := have[n]; !ok {
+			extra = append(extra, n)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return missing, extra
+}
@@ -0,0 +1,234 @@
+//go:build linux || freebsd || openbsd || netbsd || dragonfly || darwin
+// +build linux freebsd openbsd netbsd dragonfly darwin
+
+package fsnotify
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// isHardLink reports if fi is a regular file with more than one link.
+func isHardLink(fi fs.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && fi.Mode().IsRegular() && st.Nlink > 1
+}
+
+// attrCache keeps the attributes of files, so it can tell which attributes
+// changed on a Chmod; see DetectAttrChanges.
+type attrCache struct {
+	mu sync.Mutex
+	m  map[string]attrState
+}
+
+type attrState struct {
+	mode     fs.FileMode
+	uid, gid uint32
+	nlink    uint64
+	mtime    time.Time
+	xattr    uint64 // See xattrSum.
+}
+
+func newAttrState(name string, fi fs.FileInfo) attrState {
+	a := attrState{mode: fi.Mode(), mtime: fi.ModTime(), xattr: xattrSum(name)}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		a.uid, a.gid, a.nlink = st.Uid, st.Gid, uint64(st.Nlink)
+	}
+	return a
+}
+
+// add the attributes of name.
+func (c *attrCache) add(name string) {
+	if fi, err := os.Lstat(name); err == nil {
+		c.set(name, fi)
+	}
+}
+
+// addAll adds the attributes of name, and of all files in it if it's a
+// directory.
+func (c *attrCache) addAll(name string) {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return
+	}
+	c.set(name, fi)
+	if !fi.IsDir() {
+		return
+	}
+
+	ls, err := os.ReadDir(name)
+	if err != nil {
+		return
+	}
+	for _, f := range ls {
+		if fi, err := f.Info(); err == nil {
+			c.set(filepath.Join(name, f.Name()), fi)
+		}
+	}
+}
+
+func (c *attrCache) set(name string, fi fs.FileInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]attrState)
+	}
+	c.m[name] = newAttrState(name, fi)
+}
+
+// remove name, and all files in it.
+func (c *attrCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, name)
+	for k := range c.m {
+		if filepath.Dir(k) == name {
+			delete(c.m, k)
+		}
+	}
+}
+
+// changed reports which attributes of name changed since the last call, or
+// since it was added, and the previous and new owner if that changed. It
+// returns 0 if that's not known.
+func (c *attrCache) changed(name string) (AttrChange, *OwnerChange) {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return 0, nil
+	}
+	have := newAttrState(name, fi)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]attrState)
+	}
+	prev, ok := c.m[name]
+	c.m[name] = have
+	if !ok {
+		return 0, nil
+	}
+
+	var (
+		ch    AttrChange
+		owner *OwnerChange
+	)
+	if have.mode != prev.mode {
+		ch |= AttrMode
+	}
+	if have.uid != prev.uid || have.gid != prev.gid {
+		ch |= AttrOwner
+		owner = &OwnerChange{
+			OldUID: int(prev.uid), OldGID: int(prev.gid),
+			NewUID: int(have.uid), NewGID: int(have.gid),
+		}
+	}
+	if have.nlink != prev.nlink {
+		ch |= AttrLinks
+	}
+	if !have.mtime.Equal(prev.mtime) {
+		ch |= AttrTimes
+	}
+	if have.xattr != prev.xattr {
+		ch |= AttrXattr
+	}
+	return ch, owner
+}
+
+// idCache keeps the inode numbers of files, so that Event.FileID can be set for
+// files that no longer exist; see DetectFileIDs.
+type idCache struct {
+	mu sync.Mutex
+	m  map[string]uint64
+}
+
+func fileID(fi fs.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// deviceID returns the device of fi; see Event.Device.
+func deviceID(fi fs.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+	return 0
+}
+
+// add the ID of name, and of all files in it if it's a directory.
+func (c *idCache) addAll(name string) {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return
+	}
+	c.set(name, fi)
+	if !fi.IsDir() {
+		return
+	}
+
+	ls, err := os.ReadDir(name)
+	if err != nil {
+		return
+	}
+	for _, f := range ls {
+		if fi, err := f.Info(); err == nil {
+			c.set(filepath.Join(name, f.Name()), fi)
+		}
+	}
+}
+
+// set the ID of name from fi, and return it.
+func (c *idCache) set(name string, fi fs.FileInfo) uint64 {
+	id := fileID(fi)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]uint64)
+	}
+	c.m[name] = id
+	return id
+}
+
+// get the ID of name; this is read from the file if it's not in the cache yet.
+// Returns 0 if it's not known.
+func (c *idCache) get(name string) uint64 {
+	c.mu.Lock()
+	id, ok := c.m[name]
+	c.mu.Unlock()
+	if ok {
+		return id
+	}
+	if fi, err := os.Lstat(name); err == nil {
+		return c.set(name, fi)
+	}
+	return 0
+}
+
+// update reads the ID of name, for a new file or one that may have been
+// replaced.
+func (c *idCache) update(name string) uint64 {
+	if fi, err := os.Lstat(name); err == nil {
+		return c.set(name, fi)
+	}
+	return 0
+}
+
+// remove name, and all files in it, and return the ID name had.
+func (c *idCache) remove(name string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.m[name]
+	delete(c.m, name)
+	for k := range c.m {
+		if filepath.Dir(k) == name {
+			delete(c.m, k)
+		}
+	}
+	return id
+}
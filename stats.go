@@ -0,0 +1,526 @@
+package fsnotify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stats contains statistics about a Watcher, as returned by [Watcher.Stats].
+type Stats struct {
+	// Number of kernel watches: watched paths on Linux, directory handles on
+	// Windows, and open file descriptors on kqueue (macOS, BSD).
+	Watches int
+
+	// Highest number of events that were queued in the Events channel. This is
+	// always 0 if the channel is unbuffered.
+	EventsHighWater int
+
+	// Number of [SlowConsumer] warnings that were sent.
+	SlowConsumer int
+
+	// Number of events that were dropped because the queue was full (see
+	// [WithEventQueue]), or because the watcher was closed before they could
+	// be sent (see [DrainOnClose]).
+	Dropped int
+
+	// Number of duplicate events that were dropped; see [WithDedup] and
+	// [WithMergeOverlapping].
+	Deduplicated int
+
+	// Number of events that were dropped because they matched a preset from
+	// [WithFilterPresets].
+	Filtered int
+
+	// Number of events that were dropped for every watch, including
+	// duplicates from WithDedup; see [WithOverflowMarks]. Watches without
+	// dropped events aren't in the map.
+	DroppedByWatch map[string]int
+
+	// Time between reading events from the kernel and sending them on the
+	// Events channel, over the last 1024 events. For an unbuffered channel
+	// this is until the application received the event, so a high latency
+	// here means the application is slow, rather than the kernel.
+	LatencyP50 time.Duration
+	LatencyP99 time.Duration
+	LatencyMax time.Duration
+}
+
+// Stats returns statistics about the watcher.
+func (w *Watcher) Stats() Stats {
+	watches := w.watchCount()
+	w.dedup.mu.Lock()
+	deduplicated := w.dedup.dropped
+	w.dedup.mu.Unlock()
+	w.filter.mu.Lock()
+	filtered := w.filter.dropped
+	w.filter.mu.Unlock()
+
+	w.queue.mu.Lock()
+	defer w.queue.mu.Unlock()
+	s := Stats{
+		EventsHighWater: w.queue.highWater,
+		SlowConsumer:    w.queue.warnings,
+		Dropped:         w.queue.dropped,
+		Deduplicated:    deduplicated,
+		Filtered:        filtered,
+		Watches:         watches,
+	}
+	if len(w.queue.lost) > 0 {
+		s.DroppedByWatch = make(map[string]int, len(w.queue.lost))
+		for k, v := range w.queue.lost {
+			s.DroppedByWatch[k] = v
+		}
+	}
+
+	n := w.queue.nlatency
+	if n > len(w.queue.latency) {
+		n = len(w.queue.latency)
+	}
+	if n > 0 {
+		l := make([]time.Duration, n)
+		copy(l, w.queue.latency[:n])
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		s.LatencyP50 = l[n*50/100]
+		s.LatencyP99 = l[n*99/100]
+		s.LatencyMax = l[n-1]
+	}
+	return s
+}
+
+// PoolStats contains statistics about a Pool, as returned by [Pool.Stats].
+type PoolStats struct {
+	Watchers int // Number of watchers in the pool.
+	Watches  int // Number of kernel watches of all watchers; see Stats.Watches.
+}
+
+// SlowConsumer is sent on Watcher.Errors if the application is reading events
+// too slowly; see [WithSlowConsumer].
+//
+// This is a warning: no events were lost (yet), but if the application keeps
+// reading events slower than they come in the kernel buffers will overflow.
+type SlowConsumer struct {
+	Queued   int           // Events in the Events channel when the warning was sent.
+	Duration time.Duration // How long events have been backed up for.
+}
+
+func (e *SlowConsumer) Error() string {
+	return fmt.Sprintf("fsnotify: slow consumer: events backed up for %s (%d queued)",
+		e.Duration.Round(time.Millisecond), e.Queued)
+}
+
+func (e *SlowConsumer) Temporary() bool { return true }
+func (e *SlowConsumer) Path() string    { return "" }
+
+// Quiescent is sent on Watcher.Errors if there were no events for some time;
+// see [WithQuiescentWarning].
+//
+// This is a warning: the watches are still working, but the filesystem may be
+// frozen or just idle.
+type Quiescent struct {
+	Since  time.Time // Time of the last event, or when the watcher was created.
+	Frozen []string  // Directories where a probe write didn't finish; nil without probes.
+}
+
+func (e *Quiescent) Error() string {
+	s := fmt.Sprintf("fsnotify: no events since %s", e.Since.Format(time.RFC3339))
+	if len(e.Frozen) > 0 {
+		s += fmt.Sprintf("; filesystem appears frozen for %q", e.Frozen)
+	}
+	return s
+}
+
+func (e *Quiescent) Temporary() bool { return true }
+func (e *Quiescent) Path() string {
+	if len(e.Frozen) > 0 {
+		return e.Frozen[0]
+	}
+	return ""
+}
+
+// How long a probe write for WithQuiescentWarning can take.
+const probeTimeout = time.Second
+
+// watchQuiet sends a Quiescent warning if there were no events for after,
+// until the watcher is closed; see WithQuiescentWarning.
+func (w *Watcher) watchQuiet(after time.Duration, probe bool) {
+	var (
+		created = time.Now()
+		warned  time.Time
+		t       = time.NewTimer(after)
+	)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.Done():
+			return
+		case <-t.C:
+		}
+
+		since := w.queue.lastRead()
+		if since.IsZero() {
+			since = created
+		}
+		if wait := after - time.Since(since); wait > 0 {
+			t.Reset(wait)
+			continue
+		}
+		t.Reset(after)
+		if since.Equal(warned) {
+			continue
+		}
+		warned = since
+
+		var frozen []string
+		if probe {
+			if frozen = probeDirs(w.WatchList()); len(frozen) == 0 {
+				continue
+			}
+		}
+		if !w.replays.start() {
+			return
+		}
+		select {
+		case w.Errors <- &Quiescent{Since: since, Frozen: frozen}:
+		case <-w.replays.stop:
+		}
+		w.replays.wg.Done()
+	}
+}
+
+// probeDirs creates and removes a file in the directory of every path, and
+// returns the directories where that didn't finish within probeTimeout.
+// Directories where it fails (e.g. because it's read-only) are not frozen.
+func probeDirs(paths []string) []string {
+	dirs := make(map[string]chan struct{})
+	for _, p := range paths {
+		p, _ = recursivePath(p)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			p = filepath.Dir(p)
+		}
+		if _, ok := dirs[p]; ok {
+			continue
+		}
+		done := make(chan struct{})
+		dirs[p] = done
+		go func(dir string) {
+			defer close(done)
+			fp, err := os.CreateTemp(dir, ".fsnotify-probe-")
+			if err != nil {
+				return
+			}
+			fp.Close()
+			os.Remove(fp.Name())
+		}(p)
+	}
+
+	var (
+		frozen  []string
+		timeout = time.NewTimer(probeTimeout)
+		expired bool
+	)
+	defer timeout.Stop()
+	for dir, done := range dirs {
+		if !expired {
+			select {
+			case <-done:
+				continue
+			case <-timeout.C:
+				expired = true
+			}
+		}
+		select {
+		case <-done:
+		default:
+			frozen = append(frozen, dir)
+		}
+	}
+	sort.Strings(frozen)
+	return frozen
+}
+
+// Never send SlowConsumer warnings more often than this, or the WithSlowConsumer
+// duration if that's longer.
+const slowConsumerInterval = time.Second
+
+// queueStats keeps track of the Events channel, for Stats and SlowConsumer
+// warnings.
+type queueStats struct {
+	mu        sync.Mutex
+	highWater int
+	warnings  int
+	dropped   int
+	lost      map[string]int      // Dropped events by watch.
+	unmarked  map[string]int      // Dropped events not yet sent in an OverflowMark.
+	readAt    time.Time           // When the events currently being sent were read.
+	latency   [1024]time.Duration // Ring buffer.
+	nlatency  int
+
+	// Set with DrainOnClose; drainBy is set on the first closed() call.
+	drain   time.Duration
+	drainBy time.Time
+
+	// Set with WithSlowConsumer; slowAfter is 0 if it's not used.
+	slowQueued int
+	slowAfter  time.Duration
+	since      time.Time // Since when the queue is backed up; zero if it's not.
+	warned     time.Time // Time of the last warning.
+}
+
+func (q *queueStats) setSlow(queued int, after time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if queued < 1 {
+		queued = 1
+	}
+	q.slowQueued, q.slowAfter = queued, after
+}
+
+// drop is called when an event is dropped.
+func (q *queueStats) drop(e Event) {
+	q.mu.Lock()
+	q.dropped++
+	q.mu.Unlock()
+	q.lose(e)
+}
+
+// lose counts a dropped event for the watch it's for.
+func (q *queueStats) lose(e Event) {
+	root := e.WatchRoot
+	if root == "" {
+		root = filepath.Dir(e.Name)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.lost == nil {
+		q.lost, q.unmarked = make(map[string]int), make(map[string]int)
+	}
+	q.lost[root]++
+	q.unmarked[root]++
+}
+
+// marks returns an OverflowMark for every watch with dropped events since the
+// previous call, sorted by path.
+func (q *queueStats) marks() []Event {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	marks := make([]Event, 0, len(q.unmarked))
+	for root, n := range q.unmarked {
+		marks = append(marks, Event{Name: root, Op: OverflowMark, Dropped: n, WatchRoot: root})
+		delete(q.unmarked, root)
+	}
+	sort.Slice(marks, func(i, j int) bool { return marks[i].Name < marks[j].Name })
+	return marks
+}
+
+// sendMarks sends the OverflowMark events every interval until the watcher is
+// closed; see WithOverflowMarks.
+func (w *Watcher) sendMarks(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.Done():
+			return
+		case <-t.C:
+		}
+
+		marks := w.queue.marks()
+		if len(marks) == 0 {
+			continue
+		}
+		if !w.replays.start() {
+			return
+		}
+		for _, m := range marks {
+			if w.replay(m) != nil {
+				break
+			}
+		}
+		w.replays.wg.Done()
+	}
+}
+
+// closed is called when an event can't be sent because the watcher is closed.
+// With DrainOnClose this still tries to send the event on ch until the drain
+// timeout expires. It returns true if the event was sent, and counts it as
+// dropped if it wasn't.
+func (q *queueStats) closed(ch chan<- Event, e Event) bool {
+	q.mu.Lock()
+	if q.drain > 0 && q.drainBy.IsZero() {
+		q.drainBy = time.Now().Add(q.drain)
+	}
+	left := time.Until(q.drainBy)
+	q.mu.Unlock()
+
+	if left > 0 {
+		t := time.NewTimer(left)
+		defer t.Stop()
+		select {
+		case ch <- e:
+			return true
+		case <-t.C:
+		}
+	}
+	q.drop(e)
+	return false
+}
+
+// lastRead returns when events were last read from the kernel.
+func (q *queueStats) lastRead() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.readAt
+}
+
+// read is called after reading events from the kernel.
+func (q *queueStats) read() {
+	now := time.Now()
+	q.mu.Lock()
+	q.readAt = now
+	q.mu.Unlock()
+}
+
+// queued is called before sending an event, with the number of events that are
+// already queued. The returned time should be passed to sent().
+func (q *queueStats) queued(n int) time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n > q.highWater {
+		q.highWater = n
+	}
+	if q.slowAfter == 0 {
+		return time.Time{}
+	}
+
+	now := time.Now()
+	if n < q.slowQueued {
+		q.since = time.Time{}
+	} else if q.since.IsZero() {
+		q.since = now
+	}
+	return now
+}
+
+// sent is called after an event was sent. It returns a *SlowConsumer error if
+// the queue has been backed up for longer than the WithSlowConsumer duration;
+// an event send that blocked for that long also counts as backed up, so this
+// works for unbuffered channels too.
+func (q *queueStats) sent(start time.Time, n int) error {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.readAt.IsZero() {
+		q.latency[q.nlatency%len(q.latency)] = now.Sub(q.readAt)
+		q.nlatency++
+	}
+
+	if start.IsZero() {
+		return nil
+	}
+	if q.since.IsZero() && now.Sub(start) >= q.slowAfter {
+		q.since = start
+	}
+	if q.since.IsZero() || now.Sub(q.since) < q.slowAfter {
+		return nil
+	}
+	interval := q.slowAfter
+	if interval < slowConsumerInterval {
+		interval = slowConsumerInterval
+	}
+	if now.Sub(q.warned) < interval {
+		return nil
+	}
+
+	q.warned = now
+	q.warnings++
+	return &SlowConsumer{Queued: n, Duration: now.Sub(q.since)}
+}
+
+// PathCount is the number of events for a watch, as returned by
+// [Watcher.TopPaths].
+type PathCount struct {
+	Path   string // The watched path, as passed to Add.
+	Events int    // Events from the kernel in the last minute.
+}
+
+// TopPaths returns the n watches with the most events in the last minute, with
+// the noisiest first, so an application can find directories such as caches
+// and logs that generate a lot of events, and remove or rate-limit them.
+//
+// Events are counted as they're read from the kernel, as that's the load on
+// the watcher; this includes events that are filtered afterwards, such as
+// directories with [WithoutDirectories].
+// Watches without events aren't included, so fewer than n may be returned.
+//
+// This is currently only supported on Linux; it returns nil on other
+// platforms.
+func (w *Watcher) TopPaths(n int) []PathCount {
+	return w.hot.top(n, time.Now())
+}
+
+const (
+	hotWindow  = time.Minute
+	hotBuckets = 12
+	hotBucket  = hotWindow / hotBuckets
+)
+
+// hotPaths counts events by watch over the last hotWindow, for TopPaths. The
+// counts are kept in a ring of buckets, so old events expire in steps of
+// hotBucket.
+type hotPaths struct {
+	mu      sync.Mutex
+	buckets [hotBuckets]map[string]int
+	epoch   [hotBuckets]int64 // Index of the bucket since the Unix epoch.
+}
+
+// add counts an event for the watch path at t.
+func (h *hotPaths) add(path string, t time.Time) {
+	idx := t.UnixNano() / int64(hotBucket)
+	slot := idx % hotBuckets
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.epoch[slot] != idx || h.buckets[slot] == nil {
+		h.epoch[slot], h.buckets[slot] = idx, make(map[string]int)
+	}
+	h.buckets[slot][path]++
+}
+
+// top returns the n paths with the most events in the window before t.
+func (h *hotPaths) top(n int, t time.Time) []PathCount {
+	idx := t.UnixNano() / int64(hotBucket)
+
+	h.mu.Lock()
+	sum := make(map[string]int)
+	for i, b := range h.buckets {
+		if h.epoch[i] > idx-hotBuckets && h.epoch[i] <= idx {
+			for p, c := range b {
+				sum[p] += c
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	if len(sum) == 0 || n <= 0 {
+		return nil
+	}
+	top := make([]PathCount, 0, len(sum))
+	for p, c := range sum {
+		top = append(top, PathCount{Path: p, Events: c})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Events == top[j].Events {
+			return top[i].Path < top[j].Path
+		}
+		return top[i].Events > top[j].Events
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
@@ -0,0 +1,97 @@
+package fsnotify
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Maximum number of paths in Summary.Names.
+const summaryNames = 100
+
+// Summary is the aggregate of the events for a directory in an interval, as
+// sent in Event.Summary with [WithSummaries].
+type Summary struct {
+	// Number of events for every operation. An event with more than one
+	// operation is counted for each of them.
+	Counts map[Op]int
+
+	// Paths that had events, sorted. At most 100 paths are included; More is
+	// the number of events for other paths.
+	Names []string
+	More  int
+}
+
+// summarizer collects events by directory; see WithSummaries.
+type summarizer struct {
+	mu   sync.Mutex
+	on   bool
+	dirs map[string]*summaryDir
+}
+
+type summaryDir struct {
+	event Event // Name, Op, WatchRoot, Device, and Summary.Counts.
+	names map[string]struct{}
+	more  int
+}
+
+// absorb adds e to the summary for its directory, and reports if it did so;
+// this is always true if WithSummaries is used.
+func (s *summarizer) absorb(e Event) bool {
+	if !s.on {
+		return false
+	}
+
+	dir := filepath.Dir(e.Name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dirs == nil {
+		s.dirs = make(map[string]*summaryDir)
+	}
+	d, ok := s.dirs[dir]
+	if !ok {
+		d = &summaryDir{
+			event: Event{Name: dir, WatchRoot: e.WatchRoot, Device: e.Device,
+				Summary: &Summary{Counts: make(map[Op]int)}},
+			names: make(map[string]struct{}),
+		}
+		s.dirs[dir] = d
+	}
+
+	d.event.Op |= e.Op
+	for _, op := range [...]Op{Create, Write, Remove, Rename, Chmod, CloseWrite, Unmount} {
+		if e.Has(op) {
+			d.event.Summary.Counts[op]++
+		}
+	}
+	if _, ok := d.names[e.Name]; !ok {
+		if len(d.names) < summaryNames {
+			d.names[e.Name] = struct{}{}
+		} else {
+			d.more++
+		}
+	}
+	return true
+}
+
+// flush returns the summaries since the previous call, sorted by directory.
+func (s *summarizer) flush() []Event {
+	s.mu.Lock()
+	dirs := s.dirs
+	s.dirs = nil
+	s.mu.Unlock()
+
+	events := make([]Event, 0, len(dirs))
+	for _, d := range dirs {
+		e := d.event
+		e.Summary.Names = make([]string, 0, len(d.names))
+		for n := range d.names {
+			e.Summary.Names = append(e.Summary.Names, n)
+		}
+		sort.Strings(e.Summary.Names)
+		e.Summary.More = d.more
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
@@ -0,0 +1,284 @@
+package fsnotify
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Supervisor wraps a [Watcher] and recreates it when it fails; see [Supervise].
+//
+// It has the same methods and channels as Watcher, and can be used as a
+// drop-in replacement.
+type Supervisor struct {
+	// Events sends the filesystem change events of the current Watcher.
+	Events chan Event
+
+	// Errors sends the errors of the current Watcher, except for the fatal
+	// errors that make the Supervisor recreate it; those are passed to onFatal.
+	Errors chan error
+
+	factory func() (*Watcher, error)
+	onFatal func(error)
+
+	mu      sync.Mutex
+	w       *Watcher
+	watches map[string][]addOpt // Options every path was added with.
+	closed  bool
+	done    chan struct{} // Closed by Close.
+	exited  chan struct{} // Closed when run exits.
+}
+
+// errStopped is passed to onFatal if the Watcher's channels were closed without
+// calling Supervisor.Close.
+var errStopped = errors.New("fsnotify: watcher stopped unexpectedly")
+
+// Don't retry the factory more often than this, doubling on every failure.
+const (
+	superviseMinDelay = 100 * time.Millisecond
+	superviseMaxDelay = 30 * time.Second
+)
+
+// Supervise creates a new watcher with factory, and creates a new one (and adds
+// all paths again) if it fails with a fatal error. factory is usually
+// [NewWatcher], or a function that calls [NewWatcherWith].
+//
+// A fatal error is an error that's not temporary and not about a specific path
+// (such as a failed read from the inotify file descriptor, or a closed
+// completion port on Windows), or the Watcher's channels being closed without
+// calling [Supervisor.Close]. onFatal is called with the error before the
+// watcher is recreated, and can be nil. Events that happen while the watcher is
+// recreated are lost.
+//
+// If factory fails when recreating the watcher the error is sent on Errors, and
+// it's retried with an increasing delay until it succeeds or Close is called.
+// Paths that can't be added again are removed and the error is sent on Errors.
+func Supervise(factory func() (*Watcher, error), onFatal func(error)) (*Supervisor, error) {
+	w, err := factory()
+	if err != nil {
+		return nil, err
+	}
+	s := &Supervisor{
+		Events:  make(chan Event),
+		Errors:  make(chan error),
+		factory: factory,
+		onFatal: onFatal,
+		w:       w,
+		watches: make(map[string][]addOpt),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Add starts monitoring the path for changes; see [Watcher.Add].
+func (s *Supervisor) Add(name string) error { return s.AddWith(name) }
+
+// AddWith is like [Supervisor.Add], but allows adding options; see
+// [Watcher.AddWith]. The options are remembered for when the watcher is
+// recreated.
+func (s *Supervisor) AddWith(name string, opts ...addOpt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if err := s.w.AddWith(name, opts...); err != nil {
+		return err
+	}
+	s.watches[name] = opts
+	return nil
+}
+
+// Remove stops monitoring the path for changes; see [Watcher.Remove].
+func (s *Supervisor) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	delete(s.watches, name)
+	return s.w.Remove(name)
+}
+
+// WatchList returns all paths explicitly added with [Supervisor.Add] (and are
+// not yet removed); see [Watcher.WatchList].
+func (s *Supervisor) WatchList() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	return s.w.WatchList()
+}
+
+// Replay sends a Create event for every file and directory in path; see
+// [Watcher.Replay].
+func (s *Supervisor) Replay(path string) error {
+	s.mu.Lock()
+	w := s.w
+	s.mu.Unlock()
+	return w.Replay(path)
+}
+
+// Stats returns statistics about the current watcher; they're reset when the
+// watcher is recreated.
+func (s *Supervisor) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Stats()
+}
+
+// Close closes the current watcher and the Events and Errors channels, and
+// stops recreating the watcher.
+func (s *Supervisor) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	w := s.w
+	s.mu.Unlock()
+
+	err := w.Close()
+	<-s.exited
+	return err
+}
+
+func (s *Supervisor) run() {
+	defer func() {
+		close(s.Events)
+		close(s.Errors)
+		close(s.exited)
+	}()
+
+	for {
+		s.mu.Lock()
+		w := s.w
+		s.mu.Unlock()
+
+		err := s.forward(w)
+		if err == nil {
+			return
+		}
+		if s.onFatal != nil {
+			s.onFatal(err)
+		}
+		w.Close()
+		if !s.recreate() {
+			return
+		}
+	}
+}
+
+// forward sends the events and errors from w until a fatal error occurs, which
+// is returned. It returns nil if the Supervisor was closed.
+func (s *Supervisor) forward(w *Watcher) error {
+	for {
+		select {
+		case <-s.done:
+			return nil
+		case e, ok := <-w.Events:
+			if !ok {
+				return s.stopped()
+			}
+			select {
+			case s.Events <- e:
+			case <-s.done:
+				return nil
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return s.stopped()
+			}
+			if isFatal(err) {
+				return err
+			}
+			if !s.sendError(err) {
+				return nil
+			}
+		}
+	}
+}
+
+// stopped returns errStopped if the watcher's channels were closed, or nil if
+// that's because the Supervisor was closed.
+func (s *Supervisor) stopped() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+		return errStopped
+	}
+}
+
+// recreate creates a new watcher and adds all paths again. It returns false if
+// the Supervisor was closed.
+func (s *Supervisor) recreate() bool {
+	delay := superviseMinDelay
+	for {
+		w, err := s.factory()
+		if err != nil {
+			if !s.sendError(newError(err, "")) {
+				return false
+			}
+			select {
+			case <-time.After(delay):
+			case <-s.done:
+				return false
+			}
+			if delay *= 2; delay > superviseMaxDelay {
+				delay = superviseMaxDelay
+			}
+			continue
+		}
+
+		var errs []error
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			w.Close()
+			return false
+		}
+		for name, opts := range s.watches {
+			if err := w.AddWith(name, opts...); err != nil {
+				delete(s.watches, name)
+				errs = append(errs, newError(err, name))
+			}
+		}
+		s.w = w
+		s.mu.Unlock()
+
+		for _, err := range errs {
+			if !s.sendError(err) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Returns true if the error was sent, or false if the Supervisor is closed.
+func (s *Supervisor) sendError(err error) bool {
+	select {
+	case s.Errors <- err:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// isFatal reports if err means the watcher stopped working.
+func isFatal(err error) bool {
+	var e interface {
+		Temporary() bool
+		Path() string
+	}
+	if !errors.As(err, &e) {
+		return false
+	}
+	return !e.Temporary() && e.Path() == ""
+}
@@ -3,6 +3,6 @@
 
 package fsnotify
 
-import "golang.org/x/sys/unix"
-
-const openMode = unix.O_NONBLOCK | unix.O_RDONLY | unix.O_CLOEXEC
+// Extended attributes on BSD are listed in a different format, and aren't
+// supported.
+func xattrSum(name string) uint64 { return 0 }
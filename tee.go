@@ -0,0 +1,73 @@
+package fsnotify
+
+// TeeQueue is the queue for one of the channels returned by [Tee].
+type TeeQueue struct {
+	Size   int         // Buffer size of the channel; at least 1.
+	Policy QueuePolicy // What to do if the channel is full.
+}
+
+// Tee sends every event from in to a new channel for every queue, so that
+// several consumers can read the same events; for example a consumer that
+// writes the events to a slow log, and the main application:
+//
+//	ch := fsnotify.Tee(w.Events,
+//		fsnotify.TeeQueue{Size: 1024, Policy: fsnotify.QueueBlock},
+//		fsnotify.TeeQueue{Size: 1024, Policy: fsnotify.QueueDropOldest})
+//	go writeLog(ch[1])
+//	for e := range ch[0] { ... }
+//
+// Every channel has its own buffer and [QueuePolicy]. A full channel with
+// QueueBlock stops all channels, so a consumer that may be slow should use
+// one of the drop policies to not hold up the others.
+//
+// The channels are closed once in is closed.
+func Tee(in <-chan Event, queues ...TeeQueue) []<-chan Event {
+	var (
+		out  = make([]chan Event, len(queues))
+		recv = make([]<-chan Event, len(queues))
+	)
+	for i, q := range queues {
+		if q.Size < 1 {
+			q.Size = 1
+		}
+		out[i] = make(chan Event, q.Size)
+		recv[i] = out[i]
+	}
+
+	go func() {
+		for e := range in {
+			for i, q := range queues {
+				teeSend(out[i], q.Policy, e)
+			}
+		}
+		for _, ch := range out {
+			close(ch)
+		}
+	}()
+	return recv
+}
+
+// teeSend sends e on ch according to policy.
+func teeSend(ch chan Event, policy QueuePolicy, e Event) {
+	switch policy {
+	case QueueDropNewest:
+		select {
+		case ch <- e:
+		default:
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case ch <- e:
+				return
+			default:
+			}
+			select {
+			case <-ch:
+			default:
+			}
+		}
+	default:
+		ch <- e
+	}
+}
@@ -0,0 +1,142 @@
+package fsnotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Watch creates a watcher with the options, adds all the paths, and returns its
+// Events and Errors channels. The watcher is closed and both channels are
+// closed once ctx is cancelled (or the watcher stops because of an error).
+//
+// The options are passed to [NewWatcherWith], so they apply to the watcher and
+// to every path that's added.
+//
+// A path that ends with "/..." (or "\..." on Windows) is watched recursively:
+// all directories in it are added, as well as directories that are created
+// later. A Create event is sent for files and directories found in a new
+// directory, as they may have been created before the directory was added; it
+// may be sent twice if the kernel also reported it. Errors from adding new
+// directories are sent on the error channel.
+//
+// If any path can't be added, the watcher is closed and the error is returned.
+// Watch returns ctx.Err() if ctx is already cancelled.
+func Watch(ctx context.Context, paths []string, opts ...addOpt) (<-chan Event, <-chan error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	w, err := NewWatcherWith(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var roots []string
+	for _, p := range paths {
+		p, recurse := recursivePath(p)
+		if !recurse {
+			err = w.Add(p)
+		} else {
+			roots = append(roots, p)
+			err = addTree(w, p, nil)
+		}
+		if err != nil {
+			w.Close()
+			return nil, nil, fmt.Errorf("fsnotify: watching %q: %w", p, err)
+		}
+	}
+
+	var (
+		events = make(chan Event)
+		errs   = make(chan error)
+	)
+	go func() {
+		defer close(errs)
+		defer close(events)
+		defer w.Close()
+
+		sendEvent := func(e Event) bool {
+			select {
+			case events <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		sendError := func(err error) bool {
+			select {
+			case errs <- err:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-w.Errors:
+				if !ok || !sendError(err) {
+					return
+				}
+			case e, ok := <-w.Events:
+				if !ok || !sendEvent(e) {
+					return
+				}
+				if !e.Has(Create) || !inTree(roots, e.Name) {
+					continue
+				}
+				if fi, err := os.Lstat(e.Name); err != nil || !fi.IsDir() {
+					continue
+				}
+				var found []Event
+				err := addTree(w, e.Name, func(name string) {
+					found = append(found, Event{Name: name, Op: Create, WatchRoot: e.WatchRoot})
+				})
+				if err != nil && !errors.Is(err, fs.ErrNotExist) && !sendError(err) {
+					return
+				}
+				for _, f := range found {
+					if !sendEvent(f) {
+						return
+					}
+				}
+			}
+		}
+	}()
+	return events, errs, nil
+}
+
+// addTree adds root and all directories in it to w, and calls found for every
+// entry in it, except root.
+func addTree(w *Watcher, root string, found func(name string)) error {
+	return filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != root && found != nil {
+			found(name)
+		}
+		if !d.IsDir() && name != root {
+			return nil
+		}
+		return w.Add(name)
+	})
+}
+
+// inTree reports if name is one of the roots, or in one of them.
+func inTree(roots []string, name string) bool {
+	for _, r := range roots {
+		if r == "." && !filepath.IsAbs(name) {
+			return true
+		}
+		if name == r || strings.HasPrefix(name, r+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
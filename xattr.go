@@ -0,0 +1,55 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package fsnotify
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrSum returns a checksum of the names and values of the extended
+// attributes of name, without following symlinks. It returns 0 if there are no
+// extended attributes, or if they can't be read.
+func xattrSum(name string) uint64 {
+	list := xattrGet(func(b []byte) (int, error) { return unix.Llistxattr(name, b) })
+	if len(list) == 0 {
+		return 0
+	}
+	attrs := bytes.Split(bytes.TrimRight(list, "\x00"), []byte{0})
+	sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+
+	h := fnv.New64a()
+	for _, a := range attrs {
+		v := xattrGet(func(b []byte) (int, error) { return unix.Lgetxattr(name, string(a), b) })
+		h.Write(a)
+		h.Write([]byte{0})
+		h.Write(v)
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// xattrGet calls fn with a nil buffer to get the size, and then again with a
+// buffer of that size. It returns nil on errors.
+func xattrGet(fn func(b []byte) (int, error)) []byte {
+	for i := 0; i < 3; i++ {
+		sz, err := fn(nil)
+		if err != nil || sz <= 0 {
+			return nil
+		}
+		b := make([]byte, sz)
+		sz, err = fn(b)
+		if err == unix.ERANGE { // Changed between the calls.
+			continue
+		}
+		if err != nil {
+			return nil
+		}
+		return b[:sz]
+	}
+	return nil
+}